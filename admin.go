@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(AdminAPI{})
+}
+
+// AdminAPI exposes the execution statistics of the CGI routes at /cgi/stats
+// of the admin endpoint and allows changing their limits at /cgi/limits.
+type AdminAPI struct{}
+
+// Stats is the response of the /cgi/stats admin endpoint.
+type Stats struct {
+	// Requests currently holding a slot of the process limit
+	Running int `json:"running"`
+	// Process limit of the cgi app (0 = unlimited)
+	MaxProcesses int `json:"maxProcesses"`
+	// Statistics by route name
+	Routes map[string]RouteStats `json:"routes"`
+	// Temporary files of the Caddy process
+	TempFiles TempFileStats `json:"tempFiles"`
+}
+
+// Limits is the body of the /cgi/limits admin endpoint. Fields that are not
+// set are left unchanged by a POST.
+type Limits struct {
+	// Process limit of the cgi app (0 = unlimited)
+	MaxProcesses *int `json:"maxProcesses,omitempty"`
+	// Limits by route name
+	Routes map[string]RouteLimits `json:"routes,omitempty"`
+}
+
+// RouteLimits holds the limits of a route that can be changed at runtime.
+type RouteLimits struct {
+	Weight   *int            `json:"weight,omitempty"`
+	Deadline *caddy.Duration `json:"deadline,omitempty"`
+	Timeout  *caddy.Duration `json:"timeout,omitempty"`
+	// Only for routes configured with max_concurrent
+	MaxConcurrent *int `json:"maxConcurrent,omitempty"`
+	// Only for routes configured with cache
+	Cache *caddy.Duration `json:"cache,omitempty"`
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
+
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.cgi",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/cgi/stats", Handler: caddy.AdminHandlerFunc(a.handleStats)},
+		{Pattern: "/cgi/limits", Handler: caddy.AdminHandlerFunc(a.handleLimits)},
+	}
+}
+
+func (a *AdminAPI) handleStats(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			Code: http.StatusMethodNotAllowed,
+			Err:  fmt.Errorf("method not allowed"),
+		}
+	}
+
+	stats := Stats{Routes: make(map[string]RouteStats), TempFiles: tempFiles.snapshot()}
+	if app := runningApp(); app != nil {
+		stats.Routes = app.stats.snapshot()
+		if app.scheduler != nil {
+			stats.Running, stats.MaxProcesses = app.scheduler.usage()
+			for name, queued := range app.scheduler.queued() {
+				rs, ok := stats.Routes[name]
+				if !ok {
+					rs = new(routeStats).snapshot()
+				}
+				rs.Queued = queued
+				stats.Routes[name] = rs
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(stats)
+}
+
+func (a *AdminAPI) handleLimits(w http.ResponseWriter, r *http.Request) error {
+	app := runningApp()
+	if app == nil {
+		return caddy.APIError{
+			Code: http.StatusNotFound,
+			Err:  fmt.Errorf("cgi app not running"),
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var limits Limits
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			return caddy.APIError{
+				Code: http.StatusBadRequest,
+				Err:  fmt.Errorf("decoding limits: %v", err),
+			}
+		}
+		if err := app.applyLimits(limits); err != nil {
+			return caddy.APIError{
+				Code: http.StatusBadRequest,
+				Err:  err,
+			}
+		}
+	default:
+		return caddy.APIError{
+			Code: http.StatusMethodNotAllowed,
+			Err:  fmt.Errorf("method not allowed"),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(app.currentLimits())
+}
@@ -0,0 +1,140 @@
+package cgi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestAdminAPI_Stats(t *testing.T) {
+	app := &App{MaxProcesses: 4}
+	if err := app.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer app.Stop()
+
+	rs := app.stats.route("public")
+	for i := 1; i <= 100; i++ {
+		usage := processUsage{User: 10 * time.Millisecond, MaxRSS: int64(i) << 20}
+		if i%10 == 0 {
+			usage.Signal = "SIGSEGV"
+		}
+		rs.recordExit(time.Duration(i)*time.Millisecond, i%2, usage)
+	}
+	rs.recordFailure(failTimeout)
+	rs.recordFailure(failTimeout)
+
+	var api AdminAPI
+	w := httptest.NewRecorder()
+	if err := api.handleStats(w, httptest.NewRequest(http.MethodGet, "/cgi/stats", nil)); err != nil {
+		t.Fatal(err)
+	}
+	var stats Stats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.MaxProcesses != 4 {
+		t.Errorf("Unexpected process limit %d. Expected %d.", stats.MaxProcesses, 4)
+	}
+	public := stats.Routes["public"]
+	if public.Total != 100 {
+		t.Errorf("Unexpected total %d. Expected %d.", public.Total, 100)
+	}
+	if p95 := public.Latency["p95"]; p95 != 0.095 {
+		t.Errorf("Unexpected p95 %v. Expected %v.", p95, 0.095)
+	}
+	if public.ExitCodes["1"] != 50 {
+		t.Errorf("Unexpected count of exit code 1: %d. Expected %d.", public.ExitCodes["1"], 50)
+	}
+	if public.Signals["SIGSEGV"] != 10 {
+		t.Errorf("Unexpected count of SIGSEGV: %d. Expected %d.", public.Signals["SIGSEGV"], 10)
+	}
+	if public.Errors[failTimeout] != 2 {
+		t.Errorf("Unexpected count of timeouts: %d. Expected %d.", public.Errors[failTimeout], 2)
+	}
+	if public.MaxRSS != 100<<20 {
+		t.Errorf("Unexpected max RSS %d. Expected %d.", public.MaxRSS, 100<<20)
+	}
+	if public.CPUUser < 0.999 || public.CPUUser > 1.001 {
+		t.Errorf("Unexpected user CPU time %v. Expected %v.", public.CPUUser, 1.0)
+	}
+}
+
+func TestAdminAPI_Limits(t *testing.T) {
+	app := &App{MaxProcesses: 4}
+	if err := app.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer app.Stop()
+	app.limits.route("public").setWeight(1)
+	queue := newScheduler(4)
+	app.limits.route("public").addQueue(queue, 4)
+	cache := newResponseCache(time.Minute, 0, nil, nil, "public", zap.NewNop())
+	app.limits.route("public").addCache(cache, time.Minute)
+	app.limits.route("plain").setWeight(1)
+
+	var api AdminAPI
+	post := func(body string) error {
+		req := httptest.NewRequest(http.MethodPost, "/cgi/limits", strings.NewReader(body))
+		return api.handleLimits(httptest.NewRecorder(), req)
+	}
+
+	if err := post(`{"maxProcesses":2,"routes":{"public":{"weight":5,"deadline":"10s","maxConcurrent":2,"cache":"5m"}}}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, capacity := app.scheduler.usage(); capacity != 2 {
+		t.Errorf("Unexpected process limit %d. Expected %d.", capacity, 2)
+	}
+	rl, _ := app.limits.lookup("public")
+	if rl.getWeight() != 5 {
+		t.Errorf("Unexpected weight %d. Expected %d.", rl.getWeight(), 5)
+	}
+	if rl.getDeadline() != 10*time.Second {
+		t.Errorf("Unexpected deadline %v. Expected %v.", rl.getDeadline(), 10*time.Second)
+	}
+
+	if _, capacity := queue.usage(); capacity != 2 {
+		t.Errorf("Unexpected max_concurrent %d. Expected %d.", capacity, 2)
+	}
+	if ttl := cache.getTTL(); ttl != 5*time.Minute {
+		t.Errorf("Unexpected cache lifetime %v. Expected %v.", ttl, 5*time.Minute)
+	}
+	limits := app.currentLimits()
+	if public := limits.Routes["public"]; public.MaxConcurrent == nil || *public.MaxConcurrent != 2 || public.Cache == nil {
+		t.Errorf("Unexpected limits %+v of the cached route.", public)
+	}
+	if plain := limits.Routes["plain"]; plain.MaxConcurrent != nil || plain.Cache != nil {
+		t.Errorf("Unexpected limits %+v of the plain route.", plain)
+	}
+
+	// Invalid changes are rejected as a whole.
+	if err := post(`{"maxProcesses":8,"routes":{"other":{"weight":2}}}`); err == nil {
+		t.Error("Expected an error for an unknown route.")
+	}
+	for _, body := range []string{
+		`{"routes":{"plain":{"maxConcurrent":2}}}`,
+		`{"routes":{"plain":{"cache":"1m"}}}`,
+		`{"routes":{"public":{"maxConcurrent":0}}}`,
+		`{"routes":{"public":{"cache":"0s"}}}`,
+	} {
+		if err := post(body); err == nil {
+			t.Errorf("Expected an error for %s.", body)
+		}
+	}
+	if _, capacity := app.scheduler.usage(); capacity != 2 {
+		t.Errorf("Unexpected process limit %d. Expected %d.", capacity, 2)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultAffinityCookie is the name of the affinity cookie if none is
+// configured.
+const defaultAffinityCookie = "cgi_affinity"
+
+// affinity mints and validates the cookies binding clients to a pool worker.
+// Cookies are signed with a key of the pool, so they become invalid along
+// with the worker numbers once the pool is replaced.
+type affinity struct {
+	name string
+	key  []byte
+}
+
+func newAffinity(name string) (*affinity, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &affinity{name: name, key: key}, nil
+}
+
+// sign returns the cookie value for worker id.
+func (a *affinity) sign(id int) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(strconv.Itoa(id)))
+	return strconv.Itoa(id) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// worker returns the worker the request is bound to; 0 if it carries no
+// valid affinity cookie.
+func (a *affinity) worker(req *http.Request) int {
+	cookie, err := req.Cookie(a.name)
+	if err != nil {
+		return 0
+	}
+	dot := strings.IndexByte(cookie.Value, '.')
+	if dot < 0 {
+		return 0
+	}
+	id, err := strconv.Atoi(cookie.Value[:dot])
+	if err != nil || id <= 0 || !hmac.Equal([]byte(cookie.Value), []byte(a.sign(id))) {
+		return 0
+	}
+	return id
+}
+
+// cookie returns the cookie binding the client of req to worker id.
+func (a *affinity) cookie(id int, req *http.Request) *http.Cookie {
+	return &http.Cookie{
+		Name:     a.name,
+		Value:    a.sign(id),
+		Path:     "/",
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
@@ -0,0 +1,543 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "cgi-import-apache",
+		Func:  cmdImportApache,
+		Usage: "[--document-root <dir>] <file>...",
+		Short: "Converts the CGI setup of Apache configuration files into a Caddyfile",
+		Long: `
+Reads Apache configuration files (httpd.conf, included files or .htaccess
+files) and prints a Caddyfile with equivalent cgi blocks to standard output.
+
+Converted are ScriptAlias, Alias, AddHandler cgi-script together with Options
+ExecCGI, SetEnv and PassEnv, within the main server, <VirtualHost> and
+<Directory> sections. The directives of an .htaccess file apply to its
+directory. Anything else related to CGI that can't be converted is reported as
+a comment in the output.
+
+--document-root sets the document root of the main server if the files don't
+contain a DocumentRoot directive, as is typically the case for .htaccess files.
+`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("cgi-import-apache", flag.ExitOnError)
+			fs.String("document-root", "", "Document root of the main server")
+			return fs
+		}(),
+	})
+}
+
+func cmdImportApache(fl caddycmd.Flags) (int, error) {
+	if fl.NArg() == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("no configuration files given")
+	}
+	var sources []apacheSource
+	for _, name := range fl.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		defer f.Close()
+		sources = append(sources, apacheSource{name: name, r: f})
+	}
+	out, err := convertApache(sources, fl.String("document-root"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Print(out)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// apacheSource is an Apache configuration file to convert.
+type apacheSource struct {
+	name string
+	r    io.Reader
+}
+
+// apacheAlias maps a URL path to a file or directory.
+type apacheAlias struct {
+	url, path string
+}
+
+// apacheScope collects the CGI related settings of a directory; the scope of
+// the directory "" applies to all of them.
+type apacheScope struct {
+	dir     string
+	exts    []string // extensions handled by cgi-script
+	execCGI int      // 1 with ExecCGI, -1 without, 0 if not set
+	env     []string
+	passEnv []string
+}
+
+// merge adds the settings of o, which take precedence, to s.
+func (s *apacheScope) merge(o *apacheScope) {
+	for _, ext := range o.exts {
+		if !stringInSlice(ext, s.exts) {
+			s.exts = append(s.exts, ext)
+		}
+	}
+	if o.execCGI != 0 {
+		s.execCGI = o.execCGI
+	}
+	s.env = append(s.env, o.env...)
+	s.passEnv = append(s.passEnv, o.passEnv...)
+}
+
+// equal reports whether s and o result in the same cgi block settings.
+func (s *apacheScope) equal(o *apacheScope) bool {
+	return strings.Join(s.exts, " ") == strings.Join(o.exts, " ") && s.execCGI == o.execCGI &&
+		strings.Join(s.env, "\x00") == strings.Join(o.env, "\x00") &&
+		strings.Join(s.passEnv, " ") == strings.Join(o.passEnv, " ")
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// apacheSite is the main server or a virtual host.
+type apacheSite struct {
+	addrs         []string
+	port          string // of a virtual host
+	documentRoot  string
+	scriptAliases []apacheAlias
+	aliases       []apacheAlias
+	scopes        []*apacheScope
+	notes         []string
+}
+
+// scope returns the scope of dir, creating it if necessary.
+func (s *apacheSite) scope(dir string) *apacheScope {
+	for _, sc := range s.scopes {
+		if sc.dir == dir {
+			return sc
+		}
+	}
+	sc := &apacheScope{dir: dir}
+	s.scopes = append(s.scopes, sc)
+	return sc
+}
+
+// apacheSection is an open <Section> of a configuration file.
+type apacheSection struct {
+	name  string
+	site  *apacheSite
+	scope *apacheScope // nil where CGI directives aren't converted
+}
+
+// apacheTokens splits a configuration line into its words, honoring quotes.
+func apacheTokens(line string) []string {
+	var tokens []string
+	var cur strings.Builder
+	inQuote, inToken := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && inQuote && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+		case c == '"':
+			inQuote = !inQuote
+			inToken = true
+		case (c == ' ' || c == '\t') && !inQuote:
+			if inToken {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+				inToken = false
+			}
+		default:
+			cur.WriteByte(c)
+			inToken = true
+		}
+	}
+	if inToken {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens
+}
+
+// convertApache converts the CGI setup of the Apache configuration files in
+// sources into a Caddyfile. documentRoot is used for the main server if the
+// files don't set one.
+func convertApache(sources []apacheSource, documentRoot string) (string, error) {
+	main := &apacheSite{}
+	sites := []*apacheSite{main}
+	for _, src := range sources {
+		site := main
+		global := main.scope("")
+		if filepath.Base(src.name) == ".htaccess" {
+			dir, err := filepath.Abs(filepath.Dir(src.name))
+			if err != nil {
+				return "", err
+			}
+			global = main.scope(filepath.ToSlash(dir))
+		}
+		stack := []apacheSection{{site: site, scope: global}}
+
+		sc := bufio.NewScanner(src.r)
+		lineNo := 0
+		var pending string
+		for sc.Scan() {
+			lineNo++
+			line := strings.TrimSpace(sc.Text())
+			if strings.HasSuffix(line, "\\") {
+				pending += strings.TrimSuffix(line, "\\") + " "
+				continue
+			}
+			line, pending = strings.TrimSpace(pending+line), ""
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			top := stack[len(stack)-1]
+			note := func(format string, args ...interface{}) {
+				top.site.notes = append(top.site.notes, fmt.Sprintf("%s:%d: ", src.name, lineNo)+fmt.Sprintf(format, args...))
+			}
+
+			if strings.HasPrefix(line, "</") {
+				if len(stack) == 1 {
+					return "", fmt.Errorf("%s:%d: unexpected %s", src.name, lineNo, line)
+				}
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			if strings.HasPrefix(line, "<") {
+				tokens := apacheTokens(strings.TrimSuffix(strings.TrimPrefix(line, "<"), ">"))
+				if len(tokens) == 0 {
+					return "", fmt.Errorf("%s:%d: invalid section %s", src.name, lineNo, line)
+				}
+				section := apacheSection{name: strings.ToLower(tokens[0]), site: top.site}
+				switch section.name {
+				case "virtualhost":
+					site := &apacheSite{port: "80"}
+					if len(tokens) > 1 {
+						if i := strings.LastIndex(tokens[1], ":"); i >= 0 {
+							site.port = tokens[1][i+1:]
+						}
+					}
+					sites = append(sites, site)
+					section.site = site
+					section.scope = site.scope("")
+				case "directory":
+					if len(tokens) == 2 && !strings.HasPrefix(tokens[1], "~") {
+						section.scope = top.site.scope(strings.TrimSuffix(tokens[1], "/"))
+					} else {
+						note("<%s> with a regular expression not converted", tokens[0])
+					}
+				case "ifmodule", "ifdefine", "ifversion":
+					// Conditions are assumed to hold.
+					section.scope = top.scope
+				default:
+					if top.scope != nil {
+						note("CGI directives within <%s> not converted", tokens[0])
+					}
+				}
+				stack = append(stack, section)
+				continue
+			}
+
+			tokens := apacheTokens(line)
+			if top.scope == nil {
+				continue
+			}
+			args := tokens[1:]
+			switch name := strings.ToLower(tokens[0]); name {
+			case "documentroot":
+				if len(args) == 1 {
+					top.site.documentRoot = strings.TrimSuffix(args[0], "/")
+				}
+			case "servername", "serveralias":
+				if top.site == main {
+					continue
+				}
+				for _, addr := range args {
+					if top.site.port != "80" && top.site.port != "443" {
+						addr += ":" + top.site.port
+					}
+					top.site.addrs = append(top.site.addrs, addr)
+				}
+			case "scriptalias", "alias":
+				if len(args) != 2 {
+					note("%s needs a URL path and a file or directory", tokens[0])
+					continue
+				}
+				a := apacheAlias{url: args[0], path: args[1]}
+				if name == "scriptalias" {
+					top.site.scriptAliases = append(top.site.scriptAliases, a)
+				} else {
+					top.site.aliases = append(top.site.aliases, a)
+				}
+			case "addhandler":
+				if len(args) < 2 || args[0] != "cgi-script" {
+					continue
+				}
+				for _, ext := range args[1:] {
+					ext = strings.TrimPrefix(ext, ".")
+					if !stringInSlice(ext, top.scope.exts) {
+						top.scope.exts = append(top.scope.exts, ext)
+					}
+				}
+			case "options":
+				relative := false
+				for _, opt := range args {
+					relative = relative || strings.HasPrefix(opt, "+") || strings.HasPrefix(opt, "-")
+				}
+				if !relative {
+					top.scope.execCGI = -1
+				}
+				for _, opt := range args {
+					switch strings.ToLower(opt) {
+					case "execcgi", "+execcgi", "all":
+						top.scope.execCGI = 1
+					case "-execcgi":
+						top.scope.execCGI = -1
+					}
+				}
+			case "setenv":
+				if len(args) == 0 {
+					continue
+				}
+				top.scope.env = append(top.scope.env, args[0]+"="+strings.Join(args[1:], " "))
+			case "passenv":
+				top.scope.passEnv = append(top.scope.passEnv, args...)
+			case "scriptaliasmatch", "include", "includeoptional":
+				note("%s not converted", tokens[0])
+			case "sethandler":
+				if len(args) > 0 && args[0] == "cgi-script" {
+					note("%s not converted", tokens[0])
+				}
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return "", err
+		}
+		if len(stack) > 1 {
+			return "", fmt.Errorf("%s: unterminated <%s>", src.name, stack[len(stack)-1].name)
+		}
+	}
+	if main.documentRoot == "" {
+		main.documentRoot = strings.TrimSuffix(filepath.ToSlash(documentRoot), "/")
+	}
+
+	var b strings.Builder
+	b.WriteString("{\n\torder cgi last\n}\n")
+	for i, site := range sites {
+		if i > 0 {
+			// Virtual hosts inherit the settings of the main server.
+			inherited := &apacheSite{
+				addrs:         site.addrs,
+				port:          site.port,
+				documentRoot:  site.documentRoot,
+				scriptAliases: append(append([]apacheAlias(nil), main.scriptAliases...), site.scriptAliases...),
+				aliases:       append(append([]apacheAlias(nil), main.aliases...), site.aliases...),
+				notes:         site.notes,
+			}
+			if inherited.documentRoot == "" {
+				inherited.documentRoot = main.documentRoot
+			}
+			for _, sc := range main.scopes {
+				inherited.scope(sc.dir).merge(sc)
+			}
+			for _, sc := range site.scopes {
+				inherited.scope(sc.dir).merge(sc)
+			}
+			site = inherited
+		}
+		if len(site.addrs) == 0 {
+			port := site.port
+			if port == "" {
+				port = "80"
+			}
+			site.addrs = []string{":" + port}
+		}
+		b.WriteString("\n" + strings.Join(site.addrs, " ") + " {\n")
+		site.write(&b, i == 0)
+		b.WriteString("}\n")
+	}
+	return b.String(), nil
+}
+
+// effective returns the merged settings of the scopes applying to dir.
+func (s *apacheSite) effective(dir string) *apacheScope {
+	var applying []*apacheScope
+	for _, sc := range s.scopes {
+		if sc.dir == "" || sc.dir == dir || strings.HasPrefix(dir, sc.dir+"/") {
+			applying = append(applying, sc)
+		}
+	}
+	sort.SliceStable(applying, func(i, j int) bool {
+		return len(applying[i].dir) < len(applying[j].dir)
+	})
+	eff := &apacheScope{dir: dir}
+	for _, sc := range applying {
+		eff.merge(sc)
+	}
+	return eff
+}
+
+// urlPath returns the URL path under which dir is served along with the
+// alias it is served through; ok is false if dir isn't served at all.
+func (s *apacheSite) urlPath(dir string) (urlPath string, alias apacheAlias, ok bool) {
+	for _, a := range s.aliases {
+		target := strings.TrimSuffix(a.path, "/")
+		if dir == target || strings.HasPrefix(dir, target+"/") {
+			return path.Join(a.url, strings.TrimPrefix(dir, target)), a, true
+		}
+	}
+	if root := s.documentRoot; root != "" && (dir == root || strings.HasPrefix(dir, root+"/")) {
+		return path.Join("/", strings.TrimPrefix(dir, root)), apacheAlias{path: root}, true
+	}
+	return "", apacheAlias{}, false
+}
+
+// apacheRoute is a cgi block for the files with the given extensions below a
+// directory, or a 403 response for them if CGI is disabled there.
+type apacheRoute struct {
+	urlPath string
+	alias   apacheAlias
+	scope   *apacheScope
+	deny    bool
+}
+
+// write writes the cgi blocks of the site; main tells whether it is the main
+// server, which notes directories no site serves.
+func (s *apacheSite) write(b *strings.Builder, main bool) {
+	for _, n := range s.notes {
+		b.WriteString("\t# " + n + "\n")
+	}
+	// Named matchers capture the path of the script below aliases.
+	n := 0
+	matcher := func(re string) string {
+		n++
+		name := fmt.Sprintf("cgi%d", n)
+		b.WriteString("\t@" + name + " path_regexp " + name + " " + caddyQuote(re) + "\n")
+		return name
+	}
+
+	for _, a := range s.scriptAliases {
+		target := a.path
+		isDir := strings.HasSuffix(a.url, "/") || strings.HasSuffix(target, "/")
+		if info, err := os.Stat(target); err == nil && info.IsDir() {
+			isDir = true
+		}
+		url := strings.TrimSuffix(a.url, "/")
+		target = strings.TrimSuffix(target, "/")
+		if !isDir {
+			sc := s.effective(path.Dir(target))
+			writeCGIBlock(b, caddyQuote(url+"*"), target, url, sc.env, sc.passEnv)
+			continue
+		}
+		name := matcher("^" + regexp.QuoteMeta(url) + "(/[^/]+)")
+		sc := s.effective(target)
+		writeCGIBlock(b, "@"+name, target+"{http.regexp."+name+".1}", url, sc.env, sc.passEnv)
+	}
+
+	dirs := map[string]bool{}
+	for _, sc := range s.scopes {
+		dir := sc.dir
+		if dir == "" {
+			dir = s.documentRoot
+		}
+		if dir != "" && (len(sc.exts) > 0 || sc.execCGI != 0) {
+			dirs[dir] = true
+		}
+	}
+	var sorted []string
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+
+	// Directories get a route unless it wouldn't change anything compared
+	// to the one of the directory they are in. Routes of subdirectories go
+	// first, since the routes of the directories they are in match them,
+	// too.
+	var routes []apacheRoute
+	emitted := map[string]*apacheRoute{}
+	for _, dir := range sorted {
+		urlPath, alias, ok := s.urlPath(dir)
+		if !ok {
+			if main {
+				b.WriteString("\t# " + dir + ": not served by any site\n")
+			}
+			continue
+		}
+		eff := s.effective(dir)
+		var parent *apacheRoute
+		for d := path.Dir(dir); d != "/" && d != "."; d = path.Dir(d) {
+			if parent = emitted[d]; parent != nil {
+				break
+			}
+		}
+		enabled := eff.execCGI == 1 && len(eff.exts) > 0
+		switch {
+		case parent != nil && !parent.deny && parent.scope.equal(eff):
+			continue
+		case enabled:
+			routes = append(routes, apacheRoute{urlPath: urlPath, alias: alias, scope: eff})
+		case parent != nil && !parent.deny:
+			// Scripts would run by the route of the parent otherwise.
+			routes = append(routes, apacheRoute{urlPath: urlPath, scope: parent.scope, deny: true})
+		default:
+			if len(eff.exts) > 0 {
+				b.WriteString("\t# " + dir + ": AddHandler cgi-script without Options ExecCGI not converted\n")
+			}
+			continue
+		}
+		emitted[dir] = &routes[len(routes)-1]
+	}
+	for i := len(routes) - 1; i >= 0; i-- {
+		r := routes[i]
+		exts := make([]string, len(r.scope.exts))
+		for i, ext := range r.scope.exts {
+			exts[i] = regexp.QuoteMeta(ext)
+		}
+		ext := `\.(` + strings.Join(exts, "|") + `)`
+		base := strings.TrimSuffix(r.alias.url, "/")
+		rel := regexp.QuoteMeta(strings.TrimSuffix(strings.TrimPrefix(r.urlPath, base), "/") + "/")
+		name := matcher("^" + regexp.QuoteMeta(base) + "(" + rel + ".*" + ext + ")$")
+		switch {
+		case r.deny:
+			b.WriteString("\trespond @" + name + " 403\n")
+		case r.alias.url != "":
+			writeCGIBlock(b, "@"+name, r.alias.path+"{http.regexp."+name+".1}", r.alias.url, r.scope.env, r.scope.passEnv)
+		default:
+			writeCGIBlock(b, "@"+name, r.alias.path+"{http.request.uri.path}", "", r.scope.env, r.scope.passEnv)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package cgi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+)
+
+func TestConvertApache(t *testing.T) {
+	conf := `
+DocumentRoot "/var/www/html"
+ScriptAlias /cgi-bin/ "/var/www/cgi-bin/"
+SetEnv TZ Europe/Berlin
+<IfModule mod_alias.c>
+	Alias /tools /opt/tools
+</IfModule>
+<Directory "/var/www/cgi-bin">
+	SetEnv DB /var/lib/app.db
+	PassEnv HOME
+</Directory>
+<Directory /var/www/html>
+	Options Indexes FollowSymLinks
+	AddHandler cgi-script .cgi .pl
+</Directory>
+<Directory /var/www/html/app>
+	Options +ExecCGI
+</Directory>
+<Directory /var/www/html/app/uploads>
+	Options -ExecCGI
+</Directory>
+<Directory /opt/tools>
+	Options ExecCGI
+	AddHandler cgi-script .sh
+	SetEnv GREETING "hello world"
+</Directory>
+<VirtualHost *:8080>
+	ServerName shop.example.com
+	DocumentRoot /srv/shop
+	ScriptAlias /checkout /srv/shop-bin/checkout.pl
+	<Directory /srv/shop>
+		Options +ExecCGI
+		AddHandler cgi-script cgi
+	</Directory>
+</VirtualHost>
+ScriptAliasMatch ^/legacy/(.*) /old/$1
+`
+	htaccess := "Options +ExecCGI\nAddHandler cgi-script .py\nSetEnv MODE test\n"
+	expected := `{
+	order cgi last
+}
+
+:80 {
+	# httpd.conf:36: ScriptAliasMatch not converted
+	@cgi1 path_regexp cgi1 ^/cgi-bin(/[^/]+)
+	cgi @cgi1 /var/www/cgi-bin{http.regexp.cgi1.1} {
+		script_name /cgi-bin
+		env TZ=Europe/Berlin DB=/var/lib/app.db
+		pass_env HOME
+	}
+	# /var/www/html: AddHandler cgi-script without Options ExecCGI not converted
+	@cgi2 path_regexp cgi2 ^(/py/.*\.(cgi|pl|py))$
+	cgi @cgi2 /var/www/html{http.request.uri.path} {
+		env TZ=Europe/Berlin MODE=test
+	}
+	@cgi3 path_regexp cgi3 ^(/app/uploads/.*\.(cgi|pl))$
+	respond @cgi3 403
+	@cgi4 path_regexp cgi4 ^(/app/.*\.(cgi|pl))$
+	cgi @cgi4 /var/www/html{http.request.uri.path} {
+		env TZ=Europe/Berlin
+	}
+	@cgi5 path_regexp cgi5 ^/tools(/.*\.(sh))$
+	cgi @cgi5 /opt/tools{http.regexp.cgi5.1} {
+		script_name /tools
+		env TZ=Europe/Berlin "GREETING=hello world"
+	}
+}
+
+shop.example.com:8080 {
+	@cgi1 path_regexp cgi1 ^/cgi-bin(/[^/]+)
+	cgi @cgi1 /var/www/cgi-bin{http.regexp.cgi1.1} {
+		script_name /cgi-bin
+		env TZ=Europe/Berlin DB=/var/lib/app.db
+		pass_env HOME
+	}
+	cgi /checkout* /srv/shop-bin/checkout.pl {
+		script_name /checkout
+		env TZ=Europe/Berlin
+	}
+	@cgi2 path_regexp cgi2 ^(/.*\.(cgi))$
+	cgi @cgi2 /srv/shop{http.request.uri.path} {
+		env TZ=Europe/Berlin
+	}
+	@cgi3 path_regexp cgi3 ^/tools(/.*\.(sh))$
+	cgi @cgi3 /opt/tools{http.regexp.cgi3.1} {
+		script_name /tools
+		env TZ=Europe/Berlin "GREETING=hello world"
+	}
+}
+`
+	out, err := convertApache([]apacheSource{
+		{name: "httpd.conf", r: strings.NewReader(conf)},
+		{name: "/var/www/html/py/.htaccess", r: strings.NewReader(htaccess)},
+	}, "")
+	if err != nil {
+		t.Fatalf("Cannot convert: %v", err)
+	}
+	if out != expected {
+		t.Errorf("Unexpected Caddyfile\n========== Got ==========\n%s\n========== Wanted ==========\n%s", out, expected)
+	}
+	if _, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(out), nil); err != nil {
+		t.Errorf("Cannot adapt converted Caddyfile: %v", err)
+	}
+
+	if _, err := convertApache([]apacheSource{{name: "httpd.conf", r: strings.NewReader("<Directory /x>\n")}}, ""); err == nil {
+		t.Error("Unterminated section accepted.")
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(App{})
+}
+
+// App holds settings and state shared by all cgi handlers. It only needs to
+// be configured (as "cgi" app in the JSON config) to enable limits that
+// span several routes.
+type App struct {
+	// Maximum number of CGI requests executing at the same time across all
+	// routes; 0 means unlimited. Waiting requests are admitted fairly across
+	// routes according to their weight.
+	MaxProcesses int `json:"maxProcesses,omitempty"`
+	// True to make Caddy the subreaper of the processes scripts start, so
+	// orphaned ones are reaped by Caddy instead of init (Linux only). Also
+	// needed for reaping them when Caddy runs as PID 1.
+	Subreaper bool `json:"subreaper,omitempty"`
+	// Named sandboxes routes can refer to
+	Sandboxes map[string]Sandbox `json:"sandboxes,omitempty"`
+	// Interpreters by extension of the executable (like .py), each the
+	// command and its arguments (like python3 -u), that scripts are run with
+	Interpreters map[string][]string `json:"interpreters,omitempty"`
+	// Total size in bytes of temporary files, like spooled request bodies,
+	// above which a warning is logged; 0 disables the warning
+	TempWarnSize int64 `json:"tempWarnSize,omitempty"`
+	// Size in bytes of the buffer request bodies are written to temporary
+	// files with; 32 KiB by default
+	TempBufferSize int `json:"tempBufferSize,omitempty"`
+	// True to write spooled request bodies bypassing the page cache
+	// (O_DIRECT, Linux only). The buffer size has to be a multiple of 4096
+	// then.
+	TempDirectIO bool `json:"tempDirectIO,omitempty"`
+	// When to flush temporary files to disk: "none" (the default), "end"
+	// once the body has been written or "always" after every buffer
+	TempSync string `json:"tempSync,omitempty"`
+
+	scheduler *scheduler
+	stats     *statsRegistry
+	limits    *limitsRegistry
+}
+
+// Interface guards
+var (
+	_ caddy.App         = (*App)(nil)
+	_ caddy.Provisioner = (*App)(nil)
+)
+
+func (App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "cgi",
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (a *App) Provision(ctx caddy.Context) error {
+	a.scheduler = newScheduler(a.MaxProcesses)
+	a.stats = newStatsRegistry()
+	a.limits = newLimitsRegistry()
+	return a.processTempSettings()
+}
+
+// processTempSettings validates how request bodies are written to temporary
+// files.
+func (a *App) processTempSettings() error {
+	if a.TempBufferSize < 0 {
+		return fmt.Errorf("invalid temporary file buffer size %d", a.TempBufferSize)
+	}
+	if a.TempBufferSize == 0 {
+		a.TempBufferSize = defaultTempBufferSize
+	}
+	switch a.TempSync {
+	case "":
+		a.TempSync = tempSyncNone
+	case tempSyncNone, tempSyncEnd, tempSyncAlways:
+	default:
+		return fmt.Errorf("invalid temporary file sync policy %q, expected %s, %s or %s",
+			a.TempSync, tempSyncNone, tempSyncEnd, tempSyncAlways)
+	}
+	if a.TempDirectIO {
+		if !directIOSupported {
+			return fmt.Errorf("direct I/O is not supported on this platform")
+		}
+		if a.TempBufferSize%directIOAlign != 0 {
+			return fmt.Errorf("temporary file buffer size %d is not a multiple of %d, as direct I/O requires",
+				a.TempBufferSize, directIOAlign)
+		}
+	}
+	return nil
+}
+
+// currentLimits returns the limits in effect.
+func (a *App) currentLimits() Limits {
+	_, capacity := a.scheduler.usage()
+	limits := Limits{MaxProcesses: &capacity, Routes: make(map[string]RouteLimits)}
+	for _, name := range a.limits.names() {
+		rl, _ := a.limits.lookup(name)
+		weight := rl.getWeight()
+		deadline := caddy.Duration(rl.getDeadline())
+		timeout := caddy.Duration(rl.getTimeout())
+		route := RouteLimits{Weight: &weight, Deadline: &deadline, Timeout: &timeout}
+		if concurrent, ok := rl.getMaxConcurrent(); ok {
+			route.MaxConcurrent = &concurrent
+		}
+		if ttl, ok := rl.getCacheTTL(); ok {
+			cache := caddy.Duration(ttl)
+			route.Cache = &cache
+		}
+		limits.Routes[name] = route
+	}
+	return limits
+}
+
+// applyLimits changes the limits in effect. The changes are validated before
+// any of them is applied.
+func (a *App) applyLimits(limits Limits) error {
+	if limits.MaxProcesses != nil && *limits.MaxProcesses < 0 {
+		return fmt.Errorf("invalid process limit %d", *limits.MaxProcesses)
+	}
+	routes := make(map[string]*routeLimits, len(limits.Routes))
+	for name, l := range limits.Routes {
+		rl, ok := a.limits.lookup(name)
+		if !ok {
+			return fmt.Errorf("unknown route %q", name)
+		}
+		if l.Weight != nil && *l.Weight < 1 {
+			return fmt.Errorf("invalid weight %d for route %q", *l.Weight, name)
+		}
+		if l.Deadline != nil && *l.Deadline < 0 {
+			return fmt.Errorf("invalid deadline for route %q", name)
+		}
+		if l.Timeout != nil && *l.Timeout < 0 {
+			return fmt.Errorf("invalid timeout for route %q", name)
+		}
+		if l.MaxConcurrent != nil {
+			if _, ok := rl.getMaxConcurrent(); !ok {
+				return fmt.Errorf("route %q has no max_concurrent", name)
+			}
+			if *l.MaxConcurrent < 1 {
+				return fmt.Errorf("invalid max_concurrent %d for route %q", *l.MaxConcurrent, name)
+			}
+		}
+		if l.Cache != nil {
+			if _, ok := rl.getCacheTTL(); !ok {
+				return fmt.Errorf("route %q has no cache", name)
+			}
+			if *l.Cache <= 0 {
+				return fmt.Errorf("invalid cache lifetime for route %q", name)
+			}
+		}
+		routes[name] = rl
+	}
+
+	if limits.MaxProcesses != nil {
+		a.scheduler.setCapacity(*limits.MaxProcesses)
+	}
+	for name, l := range limits.Routes {
+		if l.Weight != nil {
+			routes[name].setWeight(*l.Weight)
+		}
+		if l.Deadline != nil {
+			routes[name].setDeadline(time.Duration(*l.Deadline))
+		}
+		if l.Timeout != nil {
+			routes[name].setTimeout(time.Duration(*l.Timeout))
+		}
+		if l.MaxConcurrent != nil {
+			routes[name].setMaxConcurrent(*l.MaxConcurrent)
+		}
+		if l.Cache != nil {
+			routes[name].setCacheTTL(time.Duration(*l.Cache))
+		}
+	}
+	return nil
+}
+
+// The running App, used by the admin API. When a config is reloaded, the new
+// App is started before the old one is stopped.
+var (
+	runningMu sync.Mutex
+	running   *App
+)
+
+// runningApp returns the App of the running config or nil.
+func runningApp() *App {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	return running
+}
+
+// Start implements caddy.App.
+func (a *App) Start() error {
+	if err := startSupervisor(caddy.Log().Named("cgi.supervisor"), a.Subreaper); err != nil {
+		return err
+	}
+	if a.TempDirectIO {
+		if err := probeDirectIO(); err != nil {
+			return fmt.Errorf("temporary directory doesn't support direct I/O: %v", err)
+		}
+	}
+	tempFiles.configure(caddy.Log().Named("cgi.tempfiles"), a.TempWarnSize)
+	tempFiles.tune(spillSettings{bufferSize: a.TempBufferSize, direct: a.TempDirectIO, sync: a.TempSync})
+	tempFiles.sweep()
+	runningMu.Lock()
+	running = a
+	runningMu.Unlock()
+	return nil
+}
+
+// Stop implements caddy.App.
+func (a *App) Stop() error {
+	runningMu.Lock()
+	if running == a {
+		running = nil
+	}
+	runningMu.Unlock()
+	return nil
+}
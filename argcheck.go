@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// compileArgPattern compiles the pattern values in arguments have to match
+// as a whole; nil without a pattern.
+func compileArgPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid argument pattern: %v", err)
+	}
+	return re, nil
+}
+
+// checkArgs makes sure that the values of the placeholders in the arguments,
+// and the arguments taken from the query string, match the argument
+// pattern. Values that don't are never passed to the script, so malicious
+// requests can't smuggle options or other unexpected arguments into its
+// command line.
+func (c CGI) checkArgs(repl *caddy.Replacer, queryArgs []string) error {
+	if c.argPattern == nil {
+		return nil
+	}
+	for _, arg := range c.Args {
+		_, err := repl.ReplaceFunc(arg, func(variable string, val interface{}) (interface{}, error) {
+			var str string
+			if val != nil {
+				str = fmt.Sprint(val)
+			}
+			if !c.argPattern.MatchString(str) {
+				return nil, fmt.Errorf("value of placeholder {%s} in arguments doesn't match the argument pattern", variable)
+			}
+			return val, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, arg := range queryArgs {
+		if !c.argPattern.MatchString(arg) {
+			return fmt.Errorf("argument from the query string doesn't match the argument pattern")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// bakingKey marks the context of requests that are executed to bake a
+// response, so they bypass the baked response.
+type bakingKey struct{}
+
+// bakedResponse is the stored result of an offline execution.
+type bakedResponse struct {
+	header  http.Header
+	body    []byte
+	gzipped []byte
+	bakedAt time.Time
+}
+
+// baker periodically executes a script for a fixed path and serves the
+// result statically in the meantime.
+type baker struct {
+	path     string
+	interval time.Duration
+	logger   *zap.Logger
+
+	mu     sync.RWMutex
+	result *bakedResponse
+
+	signals chan os.Signal
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newBaker(path string, interval time.Duration, logger *zap.Logger) *baker {
+	return &baker{
+		path:     path,
+		interval: interval,
+		logger:   logger,
+		signals:  make(chan os.Signal, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// run bakes right away and then on every interval or signal until close is
+// called.
+func (b *baker) run(c CGI) {
+	defer close(b.done)
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		if err := b.bake(c); err != nil {
+			b.logger.Error("baking failed; keeping previous result", zap.String("path", b.path), zap.Error(err))
+		}
+		select {
+		case <-ticker.C:
+		case <-b.signals:
+			b.logger.Info("re-baking on signal", zap.String("path", b.path))
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// bake executes the script once and stores the response if it succeeded.
+func (b *baker) bake(c CGI) error {
+	ctx := context.WithValue(context.Background(), bakingKey{}, true)
+	ctx = context.WithValue(ctx, caddy.ReplacerCtxKey, caddy.NewReplacer())
+	req, err := http.NewRequest(http.MethodGet, "http://localhost"+b.path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	rec := &bakeRecorder{header: make(http.Header)}
+	if err := c.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	})); err != nil {
+		return err
+	}
+	if rec.status != http.StatusOK {
+		return fmt.Errorf("script responded with status %d", rec.status)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(rec.body.Bytes())
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.result = &bakedResponse{
+		header:  rec.header,
+		body:    rec.body.Bytes(),
+		gzipped: gz.Bytes(),
+		bakedAt: time.Now(),
+	}
+	b.mu.Unlock()
+	b.logger.Debug("baked response", zap.String("path", b.path), zap.Int("size", rec.body.Len()))
+	return nil
+}
+
+// serve answers r from the baked response if it applies. It reports whether
+// it did.
+func (b *baker) serve(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.URL.Path != b.path || r.URL.RawQuery != "" || r.Context().Value(bakingKey{}) != nil {
+		return false
+	}
+	b.mu.RLock()
+	result := b.result
+	b.mu.RUnlock()
+	if result == nil {
+		return false
+	}
+
+	for k, vv := range result.header {
+		w.Header()[k] = vv
+	}
+	body := result.body
+	if result.header.Get("Content-Encoding") == "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			body = result.gzipped
+		}
+	}
+	http.ServeContent(w, r, "", result.bakedAt, bytes.NewReader(body))
+	return true
+}
+
+// close stops baking.
+func (b *baker) close() {
+	signal.Stop(b.signals)
+	close(b.stop)
+	<-b.done
+}
+
+// acceptsGzip reports whether the client accepts gzip encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// bakeRecorder captures a response in memory.
+type bakeRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (br *bakeRecorder) Header() http.Header {
+	return br.header
+}
+
+func (br *bakeRecorder) WriteHeader(status int) {
+	if br.status == 0 && !isInformational(status) {
+		br.status = status
+	}
+}
+
+func (br *bakeRecorder) Write(p []byte) (int, error) {
+	if br.status == 0 {
+		br.status = http.StatusOK
+	}
+	return br.body.Write(p)
+}
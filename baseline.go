@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// perRequestEnv lists the environment variables that are only present for
+// some requests; they are left out of the baseline along with the HTTP_
+// variables of request headers.
+var perRequestEnv = map[string]bool{
+	"CONTENT_LENGTH":  true,
+	"CONTENT_TYPE":    true,
+	"HTTPS":           true,
+	"REMOTE_PORT":     true,
+	"REMOTE_PEER_PID": true,
+	"REMOTE_PEER_UID": true,
+	"REMOTE_PEER_GID": true,
+}
+
+// envBaseline compares the names of the environment variables a route passes
+// to its script with those recorded in a file, to notice when an upgrade or a
+// change of the configuration or of the environment of Caddy changes what
+// scripts get. The file is written from the first request if it doesn't
+// exist; it lists one name per line.
+type envBaseline struct {
+	path string
+
+	mu       sync.Mutex
+	keys     map[string]bool // nil until recorded or loaded
+	reported map[string]bool // differences already logged
+}
+
+// newEnvBaseline loads the baseline at path if it exists.
+func newEnvBaseline(path string) (*envBaseline, error) {
+	b := &envBaseline{path: path, reported: make(map[string]bool)}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b.keys = make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if key := strings.TrimSpace(sc.Text()); key != "" && !strings.HasPrefix(key, "#") {
+			b.keys[key] = true
+		}
+	}
+	return b, sc.Err()
+}
+
+// envKeys returns the sorted names of env that are part of the baseline.
+func envKeys(env []string) []string {
+	var keys []string
+	for _, e := range env {
+		key := e
+		if eq := strings.IndexByte(e, '='); eq >= 0 {
+			key = e[:eq]
+		}
+		if strings.HasPrefix(key, "HTTP_") || perRequestEnv[key] {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// check compares env with the baseline, recording it first if necessary, and
+// logs a warning for every difference not reported before.
+func (b *envBaseline) check(env []string, logger *zap.Logger) {
+	keys := envKeys(env)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.keys == nil {
+		b.keys = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			b.keys[key] = true
+		}
+		if err := b.write(keys); err != nil {
+			logger.Error("cannot record environment baseline", zap.String("file", b.path), zap.Error(err))
+		} else {
+			logger.Info("recorded environment baseline", zap.String("file", b.path), zap.Int("count", len(keys)))
+		}
+		return
+	}
+
+	var added, missing []string
+	present := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		present[key] = true
+		if !b.keys[key] {
+			added = append(added, key)
+		}
+	}
+	for key := range b.keys {
+		if !present[key] {
+			missing = append(missing, key)
+		}
+	}
+	if len(added) == 0 && len(missing) == 0 {
+		return
+	}
+	sort.Strings(missing)
+	diff := strings.Join(added, ",") + "/" + strings.Join(missing, ",")
+	if b.reported[diff] {
+		return
+	}
+	b.reported[diff] = true
+	logger.Warn("environment differs from baseline",
+		zap.String("file", b.path), zap.Strings("added", added), zap.Strings("missing", missing))
+}
+
+// write stores keys as baseline, replacing the file atomically.
+func (b *envBaseline) write(keys []string) error {
+	f, err := ioutil.TempFile(filepath.Dir(b.path), ".baseline-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strings.Join(keys, "\n") + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), b.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
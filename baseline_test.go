@@ -0,0 +1,55 @@
+package cgi
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestEnvBaseline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baseline.env")
+	core, logs := observer.New(zapcore.WarnLevel)
+	logger := zap.New(core)
+
+	b, err := newEnvBaseline(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.check([]string{"PATH_INFO=/a", "SCRIPT_NAME=/x", "HTTP_ACCEPT=*/*", "CONTENT_LENGTH=3"}, logger)
+	recorded, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "PATH_INFO\nSCRIPT_NAME\n"; string(recorded) != expected {
+		t.Errorf("Unexpected baseline %q. Expected %q.", recorded, expected)
+	}
+
+	// A baseline loaded from the file ignores values and per-request variables.
+	if b, err = newEnvBaseline(path); err != nil {
+		t.Fatal(err)
+	}
+	b.check([]string{"PATH_INFO=/b", "SCRIPT_NAME=/y", "HTTP_COOKIE=a=b", "HTTPS=on"}, logger)
+	if logs.Len() != 0 {
+		t.Errorf("Unexpected warnings %v. Expected none.", logs.AllUntimed())
+	}
+
+	// Differences are reported once.
+	for i := 0; i < 2; i++ {
+		b.check([]string{"PATH_INFO=/b", "DB=x"}, logger)
+	}
+	entries := logs.TakeAll()
+	if len(entries) != 1 {
+		t.Fatalf("Unexpected number of warnings %d. Expected %d.", len(entries), 1)
+	}
+	fields := entries[0].ContextMap()
+	if added := fields["added"].([]interface{}); len(added) != 1 || added[0] != "DB" {
+		t.Errorf("Unexpected added variables %v. Expected %v.", added, []string{"DB"})
+	}
+	if missing := fields["missing"].([]interface{}); len(missing) != 1 || missing[0] != "SCRIPT_NAME" {
+		t.Errorf("Unexpected missing variables %v. Expected %v.", missing, []string{"SCRIPT_NAME"})
+	}
+}
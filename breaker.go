@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"sync"
+	"time"
+)
+
+// Defaults of the circuit breaker.
+const (
+	defaultBreakerWindow   = time.Minute
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// States of a circuit breaker, as reported by the {cgi.breaker} placeholder.
+const (
+	breakerClosed   = "closed"    // requests run the script
+	breakerOpen     = "open"      // requests are rejected
+	breakerHalfOpen = "half-open" // a single request tries whether the script recovered
+)
+
+// circuitBreaker keeps requests from running scripts that keep failing. Once
+// a script failed the given number of times within the window, requests for
+// it are rejected until the cooldown passed. Then a single request is let
+// through: if it succeeds, the script runs again as usual, otherwise the
+// next cooldown starts.
+type circuitBreaker struct {
+	failures int
+	window   time.Duration
+	cooldown time.Duration
+
+	mu      sync.Mutex
+	scripts map[string]*breakerState
+}
+
+// breakerState is the state of the breaker for a single script.
+type breakerState struct {
+	failed    []time.Time // failures within the window while closed
+	openUntil time.Time   // end of the cooldown; zero while closed
+	probing   bool        // a request tries whether the script recovered
+}
+
+func newCircuitBreaker(failures int, window, cooldown time.Duration) *circuitBreaker {
+	if window <= 0 {
+		window = defaultBreakerWindow
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &circuitBreaker{
+		failures: failures,
+		window:   window,
+		cooldown: cooldown,
+		scripts:  make(map[string]*breakerState),
+	}
+}
+
+// allow reports whether a request may run the script at path and the state
+// of its breaker. Rejected requests learn the time until the next request
+// is let through; probe tells whether the request tries whether the script
+// recovered. Requests that were allowed must be recorded.
+func (cb *circuitBreaker) allow(path string, now time.Time) (ok bool, state string, retryAfter time.Duration, probe bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	st := cb.scripts[path]
+	switch {
+	case st == nil || st.openUntil.IsZero():
+		return true, breakerClosed, 0, false
+	case now.Before(st.openUntil):
+		return false, breakerOpen, st.openUntil.Sub(now), false
+	case st.probing:
+		return false, breakerHalfOpen, 0, false
+	}
+	st.probing = true
+	return true, breakerHalfOpen, 0, true
+}
+
+// record notes the outcome of a request allowed for the script at path. It
+// reports whether the breaker opened because of it.
+func (cb *circuitBreaker) record(path string, probe, failed bool, now time.Time) (opened bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	st := cb.scripts[path]
+	if probe {
+		if !failed {
+			delete(cb.scripts, path)
+			return false
+		}
+		st.probing = false
+		st.openUntil = now.Add(cb.cooldown)
+		return true
+	}
+	if st != nil && !st.openUntil.IsZero() {
+		// The request started before the breaker opened.
+		return false
+	}
+	if st == nil {
+		if !failed {
+			return false
+		}
+		st = new(breakerState)
+		cb.scripts[path] = st
+	}
+	recent := st.failed[:0]
+	for _, t := range st.failed {
+		if now.Sub(t) < cb.window {
+			recent = append(recent, t)
+		}
+	}
+	st.failed = recent
+	if !failed {
+		if len(st.failed) == 0 {
+			delete(cb.scripts, path)
+		}
+		return false
+	}
+	st.failed = append(st.failed, now)
+	if len(st.failed) < cb.failures {
+		return false
+	}
+	st.failed = nil
+	st.openUntil = now.Add(cb.cooldown)
+	return true
+}
+
+// release gives up a probe that didn't get to run the script, so the next
+// request tries instead.
+func (cb *circuitBreaker) release(path string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if st := cb.scripts[path]; st != nil {
+		st.probing = false
+	}
+}
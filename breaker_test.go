@@ -0,0 +1,112 @@
+package cgi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := newCircuitBreaker(2, time.Minute, 30*time.Second)
+	now := time.Now()
+	expect := func(at time.Duration, ok bool, state string, probe bool) {
+		t.Helper()
+		gotOK, gotState, _, gotProbe := cb.allow("script", now.Add(at))
+		if gotOK != ok || gotState != state || gotProbe != probe {
+			t.Errorf("Unexpected %v, %s, probe %v after %v. Expected %v, %s, probe %v.",
+				gotOK, gotState, gotProbe, at, ok, state, probe)
+		}
+	}
+
+	// Failures further apart than the window don't open the breaker.
+	cb.record("script", false, true, now)
+	cb.record("script", false, true, now.Add(2*time.Minute))
+	expect(2*time.Minute, true, breakerClosed, false)
+	if !cb.record("script", false, true, now.Add(150*time.Second)) {
+		t.Error("Breaker not opened by the second failure within the window.")
+	}
+	expect(160*time.Second, false, breakerOpen, false)
+	expect(181*time.Second, true, breakerHalfOpen, true)
+	// Only a single request tries while half open.
+	expect(181*time.Second, false, breakerHalfOpen, false)
+	cb.record("script", true, true, now.Add(182*time.Second))
+	expect(200*time.Second, false, breakerOpen, false)
+	expect(213*time.Second, true, breakerHalfOpen, true)
+	cb.record("script", true, false, now.Add(213*time.Second))
+	expect(213*time.Second, true, breakerClosed, false)
+	if len(cb.scripts) != 0 {
+		t.Errorf("Unexpected state of %d scripts kept. Expected none.", len(cb.scripts))
+	}
+
+	// A probe that didn't run lets the next request try.
+	cb.record("other", false, true, now)
+	cb.record("other", false, true, now)
+	if ok, _, _, probe := cb.allow("other", now.Add(time.Minute)); !ok || !probe {
+		t.Fatal("Expected a probe once the cooldown passed.")
+	}
+	cb.release("other")
+	if ok, _, _, probe := cb.allow("other", now.Add(time.Minute)); !ok || !probe {
+		t.Error("Expected another probe after the first was released.")
+	}
+}
+
+func TestCGI_ServeHTTPCircuitBreaker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := CGI{
+		Executable: "test/flaky",
+		Args:       []string{filepath.Join(dir, "runs"), "2"},
+		logger:     zap.NewNop(),
+		breaker:    newCircuitBreaker(2, time.Minute, 100*time.Millisecond),
+	}
+	serve := func() (*httptest.ResponseRecorder, *caddy.Replacer, error) {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		repl := caddy.NewReplacer()
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+		return res, repl, c.ServeHTTP(res, req, NoOpNextHandler{})
+	}
+
+	for i := 0; i < 2; i++ {
+		if res, _, err := serve(); err != nil || res.Code != 500 {
+			t.Fatalf("Unexpected result %d, %v of failing run %d. Expected 500.", res.Code, err, i+1)
+		}
+	}
+	res, repl, err := serve()
+	herr, ok := err.(caddyhttp.HandlerError)
+	if !ok || herr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Unexpected error %v. Expected status %d.", err, http.StatusServiceUnavailable)
+	}
+	if state, _ := repl.GetString("cgi.breaker"); state != breakerOpen {
+		t.Errorf("Unexpected breaker state %q. Expected %q.", state, breakerOpen)
+	}
+	if retry := res.Header().Get("Retry-After"); retry != "1" {
+		t.Errorf("Unexpected Retry-After %q. Expected %q.", retry, "1")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	res, repl, err = serve()
+	if err != nil || res.Code != 200 {
+		t.Fatalf("Unexpected result %d, %v once the script recovered. Expected 200.", res.Code, err)
+	}
+	if state, _ := repl.GetString("cgi.breaker"); state != breakerHalfOpen {
+		t.Errorf("Unexpected breaker state %q. Expected %q.", state, breakerHalfOpen)
+	}
+	_, repl, _ = serve()
+	if state, _ := repl.GetString("cgi.breaker"); state != breakerClosed {
+		t.Errorf("Unexpected breaker state %q. Expected %q.", state, breakerClosed)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// defaultBufferSpool is the size above which buffered responses are spooled
+// to a temporary file if not configured.
+const defaultBufferSpool = 1 << 20
+
+// bufferWriter collects responses completely, in memory up to a size and in a
+// temporary file beyond, before sending them with their Content-Length. With
+// ranges, successful responses to GET requests are answered like a static
+// file, honoring byte ranges and conditional requests; with all, every other
+// response with a body is held back as well. Event streams, responses that
+// already are partial and responses to HEAD requests pass through.
+type bufferWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	req     *http.Request
+	spool   int64
+	ranges  bool
+	all     bool
+	status  int  // held back status
+	passing bool // true once the response passes through
+	body    bytes.Buffer
+	file    *spoolWriter // the spooled body beyond spool, if any
+	size    int64
+}
+
+func newBufferWriter(w http.ResponseWriter, req *http.Request, spool int64, ranges, all bool) *bufferWriter {
+	if spool <= 0 {
+		spool = defaultBufferSpool
+	}
+	return &bufferWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		req:                   req,
+		spool:                 spool,
+		ranges:                ranges,
+		all:                   all,
+		passing:               req.Method == http.MethodHead || (!all && req.Method != http.MethodGet),
+	}
+}
+
+// rangeable reports whether the response with status is answered with the
+// requested ranges.
+func (bw *bufferWriter) rangeable(status int) bool {
+	return bw.ranges && bw.req.Method == http.MethodGet && status == http.StatusOK
+}
+
+func (bw *bufferWriter) WriteHeader(status int) {
+	if bw.passing || isInformational(status) {
+		bw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if bw.status != 0 {
+		return
+	}
+	header := bw.Header()
+	held := bw.rangeable(status) || (bw.all && status != http.StatusNoContent && status != http.StatusNotModified)
+	if !held || header.Get("Content-Range") != "" ||
+		strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		bw.passing = true
+		bw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	bw.status = status
+}
+
+func (bw *bufferWriter) Write(p []byte) (int, error) {
+	if bw.status == 0 && !bw.passing {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if bw.passing {
+		return bw.ResponseWriter.Write(p)
+	}
+	if bw.file == nil && bw.size+int64(len(p)) > bw.spool {
+		f, err := tempFiles.create("response")
+		if err != nil {
+			// Without a file, the response can only be streamed.
+			if err := bw.release(); err != nil {
+				return 0, err
+			}
+			return bw.ResponseWriter.Write(p)
+		}
+		bw.file = &spoolWriter{f: f}
+		if _, err := bw.file.Write(bw.body.Bytes()); err != nil {
+			return 0, err
+		}
+		bw.body.Reset()
+	}
+	var n int
+	var err error
+	if bw.file != nil {
+		n, err = bw.file.Write(p)
+	} else {
+		n, err = bw.body.Write(p)
+	}
+	bw.size += int64(n)
+	return n, err
+}
+
+// Flush does nothing while the response is held back; it is sent once the
+// script is done.
+func (bw *bufferWriter) Flush() {
+	if bw.passing {
+		bw.ResponseWriterWrapper.Flush()
+	}
+}
+
+// release sends what was held back in memory and passes the rest through.
+func (bw *bufferWriter) release() error {
+	bw.passing = true
+	bw.ResponseWriter.WriteHeader(bw.status)
+	_, err := bw.ResponseWriter.Write(bw.body.Bytes())
+	bw.body.Reset()
+	return err
+}
+
+// finish sends the held back response with its Content-Length or, for
+// ranges, the requested ranges or 304 (Not Modified), 412 (Precondition
+// Failed) or 416 (Range Not Satisfiable) like http.ServeContent. It removes
+// the temporary file, if any.
+func (bw *bufferWriter) finish() {
+	if bw.file != nil {
+		defer func() {
+			bw.file.f.Close()
+			tempFiles.remove(bw.file.f.Name())
+		}()
+	}
+	if bw.passing || bw.status == 0 {
+		return
+	}
+	bw.passing = true
+	var content io.ReadSeeker = bytes.NewReader(bw.body.Bytes())
+	if bw.file != nil {
+		if bw.file.err != nil {
+			bw.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		content = io.NewSectionReader(bw.file.f, 0, bw.size)
+	}
+	header := bw.Header()
+	if !bw.rangeable(bw.status) {
+		header.Set("Content-Length", strconv.FormatInt(bw.size, 10))
+		bw.ResponseWriter.WriteHeader(bw.status)
+		io.Copy(bw.ResponseWriter, content)
+		return
+	}
+	// ServeContent computes the length of what it sends itself, and a
+	// missing Content-Type must not be sniffed from the body.
+	header.Del("Content-Length")
+	if _, ok := header["Content-Type"]; !ok {
+		header["Content-Type"] = nil
+	}
+	modified, _ := http.ParseTime(header.Get("Last-Modified"))
+	http.ServeContent(bw.ResponseWriter, bw.req, "", modified, content)
+}
@@ -0,0 +1,109 @@
+package cgi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCGI_ServeHTTPAcceptRanges(t *testing.T) {
+	// The script sends the query as body and the header in X-Hdr; bodies
+	// longer than 8 bytes are spooled.
+	c := CGI{
+		Executable: "/bin/sh",
+		Args: []string{"-c", `printf 'Content-Type: text/plain\r\n'; [ -n "$HTTP_X_HDR" ] && printf '%s\r\n' "$HTTP_X_HDR"
+printf '\r\n%s' "$QUERY_STRING"`},
+		AcceptRanges: true,
+		BufferSpool:  8,
+		logger:       zap.NewNop(),
+	}
+	for i, step := range []struct {
+		method, target string
+		header         http.Header
+		status         int
+		body           string
+		contentRange   string
+	}{
+		{http.MethodGet, "/?abcdefghijklmnopqrstuvwxyz", nil, http.StatusOK, "abcdefghijklmnopqrstuvwxyz", ""},
+		{http.MethodGet, "/?abcdefghijklmnopqrstuvwxyz", http.Header{"Range": {"bytes=2-4"}}, http.StatusPartialContent, "cde", "bytes 2-4/26"},
+		{http.MethodGet, "/?abcdef", http.Header{"Range": {"bytes=-2"}}, http.StatusPartialContent, "ef", "bytes 4-5/6"},
+		{http.MethodGet, "/?abcdef", http.Header{"Range": {"bytes=10-"}}, http.StatusRequestedRangeNotSatisfiable, "invalid range: failed to overlap\n", "bytes */6"},
+		{http.MethodGet, "/?abcdef", http.Header{"Range": {"bytes=0-1"}, "X-Hdr": {`ETag: "v1"`}, "If-Range": {`"v2"`}}, http.StatusOK, "abcdef", ""},
+		{http.MethodGet, "/?abcdef", http.Header{"Range": {"bytes=0-1"}, "X-Hdr": {`ETag: "v1"`}, "If-Range": {`"v1"`}}, http.StatusPartialContent, "ab", "bytes 0-1/6"},
+		{http.MethodGet, "/?abcdef", http.Header{"X-Hdr": {`ETag: "v1"`}, "If-None-Match": {`"v1"`}}, http.StatusNotModified, "", ""},
+		{http.MethodGet, "/?abcdef", http.Header{"Range": {"bytes=0-1"}, "X-Hdr": {"Status: 404 Not Found"}}, http.StatusNotFound, "abcdef", ""},
+		{http.MethodPost, "/?abcdef", http.Header{"Range": {"bytes=0-1"}}, http.StatusOK, "abcdef", ""},
+	} {
+		req := httptest.NewRequest(step.method, step.target, nil)
+		for k, v := range step.header {
+			req.Header[k] = v
+		}
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		res := httptest.NewRecorder()
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if res.Code != step.status || res.Body.String() != step.body || res.Header().Get("Content-Range") != step.contentRange {
+			t.Errorf("Step %d: unexpected response %d %q with range %q. Expected %d %q with range %q.", i,
+				res.Code, res.Body.String(), res.Header().Get("Content-Range"), step.status, step.body, step.contentRange)
+		}
+		if step.status == http.StatusOK && step.method == http.MethodGet && res.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("Step %d: unexpected Accept-Ranges %q. Expected bytes.", i, res.Header().Get("Accept-Ranges"))
+		}
+	}
+
+	tempFiles.mu.Lock()
+	defer tempFiles.mu.Unlock()
+	for name := range tempFiles.files {
+		if strings.Contains(filepath.Base(name), "cgi_response_") {
+			t.Errorf("Unexpected temporary file %s left behind.", name)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPBufferOutput(t *testing.T) {
+	// The script sends the query as body, the content type in X-Type and
+	// the header in X-Hdr; bodies longer than 8 bytes are spooled.
+	c := CGI{
+		Executable: "/bin/sh",
+		Args: []string{"-c", `t=$HTTP_X_TYPE; [ -z "$t" ] && t=text/plain; printf 'Content-Type: %s\r\n' "$t"; [ -n "$HTTP_X_HDR" ] && printf '%s\r\n' "$HTTP_X_HDR"
+printf '\r\n%s' "$QUERY_STRING"`},
+		BufferOutput: true,
+		BufferSpool:  8,
+		logger:       zap.NewNop(),
+	}
+	for i, step := range []struct {
+		method, target string
+		header         http.Header
+		status         int
+		body           string
+		contentLength  string
+	}{
+		{http.MethodGet, "/?abcdefghijklmnopqrstuvwxyz", nil, http.StatusOK, "abcdefghijklmnopqrstuvwxyz", "26"},
+		{http.MethodGet, "/?abc", nil, http.StatusOK, "abc", "3"},
+		{http.MethodPost, "/?abcdef", nil, http.StatusOK, "abcdef", "6"},
+		{http.MethodGet, "/?abcdefghij", http.Header{"X-Hdr": {"Status: 404 Not Found"}}, http.StatusNotFound, "abcdefghij", "10"},
+		{http.MethodGet, "/?abcdef", http.Header{"Range": {"bytes=0-1"}}, http.StatusOK, "abcdef", "6"},
+		{http.MethodGet, "/?data:x", http.Header{"X-Type": {"text/event-stream"}}, http.StatusOK, "data:x", ""},
+	} {
+		req := httptest.NewRequest(step.method, step.target, nil)
+		for k, v := range step.header {
+			req.Header[k] = v
+		}
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		res := httptest.NewRecorder()
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if res.Code != step.status || res.Body.String() != step.body || res.Header().Get("Content-Length") != step.contentLength {
+			t.Errorf("Step %d: unexpected response %d %q with length %q. Expected %d %q with length %q.", i,
+				res.Code, res.Body.String(), res.Header().Get("Content-Length"), step.status, step.body, step.contentLength)
+		}
+	}
+}
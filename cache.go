@@ -0,0 +1,347 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// cacheVaryUser names the authenticated user in CGI.CacheVary, next to
+// request headers.
+const cacheVaryUser = "remote_user"
+
+// defaultCacheSize is the size of the response cache in memory if not
+// configured.
+const defaultCacheSize = 16 << 20
+
+// cacheStorage is the part of caddy.Context.Storage the response cache uses.
+type cacheStorage interface {
+	Store(key string, value []byte) error
+	Load(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// cachedResponse is a response stored in the cache.
+type cachedResponse struct {
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Body    []byte      `json:"body"`
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"`
+}
+
+// responseCache keeps successful responses to GET and HEAD requests for a
+// while, keyed by method, host, path, query and the values of selected
+// request headers. Responses live in memory, evicting the least recently
+// used ones beyond the size limit, and optionally in storage as well, where
+// they survive evictions and reloads until they expire.
+type responseCache struct {
+	ttl     int64 // time.Duration; accessed atomically, may change at runtime
+	max     int64
+	vary    []string // canonical names of request headers in the key
+	user    bool     // whether the authenticated user is part of the key
+	storage cacheStorage
+	prefix  string // of the keys in storage
+	logger  *zap.Logger
+
+	mu    sync.Mutex
+	lru   *list.List // of *cacheEntry, most recently used first
+	items map[string]*list.Element
+	size  int64
+}
+
+type cacheEntry struct {
+	key string
+	res *cachedResponse
+}
+
+func newResponseCache(ttl time.Duration, max int64, vary []string, storage cacheStorage, route string, logger *zap.Logger) *responseCache {
+	if max <= 0 {
+		max = defaultCacheSize
+	}
+	rc := &responseCache{
+		ttl:     int64(ttl),
+		max:     max,
+		storage: storage,
+		logger:  logger,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+	for _, name := range vary {
+		if strings.EqualFold(name, cacheVaryUser) {
+			rc.user = true
+			continue
+		}
+		rc.vary = append(rc.vary, http.CanonicalHeaderKey(name))
+	}
+	sum := sha256.Sum256([]byte(route))
+	rc.prefix = "cgi/cache/" + hex.EncodeToString(sum[:8]) + "/"
+	return rc
+}
+
+func (rc *responseCache) getTTL() time.Duration {
+	return time.Duration(atomic.LoadInt64(&rc.ttl))
+}
+
+// setTTL changes the lifetime of responses cached from now on; cached ones
+// keep theirs.
+func (rc *responseCache) setTTL(ttl time.Duration) {
+	atomic.StoreInt64(&rc.ttl, int64(ttl))
+}
+
+// key returns the cache key of r, the request as the script sees it, made by
+// user, the authenticated user if any; empty if r can't be answered from the
+// cache. Requests with credentials, cookies or by an authenticated user only
+// are if Authorization, Cookie or the user respectively are part of the key.
+func (rc *responseCache) key(r *http.Request, user string) string {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return ""
+	}
+	if _, ok := r.Header["Authorization"]; ok && !rc.varies("Authorization") {
+		return ""
+	}
+	if _, ok := r.Header["Cookie"]; ok && !rc.varies("Cookie") {
+		return ""
+	}
+	if user != "" && !rc.user {
+		return ""
+	}
+	var b strings.Builder
+	// HEAD requests are answered from GET responses.
+	b.WriteString(http.MethodGet + "\x00" + r.Host + "\x00" + r.URL.RequestURI())
+	for _, name := range rc.vary {
+		b.WriteString("\x00" + strings.Join(r.Header[name], ","))
+	}
+	if rc.user {
+		b.WriteString("\x00" + user)
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// varies reports whether the request header name is part of the key.
+func (rc *responseCache) varies(name string) bool {
+	for _, v := range rc.vary {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the response stored for key, if it didn't expire yet.
+func (rc *responseCache) get(key string, now time.Time) *cachedResponse {
+	rc.mu.Lock()
+	if el, ok := rc.items[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if now.Before(entry.res.Expires) {
+			rc.lru.MoveToFront(el)
+			rc.mu.Unlock()
+			return entry.res
+		}
+		rc.remove(el)
+	}
+	rc.mu.Unlock()
+	if rc.storage == nil {
+		return nil
+	}
+	data, err := rc.storage.Load(rc.prefix + key)
+	if err != nil {
+		return nil
+	}
+	var res cachedResponse
+	if err := json.Unmarshal(data, &res); err != nil || !now.Before(res.Expires) {
+		rc.storage.Delete(rc.prefix + key)
+		return nil
+	}
+	rc.keep(key, &res)
+	return &res
+}
+
+// put stores res for key.
+func (rc *responseCache) put(key string, res *cachedResponse) {
+	rc.keep(key, res)
+	if rc.storage == nil {
+		return
+	}
+	data, err := json.Marshal(res)
+	if err == nil {
+		err = rc.storage.Store(rc.prefix+key, data)
+	}
+	if err != nil {
+		rc.logger.Warn("cannot store cached response", zap.Error(err))
+	}
+}
+
+// keep stores res for key in memory, evicting the least recently used
+// responses beyond the size limit.
+func (rc *responseCache) keep(key string, res *cachedResponse) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if el, ok := rc.items[key]; ok {
+		rc.remove(el)
+	}
+	rc.items[key] = rc.lru.PushFront(&cacheEntry{key, res})
+	rc.size += int64(len(res.Body))
+	for rc.size > rc.max {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+// remove drops el from memory; rc.mu must be held.
+func (rc *responseCache) remove(el *list.Element) {
+	entry := rc.lru.Remove(el).(*cacheEntry)
+	delete(rc.items, entry.key)
+	rc.size -= int64(len(entry.res.Body))
+}
+
+// serve answers r from the response stored for key, if any. It reports
+// whether it did.
+func (rc *responseCache) serve(w http.ResponseWriter, r *http.Request, key string) bool {
+	now := time.Now()
+	res := rc.get(key, now)
+	if res == nil {
+		return false
+	}
+	for k, vv := range res.Header {
+		w.Header()[k] = vv
+	}
+	w.Header().Set("Age", strconv.Itoa(int(now.Sub(res.Stored).Seconds())))
+	if notModified(r, w.Header()) {
+		writeNotModified(w)
+		return true
+	}
+	w.WriteHeader(res.Status)
+	if r.Method != http.MethodHead {
+		w.Write(res.Body)
+	}
+	return true
+}
+
+// record returns a writer that passes the response on to w and keeps a copy
+// for the cache.
+func (rc *responseCache) record(w http.ResponseWriter) *cacheRecorder {
+	return &cacheRecorder{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}, max: rc.max}
+}
+
+// store puts the response recorded by cr into the cache for key if it may
+// be cached, for as long as its Cache-Control allows or the TTL of the cache.
+func (rc *responseCache) store(key string, cr *cacheRecorder) {
+	if cr.status != http.StatusOK || cr.overflow {
+		return
+	}
+	ttl, ok := cacheLifetime(cr.header, rc.getTTL())
+	if !ok {
+		return
+	}
+	for _, name := range strings.Split(strings.Join(cr.header["Vary"], ","), ",") {
+		// Responses depending on request headers outside the key would be
+		// served to the wrong clients.
+		if name = strings.TrimSpace(name); name != "" && (name == "*" || !rc.varies(http.CanonicalHeaderKey(name))) {
+			return
+		}
+	}
+	now := time.Now()
+	rc.put(key, &cachedResponse{
+		Status:  cr.status,
+		Header:  cr.header,
+		Body:    cr.body.Bytes(),
+		Stored:  now,
+		Expires: now.Add(ttl),
+	})
+}
+
+// cacheLifetime returns how long a response with header may be cached,
+// following its Cache-Control and defaulting to ttl, and false if it may
+// not be cached at all.
+func cacheLifetime(header http.Header, ttl time.Duration) (time.Duration, bool) {
+	if _, ok := header["Set-Cookie"]; ok {
+		return 0, false
+	}
+	maxAge, sMaxAge := -1, -1
+	for _, directive := range strings.Split(strings.Join(header["Cache-Control"], ","), ",") {
+		name, value := strings.TrimSpace(directive), ""
+		if eq := strings.IndexByte(name, '='); eq >= 0 {
+			name, value = strings.TrimSpace(name[:eq]), strings.Trim(strings.TrimSpace(name[eq+1:]), `"`)
+		}
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache", "private":
+			return 0, false
+		case "max-age":
+			if n, err := strconv.Atoi(value); err == nil {
+				maxAge = n
+			}
+		case "s-maxage":
+			if n, err := strconv.Atoi(value); err == nil {
+				sMaxAge = n
+			}
+		}
+	}
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	if maxAge >= 0 {
+		ttl = time.Duration(maxAge) * time.Second
+	}
+	return ttl, ttl > 0
+}
+
+// cacheRecorder passes a response on and keeps a copy of it, up to a size.
+type cacheRecorder struct {
+	*caddyhttp.ResponseWriterWrapper
+	max      int64
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (cr *cacheRecorder) WriteHeader(status int) {
+	if cr.status == 0 && !isInformational(status) {
+		cr.status = status
+		cr.header = cr.Header().Clone()
+	}
+	cr.ResponseWriter.WriteHeader(status)
+}
+
+func (cr *cacheRecorder) Write(p []byte) (int, error) {
+	if cr.status == 0 {
+		cr.WriteHeader(http.StatusOK)
+	}
+	if !cr.overflow {
+		if int64(cr.body.Len()+len(p)) > cr.max {
+			cr.overflow = true
+			cr.body.Reset()
+		} else {
+			cr.body.Write(p)
+		}
+	}
+	return cr.ResponseWriter.Write(p)
+}
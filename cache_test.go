@@ -0,0 +1,244 @@
+package cgi
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// memoryStorage is a cacheStorage in memory.
+type memoryStorage map[string][]byte
+
+func (ms memoryStorage) Store(key string, value []byte) error {
+	ms[key] = value
+	return nil
+}
+
+func (ms memoryStorage) Load(key string) ([]byte, error) {
+	if value, ok := ms[key]; ok {
+		return value, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (ms memoryStorage) Delete(key string) error {
+	delete(ms, key)
+	return nil
+}
+
+func TestCGI_ServeHTTPCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-cgi-cache")
+	if err != nil {
+		t.Fatalf("Cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// The script counts its executions and sends the header in $HDR.
+	script := `n=$(cat "$COUNTER" 2>/dev/null || echo 0); n=$((n+1)); echo $n > "$COUNTER"
+printf 'Content-Type: text/plain\r\n%s\r\n\r\n%s' "$HDR" $n`
+	newCGI := func(header string) CGI {
+		return CGI{
+			Executable: "/bin/sh",
+			Args:       []string{"-c", script},
+			Envs:       []string{"COUNTER=" + filepath.Join(dir, "counter"), "HDR=" + header},
+			logger:     zap.NewNop(),
+		}
+	}
+	serve := func(c CGI, method, target string, header http.Header) (*httptest.ResponseRecorder, string) {
+		req := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		repl := caddy.NewReplacer()
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+		res := httptest.NewRecorder()
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		state, _ := repl.GetString("cgi.cache")
+		return res, state
+	}
+
+	storage := memoryStorage{}
+	c := newCGI("X-Script: yes")
+	c.cache = newResponseCache(time.Minute, 0, []string{"accept-language"}, storage, "test", zap.NewNop())
+	for i, step := range []struct {
+		method, target string
+		header         http.Header
+		body, state    string
+	}{
+		{http.MethodGet, "/page", nil, "1", "miss"},
+		{http.MethodGet, "/page", nil, "1", "hit"},
+		{http.MethodHead, "/page", nil, "", "hit"},
+		{http.MethodGet, "/page?fresh", nil, "2", "miss"},
+		{http.MethodGet, "/page", http.Header{"Accept-Language": {"de"}}, "3", "miss"},
+		{http.MethodGet, "/page", http.Header{"Accept-Language": {"de"}}, "3", "hit"},
+		{http.MethodGet, "/page", http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}, "4", ""},
+		{http.MethodPost, "/page", nil, "5", ""},
+	} {
+		res, state := serve(c, step.method, step.target, step.header)
+		if res.Code != http.StatusOK || res.Body.String() != step.body || state != step.state {
+			t.Errorf("Step %d: unexpected response %d %q (%s). Expected %d %q (%s).",
+				i, res.Code, res.Body.String(), state, http.StatusOK, step.body, step.state)
+		}
+		if res.Header().Get("X-Script") != "yes" {
+			t.Errorf("Step %d: unexpected headers %v.", i, res.Header())
+		}
+	}
+
+	// The storage keeps the responses across reloads.
+	c.cache = newResponseCache(time.Minute, 0, []string{"Accept-Language"}, storage, "test", zap.NewNop())
+	if res, state := serve(c, http.MethodGet, "/page", nil); res.Body.String() != "1" || state != "hit" {
+		t.Errorf("Unexpected response %q (%s) after reload. Expected %q (hit).", res.Body.String(), state, "1")
+	}
+
+	// Responses that forbid caching or set cookies aren't cached.
+	for _, header := range []string{"Cache-Control: no-store", "Cache-Control: max-age=0", "Set-Cookie: a=b", "Vary: Cookie"} {
+		c := newCGI(header)
+		c.cache = newResponseCache(time.Minute, 0, nil, nil, "test", zap.NewNop())
+		first, _ := serve(c, http.MethodGet, "/other", nil)
+		second, state := serve(c, http.MethodGet, "/other", nil)
+		if state != "miss" || first.Body.String() == second.Body.String() {
+			t.Errorf("Unexpected cached response %q (%s) with %s.", second.Body.String(), state, header)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPCachePrivate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-cgi-cache")
+	if err != nil {
+		t.Fatalf("Cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	script := `n=$(cat "$COUNTER" 2>/dev/null || echo 0); n=$((n+1)); echo $n > "$COUNTER"
+printf 'Content-Type: text/plain\r\n\r\n%s' $n`
+	serve := func(c CGI, cookie, user string) string {
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		repl := caddy.NewReplacer()
+		if user != "" {
+			repl.Set("http.auth.user.id", user)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+		if err := c.ServeHTTP(httptest.NewRecorder(), req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		state, _ := repl.GetString("cgi.cache")
+		return state
+	}
+
+	for _, test := range []struct {
+		vary         []string
+		cookie, user []string
+		states       []string
+	}{
+		// Responses may depend on cookies and the user the script sees, so
+		// they bypass the cache ...
+		{nil, []string{"a=1", "a=1"}, []string{"", ""}, []string{"", ""}},
+		{nil, []string{"", ""}, []string{"alice", "alice"}, []string{"", ""}},
+		// ... unless they are part of the key.
+		{[]string{"Cookie"}, []string{"a=1", "a=1", "a=2"}, []string{"", "", ""}, []string{"miss", "hit", "miss"}},
+		{[]string{"remote_user"}, []string{"", "", ""}, []string{"alice", "alice", "bob"}, []string{"miss", "hit", "miss"}},
+	} {
+		c := CGI{
+			Executable: "/bin/sh",
+			Args:       []string{"-c", script},
+			Envs:       []string{"COUNTER=" + filepath.Join(dir, "counter")},
+			logger:     zap.NewNop(),
+		}
+		c.cache = newResponseCache(time.Minute, 0, test.vary, nil, "test", zap.NewNop())
+		for i, expected := range test.states {
+			if state := serve(c, test.cookie[i], test.user[i]); state != expected {
+				t.Errorf("Vary %v, request %d: unexpected cache state %q. Expected %q.", test.vary, i, state, expected)
+			}
+		}
+	}
+}
+
+func TestCGI_ServeHTTPCacheScriptRequest(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		cgi             CGI
+		first, second   string
+		secondCacheHits bool
+	}{
+		{"stripped", CGI{StripQueryParams: []string{"utm_*"}}, "/page?id=1&utm_source=a", "/page?id=1&utm_source=b", true},
+		{"not stripped", CGI{}, "/page?id=1&utm_source=a", "/page?id=1&utm_source=b", false},
+		{"canonical query", CGI{Canonicalize: true}, "/page?b=2&a=1", "/page?a=1&b=2", true},
+		{"query", CGI{}, "/page?b=2&a=1", "/page?a=1&b=2", false},
+		{"canonical host", CGI{Canonicalize: true}, "http://Example.COM/page", "http://example.com/page", true},
+		{"host", CGI{}, "http://Example.COM/page", "http://example.com/page", false},
+	} {
+		c := test.cgi
+		c.Executable = "test/example"
+		c.logger = zap.NewNop()
+		c.cache = newResponseCache(time.Minute, 0, nil, nil, "test", zap.NewNop())
+		var states []string
+		for _, target := range []string{test.first, test.second} {
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			repl := caddy.NewReplacer()
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+			if err := c.ServeHTTP(httptest.NewRecorder(), req, NoOpNextHandler{}); err != nil {
+				t.Fatalf("Cannot serve http: %v", err)
+			}
+			state, _ := repl.GetString("cgi.cache")
+			states = append(states, state)
+		}
+		if hit := states[1] == "hit"; states[0] != "miss" || hit != test.secondCacheHits {
+			t.Errorf("%s: unexpected cache states %v. Expected a hit for the second request: %v.", test.name, states, test.secondCacheHits)
+		}
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	rc := newResponseCache(time.Minute, 10, nil, nil, "test", zap.NewNop())
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		rc.put(key, &cachedResponse{Status: http.StatusOK, Body: []byte("1234"), Stored: now, Expires: now.Add(time.Minute)})
+		if key == "b" {
+			// a becomes the most recently used.
+			rc.get("a", now)
+		}
+	}
+	if rc.get("b", now) != nil {
+		t.Error("Expected the least recently used response to be evicted.")
+	}
+	if rc.get("a", now) == nil || rc.get("c", now) == nil {
+		t.Error("Expected the recently used responses to be kept.")
+	}
+	if rc.get("a", now.Add(2*time.Minute)) != nil {
+		t.Error("Expected an expired response not to be served.")
+	}
+}
+
+func TestCacheLifetime(t *testing.T) {
+	for _, test := range []struct {
+		header   http.Header
+		ttl      time.Duration
+		ok       bool
+		expected time.Duration
+	}{
+		{http.Header{}, time.Minute, true, time.Minute},
+		{http.Header{"Cache-Control": {"public, max-age=30"}}, time.Minute, true, 30 * time.Second},
+		{http.Header{"Cache-Control": {"max-age=30, s-maxage=\"90\""}}, time.Minute, true, 90 * time.Second},
+		{http.Header{"Cache-Control": {"Private"}}, time.Minute, false, 0},
+		{http.Header{"Cache-Control": {"no-cache"}}, time.Minute, false, 0},
+		{http.Header{"Cache-Control": {"max-age=0"}}, time.Minute, false, 0},
+		{http.Header{"Set-Cookie": {"a=b"}}, time.Minute, false, 0},
+	} {
+		ttl, ok := cacheLifetime(test.header, test.ttl)
+		if ok != test.ok || (ok && ttl != test.expected) {
+			t.Errorf("Unexpected lifetime %v (%v) of %v. Expected %v (%v).", ttl, ok, test.header, test.expected, test.ok)
+		}
+	}
+}
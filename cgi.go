@@ -18,15 +18,19 @@
 package cgi
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"net/http"
-	"net/http/cgi"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 // currentDir returns the current working directory
@@ -35,6 +39,39 @@ func currentDir() (wdStr string) {
 	return
 }
 
+// envName turns an arbitrary key into something usable as an environment
+// variable name: upper case with anything but letters and digits replaced
+// by underscores.
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - ('a' - 'A')
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// validEnvName reports whether name is usable as an environment variable name
+// as it is, that is envName leaves it alone and it doesn't start with a digit.
+func validEnvName(name string) bool {
+	return name != "" && envName(name) == name && (name[0] < '0' || name[0] > '9')
+}
+
+// replacerString returns the value of key in repl as string; empty if unset.
+func replacerString(repl *caddy.Replacer, key string) string {
+	val, exists := repl.Get(key)
+	if !exists || val == nil {
+		return ""
+	}
+	if str, ok := val.(string); ok {
+		return str
+	}
+	return fmt.Sprint(val)
+}
+
 // passAll returns a slice of strings made up of each environment key
 func passAll() (list []string) {
 	envList := os.Environ() // ["HOME=/home/foo", "LVL=2", ...]
@@ -47,29 +84,202 @@ func passAll() (list []string) {
 	return
 }
 
+// newHandler returns a handler for the configuration, with placeholders in
+// the executable, its arguments and the working directory replaced by repl. The request specific
+// environment is left to the caller.
+func (c CGI) newHandler(repl *caddy.Replacer) handler {
+	h := handler{
+		Root:          "/",
+		Dir:           repl.ReplaceAll(c.WorkingDirectory, ""),
+		DirFromScript: c.DirFromScript,
+		Path:          repl.ReplaceAll(c.Executable, ""),
+		Logger:        c.logger,
+		Software:      c.ServerSoftware,
+		Gateway:       c.GatewayInterface,
+		Timeout:       c.timeout(),
+		KillSignal:    c.killSignal,
+		KillGrace:     time.Duration(c.KillGrace),
+		HeaderTimeout: time.Duration(c.FirstByteTimeout),
+		MarkTruncated: c.MarkTruncated,
+		LogStderr:     c.LogStderr,
+		StderrMin:     c.StderrMinBytes,
+		Retries:       c.Retries,
+		RetryDelay:    c.retryDelay(),
+		RetryDelayMax: c.retryDelayMax(),
+		TextBusy:      c.TextBusy,
+		BusyRetries:   c.busyRetries(),
+		KeepAlive:     c.keepAlive(),
+		Streaming:     c.Streaming || c.SSE,
+		FlushInterval: time.Duration(c.FlushInterval),
+		EventStream:   c.SSE,
+		EarlyHints:    c.EarlyHints,
+		BufferLimit:   c.ResponseBuffer,
+		StreamBody:    c.ChunkedBody == chunkedBodyStream,
+		SocketStdio:   c.SocketStdio,
+		SocketBuffer:  int(c.SocketBuffer),
+		Upgrade:       c.Upgrade,
+		Rlimits:       c.rlimits,
+		Nice:          c.Nice,
+		Umask:         c.umask,
+		IOPrio:        c.ioprio,
+		Seccomp:       c.seccomp,
+		Landlock:      c.landlock,
+		Conformance:   c.Conformance,
+		StripPreamble: c.StripBOM || c.Conformance == conformanceCompat,
+		Credential:    c.credential,
+		Namespaces:    c.namespaces,
+		EnvAllow:      c.inheritEnv,
+		CookieAllow:   c.CookieAllow,
+		CookieDeny:    c.CookieDeny,
+		SetCookie:     c.SetCookie,
+		Disposition:   c.SanitizeDisposition,
+		FoldHeaders:   c.fold,
+		Cgroup:        c.cgroup,
+		CoreDumps:     c.CoreDumps,
+		KillGroup:     c.KillGroup,
+		Chroot:        c.chroot,
+		Program:       c.program,
+		ExtraFiles:    c.extraFiles,
+	}
+	for _, str := range c.Args {
+		h.Args = append(h.Args, repl.ReplaceAll(str, ""))
+	}
+	h.Interpreter = c.interpreter(h.Path)
+	if c.PassAll {
+		h.InheritEnv = passAll()
+	} else {
+		h.InheritEnv = append(h.InheritEnv, c.PassEnvs...)
+	}
+	return h
+}
+
+// remoteUserKey returns the placeholder holding the authenticated user.
+func (c CGI) remoteUserKey() string {
+	if c.RemoteUserKey != "" {
+		return c.RemoteUserKey
+	}
+	return "http.auth.user.id"
+}
+
+// remoteUser returns the authenticated user exported to the script; empty if
+// there is none or it isn't exported.
+func (c CGI) remoteUser(repl *caddy.Replacer) string {
+	if c.NoRemoteUser {
+		return ""
+	}
+	return replacerString(repl, c.remoteUserKey())
+}
+
 func (c CGI) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	// For convenience: get the currently authenticated user; if some other middleware has set that.
+	if c.isStatic(r.URL.Path) {
+		return c.serveStatic(w, r)
+	}
+	if c.canonicalRedirect(w, r) {
+		return nil
+	}
+	inspecting := c.inspects(r)
+	if c.bake != nil && !inspecting && c.bake.serve(w, r) {
+		return next.ServeHTTP(w, r)
+	}
+	if c.MaxQueryLength > 0 && len(r.URL.RawQuery) > c.MaxQueryLength {
+		return caddyhttp.Error(http.StatusRequestURITooLong,
+			fmt.Errorf("query string of %d bytes exceeds limit of %d", len(r.URL.RawQuery), c.MaxQueryLength))
+	}
+	if c.ExpectContinue == expectContinueNever && expectsContinue(r) {
+		return caddyhttp.Error(http.StatusExpectationFailed, fmt.Errorf("100-continue expectations are not supported"))
+	}
+
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
-	var username string
-	if usernameVal, exists := repl.Get("http.auth.user.id"); exists {
-		if usernameVal, ok := usernameVal.(string); ok {
-			username = usernameVal
+
+	// The request as the script sees it also makes the keys of the caches,
+	// so stripping and canonicalization let requests share responses.
+	sr := c.scriptRequest(r)
+
+	var cacheKey string
+	if c.cache != nil && !inspecting {
+		if cacheKey = c.cache.key(sr, c.remoteUser(repl)); cacheKey != "" {
+			if c.cache.serve(w, r, cacheKey) {
+				repl.Set("cgi.cache", "hit")
+				return next.ServeHTTP(w, r)
+			}
+			repl.Set("cgi.cache", "miss")
+		}
+	}
+	var headKey string
+	if c.heads != nil && !inspecting {
+		if headKey = c.heads.key(sr); headKey != "" && r.Method == http.MethodHead && c.heads.serve(w, r, headKey) {
+			return next.ServeHTTP(w, r)
 		}
 	}
 
-	scriptPath := strings.TrimPrefix(r.URL.Path, c.ScriptName)
-
-	var cgiHandler cgi.Handler
+	scriptName, scriptPath := c.scriptPaths(r)
 
-	cgiHandler.Root = "/"
+	headAsGet := c.Head != "" && r.Method == http.MethodHead && !inspecting
+	if headAsGet {
+		// Many scripts only know GET; the body they send is dropped.
+		get := new(http.Request)
+		*get = *sr
+		get.Method = http.MethodGet
+		sr = get
+	}
 
-	repl.Set("root", cgiHandler.Root)
+	repl.Set("root", "/")
 	repl.Set("path", scriptPath)
+	remoteEnv := peerEnv(r, repl)
 
-	cgiHandler.Dir = c.WorkingDirectory
-	cgiHandler.Path = repl.ReplaceAll(c.Executable, "")
-	for _, str := range c.Args {
-		cgiHandler.Args = append(cgiHandler.Args, repl.ReplaceAll(str, ""))
+	var queryArgs []string
+	if c.Conformance == conformanceCompat {
+		queryArgs = isindexArgs(sr.URL.RawQuery)
+	}
+	if err := c.checkArgs(repl, queryArgs); err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	cgiHandler := c.newHandler(repl)
+	cgiHandler.Args = append(cgiHandler.Args, queryArgs...)
+	if !sr.ProtoAtLeast(1, 1) {
+		// Interim responses are not for HTTP/1.0 clients.
+		cgiHandler.EarlyHints = false
+	}
+	if c.LocalRedirects {
+		cgiHandler.LocalRedirect = func(w http.ResponseWriter, location string) {
+			c.localRedirect(w, r, location)
+		}
+	}
+	if len(c.sendRoots) > 0 {
+		cgiHandler.Sendfile = func(w http.ResponseWriter, headers http.Header) {
+			c.sendfile(w, r, headers)
+		}
+	}
+	var transformEnv []string
+	if c.transform != nil {
+		res, err := c.transform.apply(sr, scriptName, scriptPath)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("transform: %v", err))
+		}
+		if res.status != 0 {
+			return caddyhttp.Error(res.status, fmt.Errorf("rejected by transform"))
+		}
+		if res.executable != "" {
+			cgiHandler.Path = res.executable
+			cgiHandler.Interpreter = c.interpreter(res.executable)
+		}
+		if res.argsSet {
+			cgiHandler.Args = res.args
+		}
+		transformEnv = res.env
+	}
+	warmupArgs, warming := r.Context().Value(warmupKey{}).([]string)
+	if warmupArgs != nil {
+		cgiHandler.Args = warmupArgs
+	}
+	if c.snapshots != nil && !inspecting {
+		gen, err := c.snapshots.acquire(cgiHandler.Path)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("snapshotting script: %v", err))
+		}
+		defer c.snapshots.release(gen)
+		cgiHandler.Path = gen.script
 	}
 
 	envAdd := func(key, val string) {
@@ -77,25 +287,245 @@ func (c CGI) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Ha
 		cgiHandler.Env = append(cgiHandler.Env, key+"="+val)
 	}
 	envAdd("PATH_INFO", scriptPath)
-	envAdd("SCRIPT_FILENAME", cgiHandler.Path)
-	envAdd("SCRIPT_NAME", c.ScriptName)
-	envAdd("SCRIPT_EXEC", fmt.Sprintf("%s %s", cgiHandler.Path, strings.Join(cgiHandler.Args, " ")))
-	cgiHandler.Env = append(cgiHandler.Env, "REMOTE_USER="+username)
+	envAdd("SCRIPT_FILENAME", cgiHandler.scriptFilename())
+	envAdd("SCRIPT_NAME", scriptName)
+	if c.Canonicalize && c.KeepOriginal {
+		cgiHandler.Env = append(cgiHandler.Env, "ORIGINAL_QUERY_STRING="+r.URL.RawQuery, "ORIGINAL_HTTP_HOST="+r.Host)
+	}
+	envAdd("SCRIPT_EXEC", strings.TrimPrefix(fmt.Sprintf("%s %s %s", strings.Join(cgiHandler.Interpreter, " "), cgiHandler.Path, strings.Join(cgiHandler.Args, " ")), " "))
+	cgiHandler.Env = append(cgiHandler.Env, "CGI_MODULE_FEATURES="+c.features())
+	if warming {
+		cgiHandler.Env = append(cgiHandler.Env, "CGI_WARMUP=1")
+	}
+
+	// For convenience: export the currently authenticated user; if some other middleware has set that.
+	if !c.NoRemoteUser {
+		userEnv := c.RemoteUserEnv
+		if userEnv == "" {
+			userEnv = "REMOTE_USER"
+		}
+		cgiHandler.Env = append(cgiHandler.Env, userEnv+"="+c.remoteUser(repl))
+		// Metadata lives next to the user key, e.g. http.auth.user.email next to http.auth.user.id.
+		userKey := c.remoteUserKey()
+		metaPrefix := userKey[:strings.LastIndex(userKey, ".")+1]
+		for _, meta := range c.RemoteUserMeta {
+			cgiHandler.Env = append(cgiHandler.Env, userEnv+"_"+envName(meta)+"="+replacerString(repl, metaPrefix+meta))
+		}
+	}
+
+	cgiHandler.Env = append(cgiHandler.Env, remoteEnv...)
 
 	for _, e := range c.Envs {
 		cgiHandler.Env = append(cgiHandler.Env, repl.ReplaceAll(e, ""))
 	}
+	cgiHandler.Env = append(cgiHandler.Env, transformEnv...)
 
-	if c.PassAll {
-		cgiHandler.InheritEnv = passAll()
-	} else {
-		cgiHandler.InheritEnv = append(cgiHandler.InheritEnv, c.PassEnvs...)
+	if c.baseline != nil && !inspecting && !warming {
+		c.baseline.check(cgiHandler.environ(sr), c.logger)
+	}
+	if c.mirror != nil && !inspecting && !warming {
+		id := newRequestID()
+		repl.Set("cgi.request_id", id)
+		c.logger = c.logger.With(zap.String("request_id", id))
+		cgiHandler.Logger = cgiHandler.Logger.With(zap.String("request_id", id))
+		if path, err := c.mirror.write(id, &cgiHandler, sr); err != nil {
+			c.logger.Warn("cannot mirror environment", zap.Error(err))
+		} else {
+			c.logger.Debug("environment mirrored", zap.String("file", path))
+		}
 	}
 
-	if c.Inspect {
-		inspect(cgiHandler, w, r, repl)
-	} else {
-		cgiHandler.ServeHTTP(w, r)
+	sr, unlabel := c.labelRequest(sr, cgiHandler.Path)
+	defer unlabel()
+
+	var probe, ran bool
+	if c.breaker != nil && !inspecting {
+		ok, state, retryAfter, isProbe := c.breaker.allow(cgiHandler.Path, time.Now())
+		repl.Set("cgi.breaker", state)
+		if !ok {
+			repl.Set("cgi.breaker.retry_after", int(math.Ceil(retryAfter.Seconds())))
+			return c.shed(w, r, next, repl, shedCircuitOpen, retryAfter,
+				fmt.Errorf("circuit breaker of %s is %s", cgiHandler.Path, state))
+		}
+		if probe = isProbe; probe {
+			defer func() {
+				if !ran {
+					c.breaker.release(cgiHandler.Path)
+				}
+			}()
+		}
+	}
+
+	if c.drain != nil && !inspecting {
+		ctx, done, ok := c.drain.enter(sr.Context())
+		if !ok {
+			return c.shed(w, r, next, repl, shedDraining, 0, fmt.Errorf("handler is shutting down"))
+		}
+		defer done()
+		sr = sr.WithContext(ctx)
+	}
+
+	if c.ExpectContinue == expectContinueImmediate && expectsContinue(r) && !inspecting {
+		// The client sends the body while the request waits for a
+		// process.
+		w.WriteHeader(http.StatusContinue)
+	}
+
+	if c.concurrent != nil && !inspecting {
+		ctx := r.Context()
+		if c.QueueTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(c.QueueTimeout))
+			defer cancel()
+		}
+		release, err := c.concurrent.acquire(ctx, "", 1, 0)
+		if err != nil {
+			if r.Context().Err() != nil {
+				// The client went away while waiting.
+				return nil
+			}
+			return c.shed(w, r, next, repl, shedQueueFull, 0,
+				fmt.Errorf("no free process slot within %v", time.Duration(c.QueueTimeout)))
+		}
+		defer release()
+	}
+
+	var stats *routeStats
+	if c.app != nil && !inspecting {
+		stats = c.app.stats.route(c.routeName())
+	}
+	if c.app != nil && c.app.scheduler != nil && !inspecting {
+		ctx := r.Context()
+		var expected time.Duration
+		if deadline := c.deadline(); deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, deadline)
+			defer cancel()
+		}
+		// Sorting the recent execution times is only worth it if the request
+		// has a deadline and may actually have to wait.
+		if _, ok := ctx.Deadline(); ok {
+			if _, capacity := c.app.scheduler.usage(); capacity > 0 {
+				expected = stats.percentile(0.95)
+			}
+		}
+		release, err := c.app.scheduler.acquire(ctx, c.routeName(), c.weight(), expected)
+		if err != nil {
+			if r.Context().Err() != nil {
+				// The client went away while waiting.
+				return nil
+			}
+			c.logger.Debug("request shed from queue", zap.String("route", c.routeName()), zap.Error(err))
+			return c.shed(w, r, next, repl, shedScheduler, 0, err)
+		}
+		defer release()
+	}
+
+	// Error statuses are held back until the failure is classified, which
+	// may take until the process exited.
+	var fail failure
+	cgiHandler.Failure = &fail
+	out := w
+	if headAsGet {
+		out = headWriter{&caddyhttp.ResponseWriterWrapper{ResponseWriter: out}}
+	}
+	var headRec *cacheRecorder
+	if headKey != "" {
+		headRec = c.heads.record(out)
+		out = headRec
+	}
+	var buffer *bufferWriter
+	if (c.AcceptRanges || c.BufferOutput) && !inspecting {
+		// Below the cache, which keeps the whole response.
+		buffer = newBufferWriter(out, r, c.BufferSpool, c.AcceptRanges, c.BufferOutput)
+		out = buffer
+	}
+	var recorder *cacheRecorder
+	if cacheKey != "" && r.Method == http.MethodGet {
+		// HEAD responses lack the body GET requests would get.
+		recorder = c.cache.record(out)
+		out = recorder
+	}
+	var etagger *etagWriter
+	if c.ETag && !inspecting {
+		etagger = newETagWriter(out, r, c.ETagLimit)
+		out = etagger
+	}
+	fw := &failureResponseWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: out},
+		failure:               &fail,
+		header:                c.logger.Core().Enabled(zapcore.DebugLevel),
+	}
+	start := time.Now()
+	switch {
+	case inspecting:
+		inspect(cgiHandler, fw, sr, repl)
+	case c.pool != nil:
+		c.pool.serve(&cgiHandler, fw, sr)
+		if stats != nil {
+			stats.record(time.Since(start))
+		}
+	case c.fastcgi != nil:
+		cgiHandler.serveFastCGI(c.fastcgi, fw, sr)
+		if stats != nil {
+			stats.record(time.Since(start))
+		}
+	case c.scgi != nil:
+		cgiHandler.serveSCGI(c.scgi, fw, sr)
+		if stats != nil {
+			stats.record(time.Since(start))
+		}
+	case c.uwsgi != nil:
+		cgiHandler.serveUWSGI(c.uwsgi, fw, sr)
+		if stats != nil {
+			stats.record(time.Since(start))
+		}
+	case c.daemon != nil:
+		cgiHandler.serveDaemon(c.daemon, fw, sr)
+		if stats != nil {
+			stats.record(time.Since(start))
+		}
+	case c.WebSocket && isWebSocketRequest(sr):
+		cgiHandler.serveWebSocket(fw, sr)
+		if stats != nil {
+			stats.record(time.Since(start))
+		}
+	case c.persistent != nil:
+		c.persistent.serve(repl.ReplaceAll(c.PersistentKey, ""), &cgiHandler, fw, sr)
+		if stats != nil {
+			stats.record(time.Since(start))
+		}
+	default:
+		exitCode, usage := cgiHandler.run(fw, sr)
+		if stats != nil {
+			stats.recordExit(time.Since(start), exitCode, usage)
+		}
+		if c.breaker != nil {
+			ran = true
+			if c.breaker.record(cgiHandler.Path, probe, exitCode != 0, time.Now()) {
+				c.logger.Warn("circuit breaker opened, rejecting requests",
+					zap.String("path", cgiHandler.Path), zap.Duration("cooldown", c.breaker.cooldown))
+			}
+		}
+	}
+	if status := fw.finish(); fail.class != "" && status >= http.StatusBadRequest {
+		c.logger.Error("CGI request failed", zap.String("path", cgiHandler.Path),
+			zap.String("error_class", fail.class), zap.Int("status", status))
+		if stats != nil {
+			stats.recordFailure(fail.class)
+		}
+	}
+	if etagger != nil {
+		etagger.finish()
+	}
+	if recorder != nil && fail.class == "" && !warming && r.Context().Err() == nil {
+		c.cache.store(cacheKey, recorder)
+	}
+	if buffer != nil {
+		buffer.finish()
+	}
+	if headRec != nil && fail.class == "" && !warming && r.Context().Err() == nil {
+		c.heads.store(headKey, headRec)
 	}
 	return next.ServeHTTP(w, r)
 }
@@ -1,21 +1,37 @@
 package cgi
 
 import (
+	"compress/gzip"
 	"context"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestCGI_ServeHTTP(t *testing.T) {
 	testSetup := []struct {
 		name         string
 		cgi          CGI
+		replacements map[string]interface{}
 		uri          string
 		statusCode   int
 		responseBody string
@@ -38,6 +54,45 @@ REMOTE_USER []
 HTTP_TOKEN_CLAIM_USER []
 CGI_LOCAL is unset`,
 		},
+		{
+			name: "Timeout",
+			cgi: CGI{
+				Executable: "test/slow",
+				Timeout:    caddy.Duration(100 * time.Millisecond),
+			},
+			statusCode:   504,
+			responseBody: "",
+		},
+		{
+			name: "Timeout with ignored kill signal",
+			cgi: CGI{
+				Executable: "test/slow",
+				Args:       []string{"ignore"},
+				Timeout:    caddy.Duration(100 * time.Millisecond),
+				KillGrace:  caddy.Duration(100 * time.Millisecond),
+			},
+			statusCode:   504,
+			responseBody: "",
+		},
+		{
+			name: "First byte timeout",
+			cgi: CGI{
+				Executable:       "test/slow",
+				FirstByteTimeout: caddy.Duration(100 * time.Millisecond),
+			},
+			statusCode:   504,
+			responseBody: "",
+		},
+		{
+			name: "First byte timeout with slow body",
+			cgi: CGI{
+				Executable:       "test/events",
+				Streaming:        true,
+				FirstByteTimeout: caddy.Duration(200 * time.Millisecond),
+			},
+			statusCode:   200,
+			responseBody: "data: first\n\ndata: second",
+		},
 		{
 			name: "Invalid script",
 			cgi: CGI{
@@ -66,6 +121,7 @@ Executable .................... test/example/some/path
 Root .......................... /
 Dir ........................... 
 Environment
+  CGI_MODULE_FEATURES ......... chunked-body,event-stream
   PATH_INFO ................... /some/path
   REMOTE_USER ................. 
   SCRIPT_EXEC ................. test/example/some/path arg1 arg2
@@ -73,6 +129,45 @@ Environment
   SCRIPT_NAME ................. /foo.cgi
   some ........................ thing
 Inherited environment
+Placeholders
+  {path} ...................... /some/path
+  {root} ...................... /
+  {http.request.host} ......... 
+  {http.request.method} ....... 
+  {http.request.uri.path} .....`,
+		},
+		{
+			name: "Custom remote user",
+			cgi: CGI{
+				Executable:     "test/example",
+				ScriptName:     "/foo.cgi",
+				RemoteUserKey:  "http.auth.user.sub",
+				RemoteUserEnv:  "LOGNAME",
+				RemoteUserMeta: []string{"email", "team-id"},
+				Inspect:        true,
+			},
+			replacements: map[string]interface{}{
+				"http.auth.user.sub":     "jdoe",
+				"http.auth.user.email":   "jdoe@example.com",
+				"http.auth.user.team-id": 42,
+			},
+			uri:        "/foo.cgi/some/path?x=y",
+			statusCode: 200,
+			responseBody: `CGI for Caddy inspection page
+
+Executable .................... test/example
+Root .......................... /
+Dir ........................... 
+Environment
+  CGI_MODULE_FEATURES ......... chunked-body,event-stream
+  LOGNAME ..................... jdoe
+  LOGNAME_EMAIL ............... jdoe@example.com
+  LOGNAME_TEAM_ID ............. 42
+  PATH_INFO ................... /some/path
+  SCRIPT_EXEC ................. test/example 
+  SCRIPT_FILENAME ............. test/example
+  SCRIPT_NAME ................. /foo.cgi
+Inherited environment
 Placeholders
   {path} ...................... /some/path
   {root} ...................... /
@@ -87,8 +182,12 @@ Placeholders
 			res := httptest.NewRecorder()
 			req := httptest.NewRequest(http.MethodGet, "/foo.cgi/some/path?x=y", nil)
 			repl := caddy.NewReplacer()
+			for key, val := range testCase.replacements {
+				repl.Set(key, val)
+			}
 			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
 
+			testCase.cgi.logger = zap.NewNop()
 			if err := testCase.cgi.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
 				t.Fatalf("Cannot serve http: %v", err)
 			}
@@ -105,34 +204,2370 @@ Placeholders
 	}
 }
 
-func TestCGI_UnmarshalCaddyfile(t *testing.T) {
-	content := `cgi /some/file a b c d 1 {
-  dir /somewhere
-  script_name /my.cgi
-  env foo=bar what=ever
-  pass_env some_env other_env
-  pass_all_env
-  inspect
-}`
-	d := caddyfile.NewTestDispenser(content)
-	var c CGI
-	if err := c.UnmarshalCaddyfile(d); err != nil {
-		t.Fatalf("Cannot parse caddyfile: %v", err)
+func TestCGI_ServeHTTPPersistent(t *testing.T) {
+	c := CGI{
+		Executable:    "test/persistent",
+		ScriptName:    "/foo.cgi",
+		PersistentKey: "{http.request.host}",
+		logger:        zap.NewNop(),
 	}
+	c.persistent = newPersistentPool(0, 0, 0, c.logger)
+	defer c.Cleanup()
 
-	expected := CGI{
-		Executable:       "/some/file",
-		WorkingDirectory: "/somewhere",
-		ScriptName:       "/my.cgi",
-		Args:             []string{"a", "b", "c", "d", "1"},
-		Envs:             []string{"foo=bar", "what=ever"},
-		PassEnvs:         []string{"some_env", "other_env"},
-		PassAll:          true,
-		Inspect:          true,
+	for _, step := range []struct {
+		host, path, responseBody string
+	}{
+		{"a.example.com", "/one", "KEY [a.example.com]\nPATH_INFO [/one]\nSERVED [1]"},
+		{"a.example.com", "/two", "KEY [a.example.com]\nPATH_INFO [/two]\nSERVED [2]"},
+		{"b.example.com", "/three", "KEY [b.example.com]\nPATH_INFO [/three]\nSERVED [1]"},
+		{"a.example.com", "/four", "KEY [a.example.com]\nPATH_INFO [/four]\nSERVED [3]"},
+	} {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://"+step.host+"/foo.cgi"+step.path, nil)
+		repl := caddy.NewReplacer()
+		repl.Set("http.request.host", step.host)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if res.Code != http.StatusOK {
+			t.Errorf("Unexpected statusCode %d. Expected %d.", res.Code, http.StatusOK)
+		}
+		if bodyString := strings.TrimSpace(res.Body.String()); bodyString != step.responseBody {
+			t.Errorf("Unexpected body\n========== Got ==========\n%s\n========== Wanted ==========\n%s", bodyString, step.responseBody)
+		}
 	}
+}
 
-	if !reflect.DeepEqual(c, expected) {
-		t.Fatal("Parsing yielded invalid result.")
+func TestCGI_ServeHTTPStatic(t *testing.T) {
+	c := CGI{
+		Executable:     "test/example",
+		ScriptName:     "/app",
+		StaticPrefixes: []string{"/app/example.txt", "/app/missing*"},
+		logger:         zap.NewNop(),
+	}
+	serve := func(uri string) (*httptest.ResponseRecorder, error) {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		return res, c.ServeHTTP(res, req, NoOpNextHandler{})
+	}
+
+	res, err := serve("/app/example.txt")
+	if err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	if bodyString := strings.TrimSpace(res.Body.String()); bodyString != "Example" {
+		t.Errorf("Unexpected body %q. Expected %q.", bodyString, "Example")
+	}
+
+	_, err = serve("/app/missing.css")
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusNotFound {
+		t.Errorf("Unexpected error %v. Expected status %d.", err, http.StatusNotFound)
+	}
+
+	// Dot segments can't lead out of a static prefix: the cleaned paths
+	// don't match it and go to the script.
+	for _, uri := range []string{"/app/missing/../example", "/app/missing/%2e%2e/example", "/app/missing/../../test/example"} {
+		res, err := serve(uri)
+		if err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if !strings.HasPrefix(res.Body.String(), "PATH_INFO [") {
+			t.Errorf("%s: request not handled by the script: %q", uri, res.Body.String())
+		}
+	}
+
+	// Anything else is still handed to the script.
+	res, err = serve("/app/some/path")
+	if err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	if !strings.HasPrefix(res.Body.String(), "PATH_INFO [/some/path]") {
+		t.Errorf("Request not handled by the script: %q", res.Body.String())
+	}
+}
+
+func TestCGI_ServeHTTPWorkingDirectory(t *testing.T) {
+	c := CGI{
+		Executable:       "./showdir",
+		WorkingDirectory: "{http.vars.tenant_dir}",
+		logger:           zap.NewNop(),
+	}
+	repl := caddy.NewReplacer()
+	repl.Set("http.vars.tenant_dir", "test")
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	expected := filepath.Join(currentDir(), "test")
+	if dir := strings.TrimSpace(res.Body.String()); dir != expected {
+		t.Errorf("Unexpected working directory %q. Expected %q.", dir, expected)
+	}
+}
+
+func TestCGI_ServeHTTPDirFromScript(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Symlink(filepath.Join(currentDir(), "test", "showdir"), filepath.Join(dir, "showdir")); err != nil {
+		t.Fatalf("Cannot link script: %v", err)
+	}
+
+	expected := filepath.Join(currentDir(), "test")
+	for _, step := range []struct{ executable, dir string }{
+		{"test/showdir", ""},
+		{"showdir", "test"},
+		{filepath.Join(currentDir(), "test", "showdir"), "/"},
+		{filepath.Join(dir, "showdir"), dir},
+		{"showdir", dir},
+	} {
+		c := CGI{
+			Executable:       step.executable,
+			WorkingDirectory: step.dir,
+			DirFromScript:    true,
+			logger:           zap.NewNop(),
+		}
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if got := strings.TrimSpace(res.Body.String()); got != expected {
+			t.Errorf("Unexpected working directory %q for %s in %q. Expected %q.", got, step.executable, step.dir, expected)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPTrailingSlash(t *testing.T) {
+	for _, step := range []struct {
+		mode, method, uri string
+		statusCode        int
+		location          string
+	}{
+		{"add", http.MethodGet, "/app?x=y", http.StatusMovedPermanently, "/app/?x=y"},
+		{"add", http.MethodPost, "/app/golden", http.StatusPermanentRedirect, "/app/golden/"},
+		{"add", http.MethodGet, "/app/example.txt", http.StatusOK, ""},
+		{"add", http.MethodGet, "/app/report.csv", http.StatusOK, ""},
+		{"remove", http.MethodGet, "/app/foo/", http.StatusMovedPermanently, "/app/foo"},
+		{"remove", http.MethodGet, "/", http.StatusOK, ""},
+		{"remove", http.MethodGet, "//evil.example/", http.StatusOK, ""},
+		{"add", http.MethodGet, "/app/", http.StatusOK, ""},
+	} {
+		c := CGI{
+			Executable:    "test/example",
+			ScriptName:    "/app",
+			TrailingSlash: step.mode,
+			logger:        zap.NewNop(),
+		}
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(step.method, step.uri, nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if res.Code != step.statusCode {
+			t.Errorf("%s %s: Unexpected statusCode %d. Expected %d.", step.mode, step.uri, res.Code, step.statusCode)
+		}
+		if location := res.Header().Get("Location"); location != step.location {
+			t.Errorf("%s %s: Unexpected location %q. Expected %q.", step.mode, step.uri, location, step.location)
+		}
+	}
+}
+
+func TestCGI_ScriptPaths(t *testing.T) {
+	for _, step := range []struct {
+		encoding, uri        string
+		scriptName, pathInfo string
+	}{
+		{"", "/app/a%2Fb", "/app", "/a/b"},
+		{"raw", "/app/a%2fb%7Ex", "/app", "/a%2Fb~x"},
+		{"raw", "/%61pp/x", "/app", "/x"},
+		{"raw", "/other/x", "/app", "/other/x"},
+		{"nfc", "/app/e%CC%81", "/app", "/\u00e9"},
+	} {
+		c := CGI{ScriptName: "/app", PathEncoding: step.encoding}
+		scriptName, pathInfo := c.scriptPaths(httptest.NewRequest(http.MethodGet, step.uri, nil))
+		if scriptName != step.scriptName || pathInfo != step.pathInfo {
+			t.Errorf("%q %s: Unexpected paths %q, %q. Expected %q, %q.",
+				step.encoding, step.uri, scriptName, pathInfo, step.scriptName, step.pathInfo)
+		}
+	}
+}
+
+func TestCGI_FilterQuery(t *testing.T) {
+	c := CGI{StripQueryParams: []string{"utm_*", "fbclid"}}
+	for query, expected := range map[string]string{
+		"a=1&utm_source=x&b=2":     "a=1&b=2",
+		"fbclid=abc":               "",
+		"utm%5Fmedium=y&c=%20&fbc": "c=%20&fbc",
+		"x=y&x=z":                  "x=y&x=z",
+	} {
+		if filtered := c.filterQuery(query); filtered != expected {
+			t.Errorf("Unexpected query %q for %q. Expected %q.", filtered, query, expected)
+		}
+	}
+}
+
+func TestCGI_ScriptRequest(t *testing.T) {
+	c := CGI{StripQueryParams: []string{"utm_*"}, Canonicalize: true}
+	r := httptest.NewRequest(http.MethodGet, "http://Example.COM/app?z=1&utm_id=2&a=3&z=0&%61=4", nil)
+	sr := c.scriptRequest(r)
+	if expected := "a=3&%61=4&z=1&z=0"; sr.URL.RawQuery != expected {
+		t.Errorf("Unexpected query %q. Expected %q.", sr.URL.RawQuery, expected)
+	}
+	if sr.Host != "example.com" {
+		t.Errorf("Unexpected host %q. Expected %q.", sr.Host, "example.com")
+	}
+	if r.URL.RawQuery != "z=1&utm_id=2&a=3&z=0&%61=4" || r.Host != "Example.COM" {
+		t.Error("Original request was modified.")
+	}
+}
+
+func TestCGI_ServeHTTPMarkTruncated(t *testing.T) {
+	c := CGI{
+		Executable:    "test/partial",
+		Timeout:       caddy.Duration(200 * time.Millisecond),
+		MarkTruncated: true,
+		logger:        zap.NewNop(),
+	}
+	serve := func(contentType string) *http.Response {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/partial?"+contentType, nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		return res.Result()
+	}
+
+	res := serve("text/html")
+	body, _ := ioutil.ReadAll(res.Body)
+	if !strings.HasPrefix(string(body), "start of the response\n") || !strings.Contains(string(body), "<!-- truncated") {
+		t.Errorf("Truncated HTML not marked: %q", body)
+	}
+	if res.Trailer.Get(truncatedTrailer) != "timeout" {
+		t.Errorf("Unexpected trailer %v. Expected %s.", res.Trailer, truncatedTrailer)
+	}
+
+	res = serve("text/plain")
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "start of the response\n" {
+		t.Errorf("Unexpected body %q of truncated text.", body)
+	}
+	if res.Trailer.Get(truncatedTrailer) != "timeout" {
+		t.Errorf("Unexpected trailer %v. Expected %s.", res.Trailer, truncatedTrailer)
+	}
+
+	res = serve("application/problem+json")
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Unexpected status %d of truncated JSON. Expected %d.", res.StatusCode, http.StatusGatewayTimeout)
+	}
+	if body, _ := ioutil.ReadAll(res.Body); strings.Contains(string(body), "start") {
+		t.Errorf("Truncated JSON sent: %q", body)
+	}
+}
+
+func TestCGI_ServeHTTPExtraFiles(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "app.log")
+	sockPath := filepath.Join(dir, "ipc.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+		msg, _ := ioutil.ReadAll(conn)
+		received <- string(msg)
+	}()
+
+	files, err := openExtraFiles([]string{"log=" + logPath, "ipc=unix:" + sockPath})
+	if err != nil {
+		t.Fatalf("Cannot open extra files: %v", err)
+	}
+	c := CGI{
+		Executable: "test/extrafd",
+		extraFiles: files,
+		logger:     zap.NewNop(),
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	closeExtraFiles(files)
+
+	if body := res.Body.String(); !strings.Contains(body, "CGI_FD_LOG [3]") || !strings.Contains(body, "CGI_FD_IPC [4]") {
+		t.Errorf("Unexpected descriptor numbers:\n%s", body)
+	}
+	if logged, _ := ioutil.ReadFile(logPath); string(logged) != "logged\n" {
+		t.Errorf("Unexpected log %q. Expected %q.", logged, "logged\n")
+	}
+	select {
+	case msg := <-received:
+		if msg != "ping" {
+			t.Errorf("Unexpected message %q. Expected %q.", msg, "ping")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Nothing received on the socket.")
+	}
+
+	if _, err := openExtraFiles([]string{"log"}); err == nil {
+		t.Error("Extra file without path accepted.")
+	}
+}
+
+func TestCGI_Warmup(t *testing.T) {
+	mark := filepath.Join(t.TempDir(), "mark")
+	c := CGI{
+		Executable: "test/warmup",
+		Args:       []string{"live"},
+		Envs:       []string{"WARMUP_MARK=" + mark},
+		WarmupArgs: []string{"--prime"},
+		logger:     zap.NewNop(),
+	}
+	if err := c.warmup(); err != nil {
+		t.Fatalf("Cannot warm up: %v", err)
+	}
+	if _, err := os.Stat(mark); err != nil {
+		t.Errorf("Script not executed for warm-up with its arguments: %v", err)
+	}
+
+	// Regular requests get neither the arguments nor the marker.
+	os.Remove(mark)
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	if _, err := os.Stat(mark); err == nil {
+		t.Error("Regular request treated as warm-up.")
+	}
+
+	c.Executable = "test/missing"
+	if err := c.warmup(); err == nil {
+		t.Error("Warm-up of a missing script succeeded.")
+	}
+}
+
+func TestCGI_ServeHTTPArgPattern(t *testing.T) {
+	argPattern, err := compileArgPattern(`[a-z]+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, query string
+		conformance string
+		status      int
+	}{
+		{"abc", "", "", http.StatusOK},
+		{"-rf", "", "", http.StatusBadRequest},
+		{"", "", "", http.StatusBadRequest},
+		{"abc", "-x", "", http.StatusOK},
+		{"abc", "x+y", conformanceCompat, http.StatusOK},
+		{"abc", "-x", conformanceCompat, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		c := CGI{
+			Executable:  "test/example",
+			Args:        []string{"--name={name}"},
+			Conformance: test.conformance,
+			argPattern:  argPattern,
+			logger:      zap.NewNop(),
+		}
+		repl := caddy.NewReplacer()
+		repl.Set("name", test.name)
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/example?"+test.query, nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+		err := c.ServeHTTP(res, req, NoOpNextHandler{})
+		if test.status != http.StatusOK {
+			if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != test.status {
+				t.Errorf("%q %q: Unexpected error %v. Expected status %d.", test.name, test.query, err, test.status)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if !strings.Contains(res.Body.String(), "Arg 1 [--name="+test.name+"]") {
+			t.Errorf("%q %q: Unexpected body %q.", test.name, test.query, res.Body.String())
+		}
+	}
+
+	if _, err := compileArgPattern("("); err == nil {
+		t.Error("Invalid argument pattern was accepted.")
+	}
+}
+
+func TestCGI_CheckExecutable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test scripts are shell scripts")
+	}
+	tests := []struct {
+		cgi CGI
+		ok  bool
+	}{
+		{CGI{Executable: "test/example"}, true},
+		{CGI{Executable: "example", WorkingDirectory: "test"}, true},
+		{CGI{Executable: "test/{http.request.uri.path.1}"}, true},
+		{CGI{Executable: "test/missing"}, false},
+		{CGI{Executable: "test"}, false},
+		{CGI{Executable: "test/interpreted.sh"}, false},
+		{CGI{Executable: "test/interpreted.sh", interpret: map[string][]string{".sh": {"sh"}}}, true},
+		{CGI{Executable: "test/interpreted.sh", interpret: map[string][]string{".sh": {"no-such-shell"}}}, false},
+	}
+	for _, test := range tests {
+		if err := test.cgi.checkExecutable(); (err == nil) != test.ok {
+			t.Errorf("%s: Unexpected error %v.", test.cgi.Executable, err)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPLocalRedirect(t *testing.T) {
+	c := CGI{Executable: "/bin/sh", LocalRedirects: true, logger: zap.NewNop()}
+	var srv http.Handler
+	srv = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/loop" {
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			c.ServeHTTP(w, r, NoOpNextHandler{})
+			return
+		}
+		io.WriteString(w, r.Method+" "+r.URL.RequestURI())
+	})
+	serve := func(script string) *httptest.ResponseRecorder {
+		c.Args = []string{"-c", script}
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/form", strings.NewReader("a=b"))
+		ctx := context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer())
+		req = req.WithContext(context.WithValue(ctx, caddyhttp.ServerCtxKey, srv))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		return res
+	}
+
+	res := serve(`printf "Location: /done?id=1\n\n"`)
+	if res.Code != http.StatusOK || res.Body.String() != "GET /done?id=1" {
+		t.Errorf("Unexpected response %d %q. Expected %d %q.", res.Code, res.Body.String(), http.StatusOK, "GET /done?id=1")
+	}
+	// Anything beyond the Location makes it a client redirect.
+	for _, script := range []string{
+		`printf "Location: https://example.com/\n\n"`,
+		`printf "Location: /done\nStatus: 303 See Other\n\n"`,
+		`printf "Location: /done\nContent-Type: text/plain\n\n"`,
+		`printf "Location: /done\n\nmoved"`,
+	} {
+		if res := serve(script); res.Code < 300 || res.Code > 399 {
+			t.Errorf("%s: Unexpected status %d of a client redirect.", script, res.Code)
+		}
+	}
+	if res := serve(`printf "Location: /loop\n\n"`); res.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected status %d of a redirect loop. Expected %d.", res.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestCGI_ServeHTTPSendfile(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "files"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(root, "files", "report.txt")
+	if err := ioutil.WriteFile(file, []byte("quarterly report"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "files", "link")); err != nil {
+		t.Fatal(err)
+	}
+	c := CGI{Executable: "/bin/sh", SendfileRoots: []string{root}, logger: zap.NewNop()}
+	var err error
+	if c.sendRoots, err = c.processSendfile(); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(script string, rangeHeader string) *httptest.ResponseRecorder {
+		c.Args = []string{"-c", script}
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/download", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		return res
+	}
+
+	// The body of the script is discarded, however large it is.
+	res := serve(`printf "X-Sendfile: `+file+`\nContent-Type: application/pdf\nContent-Length: 5\nX-Report: q3\n\n"; head -c 1000000 /dev/zero`, "")
+	if res.Code != http.StatusOK || res.Body.String() != "quarterly report" {
+		t.Errorf("Unexpected response %d %q. Expected %d %q.", res.Code, res.Body.String(), http.StatusOK, "quarterly report")
+	}
+	if res.Header().Get("Content-Type") != "application/pdf" || res.Header().Get("X-Report") != "q3" || res.Header().Get("Content-Length") != "16" {
+		t.Errorf("Unexpected headers %v.", res.Header())
+	}
+	if res.Header().Get(sendfileHeader) != "" {
+		t.Errorf("Unexpected %s header in the response.", sendfileHeader)
+	}
+
+	res = serve(`printf "X-Accel-Redirect: /files/report%%2etxt\n\n"`, "bytes=10-")
+	if res.Code != http.StatusPartialContent || res.Body.String() != "report" {
+		t.Errorf("Unexpected response %d %q. Expected %d %q.", res.Code, res.Body.String(), http.StatusPartialContent, "report")
+	}
+
+	tests := []struct {
+		script string
+		status int
+	}{
+		{`printf "X-Sendfile: ` + outside + `/secret\n\n"`, http.StatusInternalServerError},
+		{`printf "X-Sendfile: ` + root + `/../` + filepath.Base(outside) + `/secret\n\n"`, http.StatusInternalServerError},
+		{`printf "X-Sendfile: files/report.txt\n\n"`, http.StatusInternalServerError},
+		{`printf "X-Sendfile: ` + root + `/files/link\n\n"`, http.StatusInternalServerError},
+		{`printf "X-Accel-Redirect: /files/link\n\n"`, http.StatusInternalServerError},
+		{`printf "X-Accel-Redirect: /../../etc/passwd\n\n"`, http.StatusInternalServerError},
+		{`printf "X-Sendfile: ` + root + `/files/missing\n\n"`, http.StatusNotFound},
+		{`printf "X-Sendfile: ` + root + `/files\n\n"`, http.StatusNotFound},
+		// Other statuses pass the response of the script on.
+		{`printf "X-Sendfile: ` + file + `\nStatus: 403 Forbidden\nContent-Type: text/plain\n\ndenied"`, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if res := serve(test.script, ""); res.Code != test.status || strings.Contains(res.Body.String(), "secret") {
+			t.Errorf("%s: Unexpected response %d %q. Expected status %d.", test.script, res.Code, res.Body.String(), test.status)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPBake(t *testing.T) {
+	c := CGI{
+		Executable: "test/example",
+		ScriptName: "/foo.cgi",
+		Args:       []string{"baked"},
+		logger:     zap.NewNop(),
+	}
+	c.bake = newBaker("/foo.cgi", time.Hour, c.logger)
+	if err := c.bake.bake(c); err != nil {
+		t.Fatalf("Cannot bake: %v", err)
+	}
+	// Baked responses must not change when the script would answer differently.
+	c.Args = []string{"live"}
+
+	serve := func(uri string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		return res
+	}
+
+	res := serve("/foo.cgi")
+	if res.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Baked response not compressed: %v", res.Header())
+	}
+	zr, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(zr)
+	if !strings.Contains(string(body), "Arg 1 [baked]") {
+		t.Errorf("Unexpected baked body %q.", body)
+	}
+
+	// Other paths and queries are executed dynamically.
+	for _, uri := range []string{"/foo.cgi/other", "/foo.cgi?x=y"} {
+		if body := serve(uri).Body.String(); !strings.Contains(body, "Arg 1 [live]") {
+			t.Errorf("%s: Unexpected body %q.", uri, body)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPEventStreamKeepAlive(t *testing.T) {
+	c := CGI{
+		Executable:           "test/events",
+		EventStreamKeepAlive: caddy.Duration(100 * time.Millisecond),
+		logger:               zap.NewNop(),
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+
+	body := res.Body.String()
+	first := strings.Index(body, "data: first\n\n")
+	keepAlive := strings.Index(body, ": keep-alive\n")
+	second := strings.Index(body, "data: second\n\n")
+	if first < 0 || second < 0 || keepAlive < first || keepAlive > second {
+		t.Errorf("No keep-alive comment between events:\n%s", body)
+	}
+	if !res.Flushed {
+		t.Error("Event stream was not flushed.")
+	}
+}
+
+func TestCGI_ServeHTTPStreaming(t *testing.T) {
+	c := CGI{
+		Executable: "test/events",
+		Timeout:    caddy.Duration(100 * time.Millisecond),
+		Streaming:  true,
+		logger:     zap.NewNop(),
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+
+	if !strings.Contains(res.Body.String(), "data: second") {
+		t.Errorf("Streaming response was cut off by the timeout:\n%s", res.Body.String())
+	}
+	if res.Header().Get("X-Accel-Buffering") != "no" {
+		t.Errorf("Unexpected X-Accel-Buffering %q. Expected %q.", res.Header().Get("X-Accel-Buffering"), "no")
+	}
+	if !res.Flushed {
+		t.Error("Streaming response was not flushed.")
+	}
+}
+
+func TestCGI_ServeHTTPSSE(t *testing.T) {
+	c := CGI{
+		Executable:           "/bin/sh",
+		Args:                 []string{"-c", `printf "Content-type: text/plain\n\ndata: first\n\n"; sleep 0.5; printf "data: second\n\n"`},
+		Timeout:              caddy.Duration(100 * time.Millisecond),
+		EventStreamKeepAlive: caddy.Duration(100 * time.Millisecond),
+		SSE:                  true,
+		logger:               zap.NewNop(),
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+
+	for header, expected := range map[string]string{"Content-Type": "text/event-stream", "Cache-Control": "no-cache", "X-Accel-Buffering": "no"} {
+		if got := res.Header().Get(header); got != expected {
+			t.Errorf("Unexpected %s %q. Expected %q.", header, got, expected)
+		}
+	}
+	body := res.Body.String()
+	first := strings.Index(body, "data: first\n\n")
+	keepAlive := strings.Index(body, ": keep-alive\n")
+	second := strings.Index(body, "data: second\n\n")
+	if first < 0 || second < 0 || keepAlive < first || keepAlive > second {
+		t.Errorf("No keep-alive comment between events:\n%s", body)
+	}
+
+	// The script is terminated once the client went away.
+	c.Args = []string{"-c", `printf "Content-type: text/event-stream\n\ndata: first\n\n"; exec sleep 5`}
+	ctx, cancel := context.WithTimeout(req.Context(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := c.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx), NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Script kept running for %v after the client went away.", elapsed)
+	}
+}
+
+// writeCounter counts the writes of the response body.
+type writeCounter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (wc *writeCounter) Write(p []byte) (int, error) {
+	wc.writes++
+	return wc.ResponseRecorder.Write(p)
+}
+
+// flushCounter counts the flushes of the response.
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes int32
+}
+
+func (fc *flushCounter) Flush() {
+	atomic.AddInt32(&fc.flushes, 1)
+	fc.ResponseRecorder.Flush()
+}
+
+func TestCGI_ServeHTTPFlushInterval(t *testing.T) {
+	c := CGI{
+		Executable:    "/bin/sh",
+		Args:          []string{"-c", `printf "Content-type: text/plain\n\n"; for i in 1 2 3 4 5; do printf "$i"; sleep 0.01; done; sleep 0.3; printf "6"`},
+		FlushInterval: caddy.Duration(200 * time.Millisecond),
+		logger:        zap.NewNop(),
+	}
+	res := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	if res.Body.String() != "123456" {
+		t.Errorf("Unexpected body %q. Expected %q.", res.Body.String(), "123456")
+	}
+	// The first five writes go out together within the interval, the last
+	// one when the response ends.
+	if flushes := atomic.LoadInt32(&res.flushes); flushes != 2 {
+		t.Errorf("Unexpected %d flushes. Expected %d.", flushes, 2)
+	}
+}
+
+func TestCGI_ServeHTTPResponseBuffer(t *testing.T) {
+	tests := []struct {
+		header  string
+		writes  int
+		flushed bool
+	}{
+		{"X-Response-Size-Hint: 10", 1, false},
+		{"Content-Length: 10", 1, false},
+		{"X-Response-Size-Hint: 1000000", 2, true},
+		{"X-Other: 10", 2, false},
+	}
+	for _, test := range tests {
+		c := CGI{
+			Executable:     "/bin/sh",
+			Args:           []string{"-c", `printf "Content-type: text/plain\n` + test.header + `\n\nhello"; sleep 0.1; printf "world"`},
+			ResponseBuffer: 1024,
+			logger:         zap.NewNop(),
+		}
+		res := &writeCounter{ResponseRecorder: httptest.NewRecorder()}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if res.Body.String() != "helloworld" {
+			t.Errorf("%s: Unexpected body %q. Expected %q.", test.header, res.Body.String(), "helloworld")
+		}
+		if res.writes != test.writes || res.Flushed != test.flushed {
+			t.Errorf("%s: Unexpected %d writes, flushed %v. Expected %d, flushed %v.",
+				test.header, res.writes, res.Flushed, test.writes, test.flushed)
+		}
+		if hint := res.Header().Get(sizeHintHeader); hint != "" {
+			t.Errorf("%s: Unexpected size hint %q sent to the client.", test.header, hint)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPMaxConcurrent(t *testing.T) {
+	c := CGI{
+		Executable:    "test/example",
+		MaxConcurrent: 1,
+		QueueTimeout:  caddy.Duration(50 * time.Millisecond),
+		concurrent:    newScheduler(1),
+		logger:        zap.NewNop(),
+	}
+	// Occupy the only slot.
+	release, err := c.concurrent.acquire(context.Background(), "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/example", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	err = c.ServeHTTP(httptest.NewRecorder(), req, NoOpNextHandler{})
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected error %v. Expected status %d.", err, http.StatusServiceUnavailable)
+	}
+
+	release()
+	res := httptest.NewRecorder()
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	if res.Code != http.StatusOK {
+		t.Errorf("Unexpected status %d. Expected %d.", res.Code, http.StatusOK)
+	}
+}
+
+func TestCGI_ServeHTTPClientGone(t *testing.T) {
+	c := CGI{
+		Executable: "test/slow",
+		logger:     zap.NewNop(),
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	time.AfterFunc(100*time.Millisecond, cancel)
+	req := httptest.NewRequest(http.MethodGet, "/slow", nil).WithContext(ctx)
+
+	start := time.Now()
+	if err := c.ServeHTTP(httptest.NewRecorder(), req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Script kept running for %v after the client went away.", elapsed)
+	}
+}
+
+func TestCGI_CleanupDrain(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	c := CGI{
+		Executable:   "test/slow",
+		DrainTimeout: caddy.Duration(200 * time.Millisecond),
+		drain:        newDrainer(),
+		logger:       zap.New(core),
+	}
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/slow", nil)
+		return req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- c.ServeHTTP(httptest.NewRecorder(), newRequest(), NoOpNextHandler{})
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if err := c.Cleanup(); err != nil {
+		t.Fatalf("Cannot clean up: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Unexpected drain time %v. Expected the drain timeout of %v.", elapsed, 200*time.Millisecond)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Cannot serve http: %v", err)
+		}
+	default:
+		t.Error("Request still running after cleanup.")
+	}
+	if logs.FilterMessage("terminated CGI requests still running after drain timeout").Len() != 1 {
+		t.Error("Terminated request not logged.")
+	}
+
+	err := c.ServeHTTP(httptest.NewRecorder(), newRequest(), NoOpNextHandler{})
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected error %v. Expected status %d.", err, http.StatusServiceUnavailable)
+	}
+}
+
+func TestCGI_ServeHTTPEnvironSizeLog(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	c := CGI{
+		Executable: "test/example",
+		Envs:       []string{"BLOAT=" + strings.Repeat("x", 1000)},
+		logger:     zap.New(core),
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(httptest.NewRecorder(), req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+
+	entries := logs.FilterMessage("CGI environment size").All()
+	if len(entries) != 1 {
+		t.Fatalf("Unexpected number of log entries %d. Expected %d.", len(entries), 1)
+	}
+	fields := entries[0].ContextMap()
+	if bytes, _ := fields["bytes"].(int64); bytes < 1006 {
+		t.Errorf("Unexpected environment size %d.", bytes)
+	}
+	largest, _ := fields["largest"].([]interface{})
+	if len(largest) != 5 || largest[0] != "BLOAT (1006 bytes)" {
+		t.Errorf("Unexpected largest variables %v.", largest)
+	}
+}
+
+func TestCGI_ServeHTTPLogStderr(t *testing.T) {
+	tests := []struct {
+		exitCode, output string
+		minBytes         int
+		level            zapcore.Level
+		logged           bool
+	}{
+		{"0", "* Connected to example.com", 0, zapcore.WarnLevel, true},
+		{"0", "* Connected to example.com", 100, zapcore.DebugLevel, true},
+		{"1", "fatal: cannot connect", 100, zapcore.ErrorLevel, true},
+		{"0", "", 0, zapcore.WarnLevel, false},
+	}
+	for _, test := range tests {
+		core, logs := observer.New(zap.DebugLevel)
+		c := CGI{
+			Executable:     "test/stderr",
+			Args:           []string{test.exitCode, test.output},
+			LogStderr:      true,
+			StderrMinBytes: test.minBytes,
+			logger:         zap.New(core),
+		}
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if res.Code != http.StatusOK || res.Body.String() != "ok\n" {
+			t.Errorf("Unexpected response %d %q. Expected %d %q.", res.Code, res.Body.String(), http.StatusOK, "ok\n")
+		}
+		entries := logs.FilterMessage("CGI process wrote to standard error").All()
+		if !test.logged {
+			if len(entries) != 0 {
+				t.Errorf("Unexpected log entries %v for no output.", entries)
+			}
+			continue
+		}
+		if len(entries) != 1 {
+			t.Fatalf("Unexpected number of log entries %d. Expected %d.", len(entries), 1)
+		}
+		if entries[0].Level != test.level {
+			t.Errorf("Unexpected level %v. Expected %v.", entries[0].Level, test.level)
+		}
+		if output := entries[0].ContextMap()["output"]; output != test.output {
+			t.Errorf("Unexpected output %q. Expected %q.", output, test.output)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPInterpreter(t *testing.T) {
+	app := &App{Interpreters: map[string][]string{".sh": {"/bin/sh", "-e"}}, stats: newStatsRegistry()}
+	tests := []struct {
+		interpreters map[string][]string
+		expected     string
+	}{
+		{nil, "strict=yes script=interpreted.sh args=a b\n"},
+		{map[string][]string{".sh": {"sh"}}, "strict=no script=interpreted.sh args=a b\n"},
+	}
+	for _, test := range tests {
+		c := CGI{Executable: "test/interpreted.sh", Args: []string{"a", "b"}, Interpreters: test.interpreters, app: app, logger: zap.NewNop()}
+		if err := c.applyInterpreters(); err != nil {
+			t.Fatalf("Cannot apply interpreters: %v", err)
+		}
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if res.Code != http.StatusOK || res.Body.String() != test.expected {
+			t.Errorf("Unexpected response %d %q. Expected %d %q.", res.Code, res.Body.String(), http.StatusOK, test.expected)
+		}
+	}
+
+	for _, interpreters := range []map[string][]string{{"sh": {"/bin/sh"}}, {".sh": {}}} {
+		c := CGI{Interpreters: interpreters, app: &App{}}
+		if err := c.applyInterpreters(); err == nil {
+			t.Errorf("Invalid interpreters %v were accepted.", interpreters)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPErrorClass(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		chunked bool
+		status  int
+		class   string
+	}{
+		{"missing executable", "", false, http.StatusInternalServerError, failSpawn},
+		{"bad headers", "echo bogus", false, http.StatusInternalServerError, failBadHeaders},
+		{"timeout", "exec sleep 5", false, http.StatusGatewayTimeout, failTimeout},
+		{"signal", "kill -KILL $$", false, http.StatusInternalServerError, failSignal},
+		{"body limit", "cat", true, http.StatusRequestEntityTooLarge, failBodyLimit},
+		{"script error", "printf 'Status: 503 Busy\\n\\n'", false, http.StatusServiceUnavailable, ""},
+	}
+	for _, test := range tests {
+		core, logs := observer.New(zap.DebugLevel)
+		c := CGI{
+			Executable: "/bin/sh",
+			Args:       []string{"-c", test.script},
+			Timeout:    caddy.Duration(200 * time.Millisecond),
+			logger:     zap.New(core),
+		}
+		if test.script == "" {
+			c.Executable = "test/missing"
+		}
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large"))
+		if test.chunked {
+			req.ContentLength = -1
+			req.TransferEncoding = []string{"chunked"}
+			req.Body = http.MaxBytesReader(res, req.Body, 3)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("%s: Cannot serve http: %v", test.name, err)
+		}
+		if res.Code != test.status {
+			t.Errorf("%s: Unexpected status %d. Expected %d.", test.name, res.Code, test.status)
+		}
+		if class := res.Header().Get(errorClassHeader); class != test.class {
+			t.Errorf("%s: Unexpected error class %q. Expected %q.", test.name, class, test.class)
+		}
+		entries := logs.FilterMessage("CGI request failed").All()
+		if test.class == "" {
+			if len(entries) != 0 {
+				t.Errorf("%s: Unexpected log entries %v.", test.name, entries)
+			}
+		} else if len(entries) != 1 || entries[0].ContextMap()["error_class"] != test.class {
+			t.Errorf("%s: Unexpected log entries %v.", test.name, entries)
+		}
+	}
+
+	// The header is left out unless debug logging is enabled.
+	c := CGI{Executable: "test/missing", logger: zap.NewNop()}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	if class := res.Header().Get(errorClassHeader); class != "" {
+		t.Errorf("Unexpected error class %q without debug logging.", class)
+	}
+}
+
+func TestCGI_ServeHTTPResourceLimits(t *testing.T) {
+	c := CGI{
+		Executable:  "test/ulimit",
+		LimitCPU:    caddy.Duration(1500 * time.Millisecond),
+		LimitNofile: 64,
+		logger:      zap.NewNop(),
+	}
+	var err error
+	if c.rlimits, err = c.processLimits(); err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+
+	expected := "NOFILE [64]\nCPU [2]\nSHIM []"
+	if bodyString := strings.TrimSpace(res.Body.String()); bodyString != expected {
+		t.Errorf("Unexpected body\n========== Got ==========\n%s\n========== Wanted ==========\n%s", bodyString, expected)
+	}
+}
+
+func TestCGI_ServeHTTPPriority(t *testing.T) {
+	if !ioprioSupported {
+		t.Skip("I/O priorities are not supported on this platform")
+	}
+	c := CGI{
+		Executable:  "test/priority",
+		Nice:        5,
+		IoniceClass: "best-effort",
+		IoniceLevel: 6,
+		logger:      zap.NewNop(),
+	}
+	var err error
+	if c.ioprio, err = c.processPriority(); err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+
+	bodyString := strings.TrimSpace(res.Body.String())
+	if !strings.HasPrefix(bodyString, "NICE [5]") {
+		t.Errorf("Unexpected body %q. Expected %q.", bodyString, "NICE [5]")
+	}
+	if strings.Contains(bodyString, "IONICE") && !strings.Contains(bodyString, "IONICE [best-effort: prio 6]") {
+		t.Errorf("Unexpected body %q. Expected %q.", bodyString, "IONICE [best-effort: prio 6]")
+	}
+
+	for _, invalid := range []CGI{{Nice: 20}, {IoniceClass: "fast"}, {IoniceClass: "idle", IoniceLevel: 8}, {IoniceLevel: 1}} {
+		if _, err := invalid.processPriority(); err == nil {
+			t.Errorf("Expected an error for %+v.", invalid)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPUmask(t *testing.T) {
+	if !rlimitsSupported {
+		if _, err := (CGI{Umask: "027"}).processUmask(); err == nil {
+			t.Error("Expected umask to be rejected on this platform.")
+		}
+		t.Skip("umask is not supported on this platform")
+	}
+	c := CGI{Executable: "test/umask", Umask: "027", logger: zap.NewNop()}
+	var err error
+	if c.umask, err = c.processUmask(); err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+
+	bodyString := strings.TrimSpace(res.Body.String())
+	if bodyString != "UMASK [0027]" {
+		t.Errorf("Unexpected body %q. Expected %q.", bodyString, "UMASK [0027]")
+	}
+
+	for _, invalid := range []string{"1000", "rw", "-1"} {
+		if _, err := (CGI{Umask: invalid}).processUmask(); err == nil {
+			t.Errorf("Expected an error for umask %q.", invalid)
+		}
+	}
+}
+
+func TestCGI_Features(t *testing.T) {
+	for _, tc := range []struct {
+		cgi      CGI
+		features string
+	}{
+		{CGI{}, "chunked-body,event-stream"},
+		{CGI{ChunkedBody: chunkedBodyStream, Streaming: true}, "chunked-stream,event-stream,streaming"},
+		{CGI{PoolSize: 2, Upgrade: true}, "chunked-stream,event-stream,upgrade"},
+		{CGI{WebSocket: true}, "chunked-body,event-stream,websocket"},
+		{CGI{SSE: true}, "chunked-body,event-stream,streaming"},
+		{CGI{Streaming: true, FlushInterval: caddy.Duration(100 * time.Millisecond)}, "chunked-body,flush-interval"},
+	} {
+		if features := tc.cgi.features(); features != tc.features {
+			t.Errorf("Unexpected features %q. Expected %q.", features, tc.features)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, testCase := range []struct {
+		method       string
+		body         string
+		retries      int
+		failures     string
+		statusCode   int
+		responseBody string
+		runs         string
+	}{
+		{http.MethodGet, "", 2, "2", 200, "RUN [3]", "3"},
+		{http.MethodGet, "", 1, "2", 500, "", "2"},
+		{http.MethodPost, "", 2, "2", 500, "", "1"},
+		{http.MethodPut, "body", 2, "2", 500, "", "1"},
+	} {
+		counter := filepath.Join(dir, strconv.Itoa(i))
+		c := CGI{
+			Executable: "test/flaky",
+			Args:       []string{counter, testCase.failures},
+			Retries:    testCase.retries,
+			RetryDelay: caddy.Duration(10 * time.Millisecond),
+			logger:     zap.NewNop(),
+		}
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(testCase.method, "/", strings.NewReader(testCase.body))
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if res.Code != testCase.statusCode {
+			t.Errorf("Unexpected statusCode %d for %s. Expected %d.", res.Code, testCase.method, testCase.statusCode)
+		}
+		if body := strings.TrimSpace(res.Body.String()); body != testCase.responseBody {
+			t.Errorf("Unexpected body %q for %s. Expected %q.", body, testCase.method, testCase.responseBody)
+		}
+		runs, _ := ioutil.ReadFile(counter)
+		if got := strings.TrimSpace(string(runs)); got != testCase.runs {
+			t.Errorf("Unexpected number of runs %s for %s. Expected %s.", got, testCase.method, testCase.runs)
+		}
+	}
+
+	h := handler{RetryDelay: 100 * time.Millisecond, RetryDelayMax: time.Second}
+	for attempt, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		if delay := h.retryDelay(attempt); delay != expected {
+			t.Errorf("Unexpected delay %v after attempt %d. Expected %v.", delay, attempt, expected)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPTransform(t *testing.T) {
+	tr, err := compileTransform(`
+def transform(req):
+    if req.path_info.startswith("/admin"):
+        return {"status": 403}
+    if req.headers.get("x-variant") == "plain":
+        return None
+    return {
+        "args": [req.method + "-" + req.params.get("arg", ["none"])[0]],
+        "env": {"CGI_LOCAL": req.script_name},
+    }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := CGI{
+		Executable: "test/example",
+		ScriptName: "/example",
+		Args:       []string{"configured"},
+		logger:     zap.NewNop(),
+		transform:  tr,
+	}
+	serve := func(uri string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		res := httptest.NewRecorder()
+		return res, c.ServeHTTP(res, req, NoOpNextHandler{})
+	}
+
+	res, err := serve("/example/foo?arg=value")
+	if err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	for _, expected := range []string{"Arg 1 [GET-value]", "CGI_LOCAL is set to [/example]"} {
+		if !strings.Contains(res.Body.String(), expected) {
+			t.Errorf("Unexpected body\n%s\nExpected it to contain %q.", res.Body.String(), expected)
+		}
+	}
+
+	_, err = serve("/example/admin/users")
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusForbidden {
+		t.Errorf("Unexpected error %v. Expected status %d.", err, http.StatusForbidden)
+	}
+
+	for _, src := range []string{
+		"x = 1",
+		"def transform(req, other): pass",
+		"def transform(req): return {\"args\": \"single\"}",
+	} {
+		tr, err := compileTransform(src)
+		if err == nil {
+			_, err = tr.apply(httptest.NewRequest(http.MethodGet, "/", nil), "", "")
+		}
+		if err == nil {
+			t.Errorf("Expected an error for transform %q.", src)
+		}
+	}
+}
+
+func TestHandler_RunUsage(t *testing.T) {
+	h := handler{Path: "test/example", Root: "/", Logger: zap.NewNop()}
+	res := httptest.NewRecorder()
+	exitCode, usage := h.run(res, httptest.NewRequest(http.MethodGet, "/example", nil))
+	if exitCode != 0 {
+		t.Errorf("Unexpected exit code %d. Expected %d.", exitCode, 0)
+	}
+	if usage.MaxRSS <= 0 {
+		t.Errorf("Unexpected max RSS %d. Expected more than 0.", usage.MaxRSS)
+	}
+	if usage.Signal != "" {
+		t.Errorf("Unexpected signal %q. Expected none.", usage.Signal)
+	}
+}
+
+func TestHandler_RunChunkedBody(t *testing.T) {
+	h := handler{Path: "test/echo", Root: "/", Logger: zap.NewNop()}
+	before := tempFiles.snapshot()
+
+	req := httptest.NewRequest(http.MethodPost, "/echo", strings.NewReader("chunked body"))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	res := httptest.NewRecorder()
+	h.run(res, req)
+
+	expected := "CONTENT_LENGTH [12]\nchunked body"
+	if res.Body.String() != expected {
+		t.Errorf("Unexpected response %q. Expected %q.", res.Body.String(), expected)
+	}
+	after := tempFiles.snapshot()
+	if after.Created != before.Created+1 {
+		t.Errorf("Unexpected number of created temporary files %d. Expected %d.", after.Created, before.Created+1)
+	}
+	if after.Files != before.Files {
+		t.Errorf("Unexpected number of temporary files %d. Expected %d.", after.Files, before.Files)
+	}
+}
+
+func TestHandler_RunStreamedBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	started := filepath.Join(dir, "started")
+	h := handler{
+		Path:       "test/echo",
+		Root:       "/",
+		Env:        []string{"STARTED=" + started},
+		StreamBody: true,
+		Logger:     zap.NewNop(),
+	}
+	before := tempFiles.snapshot()
+
+	// The rest of the body is only sent once the script runs.
+	body, upload := io.Pipe()
+	go func() {
+		upload.Write([]byte("first "))
+		for i := 0; i < 100; i++ {
+			if _, err := os.Stat(started); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		upload.Write([]byte("second"))
+		upload.Close()
+	}()
+	req := httptest.NewRequest(http.MethodPost, "/echo", body)
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	res := httptest.NewRecorder()
+	h.run(res, req)
+
+	expected := "CONTENT_LENGTH []\nfirst second"
+	if res.Body.String() != expected {
+		t.Errorf("Unexpected response %q. Expected %q.", res.Body.String(), expected)
+	}
+	if _, err := os.Stat(started); err != nil {
+		t.Errorf("Script not started before the body was complete: %v", err)
+	}
+	if after := tempFiles.snapshot(); after.Files != before.Files {
+		t.Errorf("Unexpected number of temporary files %d. Expected %d.", after.Files, before.Files)
+	}
+}
+
+func TestHandler_WriteResponseConformance(t *testing.T) {
+	tests := []struct {
+		name        string
+		conformance string
+		output      string
+		status      int
+	}{
+		{"default bare LF", "", "Content-Type: text/plain\n\nbody", 200},
+		{"strict bare LF", conformanceStrict, "Content-Type: text/plain\n\nbody", 500},
+		{"strict CRLF", conformanceStrict, "Content-Type: text/plain\r\nStatus: 201 Created\r\n\r\nbody", 201},
+		{"default bogus line", "", "Content-Type: text/plain\nbogus\n\nbody", 200},
+		{"strict bogus line", conformanceStrict, "Content-Type: text/plain\r\nbogus\r\n\r\nbody", 500},
+		{"strict invalid value", conformanceStrict, "Content-Type: text/plain\r\nX-Test: a\x01b\r\n\r\nbody", 500},
+		{"strict bogus status", conformanceStrict, "Content-Type: text/plain\r\nStatus: 2000\r\n\r\nbody", 500},
+		{"default missing content type", "", "X-Test: a\n\nbody", 500},
+		{"compat missing content type", conformanceCompat, "X-Test: a\n\nbody", 200},
+	}
+	for _, test := range tests {
+		h := handler{Logger: zap.NewNop(), Conformance: test.conformance}
+		res := httptest.NewRecorder()
+		h.writeResponse(res, strings.NewReader(test.output))
+		if res.Code != test.status {
+			t.Errorf("%s: Unexpected status %d. Expected %d.", test.name, res.Code, test.status)
+		}
+	}
+}
+
+func TestHandler_WriteResponsePreamble(t *testing.T) {
+	tests := []struct {
+		name   string
+		strip  bool
+		output string
+		status int
+	}{
+		{"byte order mark", false, "\xEF\xBB\xBFContent-Type: text/plain\n\nbody", 500},
+		{"stripped byte order mark", true, "\xEF\xBB\xBFContent-Type: text/plain\n\nbody", 200},
+		{"stripped blank lines", true, "\xEF\xBB\xBF\r\n\nContent-Type: text/plain\r\n\r\nbody", 200},
+		{"nothing to strip", true, "Status: 201 Created\nContent-Type: text/plain\n\nbody", 201},
+	}
+	for _, test := range tests {
+		h := handler{Logger: zap.NewNop(), StripPreamble: test.strip}
+		res := httptest.NewRecorder()
+		h.writeResponse(res, strings.NewReader(test.output))
+		if res.Code != test.status {
+			t.Errorf("%s: Unexpected status %d. Expected %d.", test.name, res.Code, test.status)
+		}
+		if test.status < 300 && res.Body.String() != "body" {
+			t.Errorf("%s: Unexpected body %q. Expected %q.", test.name, res.Body.String(), "body")
+		}
+	}
+}
+
+func TestHandler_WriteResponseLineEndings(t *testing.T) {
+	tests := []struct {
+		name        string
+		conformance string
+		output      string
+		status      int
+		body        string
+	}{
+		{"default mixed", "", "Status: 201 Created\r\nContent-Type: text/plain\n\r\nbody", 201, "body"},
+		{"default CRCRLF", "", "Status: 201 Created\r\r\nContent-Type: text/plain\r\r\n\r\r\nbody", 500, ""},
+		{"compat CRCRLF", conformanceCompat, "Status: 201 Created\r\r\nContent-Type: text/plain\r\r\n\r\r\nbody", 201, "body"},
+		{"compat mixed", conformanceCompat, "Status: 201 Created\nContent-Type: text/plain\r\r\n\r\nbody\r\r\n", 201, "body\r\r\n"},
+		{"compat preamble", conformanceCompat, "\r\r\n\nStatus: 201 Created\r\r\n\r\r\nbody", 201, "body"},
+	}
+	for _, test := range tests {
+		h := handler{Logger: zap.NewNop(), Conformance: test.conformance, StripPreamble: test.conformance == conformanceCompat}
+		res := httptest.NewRecorder()
+		h.writeResponse(res, strings.NewReader(test.output))
+		if res.Code != test.status {
+			t.Errorf("%s: Unexpected status %d. Expected %d.", test.name, res.Code, test.status)
+		}
+		if res.Body.String() != test.body {
+			t.Errorf("%s: Unexpected body %q. Expected %q.", test.name, res.Body.String(), test.body)
+		}
+	}
+}
+
+func TestHandler_WriteResponseSetCookie(t *testing.T) {
+	h := handler{Logger: zap.NewNop(), SetCookie: &CookieRewrite{
+		Prefix:   "app_",
+		Path:     "/app",
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: "lax",
+	}}
+	res := httptest.NewRecorder()
+	h.writeResponse(res, strings.NewReader("Content-Type: text/plain\n"+
+		"Set-Cookie: session=abc; path=/; Expires=Wed, 21 Oct 2026 07:28:00 GMT; samesite=None\n"+
+		"set-cookie: theme=dark; Secure\n\nbody"))
+
+	expected := []string{
+		"app_session=abc; Expires=Wed, 21 Oct 2026 07:28:00 GMT; Path=/app; Secure; HttpOnly; SameSite=Lax",
+		"app_theme=dark; Path=/app; Secure; HttpOnly; SameSite=Lax",
+	}
+	if got := res.Header()["Set-Cookie"]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected cookies %q. Expected %q.", got, expected)
+	}
+
+	for _, invalid := range []CookieRewrite{{SameSite: "sometimes"}, {Prefix: "a=b"}} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("Expected an error for %+v.", invalid)
+		}
+	}
+}
+
+func TestHandler_WriteResponseFoldHeaders(t *testing.T) {
+	output := "Content-Type: text/plain\n" +
+		"Vary: Accept\nvary: Cookie\n" +
+		"Cache-Control: private\nCache-Control: max-age=60\n" +
+		"Set-Cookie: a=1; Expires=Wed, 21 Oct 2026 07:28:00 GMT\nSet-Cookie: b=2\n\nbody"
+	tests := []struct {
+		fold    []string
+		vary    []string
+		cache   []string
+		cookies int
+	}{
+		{nil, []string{"Accept", "Cookie"}, []string{"private", "max-age=60"}, 2},
+		{[]string{"vary"}, []string{"Accept, Cookie"}, []string{"private", "max-age=60"}, 2},
+		{[]string{foldAll}, []string{"Accept, Cookie"}, []string{"private, max-age=60"}, 2},
+	}
+	for _, test := range tests {
+		c := CGI{FoldHeaders: test.fold}
+		fold, err := c.processFoldHeaders()
+		if err != nil {
+			t.Fatalf("Cannot process %v: %v", test.fold, err)
+		}
+		h := handler{Logger: zap.NewNop(), FoldHeaders: fold}
+		res := httptest.NewRecorder()
+		h.writeResponse(res, strings.NewReader(output))
+		if got := res.Header()["Vary"]; !reflect.DeepEqual(got, test.vary) {
+			t.Errorf("%v: Unexpected Vary %q. Expected %q.", test.fold, got, test.vary)
+		}
+		if got := res.Header()["Cache-Control"]; !reflect.DeepEqual(got, test.cache) {
+			t.Errorf("%v: Unexpected Cache-Control %q. Expected %q.", test.fold, got, test.cache)
+		}
+		if got := len(res.Header()["Set-Cookie"]); got != test.cookies {
+			t.Errorf("%v: Unexpected number of cookies %d. Expected %d.", test.fold, got, test.cookies)
+		}
+	}
+
+	for _, invalid := range [][]string{{"set-cookie"}, {"Bad Name"}, {""}} {
+		if _, err := (CGI{FoldHeaders: invalid}).processFoldHeaders(); err == nil {
+			t.Errorf("Expected an error for %q.", invalid)
+		}
+	}
+}
+
+func TestHandler_WriteResponseDisposition(t *testing.T) {
+	h := handler{Logger: zap.NewNop(), Disposition: true}
+	res := httptest.NewRecorder()
+	h.writeResponse(res, strings.NewReader("Content-Type: text/plain\n"+
+		"Content-Disposition: inline; filename=\"../../etc/passwd\"; size=42\n\nbody"))
+	if got, expected := res.Header().Get("Content-Disposition"), `inline; filename="passwd"`; got != expected {
+		t.Errorf("Unexpected disposition %q. Expected %q.", got, expected)
+	}
+
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{`attachment; filename="report.pdf"`, `attachment; filename="report.pdf"`},
+		{`form-data; filename=report.pdf`, `attachment; filename="report.pdf"`},
+		{`attachment; filename="C:\\Windows\\win.ini"`, `attachment; filename="win.ini"`},
+		{`attachment; filename="..."`, `attachment`},
+		{`attachment; filename="a\"b.txt"`, `attachment; filename="a\"b.txt"`},
+		{"attachment; filename=\"evil\u202etxt.exe\"", `attachment; filename="eviltxt.exe"`},
+		{`attachment; filename*=UTF-8''%C3%BCber.txt`, `attachment; filename="_ber.txt"; filename*=UTF-8''%C3%BCber.txt`},
+		{`attachment; filename*=UTF-8''my%20file.txt`, `attachment; filename="my file.txt"`},
+		{`attachment; filename="a"; filename="b"`, `attachment`},
+		{`inline`, `inline`},
+	}
+	for _, test := range tests {
+		if got := sanitizeContentDisposition(test.header); got != test.expected {
+			t.Errorf("Unexpected disposition %q for %q. Expected %q.", got, test.header, test.expected)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPIsindex(t *testing.T) {
+	c := CGI{
+		Executable:   "test/example",
+		Conformance:  conformanceCompat,
+		NoRemoteUser: true,
+		logger:       zap.NewNop(),
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/example?caddy%20cgi+foo", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+
+	if !strings.Contains(res.Body.String(), "Arg 1 [caddy]") {
+		t.Errorf("ISINDEX query was not passed as arguments:\n%s", res.Body.String())
+	}
+	if ct := res.Header().Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("Unexpected Content-Type %q. Expected %q.", ct, "text/plain")
+	}
+}
+
+func TestCGI_ProcessCredential(t *testing.T) {
+	cred, err := CGI{User: "1234", Group: "5678"}.processCredential()
+	if err != nil {
+		t.Fatalf("Cannot resolve credential: %v", err)
+	}
+	if cred.Uid != 1234 || cred.Gid != 5678 {
+		t.Errorf("Unexpected credential %d:%d. Expected 1234:5678.", cred.Uid, cred.Gid)
+	}
+	if cred, _ := (CGI{}).processCredential(); cred != nil {
+		t.Error("Credential resolved without user and group.")
+	}
+	if _, err := (CGI{User: "no such user"}).processCredential(); err == nil {
+		t.Error("Unknown user was accepted.")
+	}
+}
+
+func TestCGI_ApplySandbox(t *testing.T) {
+	app := &App{Sandboxes: map[string]Sandbox{
+		"untrusted": {
+			User:        "nobody",
+			LimitCPU:    caddy.Duration(10 * time.Second),
+			LimitNofile: 64,
+			Namespaces:  []string{"net"},
+			InheritEnv:  []string{"LANG"},
+		},
+	}}
+	c := CGI{Sandbox: "untrusted", LimitNofile: 256, app: app}
+	if err := c.applySandbox(); err != nil {
+		t.Fatalf("Cannot apply sandbox: %v", err)
+	}
+	if c.User != "nobody" {
+		t.Errorf("Unexpected user %q. Expected %q.", c.User, "nobody")
+	}
+	if c.LimitCPU != caddy.Duration(10*time.Second) {
+		t.Errorf("Unexpected CPU limit %v. Expected %v.", c.LimitCPU, 10*time.Second)
+	}
+	if c.LimitNofile != 256 {
+		t.Errorf("Unexpected file limit %d. Expected %d.", c.LimitNofile, 256)
+	}
+	if !reflect.DeepEqual(c.Namespaces, []string{"net"}) {
+		t.Errorf("Unexpected namespaces %v. Expected %v.", c.Namespaces, []string{"net"})
+	}
+	if !reflect.DeepEqual(c.inheritEnv, []string{"LANG"}) {
+		t.Errorf("Unexpected inherited environment %v.", c.inheritEnv)
+	}
+
+	c = CGI{Sandbox: "missing", app: app}
+	if err := c.applySandbox(); err == nil {
+		t.Error("Unknown sandbox was accepted.")
+	}
+}
+
+func TestHandler_ProcessEnvironAllow(t *testing.T) {
+	os.Setenv("CGI_TEST_ALLOWED", "yes")
+	os.Setenv("CGI_TEST_DENIED", "no")
+	defer os.Unsetenv("CGI_TEST_ALLOWED")
+	defer os.Unsetenv("CGI_TEST_DENIED")
+
+	h := handler{
+		InheritEnv: []string{"CGI_TEST_ALLOWED", "CGI_TEST_DENIED"},
+		EnvAllow:   []string{"CGI_TEST_A*"},
+	}
+	env := strings.Join(h.processEnviron(), "\n")
+	if !strings.Contains(env, "CGI_TEST_ALLOWED=yes") {
+		t.Errorf("Allowed variable was not inherited:\n%s", env)
+	}
+	if strings.Contains(env, "CGI_TEST_DENIED") {
+		t.Errorf("Denied variable was inherited:\n%s", env)
+	}
+	if !strings.Contains(env, "PATH=") {
+		t.Errorf("PATH was not set:\n%s", env)
+	}
+}
+
+func TestHandler_EnvironCookie(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Cookie", "app_session=1; theme=dark")
+	req.Header.Add("Cookie", "other_session=2;;  lang=en ")
+
+	for _, tc := range []struct {
+		allow, deny []string
+		expected    string
+	}{
+		{nil, nil, "HTTP_COOKIE=app_session=1; theme=dark; other_session=2; lang=en"},
+		{nil, []string{"other_*"}, "HTTP_COOKIE=app_session=1; theme=dark; lang=en"},
+		{[]string{"app_*", "lang"}, nil, "HTTP_COOKIE=app_session=1; lang=en"},
+		{[]string{"*_session"}, []string{"other_*"}, "HTTP_COOKIE=app_session=1"},
+		{[]string{"none"}, nil, ""},
+	} {
+		h := handler{Root: "/", CookieAllow: tc.allow, CookieDeny: tc.deny}
+		var cookie string
+		for _, e := range h.environ(req) {
+			if strings.HasPrefix(e, "HTTP_COOKIE=") {
+				cookie = e
+			}
+		}
+		if cookie != tc.expected {
+			t.Errorf("Unexpected %q for allow %v and deny %v. Expected %q.", cookie, tc.allow, tc.deny, tc.expected)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPCredential(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the user needs root")
+	}
+	// The script must be reachable for the unprivileged user.
+	dir, err := ioutil.TempDir("", "cgi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	script, err := ioutil.ReadFile("test/whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "whoami"), script, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := CGI{
+		Executable: filepath.Join(dir, "whoami"),
+		logger:     zap.NewNop(),
+		credential: &credential{Uid: 65534, Gid: 65534},
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+
+	if !strings.Contains(res.Body.String(), "uid 65534 gid 65534") {
+		t.Errorf("Script did not run with the configured credential:\n%s", res.Body.String())
+	}
+}
+
+func TestCGI_ServeHTTPCgroup(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("cgroups are only supported on Linux")
+	}
+	// A plain directory stands in for the cgroup file system.
+	parent, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	ioutil.WriteFile(filepath.Join(parent, "cgroup.controllers"), []byte("cpu io memory pids\n"), 0644)
+	ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), nil, 0644)
+
+	c := CGI{
+		Executable:   "test/example",
+		Cgroup:       parent,
+		CgroupMemory: 64 << 20,
+		CgroupCPU:    50,
+		logger:       zap.NewNop(),
+	}
+	if c.cgroup, err = c.processCgroup(); err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/example", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	if res.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d. Expected %d.", res.Code, http.StatusOK)
+	}
+
+	dirs, _ := filepath.Glob(filepath.Join(parent, "cgi-*"))
+	if len(dirs) != 1 {
+		t.Fatalf("Unexpected number of cgroups %d. Expected 1.", len(dirs))
+	}
+	for file, expected := range map[string]string{
+		"memory.max": "67108864",
+		"cpu.max":    "50000 100000",
+	} {
+		if data, _ := ioutil.ReadFile(filepath.Join(dirs[0], file)); string(data) != expected {
+			t.Errorf("Unexpected %s %q. Expected %q.", file, data, expected)
+		}
+	}
+	if pid, _ := ioutil.ReadFile(filepath.Join(dirs[0], "cgroup.procs")); len(pid) == 0 {
+		t.Error("Process was not moved into the cgroup.")
+	}
+}
+
+func TestPersistentPool_Reload(t *testing.T) {
+	newPool := func() (caddy.Destructor, error) {
+		return newPersistentPool(0, 0, 0, zap.NewNop()), nil
+	}
+	pool, loaded, err := persistentPools.LoadOrNew("reload-test", newPool)
+	if err != nil || loaded {
+		t.Fatalf("Unexpected pool state: loaded %v, error %v", loaded, err)
+	}
+	pp := pool.(*persistentPool)
+	pp.adopt(&App{}, zap.NewNop(), syscall.SIGTERM)
+
+	p, err := pp.acquire("a", &handler{Path: "test/persistent", Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pp.release("a", p, false)
+
+	// A reload keeps the pool and signals its processes.
+	pool, loaded, err = persistentPools.LoadOrNew("reload-test", newPool)
+	if err != nil || !loaded || pool != pp {
+		t.Fatalf("Pool not kept across reload: loaded %v, error %v", loaded, err)
+	}
+	persistentPools.Delete("reload-test")
+	pp.adopt(&App{}, zap.NewNop(), syscall.SIGTERM)
+	select {
+	case <-p.done:
+	case <-time.After(time.Second):
+		t.Error("Persistent process not signaled on reload.")
+	}
+
+	persistentPools.Delete("reload-test")
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if !pp.closed {
+		t.Error("Pool not closed after its last handler was cleaned up.")
+	}
+}
+
+func TestPersistentPool_ReloadChangedLimits(t *testing.T) {
+	app := &App{}
+	load := func(limitMemory int64) *persistentPool {
+		c := CGI{Executable: "test/persistent", PersistentKey: "a", LimitMemory: limitMemory, app: app, logger: zap.NewNop()}
+		if err := c.loadPersistentPool(nil); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { persistentPools.Delete(c.poolKey) })
+		return c.persistent
+	}
+	pid := func(pp *persistentPool) int {
+		p, err := pp.acquire("a", &handler{Path: "test/persistent", Logger: zap.NewNop()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pp.release("a", p, false)
+		return p.cmd.Process.Pid
+	}
+
+	first := load(0)
+	pid1 := pid(first)
+	// The same config keeps the process running across a reload ...
+	if pool := load(0); pool != first || pid(pool) != pid1 {
+		t.Error("Persistent process not kept across a reload of the same config.")
+	}
+	// ... while a changed limit starts a new one.
+	if pool := load(1 << 30); pool == first || pid(pool) == pid1 {
+		t.Error("Persistent process kept although limit_memory changed.")
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	h := &handler{Path: "test/persistent", Root: "/", Logger: zap.NewNop()}
+	wp := newWorkerPool(2, h, nil, 0, 0)
+	defer wp.close()
+
+	served := func() string {
+		res := httptest.NewRecorder()
+		wp.serve(h, res, httptest.NewRequest(http.MethodGet, "/", nil))
+		body := res.Body.String()
+		return body[strings.Index(body, "SERVED"):]
+	}
+	// Idle workers take turns.
+	for i, expected := range []string{"SERVED [1]", "SERVED [1]", "SERVED [2]", "SERVED [2]"} {
+		if got := served(); got != expected {
+			t.Errorf("Request %d: unexpected response %q. Expected %q.", i, got, expected)
+		}
+	}
+
+	// A worker that exits is replaced; the other one keeps serving meanwhile.
+	p, _, err := wp.acquire(httptest.NewRequest(http.MethodGet, "/", nil), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.kill()
+	<-p.done
+	if got := served(); got != "SERVED [3]" {
+		t.Errorf("Unexpected response %q. Expected %q.", got, "SERVED [3]")
+	}
+	deadline := time.Now().Add(3 * respawnDelay)
+	for {
+		wp.mu.Lock()
+		workers := len(wp.workers)
+		wp.mu.Unlock()
+		if workers == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected number of workers %d. Expected %d.", workers, 2)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWorkerPoolMaxRequests(t *testing.T) {
+	h := &handler{Path: "test/persistent", Root: "/", Logger: zap.NewNop()}
+	wp := newWorkerPool(1, h, nil, 2, 0)
+	defer wp.close()
+
+	// The worker is replaced after two requests.
+	for i, expected := range []string{"WORKER [1]", "WORKER [1]", "WORKER [2]", "WORKER [2]", "WORKER [3]"} {
+		res := httptest.NewRecorder()
+		wp.serve(h, res, httptest.NewRequest(http.MethodGet, "/", nil))
+		body := res.Body.String()
+		body = body[strings.Index(body, "WORKER"):]
+		if got := body[:strings.Index(body, "\n")]; got != expected {
+			t.Errorf("Request %d: unexpected response %q. Expected %q.", i, got, expected)
+		}
+	}
+}
+
+func TestWorkerPoolIdleTimeout(t *testing.T) {
+	h := &handler{Path: "test/persistent", Root: "/", Logger: zap.NewNop()}
+	wp := newWorkerPool(2, h, nil, 0, 100*time.Millisecond)
+	defer wp.close()
+
+	workers := func() int {
+		wp.mu.Lock()
+		defer wp.mu.Unlock()
+		return len(wp.workers)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for workers() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected number of workers %d. Expected %d.", workers(), 0)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A request starts a new worker on demand.
+	res := httptest.NewRecorder()
+	wp.serve(h, res, httptest.NewRequest(http.MethodGet, "/", nil))
+	if body := res.Body.String(); !strings.Contains(body, "SERVED [1]") {
+		t.Errorf("Unexpected response %q. Expected %q.", body, "SERVED [1]")
+	}
+	if got := workers(); got != 1 {
+		t.Errorf("Unexpected number of workers %d. Expected %d.", got, 1)
+	}
+}
+
+func TestPersistentPoolMaxRequests(t *testing.T) {
+	h := &handler{Path: "test/persistent", Root: "/", Logger: zap.NewNop()}
+	pp := newPersistentPool(0, 2, 0, zap.NewNop())
+	defer pp.close()
+
+	for i, expected := range []string{"SERVED [1]", "SERVED [2]", "SERVED [1]"} {
+		res := httptest.NewRecorder()
+		pp.serve("key", h, res, httptest.NewRequest(http.MethodGet, "/", nil))
+		body := res.Body.String()
+		if got := body[strings.Index(body, "SERVED"):]; strings.TrimSpace(got) != expected {
+			t.Errorf("Request %d: unexpected response %q. Expected %q.", i, got, expected)
+		}
+	}
+}
+
+func TestPersistentPoolMaxProcesses(t *testing.T) {
+	h := &handler{Path: "test/persistent", Root: "/", Logger: zap.NewNop()}
+	pp := newPersistentPool(0, 0, 1, zap.NewNop())
+	defer pp.close()
+
+	a, err := pp.acquire("a", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pp.release("a", a, false)
+
+	// The idle process makes room for one of another key ...
+	b, err := pp.acquire("b", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-a.done:
+	case <-time.After(time.Second):
+		t.Error("Idle persistent process not stopped to make room.")
+	}
+
+	// ... while a busy one doesn't.
+	res := httptest.NewRecorder()
+	pp.serve("c", h, res, httptest.NewRequest(http.MethodGet, "/", nil))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected statusCode %d. Expected %d.", res.Code, http.StatusServiceUnavailable)
+	}
+	pp.release("b", b, false)
+}
+
+func TestPersistentPoolRestart(t *testing.T) {
+	h := &handler{Path: "test/persistent", Root: "/", Logger: zap.NewNop()}
+	pp := newPersistentPool(0, 0, 0, zap.NewNop())
+	defer pp.close()
+
+	// Concurrent requests for a key share the process started for them.
+	processes := make(chan *persistentProcess, 4)
+	for i := 0; i < cap(processes); i++ {
+		go func() {
+			p, err := pp.acquire("key", h)
+			if err != nil {
+				t.Error(err)
+			}
+			processes <- p
+		}()
+	}
+	first := <-processes
+	for i := 1; i < cap(processes); i++ {
+		if p := <-processes; p != first {
+			t.Errorf("Unexpected process %p. Expected %p.", p, first)
+		}
+	}
+	for i := 0; i < cap(processes); i++ {
+		pp.release("key", first, false)
+	}
+
+	// An idle process that exited is replaced instead of failing requests.
+	first.kill()
+	<-first.done
+	res := httptest.NewRecorder()
+	pp.serve("key", h, res, httptest.NewRequest(http.MethodGet, "/", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("Unexpected statusCode %d. Expected %d.", res.Code, http.StatusOK)
+	}
+	if body := res.Body.String(); !strings.Contains(body, "SERVED [1]") {
+		t.Errorf("Unexpected response %q. Expected %q.", body, "SERVED [1]")
+	}
+}
+
+func TestWorkerPoolAffinity(t *testing.T) {
+	h := &handler{Path: "test/persistent", Root: "/", Logger: zap.NewNop()}
+	aff, err := newAffinity(defaultAffinityCookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wp := newWorkerPool(2, h, aff, 0, 0)
+	defer wp.close()
+
+	serve := func(cookie *http.Cookie) (string, *http.Cookie) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		wp.serve(h, res, req)
+		body := res.Body.String()
+		var minted *http.Cookie
+		if cookies := res.Result().Cookies(); len(cookies) > 0 {
+			minted = cookies[0]
+		}
+		return body[strings.Index(body, "WORKER"):], minted
+	}
+
+	first, cookie := serve(nil)
+	if cookie == nil || cookie.Name != defaultAffinityCookie || !cookie.HttpOnly {
+		t.Fatalf("Unexpected affinity cookie %v.", cookie)
+	}
+	// The bound client keeps getting the same worker, while others are
+	// spread as usual.
+	for i, expected := range []string{"SERVED [2]", "SERVED [3]"} {
+		got, minted := serve(cookie)
+		if minted != nil {
+			t.Errorf("Request %d: unexpected new cookie %v.", i, minted)
+		}
+		if got[:strings.Index(got, "\n")] != first[:strings.Index(first, "\n")] || !strings.HasSuffix(got, expected) {
+			t.Errorf("Request %d: unexpected response %q. Expected %q of the first worker.", i, got, expected)
+		}
+	}
+	if other, _ := serve(nil); other[:strings.Index(other, "\n")] == first[:strings.Index(first, "\n")] {
+		t.Errorf("Unexpected response %q from the bound worker.", other)
+	}
+
+	// Forged cookies are ignored and replaced.
+	forged := &http.Cookie{Name: defaultAffinityCookie, Value: "2.forged"}
+	if _, minted := serve(forged); minted == nil || minted.Value == forged.Value {
+		t.Errorf("Unexpected cookie %v for a forged one.", minted)
+	}
+}
+
+func TestCGI_InspectHeader(t *testing.T) {
+	c := CGI{
+		Executable:    "test/example",
+		Inspect:       true,
+		InspectHeader: "X-Inspect",
+		InspectToken:  "s3cret",
+		logger:        zap.NewNop(),
+	}
+	for _, testCase := range []struct {
+		header  []string
+		inspect bool
+	}{
+		{nil, false},
+		{[]string{"wrong"}, false},
+		{[]string{"s3cret"}, true},
+		{[]string{"wrong", "s3cret"}, true},
+	} {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/foo.cgi/some/path?x=y", nil)
+		for _, val := range testCase.header {
+			req.Header.Add("x-inspect", val)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		inspected := strings.HasPrefix(res.Body.String(), "CGI for Caddy inspection page")
+		if inspected != testCase.inspect {
+			t.Errorf("Unexpected inspection %v for header %q. Expected %v.", inspected, testCase.header, testCase.inspect)
+		}
+		if !inspected && !strings.HasPrefix(res.Body.String(), "PATH_INFO ") {
+			t.Errorf("Unexpected body %q for header %q. Expected script output.", res.Body.String(), testCase.header)
+		}
+	}
+}
+
+func TestCGI_UnmarshalCaddyfile(t *testing.T) {
+	content := `cgi /some/file a b c d 1 {
+  dir /somewhere
+  dir_from_script
+  profile batch
+  script_name /my.cgi
+  env foo=bar what=ever
+  pass_env some_env other_env
+  pass_all_env
+  server_software "Apache/2.4.41 (Unix)"
+  gateway_interface CGI/1.0
+  inspect X-Inspect s3cret
+  remote_user http.auth.user.sub LOGNAME
+  remote_user_meta email
+  persistent {http.request.host}
+  idle_timeout 10m
+  max_requests 1000
+  max_processes 50
+  reload_signal SIGHUP
+  static /static/* /favicon.ico
+  trailing_slash add
+  path_encoding raw
+  max_query_length 2048
+  strip_query_params utm_* fbclid
+  canonicalize keep_original
+  bake 1h /index
+  bake_signal SIGUSR2
+  cache 30s 64MiB
+  cache_vary Accept-Language
+  cache_storage
+  etag 64KiB
+  accept_ranges 4MiB
+  buffer_output
+  head cached 5m
+  deploy_snapshot lib templates/index.html
+  snapshot_dir /var/cache/caddy-cgi
+  warmup /health
+  warmup_args --warmup
+  check_executable
+  name public
+  weight 3
+  deadline 30s
+  timeout 1m
+  first_byte_timeout 10s
+  mark_truncated
+  log_stderr 1KiB
+  retries 3 50ms 1s
+  text_busy retry 8
+  env_baseline /var/lib/caddy/baseline.env
+  env_mirror /var/lib/caddy/mirror 20
+  circuit_breaker 5 1m 30s
+  kill_signal SIGINT
+  kill_grace 10s
+  sse_keepalive 15s
+  streaming
+  sse
+  flush_interval 100ms
+  response_buffer 64KiB
+  early_hints
+  sanitize_disposition
+  fold_headers Vary Cache-Control
+  sendfile /srv/downloads /srv/media
+  local_redirects
+  chunked_body stream
+  expect_continue immediate
+  socket_stdio 256KiB
+  upgrade
+  websocket
+  limit_cpu 10s
+  limit_memory 512MiB
+  limit_nofile 256
+  conformance strict
+  strip_bom
+  user www-data
+  group www
+  sandbox untrusted
+  interpreter .py python3 -u
+  arg_pattern [a-z0-9_-]+
+  cgroup /sys/fs/cgroup/cgi
+  cgroup_memory 256MiB
+  cgroup_cpu 50%
+  core_dumps /var/crash/cgi
+  extra_files log=/var/log/app/cgi.log ipc=unix:/run/app.sock
+  max_concurrent 8
+  queue_timeout 5s
+  pool 4
+  affinity sticky
+  fastcgi
+  scgi unix//run/app.sock
+  uwsgi localhost:3031
+  daemon /run/app-daemon.sock
+  kill_group
+  drain_timeout 30s
+  nice 10
+  ionice_class idle 7
+  transform "def transform(req): return None"
+  cookie_allow app_* lang
+  cookie_deny app_debug
+  chroot /srv/jail
+  umask 0027
+  seccomp basic-io
+  landlock_read /srv/cgi /usr
+  landlock_write /srv/data
+  namespaces pid mount net
+  set_cookie {
+    prefix app_
+    path /app
+    domain example.com
+    secure
+    http_only
+    same_site strict
+  }
+  shed_response 429 {
+    retry_after 10s
+    content_type application/json
+    body "{\"error\": \"{cgi.shed.reason}\"}"
+  }
+}`
+	d := caddyfile.NewTestDispenser(content)
+	var c CGI
+	if err := c.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Cannot parse caddyfile: %v", err)
+	}
+
+	expected := CGI{
+		Executable:           "/some/file",
+		WorkingDirectory:     "/somewhere",
+		DirFromScript:        true,
+		ScriptName:           "/my.cgi",
+		Args:                 []string{"a", "b", "c", "d", "1"},
+		Envs:                 []string{"foo=bar", "what=ever"},
+		PassEnvs:             []string{"some_env", "other_env"},
+		PassAll:              true,
+		ServerSoftware:       "Apache/2.4.41 (Unix)",
+		GatewayInterface:     "CGI/1.0",
+		Inspect:              true,
+		InspectHeader:        "X-Inspect",
+		InspectToken:         "s3cret",
+		RemoteUserKey:        "http.auth.user.sub",
+		RemoteUserEnv:        "LOGNAME",
+		RemoteUserMeta:       []string{"email"},
+		PersistentKey:        "{http.request.host}",
+		IdleTimeout:          caddy.Duration(10 * time.Minute),
+		MaxRequests:          1000,
+		MaxProcesses:         50,
+		ReloadSignal:         "SIGHUP",
+		StaticPrefixes:       []string{"/static/*", "/favicon.ico"},
+		TrailingSlash:        "add",
+		PathEncoding:         "raw",
+		MaxQueryLength:       2048,
+		StripQueryParams:     []string{"utm_*", "fbclid"},
+		Canonicalize:         true,
+		KeepOriginal:         true,
+		BakeInterval:         caddy.Duration(time.Hour),
+		BakePath:             "/index",
+		BakeSignal:           "SIGUSR2",
+		Cache:                caddy.Duration(30 * time.Second),
+		CacheSize:            64 << 20,
+		CacheVary:            []string{"Accept-Language"},
+		CacheStorage:         true,
+		ETag:                 true,
+		ETagLimit:            64 << 10,
+		AcceptRanges:         true,
+		BufferOutput:         true,
+		BufferSpool:          4 << 20,
+		Head:                 "cached",
+		HeadTTL:              caddy.Duration(5 * time.Minute),
+		DeploySnapshot:       true,
+		SnapshotFiles:        []string{"lib", "templates/index.html"},
+		SnapshotDir:          "/var/cache/caddy-cgi",
+		Warmup:               true,
+		WarmupPath:           "/health",
+		WarmupArgs:           []string{"--warmup"},
+		CheckExecutable:      true,
+		Name:                 "public",
+		Weight:               3,
+		Deadline:             caddy.Duration(30 * time.Second),
+		Timeout:              caddy.Duration(time.Minute),
+		FirstByteTimeout:     caddy.Duration(10 * time.Second),
+		MarkTruncated:        true,
+		LogStderr:            true,
+		StderrMinBytes:       1024,
+		Retries:              3,
+		RetryDelay:           caddy.Duration(50 * time.Millisecond),
+		RetryDelayMax:        caddy.Duration(time.Second),
+		TextBusy:             "retry",
+		TextBusyRetries:      8,
+		BreakerFailures:      5,
+		BreakerWindow:        caddy.Duration(time.Minute),
+		BreakerCooldown:      caddy.Duration(30 * time.Second),
+		EnvBaseline:          "/var/lib/caddy/baseline.env",
+		EnvMirror:            "/var/lib/caddy/mirror",
+		EnvMirrorKeep:        20,
+		KillSignal:           "SIGINT",
+		KillGrace:            caddy.Duration(10 * time.Second),
+		EventStreamKeepAlive: caddy.Duration(15 * time.Second),
+		Streaming:            true,
+		SSE:                  true,
+		FlushInterval:        caddy.Duration(100 * time.Millisecond),
+		ResponseBuffer:       64 * 1024,
+		EarlyHints:           true,
+		LocalRedirects:       true,
+		SanitizeDisposition:  true,
+		FoldHeaders:          []string{"Vary", "Cache-Control"},
+		SendfileRoots:        []string{"/srv/downloads", "/srv/media"},
+		ChunkedBody:          "stream",
+		ExpectContinue:       "immediate",
+		SocketStdio:          true,
+		SocketBuffer:         256 << 10,
+		Upgrade:              true,
+		WebSocket:            true,
+		LimitCPU:             caddy.Duration(10 * time.Second),
+		LimitMemory:          512 << 20,
+		LimitNofile:          256,
+		Conformance:          "strict",
+		StripBOM:             true,
+		User:                 "www-data",
+		Group:                "www",
+		Sandbox:              "untrusted",
+		Interpreters:         map[string][]string{".py": {"python3", "-u"}},
+		ArgPattern:           "[a-z0-9_-]+",
+		Cgroup:               "/sys/fs/cgroup/cgi",
+		CgroupMemory:         256 << 20,
+		CgroupCPU:            50,
+		CoreDumps:            "/var/crash/cgi",
+		ExtraFiles:           []string{"log=/var/log/app/cgi.log", "ipc=unix:/run/app.sock"},
+		MaxConcurrent:        8,
+		QueueTimeout:         caddy.Duration(5 * time.Second),
+		PoolSize:             4,
+		Affinity:             "sticky",
+		FastCGI:              true,
+		SCGI:                 true,
+		SCGIAddress:          "unix//run/app.sock",
+		UWSGI:                true,
+		UWSGIAddress:         "localhost:3031",
+		Daemon:               "/run/app-daemon.sock",
+		KillGroup:            true,
+		DrainTimeout:         caddy.Duration(30 * time.Second),
+		Nice:                 10,
+		IoniceClass:          "idle",
+		IoniceLevel:          7,
+		Transform:            "def transform(req): return None",
+		CookieAllow:          []string{"app_*", "lang"},
+		CookieDeny:           []string{"app_debug"},
+		Chroot:               "/srv/jail",
+		Umask:                "0027",
+		Seccomp:              "basic-io",
+		LandlockRead:         []string{"/srv/cgi", "/usr"},
+		LandlockWrite:        []string{"/srv/data"},
+		Namespaces:           []string{"pid", "mount", "net"},
+		SetCookie: &CookieRewrite{
+			Prefix:   "app_",
+			Path:     "/app",
+			Domain:   "example.com",
+			Secure:   true,
+			HTTPOnly: true,
+			SameSite: "strict",
+		},
+		ShedResponse: &ShedResponse{
+			Status:      429,
+			RetryAfter:  caddy.Duration(10 * time.Second),
+			ContentType: "application/json",
+			Body:        `{"error": "{cgi.shed.reason}"}`,
+		},
+	}
+
+	if !reflect.DeepEqual(c, expected) {
+		t.Fatal("Parsing yielded invalid result.")
+	}
+}
+
+func TestCGI_UnmarshalCaddyfileFlagArgs(t *testing.T) {
+	for _, directive := range []string{
+		"pass_all_env yes",
+		"affinity cookie extra",
+		"kill_group yes",
+		"streaming yes",
+		"upgrade yes",
+		"canonicalize keep_original extra",
+		// A subdirective name after the optional arguments isn't taken for
+		// the next subdirective.
+		"ionice_class be 3 streaming",
+		"log_stderr 1KiB streaming",
+		"set_cookie {\n    secure yes\n  }",
+		"set_cookie {\n    http_only yes\n  }",
+	} {
+		d := caddyfile.NewTestDispenser("cgi /some/file {\n  " + directive + "\n}")
+		var c CGI
+		if err := c.UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("Expected an error for %q.", directive)
+		}
+	}
+}
+
+func TestCGI_UnmarshalCaddyfileRemoteUserEnv(t *testing.T) {
+	for _, name := range []string{"REMOTE=USER", "1USER", "remote-user", "\"\""} {
+		d := caddyfile.NewTestDispenser("cgi /some/file {\n  remote_user http.auth.user.id " + name + "\n}")
+		var c CGI
+		if err := c.UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("Expected an error for variable %s.", name)
+		}
 	}
 }
 
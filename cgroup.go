@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// cgroupConfig describes the transient cgroup v2 each script process is
+// executed in.
+type cgroupConfig struct {
+	Parent    string // delegated cgroup the transient cgroups are created in
+	MemoryMax int64  // memory.max in bytes; 0 for no limit
+	CPUMax    int    // cpu.max in percent of a CPU; 0 for no limit
+}
+
+// cgroupPeriod is the period of cpu.max in microseconds.
+const cgroupPeriod = 100000
+
+var cgroupSeq uint64
+
+// cgroup is a transient cgroup for a single process. Since os/exec cannot
+// start a process in a cgroup, it is started as shim, moved into the cgroup
+// and only then released through a pipe (fd 3 of the shim) to execute the
+// script.
+type cgroup struct {
+	dir       string
+	syncRead  *os.File
+	syncWrite *os.File
+}
+
+// processCgroup validates the cgroup settings of the CGI configuration and
+// enables the controllers needed in the parent cgroup.
+func (c CGI) processCgroup() (*cgroupConfig, error) {
+	if c.Cgroup == "" {
+		if c.CgroupMemory > 0 || c.CgroupCPU > 0 {
+			return nil, fmt.Errorf("cgroup limits need a parent cgroup")
+		}
+		return nil, nil
+	}
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("cgroups are not supported on this platform")
+	}
+	if selfExecutableErr != nil {
+		return nil, fmt.Errorf("cgroups need the path of the Caddy binary: %v", selfExecutableErr)
+	}
+	controllers, err := ioutil.ReadFile(filepath.Join(c.Cgroup, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a cgroup v2 directory: %v", c.Cgroup, err)
+	}
+	enabled, err := ioutil.ReadFile(filepath.Join(c.Cgroup, "cgroup.subtree_control"))
+	if err != nil {
+		return nil, err
+	}
+	var needed []string
+	if c.CgroupMemory > 0 {
+		needed = append(needed, "memory")
+	}
+	if c.CgroupCPU > 0 {
+		needed = append(needed, "cpu")
+	}
+	for _, controller := range needed {
+		if hasWord(enabled, controller) {
+			continue
+		}
+		if !hasWord(controllers, controller) {
+			return nil, fmt.Errorf("%s controller is not available in cgroup %s", controller, c.Cgroup)
+		}
+		if err := ioutil.WriteFile(filepath.Join(c.Cgroup, "cgroup.subtree_control"), []byte("+"+controller), 0644); err != nil {
+			return nil, fmt.Errorf("enabling %s controller in cgroup %s: %v", controller, c.Cgroup, err)
+		}
+	}
+	return &cgroupConfig{Parent: c.Cgroup, MemoryMax: c.CgroupMemory, CPUMax: c.CgroupCPU}, nil
+}
+
+// hasWord reports whether the space separated list contains word.
+func hasWord(list []byte, word string) bool {
+	for _, w := range strings.Fields(string(list)) {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// create makes a new transient cgroup; nil is returned for a nil config.
+func (cc *cgroupConfig) create() (*cgroup, error) {
+	if cc == nil {
+		return nil, nil
+	}
+	name := fmt.Sprintf("cgi-%d-%d", os.Getpid(), atomic.AddUint64(&cgroupSeq, 1))
+	cg := &cgroup{dir: filepath.Join(cc.Parent, name)}
+	if err := os.Mkdir(cg.dir, 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	if cc.MemoryMax > 0 {
+		err = cg.write("memory.max", strconv.FormatInt(cc.MemoryMax, 10))
+	}
+	if err == nil && cc.CPUMax > 0 {
+		err = cg.write("cpu.max", fmt.Sprintf("%d %d", cc.CPUMax*cgroupPeriod/100, cgroupPeriod))
+	}
+	if err == nil {
+		cg.syncRead, cg.syncWrite, err = os.Pipe()
+	}
+	if err != nil {
+		os.Remove(cg.dir)
+		return nil, err
+	}
+	return cg, nil
+}
+
+func (cg *cgroup) write(file, value string) error {
+	return ioutil.WriteFile(filepath.Join(cg.dir, file), []byte(value), 0644)
+}
+
+// attach moves the started shim process into the cgroup and releases it. If
+// that fails, the shim exits without executing the script.
+func (cg *cgroup) attach(proc *os.Process) error {
+	if cg == nil {
+		return nil
+	}
+	cg.syncRead.Close()
+	defer cg.syncWrite.Close()
+	if err := cg.write("cgroup.procs", strconv.Itoa(proc.Pid)); err != nil {
+		return fmt.Errorf("moving process into cgroup: %v", err)
+	}
+	_, err := cg.syncWrite.Write([]byte{1})
+	return err
+}
+
+// close removes the cgroup once its process exited and logs if the process
+// was killed for exceeding the memory limit. Processes the script left
+// behind are killed.
+func (cg *cgroup) close(logger *zap.Logger) {
+	if cg == nil {
+		return
+	}
+	cg.syncRead.Close()
+	cg.syncWrite.Close()
+	if events, err := ioutil.ReadFile(filepath.Join(cg.dir, "memory.events")); err == nil {
+		for _, line := range bytes.Split(events, []byte("\n")) {
+			fields := strings.Fields(string(line))
+			if len(fields) == 2 && fields[0] == "oom_kill" && fields[1] != "0" {
+				logger.Warn("CGI process exceeded its cgroup memory limit", zap.String("cgroup", cg.dir))
+			}
+		}
+	}
+	if os.Remove(cg.dir) == nil {
+		return
+	}
+	cg.write("cgroup.kill", "1")
+	go func() {
+		for i := 0; i < 10; i++ {
+			time.Sleep(100 * time.Millisecond)
+			if os.Remove(cg.dir) == nil {
+				return
+			}
+		}
+		logger.Warn("cannot remove cgroup", zap.String("cgroup", cg.dir))
+	}()
+}
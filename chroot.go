@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// processChroot validates the chroot directory of the CGI configuration and
+// returns its absolute path; empty if none is configured.
+func (c CGI) processChroot() (string, error) {
+	if c.Chroot == "" {
+		return "", nil
+	}
+	if !chrootSupported {
+		return "", fmt.Errorf("chroot is not supported on this platform")
+	}
+	// The shim is the Caddy binary, which isn't available within the
+	// chroot directory.
+	if len(c.rlimits) > 0 || c.Nice != 0 || c.ioprio != 0 || c.umask != nil || c.seccomp != nil || c.landlock != nil || c.cgroup != nil || c.namespaces.isolatesProcesses() {
+		return "", fmt.Errorf("chroot cannot be combined with resource limits, priorities, umask, seccomp, landlock, core dumps, cgroups or pid and mount namespaces")
+	}
+	root, err := filepath.Abs(c.Chroot)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("chroot %s is not a directory", root)
+	}
+	return root, nil
+}
+
+// chrootPath translates the host path p to the corresponding path within the
+// chroot directory root. Paths outside of root are an error.
+func chrootPath(root, p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of chroot %s", p, root)
+	}
+	return filepath.Join(string(filepath.Separator), rel), nil
+}
+
+// scriptFilename returns the path of the script as seen by the script itself.
+func (h *handler) scriptFilename() string {
+	if h.Chroot == "" {
+		return h.Path
+	}
+	p := h.Path
+	if !filepath.IsAbs(p) && h.Dir != "" {
+		p = filepath.Join(h.Dir, p)
+	}
+	if inside, err := chrootPath(h.Chroot, p); err == nil {
+		return inside
+	}
+	return h.Path
+}
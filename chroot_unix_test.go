@@ -0,0 +1,72 @@
+//go:build !windows
+// +build !windows
+
+package cgi
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHandler_CommandChroot(t *testing.T) {
+	root, err := filepath.Abs("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		h            handler
+		path, dir    string
+		scriptFile   string
+		outsideError bool
+	}{
+		{h: handler{Path: "test/example"}, path: "/example", dir: "/", scriptFile: "/example"},
+		{h: handler{Path: root + "/example"}, path: "/example", dir: "/", scriptFile: "/example"},
+		{h: handler{Path: "example", Dir: root}, path: "/example", dir: "/", scriptFile: "/example"},
+		{h: handler{Path: "/usr/bin/env"}, outsideError: true},
+		{h: handler{Path: "example", Dir: "/tmp"}, outsideError: true},
+	} {
+		tc.h.Chroot = root
+		cmd, err := tc.h.command(nil, nil)
+		if tc.outsideError {
+			if err == nil || !strings.Contains(err.Error(), "outside of chroot") {
+				t.Errorf("Unexpected error %v for %s in %q. Expected it to be outside of the chroot.", err, tc.h.Path, tc.h.Dir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Cannot create command: %v", err)
+		}
+		if cmd.Path != tc.path || cmd.Args[0] != tc.path || cmd.Dir != tc.dir {
+			t.Errorf("Unexpected command %q %q in %q. Expected %q in %q.", cmd.Path, cmd.Args[0], cmd.Dir, tc.path, tc.dir)
+		}
+		if cmd.SysProcAttr == nil || cmd.SysProcAttr.Chroot != root {
+			t.Errorf("Unexpected process attributes %+v. Expected chroot %s.", cmd.SysProcAttr, root)
+		}
+		if got := tc.h.scriptFilename(); got != tc.scriptFile {
+			t.Errorf("Unexpected script filename %q. Expected %q.", got, tc.scriptFile)
+		}
+	}
+}
+
+func TestCGI_ProcessChroot(t *testing.T) {
+	c := CGI{Chroot: "test"}
+	root, err := c.processChroot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(root) {
+		t.Errorf("Unexpected chroot %q. Expected an absolute path.", root)
+	}
+
+	for _, invalid := range []CGI{
+		{Chroot: "test/example"},
+		{Chroot: "test/missing"},
+		{Chroot: "test", rlimits: []rlimit{{Resource: rlimitNofile, Cur: 1, Max: 1}}},
+		{Chroot: "test", Nice: 10},
+	} {
+		if _, err := invalid.processChroot(); err == nil {
+			t.Errorf("Expected an error for chroot %q.", invalid.Chroot)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Modes of CGI.Conformance
+const (
+	// conformanceStrict rejects responses deviating from RFC 3875 and
+	// RFC 7230: malformed header lines, invalid header values, lines not
+	// terminated by CRLF and bogus status lines.
+	conformanceStrict = "strict"
+	// conformanceCompat accepts everything the default mode does and adds
+	// behaviors old scripts rely on: a default content type, ISINDEX
+	// style command line arguments and CRCRLF line terminators.
+	conformanceCompat = "compat"
+)
+
+// compatContentType is used in compat mode for responses without a
+// Content-Type header.
+const compatContentType = "text/html"
+
+// errLongHeaderLine is returned by readHeaderLine for lines exceeding the
+// buffer of the reader.
+var errLongHeaderLine = errors.New("long header line from subprocess")
+
+// readHeaderLine reads a single header line without its line terminator and
+// reports whether the line was terminated by CRLF. A last line without any
+// terminator is returned as is. If lenient, any number of carriage returns in
+// front of the line feed belong to the terminator, like the CRCRLF of
+// scripts writing CRLF through a text mode stream on Windows.
+func readHeaderLine(r *bufio.Reader, lenient bool) (line []byte, crlf bool, err error) {
+	line, err = r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, false, errLongHeaderLine
+	}
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+		if n > 1 && line[n-2] == '\r' {
+			line = line[:n-2]
+			crlf = true
+		}
+		for lenient && len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+	}
+	return line, crlf, nil
+}
+
+// utf8BOM is the byte order mark some editors put at the start of files.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// skipPreamble discards a UTF-8 byte order mark and blank lines at the start
+// of r. It reports whether there was a byte order mark and how many blank
+// lines there were. If lenient, blank lines may end in several carriage
+// returns before the line feed, as with readHeaderLine.
+func skipPreamble(r *bufio.Reader, lenient bool) (bom bool, blankLines int) {
+	if start, _ := r.Peek(len(utf8BOM)); bytes.Equal(start, utf8BOM) {
+		r.Discard(len(utf8BOM))
+		bom = true
+	}
+	for {
+		n := 0
+		if lenient {
+			for {
+				start, _ := r.Peek(n + 1)
+				if len(start) <= n || start[n] != '\r' {
+					break
+				}
+				n++
+			}
+		} else if start, _ := r.Peek(1); len(start) == 1 && start[0] == '\r' {
+			n = 1
+		}
+		start, _ := r.Peek(n + 1)
+		if len(start) <= n || start[n] != '\n' {
+			return bom, blankLines
+		}
+		r.Discard(n + 1)
+		blankLines++
+	}
+}
+
+// isindexArgs returns the command line arguments of an ISINDEX query (one
+// without an unencoded "="), as described in RFC 3875 section 4.4: the query
+// is split at "+" and every word is decoded. Nil is returned for all other
+// queries or if a word cannot be decoded.
+func isindexArgs(rawQuery string) []string {
+	if rawQuery == "" || strings.Contains(rawQuery, "=") {
+		return nil
+	}
+	var args []string
+	for _, word := range strings.Split(rawQuery, "+") {
+		arg, err := url.PathUnescape(word)
+		if err != nil {
+			return nil
+		}
+		args = append(args, arg)
+	}
+	return args
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// cookieHeader assembles the value of HTTP_COOKIE from all Cookie header
+// lines as "name=value" pairs separated by "; " (RFC 6265, section 5.4).
+// Cookies whose names match none of allow (if not empty) or any of deny are
+// left out. It returns an empty string if no cookie is left.
+func cookieHeader(lines, allow, deny []string) string {
+	var cookies []string
+	for _, line := range lines {
+		for _, cookie := range strings.Split(line, ";") {
+			cookie = strings.TrimSpace(cookie)
+			if cookie == "" {
+				continue
+			}
+			name := cookie
+			if eq := strings.IndexByte(cookie, '='); eq >= 0 {
+				name = strings.TrimSpace(cookie[:eq])
+			}
+			if cookieAllowed(allow, deny, name) {
+				cookies = append(cookies, cookie)
+			}
+		}
+	}
+	return strings.Join(cookies, "; ")
+}
+
+// cookieAllowed reports whether the cookie called name may be passed on.
+func cookieAllowed(allow, deny []string, name string) bool {
+	for _, pattern := range deny {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, pattern := range allow {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CookieRewrite describes how the Set-Cookie headers of script responses are
+// rewritten. Zero values leave the cookies unchanged.
+type CookieRewrite struct {
+	// Prefix prepended to cookie names
+	Prefix string `json:"prefix,omitempty"`
+	// Path attribute replacing the one set by the script
+	Path string `json:"path,omitempty"`
+	// Domain attribute replacing the one set by the script
+	Domain string `json:"domain,omitempty"`
+	// True to add the Secure attribute
+	Secure bool `json:"secure,omitempty"`
+	// True to add the HttpOnly attribute
+	HTTPOnly bool `json:"httpOnly,omitempty"`
+	// SameSite attribute replacing the one set by the script: "strict",
+	// "lax" or "none"
+	SameSite string `json:"sameSite,omitempty"`
+}
+
+// sameSiteValues are the valid SameSite attributes by lower case name.
+var sameSiteValues = map[string]string{
+	"strict": "Strict",
+	"lax":    "Lax",
+	"none":   "None",
+}
+
+// validate checks the configuration of the rewrite.
+func (cr *CookieRewrite) validate() error {
+	if cr.SameSite != "" {
+		if _, ok := sameSiteValues[strings.ToLower(cr.SameSite)]; !ok {
+			return fmt.Errorf("invalid same_site %q", cr.SameSite)
+		}
+	}
+	if strings.ContainsAny(cr.Prefix+cr.Path+cr.Domain, ";=, \t") {
+		return fmt.Errorf("invalid character in cookie rewrite")
+	}
+	return nil
+}
+
+// rewrite returns the rewritten value of a Set-Cookie header. Attributes the
+// rewrite doesn't touch are kept as sent by the script.
+func (cr *CookieRewrite) rewrite(value string) string {
+	parts := strings.Split(value, ";")
+	cookie := []string{cr.Prefix + strings.TrimSpace(parts[0])}
+	for _, attr := range parts[1:] {
+		attr = strings.TrimSpace(attr)
+		name := attr
+		if eq := strings.IndexByte(attr, '='); eq >= 0 {
+			name = strings.TrimSpace(attr[:eq])
+		}
+		switch strings.ToLower(name) {
+		case "":
+			continue
+		case "path":
+			if cr.Path != "" {
+				continue
+			}
+		case "domain":
+			if cr.Domain != "" {
+				continue
+			}
+		case "secure":
+			if cr.Secure {
+				continue
+			}
+		case "httponly":
+			if cr.HTTPOnly {
+				continue
+			}
+		case "samesite":
+			if cr.SameSite != "" {
+				continue
+			}
+		}
+		cookie = append(cookie, attr)
+	}
+	if cr.Path != "" {
+		cookie = append(cookie, "Path="+cr.Path)
+	}
+	if cr.Domain != "" {
+		cookie = append(cookie, "Domain="+cr.Domain)
+	}
+	if cr.Secure {
+		cookie = append(cookie, "Secure")
+	}
+	if cr.HTTPOnly {
+		cookie = append(cookie, "HttpOnly")
+	}
+	if cr.SameSite != "" {
+		cookie = append(cookie, "SameSite="+sameSiteValues[strings.ToLower(cr.SameSite)])
+	}
+	return strings.Join(cookie, "; ")
+}
@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const coreDumpsSupported = true
+
+// maxCommLen is the length the kernel truncates process names to.
+const maxCommLen = 15
+
+// collectCoreDump logs the core dump of a crashed process. Dumps written
+// relative to the working directory of the process (as core_pattern says)
+// are moved into the core dump directory.
+func (h *handler) collectCoreDump(cmd *exec.Cmd) {
+	if h.CoreDumps == "" || cmd.ProcessState == nil {
+		return
+	}
+	status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() || !status.CoreDump() {
+		return
+	}
+	pid := cmd.ProcessState.Pid()
+	fields := []zap.Field{zap.String("path", h.Path), zap.Int("pid", pid), zap.Stringer("signal", status.Signal())}
+
+	pattern, err := ioutil.ReadFile("/proc/sys/kernel/core_pattern")
+	if err != nil {
+		h.Logger.Error("CGI process dumped core", append(fields, zap.Error(err))...)
+		return
+	}
+	if p := strings.TrimSpace(string(pattern)); strings.HasPrefix(p, "|") {
+		h.Logger.Error("CGI process dumped core", append(fields, zap.String("handler", p[1:]))...)
+		return
+	}
+	usesPid, _ := ioutil.ReadFile("/proc/sys/kernel/core_uses_pid")
+	comm := filepath.Base(h.Path)
+	if len(comm) > maxCommLen {
+		comm = comm[:maxCommLen]
+	}
+	core := expandCorePattern(strings.TrimSpace(string(pattern)), pid, comm, strings.TrimSpace(string(usesPid)) == "1")
+	relative := !filepath.IsAbs(core)
+	if relative {
+		core = filepath.Join(cmd.Dir, core)
+	}
+	if matches, _ := filepath.Glob(core); len(matches) > 0 {
+		core = matches[0]
+	}
+	if relative {
+		dest := filepath.Join(h.CoreDumps, fmt.Sprintf("core.%s.%d.%d", comm, pid, time.Now().Unix()))
+		if err := os.Rename(core, dest); err != nil {
+			fields = append(fields, zap.NamedError("move_error", err))
+		} else {
+			core = dest
+		}
+	}
+	h.Logger.Error("CGI process dumped core", append(fields, zap.String("core", core))...)
+}
+
+// expandCorePattern returns the file name core_pattern yields for the
+// process. Specifiers that cannot be known afterwards (like the time of the
+// dump) become wildcards.
+func expandCorePattern(pattern string, pid int, comm string, usesPid bool) string {
+	var b strings.Builder
+	hasPid := false
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			b.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'p', 'P', 'i', 'I':
+			b.WriteString(strconv.Itoa(pid))
+			hasPid = true
+		case 'e':
+			b.WriteString(comm)
+		case 'h':
+			host, _ := os.Hostname()
+			b.WriteString(host)
+		default:
+			b.WriteByte('*')
+		}
+	}
+	if usesPid && !hasPid {
+		b.WriteString("." + strconv.Itoa(pid))
+	}
+	return b.String()
+}
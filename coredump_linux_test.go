@@ -0,0 +1,75 @@
+package cgi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestExpandCorePattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		usesPid  bool
+		expected string
+	}{
+		{"core", false, "core"},
+		{"core", true, "core.42"},
+		{"/var/crash/core.%e.%p", true, "/var/crash/core.script.42"},
+		{"core-%t-%%", false, "core-*-%"},
+	}
+	for _, test := range tests {
+		if core := expandCorePattern(test.pattern, 42, "script", test.usesPid); core != test.expected {
+			t.Errorf("Unexpected core file for %q: %q. Expected %q.", test.pattern, core, test.expected)
+		}
+	}
+}
+
+func TestCGI_ServeHTTPCoreDump(t *testing.T) {
+	pattern, err := ioutil.ReadFile("/proc/sys/kernel/core_pattern")
+	if err != nil || filepath.IsAbs(string(pattern)) || strings.HasPrefix(string(pattern), "|") {
+		t.Skip("core dumps are not written relative to the working directory")
+	}
+	dir, err := ioutil.TempDir("", "cgi-cores")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	core, logs := observer.New(zapcore.ErrorLevel)
+	c := CGI{
+		Executable: "test/crash",
+		CoreDumps:  dir,
+		logger:     zap.New(core),
+	}
+	if c.rlimits, err = c.processLimits(); err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+
+	entries := logs.FilterMessage("CGI process dumped core").All()
+	if len(entries) != 1 {
+		t.Fatalf("Unexpected number of core dump logs %d. Expected 1.", len(entries))
+	}
+	path, _ := entries[0].ContextMap()["core"].(string)
+	if filepath.Dir(path) != dir {
+		t.Errorf("Core dump %q was not moved into %q.", path, dir)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Core dump is missing: %v", err)
+	}
+}
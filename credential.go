@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// credential is the user and group a script is executed as.
+type credential struct {
+	Uid uint32 `json:"uid"`
+	Gid uint32 `json:"gid"`
+}
+
+// processCredential resolves the user and group of the CGI configuration;
+// nil is returned if neither is configured. If only a user is given, the
+// primary group of that user is used.
+func (c CGI) processCredential() (*credential, error) {
+	if c.User == "" && c.Group == "" {
+		return nil, nil
+	}
+	if !credentialsSupported {
+		return nil, fmt.Errorf("user and group are not supported on this platform")
+	}
+	cred := &credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if c.User != "" {
+		u, err := lookupUser(c.User)
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid %q of user %s", u.Uid, c.User)
+		}
+		cred.Uid = uint32(uid)
+		if c.Group == "" {
+			if u.Gid == "" {
+				return nil, fmt.Errorf("user %s has no primary group; configure a group", c.User)
+			}
+			gid, err := strconv.ParseUint(u.Gid, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid gid %q of user %s", u.Gid, c.User)
+			}
+			cred.Gid = uint32(gid)
+		}
+	}
+	if c.Group != "" {
+		gid, err := lookupGroup(c.Group)
+		if err != nil {
+			return nil, err
+		}
+		cred.Gid = gid
+	}
+	return cred, nil
+}
+
+// lookupUser finds a user by name or numeric id. Numeric ids without an
+// account are accepted as they are.
+func lookupUser(name string) (*user.User, error) {
+	if u, err := user.Lookup(name); err == nil {
+		return u, nil
+	}
+	if _, err := strconv.ParseUint(name, 10, 32); err != nil {
+		return nil, fmt.Errorf("unknown user %s", name)
+	}
+	if u, err := user.LookupId(name); err == nil {
+		return u, nil
+	}
+	return &user.User{Uid: name}, nil
+}
+
+// lookupGroup finds a group by name or numeric id and returns its id.
+func lookupGroup(name string) (uint32, error) {
+	gid := name
+	if g, err := user.LookupGroup(name); err == nil {
+		gid = g.Gid
+	}
+	id, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %s", name)
+	}
+	return uint32(id), nil
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// A daemon request is the CGI environment as NUL terminated name=value
+// pairs, ended by an empty pair, followed by exactly CONTENT_LENGTH bytes of
+// body, after which the module shuts down its side of the connection. The
+// daemon answers with a regular CGI response, ending when it closes the
+// connection. This is what a CGI script sees of a request, so a daemon can
+// hand its end of the connection to code written for CGI as is.
+
+// daemonHeaders returns the serialized environment env, a list of
+// key=value pairs.
+func daemonHeaders(env []string) []byte {
+	var b strings.Builder
+	for _, e := range env {
+		if strings.IndexByte(e, '=') <= 0 || strings.IndexByte(e, 0) >= 0 {
+			continue
+		}
+		b.WriteString(e + "\x00")
+	}
+	b.WriteByte(0)
+	return []byte(b.String())
+}
+
+// closeWriter is a connection that can shut down its writing side, like
+// *net.UnixConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// serveDaemon relays req to the daemon at backend. Chunked request bodies
+// are spooled first, so the daemon gets CONTENT_LENGTH like a CGI script.
+func (h *handler) serveDaemon(backend socketBackend, rw http.ResponseWriter, req *http.Request) {
+	req, cleanup, ok := h.spoolChunked(rw, req)
+	if !ok {
+		return
+	}
+	defer cleanup()
+	conn, err := backend.dial()
+	if err != nil {
+		h.Failure.set(failSpawn)
+		rw.WriteHeader(http.StatusInternalServerError)
+		if rb, ok := backend.(remoteBackend); ok && staleSocket(rb.address) {
+			h.Logger.Error("daemon error, the socket is stale and the daemon not running", zap.String("socket", rb.address), zap.Error(err))
+			return
+		}
+		h.Logger.Error("daemon error", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	h.serveConn(rw, req, conn, "daemon", func(w *bufio.Writer) error {
+		env := h.environ(req)
+		h.logEnvironSize(env)
+		if _, err := w.Write(daemonHeaders(env)); err != nil {
+			return err
+		}
+		if req.Body != nil && req.ContentLength > 0 {
+			if _, err := io.CopyN(w, req.Body, req.ContentLength); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if cw, ok := conn.(closeWriter); ok {
+			return cw.CloseWrite()
+		}
+		return nil
+	}, conn)
+}
@@ -0,0 +1,150 @@
+package cgi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// daemonEcho serves daemon requests on ln, answering with the variables and
+// the body it got, read until the module shut down its side.
+func daemonEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			var env []string
+			for {
+				e, err := r.ReadString(0)
+				if err != nil {
+					return
+				}
+				if e = strings.TrimSuffix(e, "\x00"); e == "" {
+					break
+				}
+				env = append(env, e)
+			}
+			body, err := ioutil.ReadAll(r)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "Status: 201 Created\r\nContent-Type: text/plain\r\n\r\n")
+			for _, name := range []string{"CONTENT_LENGTH", "REQUEST_METHOD", "SCRIPT_FILENAME", "PATH_INFO", "DAEMON_TEST"} {
+				for _, e := range env {
+					if strings.HasPrefix(e, name+"=") {
+						fmt.Fprintf(conn, "%s [%s]\n", name, e[len(name)+1:])
+					}
+				}
+			}
+			fmt.Fprintf(conn, "BODY [%s]\n", body)
+		}()
+	}
+}
+
+func TestCGI_ServeHTTPDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-cgi-daemon")
+	if err != nil {
+		t.Fatalf("Cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "app.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("Cannot listen on a Unix socket: %v", err)
+	}
+	defer ln.Close()
+	go daemonEcho(ln)
+
+	c := CGI{
+		Executable: "/srv/app.cgi",
+		Envs:       []string{"DAEMON_TEST=multi\nline"},
+		ScriptName: "/app",
+		logger:     zap.NewNop(),
+		daemon:     remoteBackend{"unix", socket},
+	}
+	for _, step := range []struct {
+		method, body string
+		chunked      bool
+	}{
+		{http.MethodGet, "", false},
+		{http.MethodPost, "name=value", false},
+		{http.MethodPost, "chunked", true},
+	} {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(step.method, "/app/path", strings.NewReader(step.body))
+		if step.chunked {
+			req.ContentLength = -1
+			req.TransferEncoding = []string{"chunked"}
+		}
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if res.Code != http.StatusCreated {
+			t.Errorf("Unexpected statusCode %d. Expected %d.", res.Code, http.StatusCreated)
+		}
+		expected := fmt.Sprintf("REQUEST_METHOD [%s]\nSCRIPT_FILENAME [/srv/app.cgi]\nPATH_INFO [/path]\nDAEMON_TEST [multi\nline]\nBODY [%s]",
+			step.method, step.body)
+		if step.body != "" {
+			expected = fmt.Sprintf("CONTENT_LENGTH [%d]\n", len(step.body)) + expected
+		}
+		if body := strings.TrimSpace(res.Body.String()); body != expected {
+			t.Errorf("Unexpected body\n========== Got ==========\n%s\n========== Wanted ==========\n%s", body, expected)
+		}
+	}
+
+	// A daemon that is not running is an internal error.
+	ln.Close()
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/app/path", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	if res.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected statusCode %d. Expected %d.", res.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "daemon.sock")
+	if staleSocket(path) {
+		t.Error("Unexpected stale socket that doesn't exist.")
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Skip(err)
+	}
+	ln.SetUnlinkOnClose(false)
+	if staleSocket(path) {
+		t.Error("Unexpected stale socket that is listened on.")
+	}
+	ln.Close()
+	if !staleSocket(path) {
+		t.Error("Expected a stale socket after closing the listener.")
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if staleSocket(file) {
+		t.Error("Unexpected stale socket that is a regular file.")
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// sanitizeContentDisposition rebuilds a Content-Disposition header of a
+// script (RFC 6266) so that it carries nothing but the disposition type and a
+// plain file name. The name is reduced to its last path element (see
+// sanitizeFilename) and sent as ASCII in filename and, if it isn't ASCII,
+// encoded in filename* as well (RFC 5987). Values that can't be
+// parsed become a plain attachment.
+func sanitizeContentDisposition(value string) string {
+	disposition, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "attachment"
+	}
+	if disposition != "inline" {
+		disposition = "attachment"
+	}
+	// ParseMediaType decodes filename* into filename, preferring it.
+	name := sanitizeFilename(params["filename"])
+	if name == "" {
+		return disposition
+	}
+	ascii := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return '_'
+		}
+		return r
+	}, name)
+	// Backslashes are path separators and gone already.
+	header := fmt.Sprintf("%s; filename=\"%s\"", disposition, strings.Replace(ascii, `"`, `\"`, -1))
+	if ascii != name {
+		header += "; filename*=UTF-8''" + strings.Replace(url.QueryEscape(name), "+", "%20", -1)
+	}
+	return header
+}
+
+// sanitizeFilename returns the last element of the path name, without
+// control and format characters, invalid UTF-8 and surrounding spaces and
+// dots, so it can't point outside the download directory or hide its
+// extension.
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		// Format characters include the bidirectional overrides that make
+		// "evil\u202Efdp.exe" look like "evilexe.pdf".
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(name, ""))
+	return strings.Trim(name, " .")
+}
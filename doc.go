@@ -60,11 +60,114 @@ sure to validate and sanitize all inbound content. If you use a CGI
 library or framework to process your scripts, make sure you understand
 its limitations.
 
+Don't run scripts with the privileges of Caddy. Scripts inherit the
+user and group of the Caddy process, which may well be root if Caddy
+binds to ports 80 and 443 without capabilities. On Unix systems user and
+group execute the scripts with the given user and group instead, by name
+or numeric id; without group the primary group of the user is used.
+Supplementary groups are dropped. The script and its working directory
+must be accessible to that user.
+
+    cgi /app/* /srv/cgi/app.cgi {
+        user www-data
+        group www-data
+    }
+
+Scripts get all cookies of a request in HTTP_COOKIE, assembled from
+every Cookie header line. When applications of different tenants share a
+host, cookie_allow and cookie_deny keep the cookies of one out of the
+environment of another. Both take cookie names, which may contain
+wildcards; a cookie is passed if it matches one of the cookie_allow
+names (if any are given) and none of the cookie_deny names.
+
+    cgi /shop/* /srv/cgi/shop.cgi {
+        cookie_allow shop_* lang
+        cookie_deny shop_admin_session
+    }
+
+The request itself is left unchanged, so other handlers still see all
+cookies.
+
+Legacy scripts often set cookies without the attributes browsers expect
+today. set_cookie rewrites the Set-Cookie headers of their responses:
+prefix prepends a string to the cookie names, path and domain replace
+the respective attributes, secure and http_only add those flags and
+same_site (strict, lax or none) replaces the SameSite attribute. All
+other attributes are kept as sent by the script.
+
+    cgi /shop/* /srv/cgi/shop.cgi {
+        set_cookie {
+            prefix shop_
+            path /shop
+            secure
+            http_only
+            same_site lax
+        }
+    }
+
+Arguments can contain placeholders, so request data can end up on the
+command line of the script, for example with cgi /convert
+/srv/cgi/convert --format={http.request.uri.query.format}. A value like
+-o/etc/passwd would then be taken as an option. arg_pattern is a regular
+expression the value of every placeholder in the arguments has to match
+as a whole, as do the arguments taken from the query string in compat
+mode (see Response Conformance); requests with other values are rejected
+with status 400 before the script runs. Empty values have to match as
+well.
+
+    cgi /convert /srv/cgi/convert --format={http.request.uri.query.format} {
+        arg_pattern [a-z0-9]+
+    }
+
+Download scripts often pass a file name from the request on into the
+Content-Disposition header of their response, where a name like
+../../.bashrc or one with a right-to-left override that hides the real
+extension ends up in the download dialog of the browser. With
+sanitize_disposition, the module rebuilds these headers from nothing but
+the disposition type (inline, anything else becomes attachment) and the
+file name, reduced to its last path element and stripped of control and
+formatting characters and of surrounding dots and spaces. Names that
+aren't ASCII are sent in filename* as well, with an ASCII fallback in
+filename. Headers that can't be parsed become a plain attachment.
+
+    cgi /download /srv/cgi/download.cgi {
+        sanitize_disposition
+    }
+
+Scripts that check whether a client may download a file don't have to
+copy the file through their standard output. With sendfile and the
+directories the files may come from, a response with an X-Sendfile
+header carrying the absolute path of a file (as with Apache's
+mod_xsendfile) or an X-Accel-Redirect header carrying its path below one
+of the directories (as with nginx) is answered with that file in place
+of the body of the script. The other headers of the script are kept, the
+content type is derived from the file name if the script didn't set one,
+and ranges and conditional requests are answered as for static files.
+Files outside of the directories, also by way of symbolic links, are
+refused with status 500, missing ones with 404. Responses with a status
+other than 200 are passed on as they are.
+
+    cgi /download /srv/cgi/download.cgi {
+        sendfile /srv/downloads
+    }
+
 Errors
 
 An error in a CGI application is generally handled within the
 application itself and reported in the headers it returns.
 
+When the module itself answers with an error status, it logs the request
+as failed with one of these classes in error_class: spawn_error (the
+script could not be started or reached), timeout (the script exceeded
+timeout or first_byte_timeout), bad_headers (the response of the script
+was invalid), body_limit (the request body exceeded the limit of
+request_body or could not be spooled, answered with 413 or 500) and
+killed_by_signal (the script was killed by a signal the module didn't
+send). The statistics of a route count failures by class, and with debug
+logging enabled, as with the global debug option, the response carries
+the class in the X-CGI-Error-Class header. Errors the script reports
+itself aren't classified.
+
 Application Modes
 
 Your CGI application can be executed directly or indirectly. In the
@@ -79,6 +182,38 @@ setting up the filename extension association.
 In the indirect case, the name of the CGI script is passed to an
 interpreter such as lua, perl or python.
 
+Instead of relying on shebang lines, scripts can be run through
+interpreters chosen by the extension of the executable. The cgi app (in
+the JSON configuration, see Shared Process Limit) maps extensions to an
+interpreter and its default arguments, and interpreter ext command
+[args...] replaces the entry for an extension in a route, for example to
+drop or change the default arguments:
+
+    {
+        "apps": {
+            "cgi": {
+                "interpreters": {
+                    ".py": ["python3", "-u"],
+                    ".pl": ["/usr/bin/perl", "-T"]
+                }
+            },
+            "http": { ... }
+        }
+    }
+
+    cgi /report* /srv/cgi/report.py arg1 {
+        interpreter .py /opt/venv/bin/python3 -u -X utf8
+    }
+
+The process then executes the interpreter with its arguments first,
+followed by the script and then the arguments of the route
+(/opt/venv/bin/python3 -u -X utf8 /srv/cgi/report.py arg1, the script
+relative to the working directory like the executable otherwise). An
+interpreter without a path is looked up in PATH; with chroot it has to
+be given as an absolute path within that directory. SCRIPT_FILENAME
+stays the script and SCRIPT_EXEC shows the whole command. Interpreters
+do not apply to in-process programs.
+
 Requirements
 
 
@@ -151,10 +286,109 @@ syntax. That looks like this:
     cgi [matcher] exec [args...] {
         scipt_name subpath
         dir working_directory
+        dir_from_script
         env key1=val1 [key2=val2...]
         pass_env key1 [key2...]
         pass_all_env
-        inspect
+        server_software string
+        gateway_interface string
+        inspect [header [token]]
+        remote_user off|replacer_key [env_var]
+        remote_user_meta key1 [key2...]
+        persistent placeholder
+        idle_timeout duration
+        max_requests count
+        max_processes count
+        name route_name
+        weight number
+        deadline duration
+        reload_signal signal
+        static prefix1 [prefix2...]
+        trailing_slash add|remove
+        path_encoding nfc|raw
+        max_query_length bytes
+        strip_query_params pattern1 [pattern2...]
+        canonicalize [keep_original]
+        bake interval [path]
+        bake_signal signal
+        cache ttl [max_size]
+        cache_vary headers...
+        cache_storage
+        etag [max_size]
+        accept_ranges [spool_size]
+        head get|cached [ttl]
+        deploy_snapshot [files...]
+        snapshot_dir directory
+        warmup [path]
+        warmup_args arg1 [arg2...]
+        check_executable
+        timeout duration
+        first_byte_timeout duration
+        profile interactive|batch|streaming
+        mark_truncated
+        log_stderr [min_size]
+        retries count [delay [max_delay]]
+        text_busy retry|snapshot [count]
+        circuit_breaker failures [window [cooldown]]
+        env_baseline file
+        env_mirror directory [keep]
+        kill_signal signal
+        kill_grace duration
+        sse_keepalive interval
+        flush_interval duration
+        response_buffer size
+        buffer_output [spool_size]
+        early_hints
+        local_redirects
+        streaming
+        sse
+        limit_cpu duration
+        limit_memory size
+        limit_nofile number
+        conformance strict|compat
+        strip_bom
+        user name
+        group name
+        sandbox name
+        interpreter ext command [args...]
+        arg_pattern regexp
+        cgroup path
+        cgroup_memory size
+        cgroup_cpu percent
+        core_dumps directory
+        extra_files name1=path1 [name2=path2...]
+        max_concurrent number
+        queue_timeout duration
+        pool size
+        kill_group
+        program module
+        drain_timeout duration
+        nice value
+        ionice_class class [level]
+        transform source
+        cookie_allow names...
+        cookie_deny names...
+        chroot directory
+        namespaces names...
+        set_cookie { ... }
+        shed_response [status] { ... }
+        sanitize_disposition
+        sendfile directories...
+        fold_headers names...
+        affinity [cookie]
+        fastcgi
+        scgi [address]
+        uwsgi [address]
+        daemon socket
+        seccomp profile
+        landlock_read paths...
+        landlock_write paths...
+        umask mask
+        chunked_body spool|stream
+        expect_continue read|immediate|never
+        socket_stdio [buffer_size]
+        upgrade
+        websocket
     }
 
 For example,
@@ -181,6 +415,28 @@ environment variable to be set; you can do this with the subdirective
 pass_env HOME. Another class of problematic applications require the
 COMPUTERNAME variable.
 
+dir sets the working directory of the script. Like the executable and
+its arguments, it may contain placeholders, which are replaced for every
+request, so each tenant of a shared script can get a directory of its
+own, for example from a variable set by another handler:
+
+    map {host} {tenant} {
+        alpha.example.com alpha
+        beta.example.com  beta
+    }
+    cgi /app* /usr/local/bin/app.cgi {
+        dir /srv/tenants/{tenant}
+    }
+
+For pool instances, which are started before any request arrives,
+request placeholders are empty, but global ones like {env.*} still work.
+
+dir_from_script runs each script in the directory that contains it, with
+symbolic links resolved, the way Apache does, so scripts can open their
+data files by relative paths. dir then only serves to find a relative
+executable; static files served with static are looked up next to the
+executable too.
+
 The pass_all_env subdirective instructs Caddy to pass each environment
 variable it knows about to the CGI excutable. This addresses a common
 frustration that is caused when an executable requires an environment
@@ -191,16 +447,1395 @@ is that a lot of server information is shared with the CGI executable.
 Use this subdirective only with CGI applications that you trust not to
 leak this information.
 
+Scripts get go as SERVER_SOFTWARE and CGI/1.1 as GATEWAY_INTERFACE. Some
+older ones look for a particular server in there and behave differently
+otherwise; server_software and gateway_interface set other values, for
+example server_software "Apache/2.4.41 (Unix)". They apply to every way
+scripts are run, including FastCGI, SCGI and uwsgi applications.
+
+By default the user authenticated by some other middleware (the replacer
+key http.auth.user.id) is exported as REMOTE_USER. If your
+authentication module publishes the user under a different key, or your
+script expects a different variable such as LOGNAME, use remote_user
+replacer_key [env_var]. The variable name may only consist of upper-case
+letters, digits and underscores and must not start with a digit.
+remote_user off disables the export altogether. remote_user_meta names
+additional metadata keys that live next to the user key (for example
+email for http.auth.user.email); each one is exported as the user
+variable suffixed with the upper-cased key, for example
+REMOTE_USER_EMAIL. Since Caddy's replacer cannot enumerate its keys, the
+metadata keys need to be listed explicitly.
+
+When Caddy listens on a unix domain socket, there is no meaningful
+remote address. Like nginx, the cgi module then sets REMOTE_ADDR and
+REMOTE_HOST to unix:. If your scripts want to know who is on the other
+end, add the cgi_peer_credentials directive to the site block. It
+installs a listener wrapper that queries the peer credentials of each
+connection (SO_PEERCRED, Linux only) and the scripts then receive
+REMOTE_PEER_PID, REMOTE_PEER_UID and REMOTE_PEER_GID. The same values
+are available as the placeholders {peer.pid}, {peer.uid} and {peer.gid},
+for example to pass them as arguments.
+
+    http://admin.local {
+        bind unix//run/caddy/admin.sock
+        cgi_peer_credentials
+        cgi /admin* /usr/local/bin/admin-tool
+    }
+
+Legacy applications often expect their assets (stylesheets, images,
+scripts) to be reachable right next to the script URL. Instead of
+mirroring the script layout with a separate file_server, static lists
+path prefixes that are served as plain files without executing the
+script. The part of the path after script_name is looked up in the
+working directory (dir, or the directory of the executable), so with
+script_name /app and static /app/static/* a request for
+/app/static/app.css returns static/app.css from there. Only GET and HEAD
+requests are accepted.
+
+Scripts that build self-referential URLs from SCRIPT_NAME and PATH_INFO
+tend to serve the same page under /app and /app/. trailing_slash add
+redirects a request for the script name without a trailing slash to the
+same path with one (like Apache's DirectorySlash), as well as requests
+for paths that are directories in the working directory; other
+PATH_INFO, like /app/report.csv, is passed on unchanged. trailing_slash
+remove does the opposite for every path. GET and HEAD requests are
+redirected with 301, other methods with 308, so clients repeat them
+including their body. Paths below static prefixes are left alone.
+
+By default PATH_INFO holds the decoded request path, so an encoded slash
+(%2F) cannot be told apart from a real one, and the same name may arrive
+in different Unicode normalization forms. path_encoding nfc normalizes
+the decoded PATH_INFO and SCRIPT_NAME to Unicode NFC. path_encoding raw
+passes both percent-encoded as the client sent them (like Apache's
+AllowEncodedSlashes NoDecode), with the escapes brought into canonical
+form: unreserved characters are decoded and the remaining escapes use
+upper case hex digits. The {path} placeholder follows PATH_INFO.
+
+Every byte of the query string ends up in the environment of the script.
+max_query_length rejects requests with longer query strings with 414
+(URI Too Long) before anything is executed. strip_query_params removes
+parameters the script doesn't care about, such as tracking parameters,
+from QUERY_STRING and REQUEST_URI. Parameter names are matched against
+glob patterns (e.g. utm_*); the order and encoding of the remaining
+parameters are kept. URLs that only differ in stripped parameters share
+one entry of the response cache.
+
+canonicalize hands the request to the script in a canonical form: query
+parameters are sorted by name (parameters of the same name keep their
+order) and the host is lower-cased, so QUERY_STRING, REQUEST_URI and
+HTTP_HOST don't vary with the order in which clients happen to send
+parameters, and neither does the entry of the response cache they are
+answered from. With canonicalize keep_original the script additionally
+receives the query and host as sent in ORIGINAL_QUERY_STRING and
+ORIGINAL_HTTP_HOST. Stripping and canonicalization affect what the
+script sees and the keys of the response caches of cache and head
+cached; the request handed on to the next handler is left untouched.
+
+A script that hangs would otherwise tie up its connection forever.
+timeout limits the execution time of the script: once it passed, the
+process receives kill_signal (SIGTERM by default) and, if it is still
+running after kill_grace (5 seconds by default), it is killed forcibly.
+If the script didn't send its headers yet, the client gets 504 (Gateway
+Timeout); otherwise the response is cut off. Scripts whose client aborts
+the download or upload are terminated the same way instead of running to
+completion. Only the process itself is signaled (unless kill_group is
+set), so scripts that start long-running children of their own should
+pass the signal on (or exec them). On Windows processes are always
+killed right away, together with the processes they started: every
+script runs in a job object of its own, which also ends whatever is left
+running once the script exited. Persistent processes are not terminated
+when a client goes away, as they serve other requests as well.
+
+first_byte_timeout only limits the time until the script sent its
+response headers. A script that doesn't send them in time is terminated
+the same way and the client gets 504, while a script that did may take
+as long as it likes for the body. Unlike timeout, it also applies to
+streaming routes, so a stuck script doesn't keep a client waiting for a
+stream that never starts. It doesn't apply to Go programs.
+
+    cgi /report* /usr/local/bin/report.cgi {
+        streaming
+        first_byte_timeout 10s
+    }
+
+Rather than tuning each of these knobs, a route can start from a profile
+that presets a coherent combination of them. Anything set explicitly
+takes precedence over the preset, even if it is zero like timeout 0 (or
+false in the JSON config). The Caddyfile adapter writes the preset
+settings into the JSON config right away:
+
+-   interactive for pages someone waits for: timeout 30s,
+    first_byte_timeout 10s, queue_timeout 5s, kill_grace 2s and
+    response_buffer 64KiB.
+
+-   batch for reports and exports: timeout 15m, kill_grace 30s and
+    flush_interval 1s.
+
+-   streaming for long-running responses: streaming, first_byte_timeout
+    30s and kill_grace 5s.
+
+    cgi /export* /usr/local/bin/export.cgi {
+        profile batch
+        timeout 1h
+    }
+
+A response cut off by timeout looks like a corrupt page to the user.
+With mark_truncated, such responses end with the trailer
+X-CGI-Truncated: timeout (as long as the script didn't set
+Content-Length), and HTML gets a comment saying so appended to the body.
+JSON is of no use when incomplete, so it is held back until the script
+is done and the client gets 504 instead if it timed out; this doesn't
+apply to streaming routes.
+
+Scripts that fail occasionally, for example because a database they
+depend on is briefly unavailable, can be run again with retries. A
+script that exits unsuccessfully without writing anything is then
+retried up to the given number of times before the client gets 500,
+waiting 100 milliseconds (or the optional second argument) before the
+first retry and twice as long before every further one, up to 5 seconds
+(or the optional third argument). Only requests with an idempotent
+method (GET, HEAD, OPTIONS, TRACE, PUT, DELETE) and without a body are
+retried, never scripts that were terminated. Every run gets the full
+timeout.
+
+    cgi /status* /usr/local/bin/status.cgi {
+        retries 3 200ms 2s
+    }
+
+Replacing a script in place during a deploy makes starting it fail with
+"text file busy" (ETXTBSY) while it is being written to, and the clients
+get 500. With text_busy retry, such a script is started again up to 5
+times (or the given number), waiting like with retries in between; this
+applies to every request, since the script didn't get to read the body.
+With text_busy snapshot, a copy of the script is started instead, as a
+hidden file next to it that is removed once the script exited; the
+script then finds itself at the path of the copy in argv[0], while
+SCRIPT_FILENAME still names the original. The copy only helps if the
+file is held open without being changed; a file in the middle of being
+rewritten is copied as it is.
+
+    cgi /app* /srv/app/app.cgi {
+        text_busy retry 10
+    }
+
+When a script keeps failing, for example because a service it needs is
+down, starting it again for every request only adds load. With
+circuit_breaker 5, requests for a script that exited unsuccessfully 5
+times within a minute (or the optional second argument) are rejected
+right away with 503 (Service Unavailable) and a Retry-After header for
+30 seconds (or the optional third argument). Afterwards a single request
+runs the script again: if it succeeds, requests are served as usual,
+otherwise the next cooldown starts. Scripts are told apart by their
+executable, after placeholders have been replaced. The placeholder
+{cgi.breaker} holds the state of the breaker (closed, open or half-open
+while a request tries again) and {cgi.breaker.retry_after} the seconds
+until the next try, so an error page can explain the outage. The circuit
+breaker is not available together with pool or persistent.
+
+    example.com {
+        cgi /report* /usr/local/bin/report.cgi {
+            circuit_breaker 5 1m 30s
+        }
+        handle_errors {
+            respond "Reports are unavailable ({cgi.breaker}), try again in {cgi.breaker.retry_after} seconds." 503
+        }
+    }
+
+Responses with content type text/event-stream (server-sent events) are
+flushed to the client after every write of the script. Proxies and load
+balancers tend to drop connections that stay silent for too long, so
+with sse_keepalive 15s a : keep-alive comment line is sent whenever the
+script didn't write anything for that long. Comments are ignored by
+clients and are only inserted between complete lines.
+
+Scripts that produce their response incrementally (progress output, long
+polling, event streams) need several settings to reach the client in
+time. streaming takes care of all of them at once: every write of the
+script is flushed to the client, proxies in front of Caddy are told not
+to buffer either (X-Accel-Buffering: no, unless set by the script),
+timeout is ignored (use first_byte_timeout instead), and event streams
+get keep-alive comments every 30 seconds unless sse_keepalive says
+otherwise.
+
+Routes that only serve server-sent events can use sse instead, which
+implies streaming and makes every successful response of the script an
+event stream: its content type becomes text/event-stream whatever the
+script said, and Cache-Control: no-cache is added unless the script sent
+a Cache-Control header itself. Error responses are passed on as they
+are. As for every script, the process gets the kill signal once the
+client went away.
+
+    cgi /updates /srv/cgi/updates.sh {
+        sse
+        sse_keepalive 15s
+    }
+
+Flushing every write costs a system call and often a small packet per
+write, which adds up for scripts that write many small pieces.
+flush_interval 100ms collects the writes instead and flushes them
+together at most that long after the first one, on all responses of the
+route and in place of flushing every write with streaming and sse.
+Whatever is left is sent once the response ends.
+
+Whether a response is better collected and sent at once or passed on as
+it is written often depends on its size. With response_buffer 64KiB,
+responses that announce their size, with Content-Length or an
+X-Response-Size-Hint header (which isn't sent to the client), choose for
+themselves: up to the given size they are read completely into a buffer
+of the announced size and sent in one go, larger ones are flushed to the
+client on every write like with streaming. Responses that don't announce
+their size are sent as usual.
+
+Scripts rarely send a Content-Length, so their responses are streamed:
+with chunked encoding for HTTP/1.1, while HTTP/1.0 clients can't keep
+the connection open, since only closing it marks the end of the body.
+With buffer_output, responses are collected completely instead, in
+memory up to 1 MiB (or the given size) and in a temporary file beyond,
+and sent with their actual Content-Length once the script is done, so
+connections of HTTP/1.0 clients can be kept alive. Flushing has no
+effect then; event streams and responses to HEAD requests are passed on
+as usual. buffer_output can't be combined with streaming or sse, and
+shares its size with accept_ranges.
+
+    cgi /report* /usr/local/bin/report.cgi {
+        buffer_output 4MiB
+    }
+
+Request bodies and responses pass through pipes, whose buffer of usually
+64 KiB makes the script and Caddy wait on each other for large
+transfers. With socket_stdio, standard input and output of scripts are
+Unix socket pairs instead, optionally with send and receive buffers of
+the given size, such as socket_stdio 1MiB; the system may cap it
+(net.core.wmem_max and net.core.rmem_max on Linux). Scripts read and
+write them like pipes. socket_stdio applies to scripts started per
+request; it is not available on Windows and can't be combined with pool,
+persistent, program, fastcgi, scgi, uwsgi, daemon or websocket.
+
+    cgi /bulk/* /srv/cgi/bulk.cgi {
+        socket_stdio 1MiB
+    }
+
+Early Hints
+
+Browsers can start loading stylesheets, scripts and fonts while a slow
+script is still working on the page if they learn about them early. With
+early_hints, the Link headers with rel=preload of a successful response
+are sent as an interim 103 Early Hints response first, carrying no other
+headers, followed by the response as the script sent it, Link headers
+included. On HTTP/2 connections that support server push, the preloaded
+resources of the same host (targets starting with /) are pushed as well.
+HTTP/1.0 clients don't get interim responses.
+
+    cgi /shop/* /srv/cgi/shop.cgi {
+        early_hints
+    }
+
+Chunked Request Bodies
+
+CGI scripts learn the size of the request body from CONTENT_LENGTH,
+which a chunked request doesn't announce. Such bodies are therefore read
+completely into a temporary file first, named cgi_body_<pid>_<random> in
+the system's temporary directory (TMPDIR on Unix), and the script gets
+the file as standard input along with its size. The file is removed once
+the script exited. Limit the size of request bodies with Caddy's
+request_body directive to bound the disk space this takes.
+
+Waiting for the whole body delays scripts handling large uploads.
+Scripts that read their standard input until its end instead of relying
+on CONTENT_LENGTH can get chunked bodies while they arrive with
+chunked_body stream. The body is still written to a temporary file, from
+which the script reads as far as the upload has progressed, so a slow
+script doesn't hold up the client. CONTENT_LENGTH is missing in that
+case. Once the script exited, Caddy stops reading the body after the
+read in progress.
+
+    cgi /upload* /usr/local/bin/upload.cgi {
+        chunked_body stream
+    }
+
+Removing a temporary file that fails is retried a few times with
+increasing delays, logging a warning each time and an error when giving
+up. When the cgi app starts, files left behind by Caddy processes that
+are no longer running, for example after a crash, are removed. The cgi
+app's tempWarnSize (in bytes, JSON only) logs a warning once the
+temporary files of the Caddy process together grow beyond it. tempFiles
+of /cgi/stats (see Execution Statistics) reports their number and size,
+how many were created, failed removal attempts and files given up on.
+
+How bodies are written to temporary files can be tuned with further
+settings of the cgi app (JSON only). tempBufferSize is the size in bytes
+of the buffer they are written with, 32 KiB by default; larger buffers
+mean fewer writes. tempSync flushes the files to disk: end once the body
+has been written, always after every buffer, or none, the default,
+leaving that to the operating system. On Linux, tempDirectIO writes
+spooled bodies past the page cache (O_DIRECT), which keeps large uploads
+from crowding out cached data, but requires a buffer size that is a
+multiple of 4096 and a temporary directory that supports it; streamed
+bodies are written as usual. Run go test -bench SpoolBody to compare the
+settings on your machine.
+
+    {
+        "apps": {
+            "cgi": {
+                "tempBufferSize": 1048576,
+                "tempDirectIO": true,
+                "tempSync": "end"
+            }
+        }
+    }
+
+Clients sending large bodies often ask with Expect: 100-continue whether
+the server wants the body at all. By default, the module leaves the
+answer to Caddy, which sends 100 Continue once the body is first read;
+that is when the script starts, so requests turned away before, for
+example by max_concurrent or the circuit breaker, are answered without
+the client sending the body. expect_continue immediate sends it right
+away instead, so the client uploads while the request waits for a
+process, and expect_continue never rejects such requests with status
+417, after which most clients try again without the expectation. Since
+the body is passed to the script as soon as it runs, the script itself
+can't decide about the 100 Continue.
+
+    cgi /upload /srv/cgi/upload.cgi {
+        expect_continue immediate
+    }
+
+Protocol Upgrades
+
+Some legacy services start with an HTTP request and then switch to their
+own protocol on the same connection. With upgrade, scripts take over the
+connection of such requests (those with Connection: Upgrade and an
+Upgrade header) themselves. They find a Unix datagram socket in the file
+descriptor named by CGI_UPGRADE_FD and answer with Status: 101 Switching
+Protocols, along with the headers the protocol needs, to accept the
+upgrade. Caddy then sends the response headers to the client and passes
+the connection over the socket in a single message: the connection's
+file descriptor as SCM_RIGHTS and, as data, whatever the client already
+sent beyond the request. From then on the script talks to the client
+directly; its standard output is no longer read. The script may also
+answer normally to refuse the upgrade.
+
+    cgi /legacy /usr/local/bin/legacy-gateway {
+        upgrade
+    }
+
+The connection can only be passed on as it is, so CGI_UPGRADE_FD is
+missing for requests over TLS or HTTP/2, and the script should refuse
+those. timeout and first_byte_timeout still apply, the former to the
+whole session. Upgrades are not available on Windows and not together
+with pool or persistent.
+
+WebSocket Sessions
+
+With websocket, tiny scripts can power interactive pages without a
+daemon of their own, the way websocketd runs them. Caddy completes the
+handshake of WebSocket requests itself and runs the script for the whole
+session, with the usual CGI environment: every message of the client,
+text or binary, arrives as a line on its standard input, and every line
+it writes to its standard output is sent to the client as a message, a
+text one if it is valid UTF-8 and a binary one otherwise. Caddy answers
+pings and reassembles fragmented messages; messages are limited to 1 MiB
+in either direction.
+
+    cgi /chat /srv/cgi/chat.sh {
+        websocket
+    }
+
+    #!/bin/sh
+    while read -r line; do
+        echo "you said: $line"
+    done
+
+Once the client closes the session or goes away, the script's standard
+input is closed and it gets the kill signal; once the script closes its
+standard output, the session is closed. timeout and first_byte_timeout
+do not apply to sessions. Other requests to the route run the script as
+usual. WebSocket sessions are only supported over HTTP/1.1 and not
+together with pool, persistent, upgrade, fastcgi, scgi or in-process
+programs.
+
+Persistent Processes
+
+Some applications have a heavy start-up, for example interpreters that
+load plenty of per-tenant state. Instead of starting a new process for
+every request, the persistent subdirective keeps one long-lived process
+per distinct value of the given placeholder and reuses it for subsequent
+requests with the same value:
+
+    cgi /app* /usr/local/bin/tenant-worker {
+        script_name /app
+        persistent {http.request.host}
+        idle_timeout 10m
+    }
+
+Each process is started with the environment variable CGI_PERSISTENT_KEY
+set to its key and serves one request at a time. A process that has not
+been used within idle_timeout (default 5 minutes) is stopped by closing
+its standard input; it will be started again on demand.
+
+Placeholders taken from the request, like the host above, let clients
+pick the key and with it start as many processes as they like.
+max_processes limits the number of processes running at the same time:
+to start a process for a new key, the one idle for the longest time is
+stopped, and requests get a 503 response while all of them are busy. A
+warning is logged when the key depends on the request and no limit is
+set.
+
+    cgi /app* /usr/local/bin/tenant-worker {
+        script_name /app
+        persistent {http.request.host}
+        max_processes 20
+    }
+
+Persistent processes have to speak a simple framed protocol on standard
+input and output. A message is a sequence of frames, each consisting of
+the decimal length of its payload, a newline and the payload itself. A
+frame of length zero terminates the message. A request message starts
+with a frame holding the usual CGI environment as NUL separated
+key=value pairs, followed by frames carrying the request body. The
+process answers with a message containing a regular CGI response
+(headers, blank line, body), split into as many frames as it likes.
+Unlike with regular CGI, chunked request bodies are passed on as they
+arrive; CONTENT_LENGTH is missing in that case.
+
+Persistent processes survive a reload of the Caddy config as long as the
+handler they belong to is configured the same way; otherwise they are
+stopped and started anew with the new configuration. To let processes
+kept this way pick up changes of their own configuration files,
+reload_signal names a signal (e.g. SIGHUP or USR1) that is sent to them
+on every reload. On Windows only KILL is available.
+
+To spread requests over several instances of the same script, pool
+starts the given number of processes speaking the same protocol ahead of
+time, when the config is loaded, and hands every request to an idle one.
+Requests wait while all of them are busy.
+
+    cgi /api* /usr/local/bin/api-worker.py {
+        pool 4
+    }
+
+Each instance gets its number in CGI_POOL_WORKER. An instance that exits
+or fails (for example after a timeout) is replaced by a new one. Since
+the instances are started before any request arrives, placeholders of
+requests in the executable and its arguments are empty. Pools are
+stopped with the config they belong to and can't be combined with
+persistent.
+
+Instances of a pool keep running while unused unless idle_timeout is
+given. With it, an instance that has not been used for that long is
+stopped like an idle persistent process, so scripts that are rarely
+needed don't hold on to their memory. Requests arriving while fewer
+instances than configured are running start new ones, which get new
+numbers in CGI_POOL_WORKER.
+
+    cgi /reports* /usr/local/bin/report-worker.py {
+        pool 2
+        idle_timeout 15m
+    }
+
+Scripts keeping per-client state in memory need every request of a
+client to reach the same instance. affinity binds clients to the
+instance that served their first request by means of a cookie, named
+cgi_affinity unless a name is given. The cookie is signed with a key of
+the pool, so clients can't pick an instance of their choice. Requests of
+a bound client wait for their instance while it is busy; once it exited,
+they go to any idle instance and the cookie is replaced. Cookies don't
+survive config reloads.
+
+    cgi /app* /usr/local/bin/app-worker.py {
+        pool 4
+        affinity
+    }
+
+Long-lived interpreters tend to grow slowly through leaks of their own.
+With max_requests, a persistent process or pool instance that served the
+given number of requests is replaced: further requests go to a new
+process right away, while the old one is stopped like an idle one once
+it finished the requests it had already been handed. Pool instances are
+numbered on in CGI_POOL_WORKER, so clients bound by affinity move to
+another instance.
+
+    cgi /api* /usr/local/bin/api-worker.py {
+        pool 4
+        max_requests 1000
+    }
+
+FastCGI and SCGI Applications
+
+Applications that are written as FastCGI responders (for example with
+net/http/fcgi, flup or FCGI::ProcManager) can be served without a
+separate process manager. With fastcgi, the executable is started once
+when the config is loaded and its standard input is a listening Unix
+socket, as the FastCGI specification expects from web servers that start
+applications themselves. The socket lives in a temporary directory of
+its own and is removed again with the config; directories left behind by
+a crashed Caddy are swept the next time it starts. Only Caddy can access
+the socket, whatever the umask.
+
+    cgi /app* /usr/local/bin/app.fcgi {
+        script_name /app
+        fastcgi
+        timeout 30s
+    }
+
+Every request opens a new connection to the socket and passes the usual
+CGI environment as parameters, so the application sees the same
+variables as a CGI script would. Variables of env are set in the
+environment of the process as well, with request placeholders left
+empty. Output on the FastCGI error stream goes to the standard error of
+Caddy. An application that exits is started again on demand with the
+next request, though not sooner than a second after its previous start.
+When the config is unloaded, it gets kill_signal and is killed if it is
+still running after five seconds.
+
+With timeout, the connection of a request is closed once the time passed
+and the client gets 504 if no response was sent yet; the application
+keeps running for other requests. fastcgi is not available on Windows
+and can't be combined with pool, persistent, program, upgrade or the
+circuit breaker.
+
+Several Python and Perl applications ship an SCGI server instead. With
+scgi, requests are relayed to the SCGI server at the given network
+address, such as localhost:4000 or unix//run/app.sock, with the usual
+CGI environment as headers; the executable then only names the script in
+SCRIPT_FILENAME. Without an address, the executable is started like a
+FastCGI application, with a listening Unix socket as its standard input.
+Since SCGI needs the length of a request body ahead, chunked bodies are
+spooled first, as described under Chunked Request Bodies. timeout and
+the limitations of fastcgi apply, too; only scgi with an address is
+available on Windows.
+
+    cgi /legacy* /srv/legacy/app.py {
+        script_name /legacy
+        scgi localhost:4000
+    }
+
+Python applications deployed with uWSGI speak its binary uwsgi protocol.
+With uwsgi, requests are relayed to the uWSGI worker at the given
+network address, such as localhost:3031 or unix//run/app.sock, with the
+CGI environment as its variables, and the status line of the response is
+taken as its status. Without an address, the executable is started with
+a listening Unix socket as its standard input, which uWSGI picks up on
+its own. Like with scgi, chunked bodies are spooled first, the
+environment may not exceed 64 KiB, and the same limitations apply.
+
+    cgi /app* /srv/app/wsgi.py {
+        script_name /app
+        uwsgi unix//run/uwsgi/app.sock
+    }
+
+Applications that run on their own, e.g. as a systemd service, but were
+written for CGI can be reached with daemon and the path of their Unix
+socket. On each connection, the daemon gets the CGI environment as NUL
+terminated NAME=value pairs, ended by an empty pair, and then exactly
+CONTENT_LENGTH bytes of body, after which the module shuts down its side
+of the connection, so the body can also be read to the end like standard
+input. The daemon answers with a regular CGI response and closes the
+connection. The module never starts the daemon or the executable, which
+only names the script in SCRIPT_FILENAME; the client gets 500 if the
+daemon is not running. Chunked bodies are spooled first, and timeout and
+the limitations of uwsgi apply. The daemon owns its socket; if it
+crashed and left a stale one behind that nothing listens on, this is
+logged when the config is loaded and when requests fail.
+
+    cgi /app* /srv/app/app.cgi {
+        script_name /app
+        daemon /run/app/cgi.sock
+    }
+
+Shared Process Limit
+
+The number of CGI requests executing at the same time can be limited
+across all routes by configuring the cgi app. As of Caddy 2.2, the
+Caddyfile cannot configure custom apps, so this has to be done in the
+JSON configuration (for example after adapting your Caddyfile with caddy
+adapt):
+
+    {
+        "apps": {
+            "cgi": {
+                "maxProcesses": 16
+            },
+            "http": { ... }
+        }
+    }
+
+Requests exceeding the limit wait until a slot becomes free. Free slots
+are handed out fairly between the routes that have requests waiting, so
+one busy script cannot monopolize all of them. Each route gets a share
+proportional to its weight (default 1). Routes are identified by their
+name, which defaults to the executable; routes with the same name share
+their share.
+
+    cgi /admin* /usr/local/bin/admin-tool {
+        name admin
+        weight 2
+    }
+
+A request that has to wait for a slot is rejected with 503 right away if
+its deadline is closer than the 95th percentile of the recent execution
+times of the route, since it is unlikely to finish in time anyway. The
+deadline is taken from the request context or set with deadline, counted
+from the moment the request reaches the route. Requests still waiting
+when their deadline passes get a 503 as well.
+
+To cap a single handler instead, set max_concurrent. Requests beyond it
+wait in a queue of that handler; with queue_timeout they are rejected
+with 503 once they waited that long, otherwise they wait as long as the
+client does. The per-handler limit applies before the shared one.
+
+    cgi /search* /usr/local/bin/search.cgi {
+        max_concurrent 8
+        queue_timeout 5s
+    }
+
+Requests rejected this way, by an open circuit_breaker or while the
+handler drains on shutdown, are answered with a plain 503 error, which
+can be handled with Caddy's handle_errors. Clients that expect
+structured errors can get a response of their own per route with
+shed_response, optionally with another status than 503. Its body, given
+inline or read from body_file when the config is loaded, is a template:
+placeholders like {cgi.shed.reason} (circuit_open, draining, queue_full
+or scheduler) and {cgi.shed.retry_after} (in seconds; 0 if unknown) are
+replaced. retry_after sends a Retry-After header, replacing the time the
+circuit breaker would announce.
+
+    cgi /api* /usr/local/bin/api.cgi {
+        max_concurrent 8
+        queue_timeout 5s
+        shed_response 429 {
+            retry_after 10s
+            content_type application/json
+            body "{\"error\": \"{cgi.shed.reason}\", \"retry_after\": {cgi.shed.retry_after}}"
+        }
+    }
+
+Execution Statistics
+
+The admin endpoint serves statistics of the CGI routes at /cgi/stats, so
+a small deployment can keep an eye on its scripts without a metrics
+stack. Routes are listed by their name (see name above, the executable
+by default). Latency percentiles (in seconds), exit codes, terminating
+signals and resource usage cover the last 128 executions of a route; the
+total counts all executions since the config was loaded. The resource
+usage sums up the user and system CPU time (in seconds) and page faults
+of the processes and reports the largest maximum resident set size (in
+bytes). Persistent processes don't report exit codes or resource usage
+per request.
+
+    curl localhost:2019/cgi/stats
+    {"running":1,"maxProcesses":8,"routes":{"public":{"total":1520,"window":128,
+    "latency":{"p50":0.012,"p90":0.034,"p95":0.051,"p99":0.2},
+    "exitCodes":{"0":127,"1":1},"signals":{"SIGSEGV":1},
+    "cpuUser":3.1,"cpuSystem":0.9,"maxRss":25165824,
+    "minorFaults":48211,"majorFaults":0,"queued":0,"errors":{"timeout":2}}},
+    "tempFiles":{"files":1,"bytes":1048576,"created":42,"cleanupFailures":0}}
+
+errors counts the requests the module answered with an error status
+since the config was loaded, by the classes described under Errors.
+
+Every process exit is also logged at debug level with the exit code, the
+terminating signal and the resource usage of the process.
+
+The goroutines serving a request carry the profiler labels cgi.route
+(the route name) and cgi.script (the script being run), so CPU and
+goroutine profiles of Caddy, e.g. from /debug/pprof/ of the admin
+endpoint, attribute the time spent in the module to the routes.
+
+Live Limits
+
+The process limit of the cgi app as well as the weight, deadline and
+timeout of each route can be changed at /cgi/limits of the admin
+endpoint without reloading the config, which would drop waiting requests
+and reset the statistics. So can maxConcurrent and the cache lifetime of
+routes configured with max_concurrent or cache; a changed lifetime
+applies to responses cached from then on. A GET returns the limits in
+effect; a POST changes the limits it contains and leaves the others
+alone, and rejects the whole change if any part of it is invalid.
+Durations are given like in the JSON config. Routes are addressed by
+their name; routes sharing a name share their limits as well.
+
+    curl -X POST -H "Content-Type: application/json" \
+        -d '{"maxProcesses":16,"routes":{"public":{"weight":2,"deadline":"5s"}}}' \
+        localhost:2019/cgi/limits
+
+Changes made this way are not written back to the config; the next
+reload applies the configured limits again.
+
+Baked Responses
+
+Pages that are generated by a script but only change now and then don't
+need to run the script for every visitor. With bake the script is
+executed offline right after the config is loaded and then once per
+interval, and its response is served statically, compressed with gzip
+for clients that accept it:
+
+    cgi /home* /usr/local/bin/homepage {
+        script_name /home
+        bake 1h
+        bake_signal SIGUSR2
+    }
+
+Only GET and HEAD requests for exactly the baked path (script_name by
+default, or the optional path after the interval) without a query string
+are answered from the baked response. Everything else, for example
+/home/live or /home?fresh, still executes the script, so the dynamic
+version remains available. The baking request is a plain GET for the
+path on host localhost; placeholders referring to a client request are
+empty. A baked response is only replaced by a successful (200) one;
+until the first bake succeeds, requests are handled dynamically.
+bake_signal names a signal that triggers baking right away, for example
+after content was updated (not available on Windows).
+
+Scripts that answer the same for everyone for a while, like a weather
+widget or a dashboard, can have their responses cached with cache and
+the time to keep them. Successful (200) responses to GET requests are
+then kept in memory, up to 16 MiB of bodies (or the optional size) with
+the least recently used ones evicted first, and replayed with an Age
+header to GET and HEAD requests for the same host, path and query as the
+script sees them. cache_vary adds the values of request headers to the
+key, e.g. Accept-Language for scripts that translate. The script's
+Cache-Control is honored: max-age or s-maxage replace the configured
+time, while no-store, no-cache and private keep a response out of the
+cache. So do Set-Cookie and a Vary header naming request headers that
+are not part of the key. Requests with an Authorization or Cookie
+header, or by a user another handler authenticated (the REMOTE_USER of
+the script), bypass the cache unless cache_vary names the header or
+remote_user respectively. With cache_storage, responses are kept in
+Caddy's storage as well, e.g. on disk, where they survive evictions and
+config reloads until they expire. The placeholder {cgi.cache} is hit or
+miss for requests the cache applies to.
+
+    cgi /weather* /usr/local/bin/weather.cgi {
+        cache 5m 64MiB
+        cache_vary Accept-Language
+    }
+
+Interpreters that compile scripts on first use or fill caches make the
+first request slow, and a broken script or interpreter path otherwise
+only shows up when a visitor hits it. warmup executes the script once
+while the config is loaded, with a GET request for the optional path
+(script_name by default) on host localhost:
+
+    cgi /app* /usr/local/bin/app.php {
+        script_name /app
+        warmup /app/health
+        warmup_args --warmup
+    }
+
+The warm-up execution has CGI_WARMUP=1 in its environment, and
+warmup_args, if given, replace the arguments of the cgi directive for
+it, so the script can tell it apart from regular requests. If the script
+can't be started or responds with a server error status (500 and above),
+loading the config fails.
+
+Browsers and proxies revalidate what they have with conditional
+requests, which scripts rarely answer themselves. With etag, successful
+(200) responses to GET requests are buffered up to 1 MiB (or the given
+size) and get a strong ETag of their body, unless the script sent one. A
+request whose If-None-Match matches the ETag, or without it, whose
+If-Modified-Since is not older than the Last-Modified header of the
+script, is then answered with 304 (Not Modified) and no body. The script
+still runs, but its response isn't sent again. Larger responses and
+streamed ones, which flush or are event streams, are passed on as usual.
+Responses served by cache are checked the same way without running the
+script at all, so both together make revalidation cheap.
+
+    cgi /dashboard* /usr/local/bin/dashboard.cgi {
+        etag
+        cache 1m
+    }
+
+Scripts that generate large downloads rarely support resuming them. With
+accept_ranges, successful (200) responses to GET requests are buffered
+completely, in memory up to 1 MiB (or the given size) and in a temporary
+file beyond, and then answered like a static file: with Content-Length,
+Accept-Ranges: bytes and just the byte ranges the client asked for with
+Range, as long as If-Range still matches the ETag or Last-Modified
+header of the script. Since nothing is sent before the script is done,
+flushing has no effect; event streams and responses with a Content-Range
+of their own are passed on as usual.
+
+    cgi /export* /usr/local/bin/export.cgi {
+        accept_ranges 8MiB
+        etag
+    }
+
+Many scripts never expect a HEAD request and answer it with an error or
+an empty response. head get runs the script with REQUEST_METHOD=GET for
+them instead and drops the body it sends. head cached does the same, but
+also keeps the status and headers of successful responses to GET
+requests for a minute (or the given time, unless their Cache-Control
+says otherwise) and answers HEAD requests for the same URL and host with
+them without running the script at all. Requests with Authorization and
+responses setting cookies are never answered that way.
+
+    cgi /files* /usr/local/bin/files.cgi {
+        head cached 5m
+    }
+
+Resource Limits
+
+A runaway script shouldn't be able to take down the whole host. On Linux
+and macOS the resource limits of the script processes can be restricted
+with setrlimit:
+
+    cgi /report* /usr/local/bin/report.pl {
+        limit_cpu 30s
+        limit_memory 512MiB
+        limit_nofile 256
+    }
+
+limit_cpu is the CPU time (rounded up to full seconds) after which the
+process receives SIGXCPU; it is killed one second later. limit_memory
+limits the address space of the process (RLIMIT_AS), so allocations
+beyond it fail. limit_nofile is the number of files the process may have
+open. Processes terminated by a signal while running with limits are
+logged with a warning. For persistent processes the limits cover the
+whole lifetime of the process, not a single request.
+
+Since the standard library offers no way to set limits for a child
+process only, the Caddy binary starts itself as a small shim which
+applies the limits and then executes the script. This costs a few
+milliseconds per execution.
+
+Heavy scripts can also be given a lower scheduling priority, so they
+don't starve Caddy itself or other services. nice sets the CPU priority
+from -20 (highest) to 19 (lowest) on Linux and macOS. On Linux,
+ionice_class sets the I/O scheduling class (realtime, best-effort or
+idle), optionally followed by the priority within the class from 0
+(highest) to 7 (lowest). Both are applied by the shim as well.
+
+    cgi /report* /usr/local/bin/report.pl {
+        nice 10
+        ionice_class idle
+    }
+
+Raising the priority beyond that of Caddy (a negative nice or the
+realtime class) needs privileges that scripts executed as a different
+user usually lack; they then fail to start.
+
+Files created by scripts, like uploads or caches, get their permissions
+from the umask, which is inherited from Caddy unless umask sets one in
+octal. The shim applies it on Linux and macOS, and it can also be set in
+a sandbox. Other platforms, like Windows, have no umask for the shim to
+set, so a configuration with umask is rejected there instead of being
+silently ignored.
+
+    cgi /upload* /usr/local/bin/upload.cgi {
+        umask 027
+    }
+
+Response Conformance
+
+By default the module is lenient about the responses of scripts: header
+lines without a colon or with an invalid name are skipped with a
+warning, lines may end with a bare LF and the status code is only
+checked for three leading digits. conformance changes that per route:
+
+    cgi /new/* /usr/local/bin/new.cgi {
+        conformance strict
+    }
+    cgi /legacy/* /usr/local/bin/legacy.cgi {
+        conformance compat
+    }
+
+In strict mode every deviation from RFC 3875 and RFC 7230 is answered
+with 500 instead: malformed header lines, header values with control
+characters, lines not terminated by CRLF and status codes outside of
+100-599 or not followed by a space.
+
+compat mode keeps the lenient behavior and adds what old scripts rely
+on. Responses without Content-Type (and without status or location) are
+sent as text/html instead of being rejected. Queries without an
+unencoded = are passed as command line arguments after the configured
+ones, split at + and decoded (the ISINDEX search of RFC 3875 section
+4.4). A UTF-8 byte order mark and blank lines in front of the headers
+are stripped, too.
+
+Header lines may always end in either LF or CRLF. Scripts that write
+CRLF through a stream translating line feeds, as Perl and Python do in
+text mode on Windows, end their lines in CR CR LF instead, which breaks
+the blank line separating headers and body. compat mode takes any number
+of carriage returns in front of the line feed as part of the line
+terminator, on every platform, so such scripts keep working wherever
+they are deployed.
+
+Scripts saved by Windows editors like Notepad often start with a byte
+order mark, which ends up in front of the first header and makes it
+invalid. With strip_bom (implied by compat mode), it is discarded along
+with blank lines before the headers, and a warning is logged so the
+script can be fixed.
+
+A script may also answer with nothing but a Location header holding a
+path, a local redirect in terms of RFC 3875 (section 6.2.2), to have the
+server respond with that resource instead. Caddy sends these on to the
+client as 302 Found redirects by default. With local_redirects, it
+serves the path itself, as a GET request without body that runs through
+all routes of the server again, and the client gets that response at the
+original URL. Responses with a status, another header or a body, and
+locations with a host, still redirect the client. A request can go
+through at most 10 local redirects; beyond that it is answered with 500.
+
+    cgi /login /srv/cgi/login.cgi {
+        local_redirects
+    }
+
+Headers a script sends more than once are sent to the client the same
+way, as repeated header lines. Some clients only look at the first of
+them, others fail on a comma-separated list. fold_headers names the
+headers whose values are joined into a single line with commas instead,
+or * for all headers. Set-Cookie headers are never folded, as their
+values may contain commas themselves; naming them is an error.
+
+    cgi /app/* /srv/cgi/app.cgi {
+        fold_headers Vary Cache-Control
+    }
+
+Sandboxes
+
+Instead of repeating the same restrictions for many routes, they can be
+defined once as a named sandbox in the cgi app (in the JSON
+configuration, see Shared Process Limit) and referred to by the routes:
+
+    {
+        "apps": {
+            "cgi": {
+                "sandboxes": {
+                    "untrusted": {
+                        "user": "nobody",
+                        "limitCpu": "10s",
+                        "limitMemory": 268435456,
+                        "limitNofile": 64,
+                        "namespaces": ["net", "ipc", "uts"],
+                        "inheritEnv": ["LANG", "LC_*"]
+                    }
+                }
+            },
+            "http": { ... }
+        }
+    }
+
+    cgi /guestbook* /srv/cgi/guestbook.pl {
+        sandbox untrusted
+    }
+
+A sandbox supports user, group and the resource limits (limitCpu,
+limitMemory, limitNofile) with the same meaning as the subdirectives;
+settings of the route take precedence. On Linux, namespaces executes the
+scripts in new namespaces (ipc, mount, net, pid and uts), which needs
+root privileges; a script in a new net namespace has no network access.
+inheritEnv lists patterns of the host environment variables the scripts
+may inherit; anything else is dropped, even if requested with pass_env
+or pass_all. An empty list leaves nothing but PATH. Routes referring to
+an undefined sandbox fail to load.
+
+On Unix systems chroot confines scripts to a directory, which becomes
+their root directory before they are executed. The executable and
+working directory are configured with their paths on the host and must
+be inside that directory; they are translated to the paths within it,
+also in SCRIPT_FILENAME. Everything the script needs, like its
+interpreter and libraries, has to be available within the directory as
+well. chroot can also be set in a sandbox.
+
+    cgi /legacy* /srv/jail/cgi-bin/legacy.cgi {
+        chroot /srv/jail
+        user nobody
+    }
+
+Changing the root directory needs root privileges (or CAP_SYS_CHROOT).
+Scripts that cannot be confined, or that are outside of the directory,
+are never executed unconfined; the request fails with 500 instead. Since
+the shim applying resource limits, priorities, the umask, seccomp
+filters, Landlock rules and cgroups is not available within the
+directory, chroot cannot be combined with those.
+
+Namespaces can also be set per route with namespaces, which takes
+precedence over those of the sandbox:
+
+    cgi /untrusted/* /srv/cgi/untrusted.cgi {
+        namespaces pid mount net
+    }
+
+With both pid and mount, the script is the first process of its own pid
+namespace and the shim mounts a new /proc for it, so it can't see any
+other processes of the host. Mounts are made private first and don't
+affect the host. If a user is configured as well, the shim switches to
+it after mounting.
+
+On Linux, seccomp restricts the system calls a script may make; it can
+also be set in a sandbox. The shim loads the filter right before
+executing the script, so it applies to the script and everything it
+starts. The preset default lets system calls fail with EPERM that debug
+other processes (ptrace), mount file systems, load kernel modules or BPF
+programs, create or join namespaces, or administrate the machine
+(rebooting, swap, the clock, host name, keyrings). basic-io additionally
+denies network sockets; Unix domain sockets keep working.
+
+    cgi /upload* /srv/cgi/upload.cgi {
+        seccomp basic-io
+    }
+
+Anything other than a preset name is the path of a compiled BPF filter
+program, a sequence of struct sock_filter in native byte order as
+exported by seccomp_export_bpf of libseccomp. Filters also set
+no_new_privs, so set-user-ID programs like sudo don't gain privileges
+within the script. A filter that can't be loaded fails the request; the
+script is never executed unfiltered. Presets are available on amd64,
+386, arm and arm64.
+
+On Linux 5.13 and later, Landlock confines scripts to parts of the file
+system, regardless of the permissions of the user they run as. Once
+landlock_read or landlock_write is set, a script can only access files
+beneath the listed paths: it may read and execute files beneath those of
+landlock_read and also create, modify and remove files beneath those of
+landlock_write. Both can also be set in a sandbox.
+
+    cgi /gallery* /srv/cgi/gallery.py {
+        landlock_read /srv/cgi /usr /lib /etc/ssl /srv/gallery
+        landlock_write /srv/gallery/uploads /tmp /dev/null
+    }
+
+Everything the script needs has to be listed, including the script
+itself, its interpreter, the libraries it loads and devices like
+/dev/null. The paths must exist when the config is loaded, and kernels
+without Landlock refuse to load it.
+
+Cgroups
+
+Resource limits apply to each process on its own. On Linux with cgroup
+v2, every script process can instead be placed into a transient cgroup
+of its own, which also covers the processes it starts and lets the
+kernel enforce the limits as a whole:
+
+    cgi /report* /usr/local/bin/report.pl {
+        cgroup /sys/fs/cgroup/caddy-cgi
+        cgroup_memory 256MiB
+        cgroup_cpu 50%
+    }
+
+cgroup is a cgroup directory Caddy may create child cgroups in, e.g. one
+delegated to the Caddy service by systemd (Delegate=yes). It must not
+contain processes itself, so it can't be the cgroup Caddy runs in. The
+memory and cpu controllers are enabled in it as needed. cgroup_memory
+sets memory.max; a script exceeding it is killed by the OOM killer,
+which is logged with a warning, without affecting Caddy or other
+scripts. cgroup_cpu sets cpu.max in percent of a single CPU (values
+above 100 allow several CPUs). The cgroup is removed after the script
+exited; processes the script left running are killed. Like the resource
+limits, this needs the Caddy binary to start itself as shim.
+
+Core Dumps
+
+On Linux, core_dumps enables core dumps for the script processes
+(RLIMIT_CORE) and collects them in the given directory, which is created
+if necessary:
+
+    cgi /legacy* /usr/local/bin/legacy.cgi {
+        core_dumps /var/crash/cgi
+    }
+
+Where the kernel writes a dump depends on /proc/sys/kernel/core_pattern.
+Dumps written relative to the working directory of the script (the
+default pattern core) are moved into the directory as
+core.<name>.<pid>.<time>. Dumps with an absolute pattern stay where they
+are, and dumps piped to a helper like systemd-coredump are handled by
+it. In any case the crash is logged as error with the signal, the
+process id and the location of the dump. Like the resource limits, this
+needs the Caddy binary to start itself as shim.
+
+Orphaned Processes
+
+Scripts that fork background helpers can leave processes behind that
+outlive the request. On Unix systems, kill_group starts every script
+process as the leader of a process group of its own and kills whatever
+is left in that group once the script exited. When a script is
+terminated because of a timeout or because its client went away, the
+kill signal and, after the grace period, the forcible kill go to the
+whole group, so programs the script started (for example ImageMagick
+called from a shell script) stop along with it. Helpers that start a new
+process group or session of their own escape this.
+
+    cgi /legacy* /usr/local/bin/legacy.cgi {
+        kill_group
+    }
+
+Processes left behind are reparented to init, which also collects them
+once they exit. When Caddy runs as PID 1, for example in a container, it
+takes that role and orphans that exited accumulate as zombies. On Linux,
+setting subreaper in the cgi app (see Shared Process Limit) makes Caddy
+reap them: orphans of scripts are reparented to Caddy even if it isn't
+PID 1, and every exited child Caddy didn't start for a handler is
+collected. Don't set it when other modules run processes of their own,
+as they could lose track of their exit status.
+
+    {
+        "apps": {
+            "cgi": {
+                "subreaper": true
+            }
+        }
+    }
+
+Extra File Descriptors
+
+Some scripts expect descriptors beyond standard input, output and error,
+for example a log file or a socket of a daemon they talk to. extra_files
+opens such files when the config is loaded and passes them to every
+script process as descriptor 3 and above, in the given order. The number
+of each is in CGI_FD_ followed by its name, in upper case:
+
+    cgi /legacy* /usr/local/bin/legacy.cgi {
+        extra_files log=/var/log/legacy/cgi.log ipc=unix:/run/legacyd.sock
+    }
+
+A script can then write to its log with echo message >&"$CGI_FD_LOG".
+Files are opened for appending and created if missing. Paths starting
+with unix: are Unix sockets, stream or datagram, connected to once; all
+processes share that connection, so messages of concurrent scripts end
+up interleaved. Neither is reopened until the next config reload. Extra
+files are not available on Windows.
+
+Request Transforms
+
+Dispatch logic that would otherwise need a wrapper script can be written
+in Starlark, a small dialect of Python. transform takes a snippet
+defining a function transform(req), which is compiled when the config is
+loaded and called for every request before the script is executed.
+Backquotes allow writing it across several lines in the Caddyfile:
+
+    cgi /app/* /usr/local/bin/app.cgi {
+        transform `
+    def transform(req):
+        if req.path_info.startswith("/admin") and req.remote_addr.startswith("10."):
+            return {"executable": "/usr/local/bin/admin.cgi"}
+        if req.path_info.startswith("/admin"):
+            return {"status": 403}
+        return {"env": {"APP_TENANT": req.host.split(".")[0]}}
+    `
+    }
+
+req has the fields method, host, path, query, remote_addr, script_name
+and path_info as strings, headers as dict of lower case names to values
+and params as dict of query parameters to lists of values. The function
+returns None to execute the script as configured, or a dict with any of
+the keys executable (a string replacing the executable), args (a list of
+strings replacing the arguments), env (a dict of variables added to the
+environment) and status (an HTTP status the request is rejected with
+instead of executing anything). Errors and invalid results fail the
+request with 500.
+
+Transforms can't access files, the network or anything but the request,
+and their computation per request is bounded. The executable and
+arguments of persistent and pool processes are fixed once they run, so
+only env and status have an effect for them.
+
+Consistent Deploys
+
+Copying a new version of a script and its libraries or templates into
+place takes a moment, and requests arriving meanwhile may run the new
+script with the old templates or a half-written file. With
+deploy_snapshot, the script is run from a copy instead, made along with
+the given files and directories (relative to the directory of the
+script) whenever any of them changed, and again if they change while
+being copied. Requests keep the copy, a generation, they started with; a
+generation is removed once a newer one replaced it and its last request
+finished. Scripts find themselves in the copy, as SCRIPT_FILENAME and
+argv[0], which is also their working directory unless dir is set, so
+relative paths to the copied files work as before.
+
+    cgi /shop* /srv/shop/shop.cgi {
+        deploy_snapshot lib templates
+        snapshot_dir /var/cache/caddy-cgi
+    }
+
+The copies are made in the temporary directory, or the one given with
+snapshot_dir, which must allow executing files; a /tmp mounted noexec
+doesn't. Files that are missing fail the request with 500.
+deploy_snapshot applies to scripts started per request, so it can't be
+combined with pool, persistent, program, fastcgi, scgi, uwsgi, daemon or
+chroot.
+
+Config Reloads
+
+When the config is reloaded, scripts started by the old config are left
+running by default, even after its handlers have been cleaned up. With
+drain_timeout, a handler being cleaned up refuses new requests with 503
+and waits for the scripts still running. Those not done once the timeout
+passed are terminated like timed out scripts, using kill_signal and
+kill_grace.
+
+    cgi /report* /usr/local/bin/report.cgi {
+        drain_timeout 30s
+    }
+
+The drain starts once Caddy stopped its old servers. Without a
+grace_period in the global options, Caddy waits for all requests before
+that happens, so drain_timeout only takes effect together with it,
+limiting how long scripts may keep running beyond the grace period. The
+handler waits for the drain to finish, which delays the completion of
+the reload; processes of persistent and pool handlers are stopped
+afterwards.
+
+Caddy only switches to a reloaded config once every handler in it has
+been provisioned; if one fails, the old config keeps running.
+check_executable takes advantage of that: it makes sure while
+provisioning that the executable exists and can be executed (or, for
+scripts run through an interpreter, that the interpreter can be found),
+so a typo in a path fails the reload instead of breaking the route until
+it is fixed. Executables and working directories with placeholders are
+only known per request and aren't checked. To make sure the script
+actually works before the new config takes over, add warmup, which
+executes it once while provisioning.
+
+    cgi /report* /usr/local/bin/report.cgi {
+        check_executable
+        warmup
+    }
+
+In-Process Programs
+
+Instead of starting the executable, a route can invoke a Go program
+compiled into Caddy. program names a module of the cgi.programs
+namespace, optionally followed by a block with its own configuration.
+The program implements ServeCGI(ctx, args, env, stdin, stdout) of the
+cgi.Program interface: it gets the arguments and the environment a
+script would get, reads the request body from stdin and writes a CGI
+response (headers, blank line, body) to stdout. This allows porting
+frequently used scripts to Go one at a time without changing routes.
+
+    cgi /report* /usr/local/bin/report.cgi {
+        program report {
+            database /var/lib/report.db
+        }
+    }
+
+The executable is still required; it is reported as SCRIPT_FILENAME and
+names the route in the statistics, but isn't run. The context passed to
+the program is done once the client went away or the timeout passed.
+Settings concerning processes, like limits, credentials or cgroups,
+don't apply to programs, and program can't be combined with persistent
+or pool. A program returning an error before writing a header results in
+a 500 response.
+
+Programs are registered like any other Caddy module, typically in an
+init function of their package:
+
+    func init() {
+        caddy.RegisterModule(Report{})
+    }
+
+    func (Report) CaddyModule() caddy.ModuleInfo {
+        return caddy.ModuleInfo{
+            ID:  "cgi.programs.report",
+            New: func() caddy.Module { return new(Report) },
+        }
+    }
+
+The lua program, which is part of this module, runs the executable of
+the route as Lua script, without starting a process at all. Scripts are
+compiled once and recompiled when their file changes.
+
+    cgi /hello* /srv/lua/hello.lua {
+        program lua
+    }
+
+A script sees the environment of a CGI script through os.getenv and its
+arguments in arg. print and io.write produce the response and io.read
+reads the request body:
+
+    print("Content-Type: text/plain")
+    print()
+    print("Hello from " .. os.getenv("REQUEST_URI"))
+
+Since scripts run within Caddy, functions that would affect the whole
+server, like os.exit and os.execute, are not available, and io offers
+nothing but read and write. Scripts are interrupted once the client went
+away or the timeout passed.
+
+Migrating from Apache
+
+Existing Apache setups can be converted with the cgi-import-apache
+command, which is part of every Caddy built with this module. It reads
+the given httpd.conf, included or .htaccess files and prints a Caddyfile
+with the equivalent cgi blocks:
+
+    caddy cgi-import-apache /etc/httpd/conf/httpd.conf /var/www/html/app/.htaccess > Caddyfile
+
+ScriptAlias becomes a cgi block for the script or for every script of
+its directory, and AddHandler cgi-script together with Options ExecCGI
+in a <Directory> section (or an .htaccess file) becomes a cgi block for
+the files with the given extensions below the document root or an Alias
+of that directory. Subdirectories with Options -ExecCGI answer requests
+for such files with status 403. SetEnv and PassEnv become env and
+pass_env. The main server and every <VirtualHost> get a site block of
+their own, named after ServerName and ServerAlias. --document-root gives
+the document root of the main server if the files don't set it, which is
+common for .htaccess files.
+
+Directives that can't be converted, like ScriptAliasMatch or <Directory>
+sections with regular expressions, are listed as comments at the start
+of the site block. The output only covers CGI: static files, rewrites
+and access control have to be configured separately. The extra path
+after the script name ends up in PATH_INFO along with the script, as
+usual for this module (see script_name), rather than on its own as with
+Apache.
+
+Migrating from nginx
+
+Locations that nginx passes to fcgiwrap are converted the same way with
+the cgi-import-nginx command:
+
+    caddy cgi-import-nginx /etc/nginx/nginx.conf /etc/nginx/sites-enabled/* > Caddyfile
+
+Every server block becomes a site block named after server_name and the
+port of listen; locations of files without server blocks, like snippets,
+end up in a site block of their own. A location counts as served by
+fcgiwrap if the address of its fastcgi_pass contains --fastcgi-pass,
+"fcgiwrap" by default; an empty value converts all locations with
+fastcgi_pass. Each location becomes a matcher and a handle block with
+the cgi directive, ordered the way nginx selects locations, so only one
+of them serves a request. SCRIPT_FILENAME gives the executable, and the
+other fastcgi_param directives, including those of the fastcgi_params
+and fastcgi.conf includes, become env variables, unless the cgi
+directive sets them anyway. nginx variables are replaced by the
+corresponding placeholders, and with fastcgi_split_path_info the script
+name and path info come from the captures of its expression:
+
+    location ^~ /git/ {
+        fastcgi_split_path_info ^(/git/[^/]+)(/.*)$;
+        fastcgi_param SCRIPT_FILENAME /usr/lib/git-core/git-http-backend;
+        fastcgi_param PATH_INFO $fastcgi_path_info;
+        fastcgi_pass unix:/run/fcgiwrap.socket;
+    }
+
+turns into
+
+    @cgi1 {
+        path_regexp ^/git/
+        vars_regexp cgi1 {http.request.uri.path} ^(/git/[^/]+)(/.*)$
+    }
+    handle @cgi1 {
+        cgi * /usr/lib/git-core/git-http-backend {
+            env PATH_INFO={http.regexp.cgi1.2}
+        }
+    }
+
+Other includes, fastcgi_pass within if blocks, locations passing to
+other FastCGI servers and variables without a placeholder are listed as
+comments.
+
 Troubleshooting
 
 If you run into unexpected results with the CGI plugin, you are able to
 examine the environment in which your CGI application runs. To enter
 inspection mode, add the subdirective inspect to your CGI configuration
-block. This is a development option that should not be used in
-production. When in inspection mode, the plugin will respond to matching
-requests with a page that displays variables of interest. In particular,
-it will show the replacement value of {match} and the environment
-variables to which your CGI application has access.
+block. Unless limited to a request header as described below, this is a
+development option that should not be used in production. When in
+inspection mode, the plugin will respond to matching requests with a
+page that displays variables of interest. In particular, it will show
+the replacement value of {match} and the environment variables to which
+your CGI application has access.
 
 For example, consider this example CGI block:
 
@@ -245,9 +1880,76 @@ CGI application (in this case, wapptclsh) will not be called.
 This information can be used to diagnose problems with how a CGI
 application is called.
 
+To inspect a route in production without taking it out of operation,
+name a request header after inspect, optionally followed by a token the
+header must carry. Only requests with that header get the inspection
+page; all others execute the script as usual. Keep the token secret,
+since the page reveals the environment of the script.
+
+    cgi /wapp/*.tcl /usr/local/bin/wapptclsh /home/quixote/projects{path} {
+        inspect X-CGI-Inspect {$CGI_INSPECT_TOKEN}
+    }
+
+    curl -H "X-CGI-Inspect: $CGI_INSPECT_TOKEN" https://example.com/wapp/hello.tcl
+
 To return to operation mode, remove or comment out the inspect
 subdirective.
 
+Large environments (huge cookies, many forwarded headers) slow down
+process start-up and can hit operating system limits. With Caddy's log
+level set to DEBUG, every execution logs the number of environment
+variables, their total size in bytes and the five largest of them with
+their sizes.
+
+Upgrades of Caddy, changes of the configuration or of the environment
+Caddy is started with can silently change what scripts get. env_baseline
+names a file listing the environment variables of the route, one per
+line, which is recorded from the first request if it doesn't exist yet.
+Later requests whose environment lacks variables of the baseline or has
+additional ones log a warning naming them, once per distinct difference.
+Values don't matter, and variables that only some requests have, like
+those of request headers, CONTENT_LENGTH, CONTENT_TYPE, HTTPS and
+REMOTE_PORT, are left out. To accept a change, delete the file (and let
+the next request record it anew) or edit it.
+
+    cgi /report* /usr/local/bin/report.cgi {
+        pass_env LANG TZ
+        env_baseline /var/lib/caddy/report.baseline
+    }
+
+Problems that show up only now and then are hard to reproduce with
+inspect. With env_mirror, the full environment and command line of every
+request are written as a JSON file into the given directory, which is
+created if needed. Each request gets a random ID, which the module adds
+as request_id to all it logs about the request and which the name of the
+file ends with, so a logged failure leads to the file of its request.
+The placeholder {cgi.request_id} holds it as well, e.g. for a response
+header. Only the most recent files are kept, 100 unless another number
+is given. The files are readable by the user running Caddy only, but
+they contain whatever secrets the environment contains, so this is meant
+for debugging.
+
+    cgi /report* /usr/local/bin/report.cgi {
+        env_mirror /var/lib/caddy/mirror 20
+    }
+
+Whatever a script writes to its standard error goes to the standard
+error of Caddy, next to its log but without any context. With
+log_stderr, it is logged instead, along with the path and process id of
+the script, once the script exited: as an error if the script exited
+unsuccessfully or its response was rejected, otherwise as a warning. The
+request isn't affected either way. Scripts that chat on standard error
+while answering successfully, for example by running curl -v, can be
+kept out of the log by giving a size: successful scripts writing less
+than that are only logged at debug level. At most 16 KiB of the output
+end up in the log entry, while its bytes field has the full size.
+log_stderr applies to scripts started for every request, so it can't be
+combined with pool, persistent, program or fastcgi.
+
+    cgi /fetch* /usr/local/bin/fetch.sh {
+        log_stderr 4KiB
+    }
+
 Environment Variable Example
 
 In this example, the Caddyfile looks like this:
@@ -308,6 +2010,21 @@ content. Secondly, the SCRIPT_EXEC variable is not a CGI standard. It is
 provided by this middleware and contains the entire command line,
 including all arguments, with which the CGI script was executed.
 
+Scripts that run on deployments with different versions or
+configurations of this middleware can find out what to rely on from
+CGI_MODULE_FEATURES, a sorted, comma separated list of the capabilities
+of the route. chunked-body means chunked request bodies arrive with
+CONTENT_LENGTH like others, chunked-stream that they arrive while they
+are uploaded and without CONTENT_LENGTH (with chunked_body stream and
+for persistent processes), event-stream that event streams are flushed
+on every write, streaming that all responses are (see streaming),
+flush-interval that responses are flushed in the interval of
+flush_interval instead, in which case neither of the former two is
+listed, upgrade that upgrade requests can take over the connection (see
+Protocol Upgrades) and websocket that WebSocket sessions are bridged to
+the script (see WebSocket Sessions). Features only ever get added, so
+check for the ones you need rather than comparing the whole list.
+
 When a browser requests
 
     http://192.168.1.2:8080/show/weekly?mode=summary
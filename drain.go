@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// drainer keeps track of the requests of a handler, so they can be given time
+// to finish when the handler is cleaned up on a config reload.
+type drainer struct {
+	mu       sync.Mutex
+	closed   bool
+	count    int // requests in flight
+	inflight sync.WaitGroup
+	stop     chan struct{} // closed once the drain period is over
+}
+
+func newDrainer() *drainer {
+	return &drainer{stop: make(chan struct{})}
+}
+
+// enter registers a request. The returned context is canceled when the
+// request outlives the drain period, which terminates its script; done must
+// be called once the request finished. ok is false if the handler is already
+// draining and must not start anything new.
+func (dr *drainer) enter(ctx context.Context) (drainCtx context.Context, done func(), ok bool) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	if dr.closed {
+		return nil, nil, false
+	}
+	dr.count++
+	dr.inflight.Add(1)
+	drainCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-dr.stop:
+			cancel()
+		case <-drainCtx.Done():
+		}
+	}()
+	return drainCtx, func() {
+		cancel()
+		dr.mu.Lock()
+		dr.count--
+		dr.mu.Unlock()
+		dr.inflight.Done()
+	}, true
+}
+
+// drain refuses new requests and waits up to timeout for the ones in flight.
+// Those still running afterwards are terminated; drain then waits up to grace
+// for them to finish. It reports the number of requests that were terminated
+// and whether all requests finished in the end.
+func (dr *drainer) drain(timeout, grace time.Duration) (terminated int, finished bool) {
+	dr.mu.Lock()
+	dr.closed = true
+	dr.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		dr.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0, true
+	case <-time.After(timeout):
+	}
+	dr.mu.Lock()
+	terminated = dr.count
+	dr.mu.Unlock()
+	close(dr.stop)
+	select {
+	case <-done:
+		return terminated, true
+	case <-time.After(grace):
+		return terminated, false
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isInformational reports whether status is an interim response that is
+// followed by the final one. 101 Switching Protocols is final.
+func isInformational(status int) bool {
+	return status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+}
+
+// preloadLinks returns the links of the Link headers in headers that ask to
+// preload a resource (rel=preload).
+func preloadLinks(headers http.Header) []string {
+	var links []string
+	for _, value := range headers["Link"] {
+		for _, link := range splitLinks(value) {
+			if linkRelPreload(link) {
+				links = append(links, link)
+			}
+		}
+	}
+	return links
+}
+
+// splitLinks splits a Link header value into its links, leaving commas
+// within targets and quoted parameters alone.
+func splitLinks(value string) []string {
+	var links []string
+	var inTarget, inQuotes bool
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case inQuotes:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inQuotes = false
+			}
+		case c == '<':
+			inTarget = true
+		case c == '>':
+			inTarget = false
+		case c == '"' && !inTarget:
+			inQuotes = true
+		case c == ',' && !inTarget:
+			if link := strings.TrimSpace(value[start:i]); link != "" {
+				links = append(links, link)
+			}
+			start = i + 1
+		}
+	}
+	if link := strings.TrimSpace(value[start:]); link != "" {
+		links = append(links, link)
+	}
+	return links
+}
+
+// linkRelPreload reports whether the rel parameter of link contains
+// preload.
+func linkRelPreload(link string) bool {
+	params := strings.Split(link[strings.LastIndexByte(link, '>')+1:], ";")
+	for _, param := range params {
+		name, value := param, ""
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			name, value = param[:i], param[i+1:]
+		}
+		if !strings.EqualFold(strings.TrimSpace(name), "rel") {
+			continue
+		}
+		for _, rel := range strings.Fields(strings.Trim(strings.TrimSpace(value), `"`)) {
+			if strings.EqualFold(rel, "preload") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// linkTarget returns the target of link.
+func linkTarget(link string) string {
+	start, end := strings.IndexByte(link, '<'), strings.IndexByte(link, '>')
+	if start < 0 || end < start {
+		return ""
+	}
+	return link[start+1 : end]
+}
+
+// sendEarlyHints sends the preload links as 103 Early Hints, with no other
+// headers, and pushes the targets on the same host if the connection
+// supports server push.
+func sendEarlyHints(rw http.ResponseWriter, links []string) {
+	header := rw.Header()
+	saved := header.Clone()
+	for k := range header {
+		delete(header, k)
+	}
+	header["Link"] = links
+	rw.WriteHeader(http.StatusEarlyHints)
+	delete(header, "Link")
+	for k, v := range saved {
+		header[k] = v
+	}
+
+	pusher, ok := rw.(http.Pusher)
+	if !ok {
+		return
+	}
+	for _, link := range links {
+		target := linkTarget(link)
+		if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+			continue
+		}
+		if err := pusher.Push(target, nil); err == http.ErrNotSupported {
+			return
+		}
+	}
+}
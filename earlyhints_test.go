@@ -0,0 +1,79 @@
+package cgi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestPreloadLinks(t *testing.T) {
+	headers := http.Header{"Link": {
+		`</style.css>; rel=preload; as=style, </a,b.js>; rel="preload"; as=script`,
+		`</next>; rel=next; title="preload, maybe", <https://cdn.example.com/font.woff2>; rel="preload prefetch"; as=font`,
+	}}
+	expected := []string{
+		`</style.css>; rel=preload; as=style`,
+		`</a,b.js>; rel="preload"; as=script`,
+		`<https://cdn.example.com/font.woff2>; rel="preload prefetch"; as=font`,
+	}
+	if links := preloadLinks(headers); !reflect.DeepEqual(links, expected) {
+		t.Errorf("Unexpected preload links %q. Expected %q.", links, expected)
+	}
+	if target := linkTarget(expected[1]); target != "/a,b.js" {
+		t.Errorf("Unexpected target %q. Expected %q.", target, "/a,b.js")
+	}
+}
+
+func TestCGI_ServeHTTPEarlyHints(t *testing.T) {
+	c := CGI{
+		Executable: "/bin/sh",
+		Args:       []string{"-c", `printf "Content-type: text/html\nLink: </style.css>; rel=preload; as=style\nLink: </next>; rel=next\nSet-Cookie: id=1\n\nhello"`},
+		EarlyHints: true,
+		logger:     zap.NewNop(),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(w, r, NoOpNextHandler{}); err != nil {
+			t.Errorf("Cannot serve http: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	var hints []textproto.MIMEHeader
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = append(hints, header)
+			}
+			return nil
+		},
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "hello" || len(res.Header["Link"]) != 2 {
+		t.Errorf("Unexpected response %d %q with links %q.", res.StatusCode, body, res.Header["Link"])
+	}
+	if len(hints) != 1 {
+		t.Fatalf("Unexpected number of early hints %d. Expected %d.", len(hints), 1)
+	}
+	if links := hints[0]["Link"]; !reflect.DeepEqual(links, []string{"</style.css>; rel=preload; as=style"}) {
+		t.Errorf("Unexpected early hint links %q.", links)
+	}
+	if cookie := hints[0].Get("Set-Cookie"); cookie != "" {
+		t.Errorf("Unexpected Set-Cookie %q in early hints.", cookie)
+	}
+}
@@ -0,0 +1,181 @@
+package cgi
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of TestCGI_Environment")
+
+// hostEnv are variables whose values depend on the machine running the tests
+// or that are set by the shell of the script.
+var hostEnv = append([]string{"PATH", "PWD", "OLDPWD", "SHLVL", "_"}, osDefaultInheritEnv...)
+
+// TestCGI_Environment compares the environment scripts get for a variety of
+// requests with test/golden/<name>.env, so changes show up as diffs of those.
+// Run the test with -update to rewrite the files after intended changes.
+func TestCGI_Environment(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cgi     CGI
+		request func() *http.Request
+		repl    map[string]interface{}
+	}{
+		{
+			name: "get",
+			request: func() *http.Request {
+				return httptest.NewRequest("GET", "/env.cgi/some/path?x=y&z", nil)
+			},
+		},
+		{
+			name: "tls",
+			request: func() *http.Request {
+				req := httptest.NewRequest("GET", "https://example.com/env.cgi", nil)
+				req.TLS = &tls.ConnectionState{}
+				return req
+			},
+		},
+		{
+			name: "ipv6",
+			request: func() *http.Request {
+				req := httptest.NewRequest("GET", "http://[2001:db8::1]:8080/env.cgi", nil)
+				req.RemoteAddr = "[2001:db8::2]:4711"
+				return req
+			},
+		},
+		{
+			name: "proxied",
+			request: func() *http.Request {
+				req := httptest.NewRequest("GET", "/env.cgi", nil)
+				req.RemoteAddr = "10.0.0.1:4711"
+				req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.2")
+				req.Header.Set("X-Forwarded-Proto", "https")
+				req.Header.Set("Forwarded", "for=203.0.113.7;proto=https")
+				// Never passed on, see https://httpoxy.org
+				req.Header.Set("Proxy", "http://attacker.example.com")
+				return req
+			},
+		},
+		{
+			name: "auth",
+			cgi:  CGI{RemoteUserMeta: []string{"email"}},
+			request: func() *http.Request {
+				req := httptest.NewRequest("GET", "/env.cgi", nil)
+				req.SetBasicAuth("jane", "secret")
+				return req
+			},
+			repl: map[string]interface{}{"http.auth.user.id": "jane", "http.auth.user.email": "jane@example.com"},
+		},
+		{
+			name: "cookies",
+			cgi:  CGI{CookieDeny: []string{"secret*"}},
+			request: func() *http.Request {
+				req := httptest.NewRequest("GET", "/env.cgi", nil)
+				req.Header.Add("Cookie", "session=abc; secret_token=xyz")
+				req.Header.Add("Cookie", "theme=dark")
+				return req
+			},
+		},
+		{
+			name: "post",
+			request: func() *http.Request {
+				req := httptest.NewRequest("POST", "/env.cgi", strings.NewReader("a=1&b=2"))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				return req
+			},
+		},
+		{
+			name: "chunked",
+			request: func() *http.Request {
+				req := httptest.NewRequest("PUT", "/env.cgi/upload", ioutil.NopCloser(strings.NewReader("chunked body")))
+				req.ContentLength = -1
+				req.TransferEncoding = []string{"chunked"}
+				req.Header.Set("Content-Type", "text/plain")
+				return req
+			},
+		},
+		{
+			name: "identity",
+			cgi:  CGI{ServerSoftware: "Apache/2.4.41 (Unix)", GatewayInterface: "CGI/1.0"},
+			request: func() *http.Request {
+				return httptest.NewRequest("GET", "/env.cgi", nil)
+			},
+		},
+		{
+			name: "unix",
+			request: func() *http.Request {
+				req := httptest.NewRequest("GET", "/env.cgi", nil)
+				req.RemoteAddr = "@"
+				return req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/caddy.sock", Net: "unix"}))
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := tc.cgi
+			c.Executable = "test/fullenv"
+			c.ScriptName = "/env.cgi"
+			c.Envs = append(c.Envs, "CGI_GLOBAL=whatever")
+			c.logger = zap.NewNop()
+
+			res := httptest.NewRecorder()
+			req := tc.request()
+			repl := caddy.NewReplacer()
+			for key, val := range tc.repl {
+				repl.Set(key, val)
+			}
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+			if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+				t.Fatalf("Cannot serve http: %v", err)
+			}
+			if res.Code != http.StatusOK {
+				t.Fatalf("Unexpected statusCode %d. Expected %d.", res.Code, http.StatusOK)
+			}
+
+			var lines []string
+			for _, line := range strings.Split(strings.TrimSpace(res.Body.String()), "\n") {
+				if !hostVariable(line) {
+					lines = append(lines, line)
+				}
+			}
+			sort.Strings(lines)
+			got := strings.Join(lines, "\n") + "\n"
+
+			golden := filepath.Join("test", "golden", tc.name+".env")
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("Unexpected environment\n========== Got ==========\n%s========== Wanted (%s) ==========\n%s", got, golden, want)
+			}
+		})
+	}
+}
+
+// hostVariable reports whether the variable definition line is one of
+// hostEnv.
+func hostVariable(line string) bool {
+	for _, name := range hostEnv {
+		if strings.HasPrefix(line, name+"=") {
+			return true
+		}
+	}
+	return false
+}
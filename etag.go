@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// defaultETagLimit is the size up to which responses are buffered to compute
+// their ETag if not configured.
+const defaultETagLimit = 1 << 20
+
+// etagWriter holds back successful responses to GET requests up to a size to
+// give them a strong ETag of their body, unless they have one already, and
+// answers the request with 304 (Not Modified) instead if its preconditions
+// say so. Larger responses, streamed ones and all others pass through.
+type etagWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	req     *http.Request
+	max     int64
+	status  int  // held back status
+	passing bool // true once the response passes through
+	body    bytes.Buffer
+}
+
+func newETagWriter(w http.ResponseWriter, req *http.Request, max int64) *etagWriter {
+	if max <= 0 {
+		max = defaultETagLimit
+	}
+	return &etagWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		req:                   req,
+		max:                   max,
+		passing:               req.Method != http.MethodGet,
+	}
+}
+
+func (ew *etagWriter) WriteHeader(status int) {
+	if ew.passing || isInformational(status) {
+		ew.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if ew.status != 0 {
+		return
+	}
+	if status != http.StatusOK || strings.HasPrefix(ew.Header().Get("Content-Type"), "text/event-stream") {
+		ew.passing = true
+		ew.ResponseWriter.WriteHeader(status)
+		return
+	}
+	ew.status = status
+}
+
+func (ew *etagWriter) Write(p []byte) (int, error) {
+	if ew.status == 0 && !ew.passing {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.passing {
+		return ew.ResponseWriter.Write(p)
+	}
+	if int64(ew.body.Len()+len(p)) > ew.max {
+		if err := ew.release(); err != nil {
+			return 0, err
+		}
+		return ew.ResponseWriter.Write(p)
+	}
+	return ew.body.Write(p)
+}
+
+// Flush passes the response through from now on; flushing means that it is
+// streamed.
+func (ew *etagWriter) Flush() {
+	if !ew.passing && ew.status != 0 {
+		ew.release()
+	}
+	ew.ResponseWriterWrapper.Flush()
+}
+
+// release sends what was held back and passes the rest through.
+func (ew *etagWriter) release() error {
+	ew.passing = true
+	ew.ResponseWriter.WriteHeader(ew.status)
+	_, err := ew.ResponseWriter.Write(ew.body.Bytes())
+	ew.body.Reset()
+	return err
+}
+
+// finish sends a held back response, with its ETag, or 304 if the request
+// already has it.
+func (ew *etagWriter) finish() {
+	if ew.passing || ew.status == 0 {
+		return
+	}
+	ew.passing = true
+	header := ew.Header()
+	if header.Get("ETag") == "" {
+		sum := sha256.Sum256(ew.body.Bytes())
+		header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	}
+	if notModified(ew.req, header) {
+		writeNotModified(ew.ResponseWriter)
+		return
+	}
+	ew.ResponseWriter.WriteHeader(ew.status)
+	ew.ResponseWriter.Write(ew.body.Bytes())
+}
+
+// notModified reports whether the GET or HEAD request r is to be answered
+// with 304 for a response with header, because it has the ETag the request
+// matches with If-None-Match or, without that, wasn't modified since the time
+// in If-Modified-Since.
+func notModified(r *http.Request, header http.Header) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(ims)
+}
+
+// writeNotModified answers with 304, without the headers describing the
+// body that isn't sent, like http.ServeContent.
+func writeNotModified(w http.ResponseWriter) {
+	header := w.Header()
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	if header.Get("ETag") != "" {
+		header.Del("Last-Modified")
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,98 @@
+package cgi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCGI_ServeHTTPETag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-cgi-etag")
+	if err != nil {
+		t.Fatalf("Cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// The script counts its executions and sends the header in X-Hdr and a
+	// body as long as the query.
+	c := CGI{
+		Executable: "/bin/sh",
+		Args: []string{"-c", `echo run >> "$COUNTER"
+printf 'Content-Type: text/plain\r\n'; [ -n "$HTTP_X_HDR" ] && printf '%s\r\n' "$HTTP_X_HDR"
+printf '\r\n%s' "$QUERY_STRING"`},
+		Envs:      []string{"COUNTER=" + filepath.Join(dir, "counter")},
+		ETag:      true,
+		ETagLimit: 16,
+		logger:    zap.NewNop(),
+	}
+	serve := func(method, target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		res := httptest.NewRecorder()
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		return res
+	}
+
+	res := serve(http.MethodGet, "/page?hello", nil)
+	etag := res.Header().Get("ETag")
+	if res.Code != http.StatusOK || res.Body.String() != "hello" || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("Unexpected response %d %q with ETag %s.", res.Code, res.Body.String(), etag)
+	}
+	if again := serve(http.MethodGet, "/page?hello", nil); again.Header().Get("ETag") != etag {
+		t.Errorf("Unexpected ETag %s of the same body. Expected %s.", again.Header().Get("ETag"), etag)
+	}
+	if other := serve(http.MethodGet, "/page?world", nil); other.Header().Get("ETag") == etag {
+		t.Errorf("Unexpected ETag %s of a different body.", etag)
+	}
+
+	lastModified := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	for i, step := range []struct {
+		method, target string
+		header         http.Header
+		status         int
+		etag           string
+	}{
+		{http.MethodGet, "/page?hello", http.Header{"If-None-Match": {`"other", ` + etag}}, http.StatusNotModified, etag},
+		{http.MethodGet, "/page?hello", http.Header{"If-None-Match": {`"other"`}}, http.StatusOK, etag},
+		{http.MethodGet, "/page?hello", http.Header{"X-Hdr": {`ETag: "v1"`}, "If-None-Match": {`W/"v1"`}}, http.StatusNotModified, `"v1"`},
+		{http.MethodGet, "/page?hello", http.Header{"X-Hdr": {"Last-Modified: " + lastModified}, "If-Modified-Since": {lastModified}}, http.StatusNotModified, etag},
+		{http.MethodGet, "/page?hello", http.Header{"X-Hdr": {"Last-Modified: " + lastModified}, "If-Modified-Since": {"Fri, 01 May 2020 11:00:00 GMT"}}, http.StatusOK, etag},
+		{http.MethodGet, "/page?hello", http.Header{"X-Hdr": {"Status: 404 Not Found"}, "If-None-Match": {"*"}}, http.StatusNotFound, ""},
+		{http.MethodGet, "/page?longer-than-the-limit", http.Header{"If-None-Match": {"*"}}, http.StatusOK, ""},
+		{http.MethodPost, "/page?hello", http.Header{"If-None-Match": {"*"}}, http.StatusOK, ""},
+	} {
+		res := serve(step.method, step.target, step.header)
+		if res.Code != step.status || res.Header().Get("ETag") != step.etag {
+			t.Errorf("Step %d: unexpected response %d with ETag %s. Expected %d with ETag %s.",
+				i, res.Code, res.Header().Get("ETag"), step.status, step.etag)
+		}
+		if res.Code == http.StatusNotModified && (res.Body.Len() > 0 || res.Header().Get("Content-Type") != "") {
+			t.Errorf("Step %d: unexpected 304 with body %q and Content-Type %s.", i, res.Body.String(), res.Header().Get("Content-Type"))
+		}
+	}
+
+	// With the cache, conditional requests don't execute the script.
+	c.cache = newResponseCache(time.Minute, 0, nil, nil, "test", zap.NewNop())
+	serve(http.MethodGet, "/cached?hello", nil)
+	before, _ := ioutil.ReadFile(filepath.Join(dir, "counter"))
+	res = serve(http.MethodGet, "/cached?hello", http.Header{"If-None-Match": {etag}})
+	if res.Code != http.StatusNotModified {
+		t.Errorf("Unexpected status %d. Expected %d.", res.Code, http.StatusNotModified)
+	}
+	if after, _ := ioutil.ReadFile(filepath.Join(dir, "counter")); len(after) != len(before) {
+		t.Error("Expected the cached response to be used.")
+	}
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Modes of answering requests with Expect: 100-continue.
+const (
+	// expectContinueRead leaves the 100 Continue to the server, which sends
+	// it once the body is first read.
+	expectContinueRead = "read"
+	// expectContinueImmediate sends the 100 Continue right away, before the
+	// request waits for a process.
+	expectContinueImmediate = "immediate"
+	// expectContinueNever rejects the expectation with 417.
+	expectContinueNever = "never"
+)
+
+// expectsContinue reports whether the client of r waits for a 100 Continue
+// before it sends the body (RFC 7231 section 5.1.1).
+func expectsContinue(r *http.Request) bool {
+	return r.ProtoAtLeast(1, 1) && r.ContentLength != 0 && strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
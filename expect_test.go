@@ -0,0 +1,90 @@
+package cgi
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestCGI_ServeHTTPExpectContinue(t *testing.T) {
+	for _, test := range []struct {
+		mode string
+		// queued is whether the client gets the 100 Continue while the
+		// request still waits for a process.
+		queued bool
+		status int
+	}{
+		{"", false, http.StatusOK},
+		{expectContinueRead, false, http.StatusOK},
+		{expectContinueImmediate, true, http.StatusOK},
+		{expectContinueNever, false, http.StatusExpectationFailed},
+	} {
+		c := CGI{
+			Executable:     "/bin/sh",
+			Args:           []string{"-c", `body=$(cat); printf "Content-Type: text/plain\n\n%s" "$body"`},
+			ExpectContinue: test.mode,
+			concurrent:     newScheduler(1),
+			logger:         zap.NewNop(),
+		}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			if err := c.ServeHTTP(w, r, NoOpNextHandler{}); err != nil {
+				w.WriteHeader(err.(caddyhttp.HandlerError).StatusCode)
+			}
+		}))
+		func() {
+			defer srv.Close()
+			// The only process slot is taken for now.
+			release, err := c.concurrent.acquire(context.Background(), "", 1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			io.WriteString(conn, "POST / HTTP/1.1\r\nHost: example.com\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+			r := bufio.NewReader(conn)
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			res, err := http.ReadResponse(r, nil)
+			if err != nil {
+				res = nil
+			}
+			if continued := res != nil && res.StatusCode == http.StatusContinue; continued != test.queued {
+				t.Errorf("%q: Unexpected 100 Continue while queued: %v. Expected %v.", test.mode, continued, test.queued)
+			}
+			release()
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if res == nil {
+				if res, err = http.ReadResponse(r, nil); err != nil {
+					t.Fatalf("%q: Cannot read response: %v", test.mode, err)
+				}
+			}
+			if res.StatusCode == http.StatusContinue {
+				io.WriteString(conn, "hello")
+				if res, err = http.ReadResponse(r, nil); err != nil {
+					t.Fatalf("%q: Cannot read response: %v", test.mode, err)
+				}
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			if res.StatusCode != test.status {
+				t.Errorf("%q: Unexpected status %d. Expected %d.", test.mode, res.StatusCode, test.status)
+			}
+			if test.status == http.StatusOK && string(body) != "hello" {
+				t.Errorf("%q: Unexpected body %q. Expected %q.", test.mode, body, "hello")
+			}
+		}()
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// extraFile is an open file passed to every process of a handler.
+type extraFile struct {
+	name string // variable holding its descriptor number
+	file *os.File
+}
+
+// openExtraFiles opens the files of specs, each given as name=path. Paths
+// starting with unix: are connected to as sockets, all others are opened for
+// appending and created if necessary.
+func openExtraFiles(specs []string) ([]extraFile, error) {
+	var files []extraFile
+	for _, spec := range specs {
+		eq := strings.IndexByte(spec, '=')
+		if eq <= 0 || eq == len(spec)-1 {
+			closeExtraFiles(files)
+			return nil, fmt.Errorf("invalid extra file %q, expected name=path", spec)
+		}
+		name, path := spec[:eq], spec[eq+1:]
+		var f *os.File
+		var err error
+		if strings.HasPrefix(path, "unix:") {
+			f, err = dialUnixFile(path[len("unix:"):])
+		} else {
+			f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		}
+		if err != nil {
+			closeExtraFiles(files)
+			return nil, fmt.Errorf("opening extra file %s: %v", name, err)
+		}
+		files = append(files, extraFile{name: "CGI_FD_" + envName(name), file: f})
+	}
+	return files, nil
+}
+
+// dialUnixFile connects to the stream or datagram socket at path and
+// returns the connection as file.
+func dialUnixFile(path string) (*os.File, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		var dgramErr error
+		if conn, dgramErr = net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"}); dgramErr != nil {
+			return nil, err
+		}
+	}
+	defer conn.Close()
+	return conn.File()
+}
+
+// closeExtraFiles closes all of files.
+func closeExtraFiles(files []extraFile) {
+	for _, f := range files {
+		f.file.Close()
+	}
+}
+
+// addExtraFiles passes h.ExtraFiles to cmd after the files it already has
+// and returns env with the variables holding their descriptor numbers.
+func (h *handler) addExtraFiles(cmd *exec.Cmd, env []string) []string {
+	for _, f := range h.ExtraFiles {
+		env = append(env, f.name+"="+strconv.Itoa(3+len(cmd.ExtraFiles)))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f.file)
+	}
+	return env
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Classes of failures the module answers with an error status itself.
+const (
+	failSpawn      = "spawn_error"      // the process could not be started or reached
+	failTimeout    = "timeout"          // the process exceeded a timeout
+	failBadHeaders = "bad_headers"      // the response of the process was invalid
+	failBodyLimit  = "body_limit"       // the request body exceeded a limit or could not be spooled
+	failSignal     = "killed_by_signal" // the process was killed by a signal not sent by the module
+)
+
+// errorClassHeader carries the failure class of a response in debug mode.
+const errorClassHeader = "X-CGI-Error-Class"
+
+// failure records the class of the failure of a request. The methods may be
+// called on nil, for handlers that don't classify failures.
+type failure struct {
+	class string
+}
+
+// set records class unless there already is one.
+func (f *failure) set(class string) {
+	if f != nil && f.class == "" {
+		f.class = class
+	}
+}
+
+// cause records class, replacing a class that was a mere consequence of it,
+// like the invalid response of a process that timed out.
+func (f *failure) cause(class string) {
+	if f != nil && (f.class == "" || f.class == failBadHeaders) {
+		f.class = class
+	}
+}
+
+// failureResponseWriter holds back error statuses without a body until the
+// request is done, so the failure class can be determined once the process
+// exited.
+type failureResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	failure *failure
+	header  bool // true to send errorClassHeader
+	status  int  // held back status
+	sent    int  // status sent to the client
+}
+
+func (fw *failureResponseWriter) WriteHeader(status int) {
+	if fw.status != 0 || fw.sent != 0 {
+		return
+	}
+	if isInformational(status) {
+		fw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if status >= http.StatusInternalServerError {
+		fw.status = status
+		return
+	}
+	fw.send(status)
+}
+
+func (fw *failureResponseWriter) Write(p []byte) (int, error) {
+	fw.release()
+	if fw.sent == 0 {
+		fw.sent = http.StatusOK
+	}
+	return fw.ResponseWriter.Write(p)
+}
+
+func (fw *failureResponseWriter) Flush() {
+	fw.release()
+	fw.ResponseWriterWrapper.Flush()
+}
+
+// finish sends a held back status and returns the status sent to the client;
+// 0 if none.
+func (fw *failureResponseWriter) finish() int {
+	fw.release()
+	return fw.sent
+}
+
+// release sends a held back status.
+func (fw *failureResponseWriter) release() {
+	if fw.status != 0 {
+		status := fw.status
+		fw.status = 0
+		fw.send(status)
+	}
+}
+
+func (fw *failureResponseWriter) send(status int) {
+	if fw.header && fw.failure.class != "" && status >= http.StatusBadRequest {
+		fw.Header().Set(errorClassHeader, fw.failure.class)
+	}
+	fw.sent = status
+	fw.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// With FastCGI, the script is started once as a socketApp and serves
+// requests as a FastCGI responder; the listening socket it gets as its
+// standard input is the one of the FastCGI specification.
+
+// Record types and roles of the FastCGI specification used by the client.
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+)
+
+// fcgiMaxContent is the maximum content length of a record.
+const fcgiMaxContent = 65535
+
+// fcgiRequestID is the id of the only request on every connection.
+const fcgiRequestID = 1
+
+// writeFCGIRecord writes a single record with content of at most
+// fcgiMaxContent bytes.
+func writeFCGIRecord(w io.Writer, recType uint8, content []byte) error {
+	header := [8]byte{fcgiVersion, recType, 0, fcgiRequestID}
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(content)
+	return err
+}
+
+// fcgiStreamWriter splits everything written into records of a stream.
+type fcgiStreamWriter struct {
+	w       *bufio.Writer
+	recType uint8
+}
+
+func (sw fcgiStreamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		if err := writeFCGIRecord(sw.w, sw.recType, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close terminates the stream with an empty record and flushes it.
+func (sw fcgiStreamWriter) Close() error {
+	if err := writeFCGIRecord(sw.w, sw.recType, nil); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+// fcgiPairs encodes env, a list of key=value pairs, as name-value pairs.
+func fcgiPairs(env []string) []byte {
+	var buf []byte
+	size := func(n int) {
+		if n > 127 {
+			buf = append(buf, byte(n>>24)|0x80, byte(n>>16), byte(n>>8), byte(n))
+		} else {
+			buf = append(buf, byte(n))
+		}
+	}
+	for _, e := range env {
+		eq := strings.IndexByte(e, '=')
+		if eq < 0 {
+			continue
+		}
+		size(eq)
+		size(len(e) - eq - 1)
+		buf = append(buf, e[:eq]...)
+		buf = append(buf, e[eq+1:]...)
+	}
+	return buf
+}
+
+// fcgiReader returns the standard output stream of the response to a
+// request and io.EOF once the request ended. Standard error goes to stderr.
+type fcgiReader struct {
+	r         *bufio.Reader
+	stderr    io.Writer
+	remaining int // content of the current standard output record
+	padding   int
+	appStatus uint32
+	done      bool
+}
+
+func (fr *fcgiReader) Read(p []byte) (int, error) {
+	for fr.remaining == 0 {
+		if fr.done {
+			return 0, io.EOF
+		}
+		if _, err := fr.r.Discard(fr.padding); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		var header [8]byte
+		if _, err := io.ReadFull(fr.r, header[:]); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		fr.padding = int(header[6])
+		switch header[1] {
+		case fcgiStdout:
+			fr.remaining = length
+		case fcgiStderr:
+			if _, err := io.CopyN(fr.stderr, fr.r, int64(length)); err != nil {
+				return 0, unexpectedEOF(err)
+			}
+		case fcgiEndRequest:
+			body := make([]byte, length)
+			if _, err := io.ReadFull(fr.r, body); err != nil {
+				return 0, unexpectedEOF(err)
+			}
+			if length >= 4 {
+				fr.appStatus = binary.BigEndian.Uint32(body)
+			}
+			fr.done = true
+		default:
+			if _, err := fr.r.Discard(length); err != nil {
+				return 0, unexpectedEOF(err)
+			}
+		}
+	}
+	if len(p) > fr.remaining {
+		p = p[:fr.remaining]
+	}
+	n, err := fr.r.Read(p)
+	fr.remaining -= n
+	return n, unexpectedEOF(err)
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF; the stream must end
+// with an end request record.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// serveFastCGI relays req to the FastCGI application at backend.
+func (h *handler) serveFastCGI(backend socketBackend, rw http.ResponseWriter, req *http.Request) {
+	conn, err := backend.dial()
+	if err != nil {
+		h.Failure.set(failSpawn)
+		rw.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("FastCGI error", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	response := &fcgiReader{r: bufio.NewReader(conn), stderr: os.Stderr}
+	h.serveConn(rw, req, conn, "FastCGI", func(w *bufio.Writer) error {
+		env := h.environ(req)
+		h.logEnvironSize(env)
+		begin := [8]byte{0, fcgiResponder}
+		if err := writeFCGIRecord(w, fcgiBeginRequest, begin[:]); err != nil {
+			return err
+		}
+		params := fcgiStreamWriter{w, fcgiParams}
+		if _, err := params.Write(fcgiPairs(env)); err != nil {
+			return err
+		}
+		if err := params.Close(); err != nil {
+			return err
+		}
+		stdin := fcgiStreamWriter{w, fcgiStdin}
+		if req.Body != nil && req.ContentLength != 0 {
+			if _, err := io.Copy(stdin, req.Body); err != nil {
+				return err
+			}
+		}
+		return stdin.Close()
+	}, response)
+	if response.appStatus != 0 {
+		h.Logger.Debug("FastCGI request ended", zap.String("path", h.Path), zap.Uint32("app_status", response.appStatus))
+	}
+}
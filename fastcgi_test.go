@@ -0,0 +1,91 @@
+package cgi
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// TestFastCGIHelper is the FastCGI application of TestCGI_ServeHTTPFastCGI;
+// the test binary serves as the executable.
+func TestFastCGIHelper(t *testing.T) {
+	if os.Getenv("FASTCGI_HELPER") != "1" {
+		return
+	}
+	served := 0
+	fcgi.Serve(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "PID [%d]\nSERVED [%d]\nREQUEST [%s %s]\nBODY [%s]\n",
+			os.Getpid(), served, r.Method, r.URL.RequestURI(), body)
+	}))
+	os.Exit(0)
+}
+
+func TestCGI_ServeHTTPFastCGI(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("FastCGI applications are not supported on Windows")
+	}
+	c := CGI{
+		Executable: os.Args[0],
+		Args:       []string{"-test.run=^TestFastCGIHelper$"},
+		Envs:       []string{"FASTCGI_HELPER=1"},
+		ScriptName: "/app.fcgi",
+		logger:     zap.NewNop(),
+	}
+	h := c.newHandler(caddy.NewReplacer())
+	h.Env = c.Envs
+	var err error
+	if c.fastcgi, err = newSocketApp(&h, "FastCGI"); err != nil {
+		t.Fatalf("Cannot start FastCGI application: %v", err)
+	}
+	defer c.Cleanup()
+
+	var pid string
+	for i, step := range []struct {
+		method, path, body string
+	}{
+		{http.MethodGet, "/app.fcgi/one", ""},
+		{http.MethodPost, "/app.fcgi/two", strings.Repeat("x", 70000)},
+	} {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(step.method, step.path, strings.NewReader(step.body))
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if res.Code != http.StatusOK {
+			t.Errorf("Unexpected statusCode %d. Expected %d.", res.Code, http.StatusOK)
+		}
+		lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+		if len(lines) != 4 {
+			t.Fatalf("Unexpected body %q", res.Body.String())
+		}
+		if i == 0 {
+			pid = lines[0]
+		} else if lines[0] != pid {
+			t.Errorf("Unexpected %s. Expected the application of the first request, %s.", lines[0], pid)
+		}
+		expected := []string{
+			fmt.Sprintf("SERVED [%d]", i+1),
+			"REQUEST [" + step.method + " " + step.path + "]",
+			"BODY [" + step.body + "]",
+		}
+		for j, line := range expected {
+			if lines[j+1] != line {
+				t.Errorf("Unexpected %.40s. Expected %.40s.", lines[j+1], line)
+			}
+		}
+	}
+}
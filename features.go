@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"sort"
+	"strings"
+)
+
+// Capabilities of the gateway reported to scripts in CGI_MODULE_FEATURES, so
+// they can tell what to rely on across versions of the module. Names are
+// never reused for something else.
+const (
+	featureChunkedBody   = "chunked-body"   // chunked request bodies arrive with CONTENT_LENGTH
+	featureChunkedStream = "chunked-stream" // chunked request bodies arrive while uploaded, without CONTENT_LENGTH
+	featureEventStream   = "event-stream"   // event streams are flushed on every write
+	featureFlushInterval = "flush-interval" // responses are flushed in the flush interval rather than on every write
+	featureStreaming     = "streaming"      // all responses are flushed on every write
+	featureUpgrade       = "upgrade"        // upgrade requests can take over the connection
+	featureWebSocket     = "websocket"      // WebSocket sessions are bridged to standard input and output
+)
+
+// features returns the capabilities the route offers to scripts as a
+// sorted, comma separated list.
+func (c CGI) features() string {
+	var list []string
+	if c.FlushInterval > 0 {
+		list = append(list, featureFlushInterval)
+	} else {
+		list = append(list, featureEventStream)
+		if c.Streaming || c.SSE {
+			list = append(list, featureStreaming)
+		}
+	}
+	if c.ChunkedBody == chunkedBodyStream || c.PersistentKey != "" || c.PoolSize > 0 {
+		// The framed protocol always passes bodies on as they arrive.
+		list = append(list, featureChunkedStream)
+	} else {
+		list = append(list, featureChunkedBody)
+	}
+	if c.Upgrade {
+		list = append(list, featureUpgrade)
+	}
+	if c.WebSocket {
+		list = append(list, featureWebSocket)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
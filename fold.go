@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// foldAll folds all response headers but Set-Cookie.
+const foldAll = "*"
+
+// processFoldHeaders validates the names of the headers to fold of the CGI
+// configuration and returns them in canonical form. Set-Cookie can't be
+// folded, its values may contain commas themselves (RFC 6265 section 3).
+func (c CGI) processFoldHeaders() ([]string, error) {
+	var names []string
+	for _, name := range c.FoldHeaders {
+		switch {
+		case name == foldAll:
+		case !httpguts.ValidHeaderFieldName(name):
+			return nil, fmt.Errorf("invalid header name to fold %q", name)
+		case http.CanonicalHeaderKey(name) == "Set-Cookie":
+			return nil, fmt.Errorf("Set-Cookie headers cannot be folded")
+		default:
+			name = http.CanonicalHeaderKey(name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// foldHeaders joins the values of the headers with the names, or all but
+// Set-Cookie with foldAll, that occur more than once into a single
+// comma-separated value (RFC 7230 section 3.2.2).
+func foldHeaders(headers http.Header, names []string) {
+	for _, name := range names {
+		if name != foldAll {
+			if vv := headers[name]; len(vv) > 1 {
+				headers[name] = []string{strings.Join(vv, ", ")}
+			}
+			continue
+		}
+		for k, vv := range headers {
+			if len(vv) > 1 && k != "Set-Cookie" {
+				headers[k] = []string{strings.Join(vv, ", ")}
+			}
+		}
+	}
+}
@@ -2,4 +2,13 @@ module github.com/aksdb/caddy-cgi/v2
 
 go 1.15
 
-require github.com/caddyserver/caddy/v2 v2.2.1
+require (
+	github.com/caddyserver/caddy/v2 v2.2.1
+	github.com/dustin/go-humanize v1.0.1-0.20200219035652-afde56e7acac
+	github.com/yuin/gopher-lua v0.0.0-20200816102855-ee81675732da
+	go.starlark.net v0.0.0-20201006213952-227f4aabceb5
+	go.uber.org/zap v1.15.0
+	golang.org/x/net v0.0.0-20200707034311-ab3426394381
+	golang.org/x/sys v0.0.0-20200625212154-ddb9806d33ae
+	golang.org/x/text v0.3.2
+)
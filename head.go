@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Modes of answering HEAD requests.
+const (
+	headGet    = "get"
+	headCached = "cached"
+)
+
+const (
+	// defaultHeadTTL is how long the headers of a response answer HEAD
+	// requests if not configured.
+	defaultHeadTTL = time.Minute
+	// headEntries is the number of responses whose headers are kept.
+	headEntries = 1024
+)
+
+// headWriter drops the body of a response to a HEAD request the script
+// answered as a GET request.
+type headWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+}
+
+func (hw headWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// headCache keeps the status and headers of successful responses to GET
+// requests for a while to answer HEAD requests for the same resource without
+// running the script, evicting the least recently used ones beyond
+// headEntries.
+type headCache struct {
+	ttl time.Duration
+
+	mu    sync.Mutex
+	lru   *list.List // of *headEntry, most recently used first
+	items map[string]*list.Element
+}
+
+type headEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	expires time.Time
+}
+
+func newHeadCache(ttl time.Duration) *headCache {
+	if ttl <= 0 {
+		ttl = defaultHeadTTL
+	}
+	return &headCache{ttl: ttl, lru: list.New(), items: make(map[string]*list.Element)}
+}
+
+// key returns the key of the resource r is for; empty for requests other
+// than GET and HEAD and those with credentials, whose responses may differ
+// per client.
+func (hc *headCache) key(r *http.Request) string {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return ""
+	}
+	if _, ok := r.Header["Authorization"]; ok {
+		return ""
+	}
+	return r.Host + "\x00" + r.URL.RequestURI()
+}
+
+// serve answers the HEAD request r with the headers kept for key, if they
+// didn't expire yet, and reports whether it did.
+func (hc *headCache) serve(w http.ResponseWriter, r *http.Request, key string) bool {
+	now := time.Now()
+	hc.mu.Lock()
+	el, ok := hc.items[key]
+	if ok && !now.Before(el.Value.(*headEntry).expires) {
+		hc.lru.Remove(el)
+		delete(hc.items, key)
+		ok = false
+	}
+	if !ok {
+		hc.mu.Unlock()
+		return false
+	}
+	hc.lru.MoveToFront(el)
+	entry := el.Value.(*headEntry)
+	hc.mu.Unlock()
+
+	for k, vv := range entry.header {
+		w.Header()[k] = vv
+	}
+	if notModified(r, w.Header()) {
+		writeNotModified(w)
+		return true
+	}
+	w.WriteHeader(entry.status)
+	return true
+}
+
+// record returns a writer that passes the response on to w and keeps its
+// status and headers.
+func (hc *headCache) record(w http.ResponseWriter) *cacheRecorder {
+	return &cacheRecorder{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+}
+
+// store keeps the status and headers recorded by cr for key if the response
+// was successful and may be cached, for as long as its Cache-Control allows
+// or the TTL.
+func (hc *headCache) store(key string, cr *cacheRecorder) {
+	if cr.status != http.StatusOK {
+		return
+	}
+	ttl, ok := cacheLifetime(cr.header, hc.ttl)
+	if !ok {
+		return
+	}
+	entry := &headEntry{key: key, status: cr.status, header: cr.header, expires: time.Now().Add(ttl)}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if el, ok := hc.items[key]; ok {
+		el.Value = entry
+		hc.lru.MoveToFront(el)
+		return
+	}
+	hc.items[key] = hc.lru.PushFront(entry)
+	for hc.lru.Len() > headEntries {
+		oldest := hc.lru.Back()
+		hc.lru.Remove(oldest)
+		delete(hc.items, oldest.Value.(*headEntry).key)
+	}
+}
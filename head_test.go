@@ -0,0 +1,101 @@
+package cgi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCGI_ServeHTTPHead(t *testing.T) {
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "counter")
+	// The script counts its executions and tells the method it saw.
+	newCGI := func(mode string) CGI {
+		c := CGI{
+			Executable: "/bin/sh",
+			Args: []string{"-c", `echo run >> "$COUNTER"
+printf 'Content-Type: text/plain\r\nX-Method: %s\r\n\r\nbody' "$REQUEST_METHOD"`},
+			Envs:   []string{"COUNTER=" + counter},
+			Head:   mode,
+			logger: zap.NewNop(),
+		}
+		if mode == headCached {
+			c.heads = newHeadCache(0)
+		}
+		return c
+	}
+	runs := func() int {
+		data, _ := ioutil.ReadFile(counter)
+		return strings.Count(string(data), "run")
+	}
+
+	for i, step := range []struct {
+		mode, method, target string
+		scriptMethod, body   string
+		runs                 int
+	}{
+		{"", http.MethodHead, "/", "HEAD", "body", 1},
+		{headGet, http.MethodHead, "/", "GET", "", 2},
+		{headGet, http.MethodGet, "/", "GET", "body", 3},
+		{headGet, http.MethodPost, "/", "POST", "body", 4},
+	} {
+		c := newCGI(step.mode)
+		req := httptest.NewRequest(step.method, step.target, nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		res := httptest.NewRecorder()
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if m := res.Header().Get("X-Method"); m != step.scriptMethod {
+			t.Errorf("Step %d: unexpected method %q. Expected %q.", i, m, step.scriptMethod)
+		}
+		if res.Body.String() != step.body {
+			t.Errorf("Step %d: unexpected body %q. Expected %q.", i, res.Body.String(), step.body)
+		}
+		if n := runs(); n != step.runs {
+			t.Errorf("Step %d: unexpected number of executions %d. Expected %d.", i, n, step.runs)
+		}
+	}
+
+	c := newCGI(headCached)
+	serve := func(method, target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		res := httptest.NewRecorder()
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		return res
+	}
+	before := runs()
+	for i, step := range []struct {
+		method, target string
+		header         http.Header
+		runs           int
+	}{
+		{http.MethodGet, "/a", nil, 1},
+		{http.MethodHead, "/a", nil, 1},
+		{http.MethodHead, "/b", nil, 2},
+		{http.MethodHead, "/b", nil, 2},
+		{http.MethodHead, "/b", http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}, 3},
+		{http.MethodGet, "/b", nil, 4},
+	} {
+		res := serve(step.method, step.target, step.header)
+		if res.Code != http.StatusOK || res.Header().Get("X-Method") != "GET" {
+			t.Errorf("Step %d: unexpected response %d with method %q. Expected 200 with GET.", i, res.Code, res.Header().Get("X-Method"))
+		}
+		if n := runs() - before; n != step.runs {
+			t.Errorf("Step %d: unexpected number of executions %d. Expected %d.", i, n, step.runs)
+		}
+	}
+}
@@ -0,0 +1,972 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found at https://golang.org/LICENSE.
+
+// This file is derived from the host side of net/http/cgi. It has been split
+// into its individual steps (environment, execution, response) so that they
+// can be reused for executables that serve more than one request.
+
+package cgi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+)
+
+var trailingPort = regexp.MustCompile(`:([0-9]+)$`)
+
+var osDefaultInheritEnv = func() []string {
+	switch runtime.GOOS {
+	case "darwin", "ios":
+		return []string{"DYLD_LIBRARY_PATH"}
+	case "android", "linux", "freebsd", "netbsd", "openbsd":
+		return []string{"LD_LIBRARY_PATH"}
+	case "hpux":
+		return []string{"LD_LIBRARY_PATH", "SHLIB_PATH"}
+	case "irix":
+		return []string{"LD_LIBRARY_PATH", "LD_LIBRARYN32_PATH", "LD_LIBRARY64_PATH"}
+	case "illumos", "solaris":
+		return []string{"LD_LIBRARY_PATH", "LD_LIBRARY_PATH_32", "LD_LIBRARY_PATH_64"}
+	case "windows":
+		return []string{"SystemRoot", "COMSPEC", "PATHEXT", "WINDIR"}
+	}
+	return nil
+}()
+
+// handler runs an executable in a subprocess with a CGI environment.
+type handler struct {
+	Path string // path to the CGI executable
+	Root string // root URI prefix of handler or empty for "/"
+
+	// Dir specifies the CGI executable's working directory.
+	// If Dir is empty, the base directory of Path is used.
+	// If Path has no base directory, the current working
+	// directory is used.
+	Dir string
+	// DirFromScript makes the directory containing the executable, with
+	// symbolic links resolved, the working directory instead of Dir, which
+	// then only serves to find a relative Path.
+	DirFromScript bool
+
+	Env        []string    // extra environment variables to set, if any, as "key=value"
+	InheritEnv []string    // environment variables to inherit from host, as "key"
+	Args       []string    // optional arguments to pass to child process
+	Logger     *zap.Logger // log for errors
+	Software   string      // SERVER_SOFTWARE, if not the default
+	Gateway    string      // GATEWAY_INTERFACE, if not the default
+
+	Timeout    time.Duration // maximum execution time, if any
+	KillSignal os.Signal     // signal to terminate timed out processes with
+	KillGrace  time.Duration // time between KillSignal and killing forcibly
+	// HeaderTimeout is the time the process has to send the response
+	// headers, if limited.
+	HeaderTimeout time.Duration
+	// MarkTruncated marks responses cut off by the timeout, see
+	// markTruncated.
+	MarkTruncated bool
+	// StripPreamble discards a UTF-8 byte order mark and blank lines in front
+	// of the response headers.
+	StripPreamble bool
+	// LogStderr logs the standard error of the process instead of passing it
+	// to the one of Caddy; if the process succeeded, at debug level unless
+	// there are at least StderrMin bytes.
+	LogStderr bool
+	StderrMin int
+	// Upgrade hands the connection of upgrade requests over to the process
+	// once it switches protocols.
+	Upgrade bool
+	// Retries is how often a script that exits unsuccessfully without any
+	// output is run again, waiting RetryDelay before the first retry and
+	// twice as long before every further one, up to RetryDelayMax.
+	Retries       int
+	RetryDelay    time.Duration
+	RetryDelayMax time.Duration
+	// TextBusy is how an executable that is open for writing when it is to
+	// be started is handled: textBusyRetry starts it again up to BusyRetries
+	// times with the delays of retries, textBusySnapshot starts a copy of
+	// it; the request fails if empty.
+	TextBusy    string
+	BusyRetries int
+
+	// KeepAlive is the time of silence after which a comment is sent in
+	// event stream responses to keep intermediaries from dropping them.
+	KeepAlive time.Duration
+	// Streaming flushes all responses on every write and tells proxies not
+	// to buffer them either.
+	Streaming bool
+	// FlushInterval, if set, is the interval in which responses are flushed
+	// to the client, instead of on every write with Streaming.
+	FlushInterval time.Duration
+	// EventStream makes every successful response an event stream, whatever
+	// content type the script gave it.
+	EventStream bool
+	// EarlyHints sends the preload links of successful responses as 103
+	// Early Hints ahead of them.
+	EarlyHints bool
+	// LocalRedirect, if set, answers local redirect responses, which carry
+	// nothing but the Location of the resource to respond with instead.
+	LocalRedirect func(rw http.ResponseWriter, location string)
+	// Sendfile, if set, answers responses with X-Sendfile or
+	// X-Accel-Redirect with the file they name and the other headers.
+	Sendfile func(rw http.ResponseWriter, headers http.Header)
+	// BufferLimit is the announced size up to which responses are sent at
+	// once; those announced larger are flushed on every write.
+	BufferLimit int64
+	// SocketStdio connects standard input and output of scripts to socket
+	// pairs instead of pipes, with buffers of SocketBuffer bytes if set.
+	SocketStdio  bool
+	SocketBuffer int
+	// StreamBody passes chunked request bodies on while they arrive instead
+	// of spooling them first.
+	StreamBody bool
+	Rlimits    []rlimit // resource limits applied to the process
+	Nice       int      // CPU scheduling priority; 0 if unchanged
+	Umask      *int     // file mode creation mask; nil if inherited
+	IOPrio     int      // I/O priority as passed to ioprio_set; 0 if unchanged
+	Seccomp    []byte   // seccomp filter program applied to the process, if any
+	// Landlock confines the file system access of the process, if set.
+	Landlock    []landlockRule
+	Conformance string      // conformanceStrict, conformanceCompat or empty
+	Credential  *credential // user and group to execute as, if any
+	Namespaces  namespaces  // namespaces to execute in, if any
+	// EnvAllow are the patterns of host variables that may be inherited; nil
+	// allows all.
+	EnvAllow []string
+	// CookieAllow and CookieDeny are the patterns of cookie names passed in
+	// HTTP_COOKIE and left out of it.
+	CookieAllow []string
+	CookieDeny  []string
+	SetCookie   *CookieRewrite // rewrite of Set-Cookie response headers, if any
+	Disposition bool           // sanitize Content-Disposition response headers
+	FoldHeaders []string       // response headers whose values are joined, if any
+	Cgroup      *cgroupConfig  // transient cgroup settings, if any
+	// CoreDumps is the directory core dumps are collected in; empty if
+	// disabled.
+	CoreDumps string
+	// KillGroup runs the process in a process group of its own, which is
+	// killed once the process exited.
+	KillGroup bool
+	Chroot    string  // absolute directory the process is confined to, if any
+	Program   Program // serves requests in-process instead of Path, if set
+	// ExtraFiles are passed to the process as descriptor 3 and above, after
+	// any the handler needs itself.
+	ExtraFiles []extraFile
+	// Interpreter, with its arguments, Path is passed to ahead of Args
+	Interpreter []string
+	// Failure receives the class of a failure of the request, if set.
+	Failure *failure
+}
+
+// removeLeadingDuplicates remove leading duplicate in environments.
+// It's possible to override environment like following.
+//
+//	handler{
+//	  ...
+//	  Env: []string{"SCRIPT_FILENAME=foo.php"},
+//	}
+func removeLeadingDuplicates(env []string) (ret []string) {
+	for i, e := range env {
+		found := false
+		if eq := strings.IndexByte(e, '='); eq != -1 {
+			keq := e[:eq+1] // "key="
+			for _, e2 := range env[i+1:] {
+				if strings.HasPrefix(e2, keq) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			ret = append(ret, e)
+		}
+	}
+	return
+}
+
+// processEnviron returns the part of the environment that does not depend on
+// a particular request.
+func (h *handler) processEnviron() (env []string) {
+	envPath := os.Getenv("PATH")
+	if envPath == "" {
+		envPath = "/bin:/usr/bin:/usr/ucb:/usr/bsd:/usr/local/bin"
+	}
+	env = append(env, "PATH="+envPath)
+
+	for _, e := range h.InheritEnv {
+		if v := os.Getenv(e); v != "" && envAllowed(h.EnvAllow, e) {
+			env = append(env, e+"="+v)
+		}
+	}
+
+	for _, e := range osDefaultInheritEnv {
+		if v := os.Getenv(e); v != "" && envAllowed(h.EnvAllow, e) {
+			env = append(env, e+"="+v)
+		}
+	}
+	return
+}
+
+// environ returns the complete CGI environment for req.
+func (h *handler) environ(req *http.Request) []string {
+	root := strings.TrimRight(h.Root, "/")
+	pathInfo := strings.TrimPrefix(req.URL.Path, root)
+
+	port := "80"
+	if req.TLS != nil {
+		port = "443"
+	}
+	if matches := trailingPort.FindStringSubmatch(req.Host); len(matches) != 0 {
+		port = matches[1]
+	}
+
+	software, gateway := "go", "CGI/1.1"
+	if h.Software != "" {
+		software = h.Software
+	}
+	if h.Gateway != "" {
+		gateway = h.Gateway
+	}
+
+	env := []string{
+		"SERVER_SOFTWARE=" + software,
+		"SERVER_PROTOCOL=HTTP/1.1",
+		"HTTP_HOST=" + req.Host,
+		"GATEWAY_INTERFACE=" + gateway,
+		"REQUEST_METHOD=" + req.Method,
+		"QUERY_STRING=" + req.URL.RawQuery,
+		"REQUEST_URI=" + req.URL.RequestURI(),
+		"PATH_INFO=" + pathInfo,
+		"SCRIPT_NAME=" + root,
+		"SCRIPT_FILENAME=" + h.scriptFilename(),
+		"SERVER_PORT=" + port,
+	}
+
+	if remoteIP, remotePort, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		env = append(env, "REMOTE_ADDR="+remoteIP, "REMOTE_HOST="+remoteIP, "REMOTE_PORT="+remotePort)
+	} else {
+		// could not parse ip:port, let's use whole RemoteAddr and leave REMOTE_PORT undefined
+		env = append(env, "REMOTE_ADDR="+req.RemoteAddr, "REMOTE_HOST="+req.RemoteAddr)
+	}
+
+	if hostDomain, _, err := net.SplitHostPort(req.Host); err == nil {
+		env = append(env, "SERVER_NAME="+hostDomain)
+	} else {
+		env = append(env, "SERVER_NAME="+req.Host)
+	}
+
+	if req.TLS != nil {
+		env = append(env, "HTTPS=on")
+	}
+
+	for k, v := range req.Header {
+		k = strings.Map(upperCaseAndUnderscore, k)
+		if k == "PROXY" {
+			// See Issue 16405
+			continue
+		}
+		if k == "COOKIE" {
+			if cookies := cookieHeader(v, h.CookieAllow, h.CookieDeny); cookies != "" {
+				env = append(env, "HTTP_COOKIE="+cookies)
+			}
+			continue
+		}
+		env = append(env, "HTTP_"+k+"="+strings.Join(v, ", "))
+	}
+
+	if req.ContentLength > 0 {
+		env = append(env, fmt.Sprintf("CONTENT_LENGTH=%d", req.ContentLength))
+	}
+	if ctype := req.Header.Get("Content-Type"); ctype != "" {
+		env = append(env, "CONTENT_TYPE="+ctype)
+	}
+
+	env = append(env, h.processEnviron()...)
+
+	if h.Env != nil {
+		env = append(env, h.Env...)
+	}
+
+	return removeLeadingDuplicates(env)
+}
+
+// logEnvironSize logs the size of env and its largest variables at debug
+// level, to help finding out what bloats the environment.
+func (h *handler) logEnvironSize(env []string) {
+	if ce := h.Logger.Check(zap.DebugLevel, "CGI environment size"); ce != nil {
+		total := 0
+		for _, e := range env {
+			total += len(e)
+		}
+		sorted := append([]string(nil), env...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return len(sorted[i]) > len(sorted[j])
+		})
+		if len(sorted) > 5 {
+			sorted = sorted[:5]
+		}
+		largest := make([]string, len(sorted))
+		for i, e := range sorted {
+			name := e
+			if eq := strings.IndexByte(e, '='); eq >= 0 {
+				name = e[:eq]
+			}
+			largest[i] = fmt.Sprintf("%s (%d bytes)", name, len(e))
+		}
+		ce.Write(zap.Int("count", len(env)), zap.Int("bytes", total), zap.Strings("largest", largest))
+	}
+}
+
+// command returns the (not yet started) command to execute with the given
+// environment.
+func (h *handler) command(env []string, cg *cgroup) (*exec.Cmd, error) {
+	var cwd, path string
+	if h.Dir != "" {
+		path = h.Path
+		cwd = h.Dir
+	} else {
+		cwd, path = filepath.Split(h.Path)
+	}
+	if cwd == "" {
+		cwd = "."
+	}
+	if h.DirFromScript {
+		script := path
+		if !filepath.IsAbs(script) {
+			script = filepath.Join(cwd, script)
+		}
+		if h.Chroot == "" {
+			// Within a chroot, links are resolved in the new root.
+			if resolved, err := filepath.EvalSymlinks(script); err == nil {
+				script = resolved
+			}
+		}
+		cwd, path = filepath.Split(script)
+	}
+	argv0 := h.Path
+	if h.Chroot != "" {
+		// Both paths are resolved within the new root.
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(cwd, path)
+		}
+		var err error
+		if cwd, err = chrootPath(h.Chroot, cwd); err != nil {
+			return nil, err
+		}
+		if path, err = chrootPath(h.Chroot, path); err != nil {
+			return nil, err
+		}
+		argv0 = path
+	}
+	args := h.Args
+	if len(h.Interpreter) > 0 {
+		interpreter, interpreterArgs, err := h.interpreterCommand(path)
+		if err != nil {
+			return nil, err
+		}
+		path, argv0 = interpreter, h.Interpreter[0]
+		args = append(interpreterArgs, h.Args...)
+	}
+
+	cmd := &exec.Cmd{
+		Path:   path,
+		Args:   append([]string{argv0}, args...),
+		Dir:    cwd,
+		Env:    env,
+		Stderr: os.Stderr,
+	}
+	if cg != nil {
+		cmd.ExtraFiles = []*os.File{cg.syncRead}
+	}
+	if len(h.ExtraFiles) > 0 {
+		env = h.addExtraFiles(cmd, env[:len(env):len(env)])
+		cmd.Env = env
+	}
+	spec := shimSpec{
+		Path:      path,
+		Rlimits:   h.Rlimits,
+		Nice:      h.Nice,
+		Umask:     h.Umask,
+		IOPrio:    h.IOPrio,
+		Seccomp:   h.Seccomp,
+		Landlock:  h.Landlock,
+		MountProc: h.Namespaces.isolatesProcesses(),
+		Cgroup:    cg != nil,
+	}
+	if spec.MountProc {
+		spec.Credential = h.Credential
+	}
+	if spec.needed() {
+		cmd.Path = selfExecutable
+		cmd.Env = append(env[:len(env):len(env)], spec.env())
+	}
+	if h.Credential != nil && spec.Credential == nil {
+		h.Credential.apply(cmd)
+	}
+	h.Namespaces.apply(cmd)
+	if h.Chroot != "" {
+		applyChroot(cmd, h.Chroot)
+	}
+	if h.KillGroup {
+		setProcessGroup(cmd)
+	}
+	return cmd, nil
+}
+
+func (h *handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.run(rw, req)
+}
+
+// run executes the CGI process for req and returns its exit code, or -1 if it
+// didn't run or was terminated by a signal.
+func (h *handler) run(rw http.ResponseWriter, req *http.Request) (exitCode int, usage processUsage) {
+	if h.Program != nil {
+		return h.runProgram(rw, req)
+	}
+	chunked := len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked"
+	var tee *bodyTee
+	if chunked && h.StreamBody {
+		var err error
+		if tee, err = teeBody(req); err != nil {
+			h.Failure.set(failBodyLimit)
+			rw.WriteHeader(http.StatusInternalServerError)
+			h.Logger.Error("cannot buffer chunked request body", zap.Error(err))
+			return -1, usage
+		}
+		defer tee.close()
+	} else if chunked {
+		spooled, cleanup, err := spoolBody(req)
+		if err != nil {
+			status := err.(caddyhttp.HandlerError).StatusCode
+			if status != http.StatusBadRequest {
+				// Not merely a broken upload of the client.
+				h.Failure.set(failBodyLimit)
+			}
+			rw.WriteHeader(status)
+			h.Logger.Error("cannot spool chunked request body", zap.Error(err))
+			return -1, usage
+		}
+		defer cleanup()
+		req = spooled
+	}
+
+	env := h.environ(req)
+	h.logEnvironSize(env)
+	// Scripts can only be run again if the request has no body, which the
+	// first run consumed.
+	retryable := h.Retries > 0 && idempotentMethods[req.Method] && req.ContentLength == 0 && !chunked
+	busyAttempt := 0
+	for attempt := 0; ; {
+		mayBusy := h.TextBusy == textBusyRetry && busyAttempt < h.BusyRetries || h.TextBusy == textBusySnapshot
+		exitCode, usage, retry, busy := h.runOnce(rw, req, env, tee, retryable && attempt < h.Retries, mayBusy)
+		var delay time.Duration
+		switch {
+		case busy && h.TextBusy == textBusySnapshot:
+			return h.runSnapshot(rw, req, env, tee)
+		case busy:
+			delay = h.retryDelay(busyAttempt)
+			busyAttempt++
+			h.Logger.Warn("CGI executable busy, retrying",
+				zap.String("path", h.Path), zap.Int("attempt", busyAttempt), zap.Duration("delay", delay))
+		case retry:
+			delay = h.retryDelay(attempt)
+			attempt++
+			h.Logger.Warn("CGI process failed without output, retrying",
+				zap.String("path", h.Path), zap.Int("exit_code", exitCode), zap.Int("attempt", attempt), zap.Duration("delay", delay))
+		default:
+			return exitCode, usage
+		}
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return exitCode, usage
+		}
+	}
+}
+
+// runSnapshot executes a copy of the executable, which was busy.
+func (h *handler) runSnapshot(rw http.ResponseWriter, req *http.Request, env []string, tee *bodyTee) (exitCode int, usage processUsage) {
+	snapshot, err := snapshotExecutable(h.Path)
+	if err != nil {
+		h.Failure.set(failSpawn)
+		rw.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("cannot copy busy CGI executable", zap.String("path", h.Path), zap.Error(err))
+		return -1, usage
+	}
+	defer os.Remove(snapshot)
+	h.Logger.Warn("CGI executable busy, starting a copy", zap.String("path", h.Path), zap.String("copy", snapshot))
+	path := h.Path
+	h.Path = snapshot
+	defer func() { h.Path = path }()
+	exitCode, usage, _, _ = h.runOnce(rw, req, env, tee, false, false)
+	return exitCode, usage
+}
+
+// runOnce executes the script once. With mayRetry, a script that exits
+// unsuccessfully without any output gets no response written; retry tells
+// the caller to run it again. Likewise with mayBusy, an executable that is
+// busy gets no response written; busy tells the caller so.
+func (h *handler) runOnce(rw http.ResponseWriter, req *http.Request, env []string, tee *bodyTee, mayRetry, mayBusy bool) (exitCode int, usage processUsage, retry, busy bool) {
+	internalError := func(err error) {
+		h.Failure.set(failSpawn)
+		rw.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("CGI error", zap.Error(err))
+	}
+
+	cg, err := h.Cgroup.create()
+	if err != nil {
+		internalError(err)
+		return -1, usage, false, false
+	}
+	defer cg.close(h.Logger)
+	cmd, err := h.command(env, cg)
+	if err != nil {
+		internalError(err)
+		return -1, usage, false, false
+	}
+	var stderr *stderrCapture
+	var stderrWrite *os.File
+	if h.LogStderr {
+		if stderr, stderrWrite, err = captureStderr(cmd); err != nil {
+			internalError(err)
+			return -1, usage, false, false
+		}
+		// Closed right after the start; this covers failing before.
+		defer stderrWrite.Close()
+	}
+	var upgrade *net.UnixConn
+	if h.Upgrade && isUpgradeRequest(req) && req.TLS == nil {
+		if _, ok := rw.(http.Hijacker); ok {
+			var child *os.File
+			if upgrade, child, err = newUpgradeSocket(); err != nil {
+				internalError(err)
+				return -1, usage, false, false
+			}
+			defer upgrade.Close()
+			defer child.Close()
+			cmd.Env = append(cmd.Env, "CGI_UPGRADE_FD="+strconv.Itoa(3+len(cmd.ExtraFiles)))
+			cmd.ExtraFiles = append(cmd.ExtraFiles, child)
+		}
+	}
+	var stdin io.WriteCloser
+	var stdoutRead io.ReadCloser
+	var body io.Reader
+	closeChild := func() {}
+	if tee != nil {
+		body = tee
+	}
+	if h.SocketStdio {
+		// The handler feeds standard input like with a tee.
+		if tee == nil && req.ContentLength != 0 {
+			body = req.Body
+		}
+		if stdin, stdoutRead, closeChild, err = h.socketStdio(cmd, body != nil); err != nil {
+			internalError(err)
+			return -1, usage, false, false
+		}
+		// Closed right after the start; this covers failing before.
+		defer closeChild()
+	} else {
+		if tee != nil {
+			if stdin, err = cmd.StdinPipe(); err != nil {
+				internalError(err)
+				return -1, usage, false, false
+			}
+		} else if req.ContentLength != 0 {
+			cmd.Stdin = req.Body
+		}
+		if stdoutRead, err = cmd.StdoutPipe(); err != nil {
+			internalError(err)
+			return -1, usage, false, false
+		}
+	}
+
+	err = startChild(cmd)
+	if stderrWrite != nil {
+		stderrWrite.Close()
+	}
+	closeChild()
+	if err != nil {
+		if h.SocketStdio {
+			// Unlike pipes, exec doesn't close them when starting fails.
+			closeStdio(stdin, stdoutRead)
+		}
+		if mayBusy && isTextBusy(err) {
+			return -1, usage, false, true
+		}
+		internalError(err)
+		return -1, usage, false, false
+	}
+	if err := cg.attach(cmd.Process); err != nil {
+		cmd.Wait()
+		doneChild(cmd)
+		if h.SocketStdio {
+			closeStdio(stdin, stdoutRead)
+		}
+		internalError(err)
+		return -1, usage, false, false
+	}
+	if stdin != nil {
+		// Unlike with cmd.Stdin, cmd.Wait doesn't wait for this, so it
+		// isn't held up by a slow upload once the script exited.
+		go func() {
+			io.Copy(stdin, body)
+			stdin.Close()
+		}()
+	}
+	// writeResponse looks for the writers of timeouts and upgrades, so they
+	// have to stay outermost.
+	status := 0
+	if stderr != nil {
+		rw = statusResponseWriter{&caddyhttp.ResponseWriterWrapper{ResponseWriter: rw}, &status}
+	}
+	wd := h.watch(req.Context(), cmd.Process)
+	defer wd.stop()
+	if h.Timeout > 0 || h.HeaderTimeout > 0 {
+		rw = timeoutResponseWriter{&caddyhttp.ResponseWriterWrapper{ResponseWriter: rw}, wd}
+	}
+	if upgrade != nil {
+		rw = upgradeResponseWriter{&caddyhttp.ResponseWriterWrapper{ResponseWriter: rw}, upgrade, wd}
+	}
+
+	output := bufio.NewReaderSize(stdoutRead, 1024)
+	silent := false
+	if mayRetry {
+		// Whether to retry can only be decided once the process exited,
+		// so the response waits for that if there is no output at all.
+		_, err := output.Peek(1)
+		silent = err == io.EOF
+	}
+	if !silent {
+		if err := h.writeResponse(rw, output); err != nil {
+			// Kill the child CGI process so we don't hang on
+			// the cmd.Wait below if the error was just
+			// the client (rw) going away. If it was a read error
+			// (because the child died itself), then the extra
+			// kill of an already-dead process is harmless (the PID
+			// won't be reused until the Wait below).
+			cmd.Process.Kill()
+		}
+	}
+	stdoutRead.Close()
+	cmd.Wait()
+	doneChild(cmd)
+	if h.KillGroup {
+		// Whatever the script left running in the background goes, too.
+		killProcessGroup(cmd.Process.Pid)
+	}
+	h.logLimitExit(cmd.ProcessState)
+	h.collectCoreDump(cmd)
+	usage = exitUsage(cmd.ProcessState)
+	exitCode = cmd.ProcessState.ExitCode()
+	if wd.timedOut() {
+		h.Failure.cause(failTimeout)
+	} else if usage.Signal != "" && req.Context().Err() == nil {
+		h.Failure.cause(failSignal)
+	}
+	h.Logger.Debug("CGI process exited", append(usage.fields(),
+		zap.String("path", h.Path), zap.Int("pid", cmd.ProcessState.Pid()), zap.Int("exit_code", exitCode))...)
+	if stderr != nil {
+		// Scripts without any output are answered below, with an
+		// internal server error.
+		stderr.log(h, cmd.ProcessState.Pid(), exitCode != 0 || status >= http.StatusInternalServerError || silent)
+	}
+	if silent {
+		// Scripts that were terminated aren't retried.
+		if exitCode != 0 && !wd.timedOut() && req.Context().Err() == nil {
+			return exitCode, usage, true, false
+		}
+		h.writeResponse(rw, output)
+	}
+	return exitCode, usage, false, false
+}
+
+// writeResponse parses the CGI response in output and relays it to rw. Invalid
+// responses are answered with an internal server error. A non-nil error means
+// that the body could not be copied completely.
+func (h *handler) writeResponse(rw http.ResponseWriter, output io.Reader) error {
+	linebody := bufio.NewReaderSize(output, 1024)
+	headers := make(http.Header)
+	statusCode := 0
+	headerLines := 0
+	sawBlankLine := false
+	strict := h.Conformance == conformanceStrict
+	// invalid rejects the response of the script.
+	invalid := func() {
+		h.Failure.set(failBadHeaders)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+	lenient := h.Conformance == conformanceCompat
+	if h.StripPreamble {
+		if bom, blankLines := skipPreamble(linebody, lenient); bom || blankLines > 0 {
+			h.Logger.Warn("stripped output in front of the response headers",
+				zap.String("path", h.Path), zap.Bool("bom", bom), zap.Int("blank_lines", blankLines))
+		}
+	}
+	for {
+		line, crlf, err := readHeaderLine(linebody, lenient)
+		if err == errLongHeaderLine {
+			invalid()
+			h.Logger.Error("long header line from subprocess")
+			return nil
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			invalid()
+			h.Logger.Error("error reading headers", zap.Error(err))
+			return nil
+		}
+		if strict && !crlf {
+			invalid()
+			h.Logger.Error("header line not terminated by CRLF", zap.ByteString("line", line))
+			return nil
+		}
+		if len(line) == 0 {
+			sawBlankLine = true
+			break
+		}
+		headerLines++
+		parts := strings.SplitN(string(line), ":", 2)
+		if len(parts) < 2 {
+			if strict {
+				invalid()
+				h.Logger.Error("bogus header line", zap.ByteString("line", line))
+				return nil
+			}
+			h.Logger.Warn("bogus header line", zap.ByteString("line", line))
+			continue
+		}
+		header, val := parts[0], parts[1]
+		if !httpguts.ValidHeaderFieldName(header) {
+			if strict {
+				invalid()
+				h.Logger.Error("invalid header name", zap.String("header", header))
+				return nil
+			}
+			h.Logger.Warn("invalid header name", zap.String("header", header))
+			continue
+		}
+		val = textproto.TrimString(val)
+		if strict && !httpguts.ValidHeaderFieldValue(val) {
+			invalid()
+			h.Logger.Error("invalid header value", zap.String("header", header))
+			return nil
+		}
+		switch {
+		case header == "Status":
+			if len(val) < 3 {
+				invalid()
+				h.Logger.Error("bogus status (short)", zap.String("status", val))
+				return nil
+			}
+			code, err := strconv.Atoi(val[0:3])
+			if err != nil || strict && (code < 100 || code > 599 || len(val) > 3 && val[3] != ' ') {
+				invalid()
+				h.Logger.Error("bogus status", zap.String("status", val), zap.ByteString("line", line))
+				return nil
+			}
+			statusCode = code
+		case h.SetCookie != nil && http.CanonicalHeaderKey(header) == "Set-Cookie":
+			headers.Add(header, h.SetCookie.rewrite(val))
+		case h.Disposition && http.CanonicalHeaderKey(header) == "Content-Disposition":
+			if clean := sanitizeContentDisposition(val); clean != val {
+				h.Logger.Debug("sanitized Content-Disposition", zap.String("header", val), zap.String("sanitized", clean))
+				val = clean
+			}
+			headers.Set(header, val)
+		default:
+			headers.Add(header, val)
+		}
+	}
+	if headerLines == 0 || !sawBlankLine {
+		invalid()
+		h.Logger.Error("no headers")
+		return nil
+	}
+
+	foldHeaders(headers, h.FoldHeaders)
+
+	if h.Sendfile != nil && isSendfile(headers) && (statusCode == 0 || statusCode == http.StatusOK) {
+		h.Sendfile(rw, headers)
+		// The script may still be writing its body.
+		io.Copy(ioutil.Discard, linebody)
+		return nil
+	}
+
+	if loc := headers.Get("Location"); loc != "" {
+		if statusCode == 0 && h.LocalRedirect != nil && isLocalRedirect(headers) {
+			if _, err := linebody.Peek(1); err == io.EOF {
+				h.LocalRedirect(rw, loc)
+				return nil
+			}
+		}
+		if statusCode == 0 {
+			statusCode = http.StatusFound
+		}
+	}
+
+	if statusCode == 0 && headers.Get("Content-Type") == "" && h.Conformance == conformanceCompat {
+		headers.Set("Content-Type", compatContentType)
+	}
+
+	if statusCode == 0 && headers.Get("Content-Type") == "" {
+		invalid()
+		h.Logger.Error("missing required Content-Type in headers")
+		return nil
+	}
+
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	if uw, ok := rw.(upgradeResponseWriter); ok && statusCode == http.StatusSwitchingProtocols {
+		uw.handOff(h, headers)
+		return nil
+	}
+
+	if h.EventStream && statusCode >= 200 && statusCode < 300 {
+		if !strings.HasPrefix(headers.Get("Content-Type"), "text/event-stream") {
+			headers.Set("Content-Type", "text/event-stream")
+		}
+		if headers.Get("Cache-Control") == "" {
+			headers.Set("Cache-Control", "no-cache")
+		}
+	}
+
+	var body io.Reader = linebody
+	tw, timed := rw.(timeoutResponseWriter)
+	marking := timed && h.MarkTruncated
+	if marking && !h.Streaming && isJSON(headers.Get("Content-Type")) {
+		// JSON that is cut off can't be parsed anyway, so it is held back
+		// until the process is done and replaced by an error if it timed
+		// out.
+		tw.wd.headersDone()
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, linebody); err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			h.Logger.Error("error reading response", zap.Error(err))
+			return nil
+		}
+		if tw.wd.timedOut() {
+			rw.WriteHeader(http.StatusGatewayTimeout)
+			h.Logger.Warn("JSON response truncated by timeout, discarded", zap.String("path", h.Path))
+			return nil
+		}
+		body = &buf
+	}
+
+	streamed := false
+	if h.BufferLimit > 0 {
+		size := responseSizeHint(headers)
+		headers.Del(sizeHintHeader)
+		switch {
+		case size < 0 || body != io.Reader(linebody):
+		case size <= h.BufferLimit:
+			// Small responses are read completely into a buffer of the
+			// announced size and sent at once.
+			if timed {
+				tw.wd.headersDone()
+			}
+			buf := bytes.NewBuffer(make([]byte, 0, size))
+			if _, err := io.Copy(buf, io.LimitReader(linebody, h.BufferLimit)); err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				h.Logger.Error("error reading response", zap.Error(err))
+				return nil
+			}
+			body = io.MultiReader(buf, linebody)
+		default:
+			streamed = true
+		}
+	}
+
+	for k, vv := range headers {
+		for _, v := range vv {
+			rw.Header().Add(k, v)
+		}
+	}
+
+	if h.Streaming && rw.Header().Get("X-Accel-Buffering") == "" {
+		rw.Header().Set("X-Accel-Buffering", "no")
+	}
+
+	if h.EarlyHints && statusCode >= 200 && statusCode < 300 {
+		if links := preloadLinks(headers); len(links) > 0 {
+			sendEarlyHints(rw, links)
+		}
+	}
+	rw.WriteHeader(statusCode)
+
+	var w io.Writer = rw
+	switch {
+	case strings.HasPrefix(headers.Get("Content-Type"), "text/event-stream"):
+		sw := newStreamWriter(rw, h.KeepAlive, h.FlushInterval)
+		defer sw.close()
+		w = sw
+	case h.Streaming || streamed || h.FlushInterval > 0:
+		sw := newStreamWriter(rw, 0, h.FlushInterval)
+		defer sw.close()
+		w = sw
+	}
+	_, err := io.Copy(w, body)
+	if err != nil {
+		h.Logger.Error("copy error", zap.Error(err))
+	} else if marking && tw.wd.timedOut() {
+		markTruncated(rw, w, headers.Get("Content-Type"))
+		h.Logger.Warn("response truncated by timeout", zap.String("path", h.Path))
+	}
+	return err
+}
+
+// truncatedTrailer is the trailer of responses cut off by the timeout.
+const truncatedTrailer = "X-CGI-Truncated"
+
+// markTruncated marks a response cut off by the timeout with a trailer and,
+// for HTML, a comment at the end of the body written to w.
+func markTruncated(rw http.ResponseWriter, w io.Writer, contentType string) {
+	if strings.HasPrefix(contentType, "text/html") {
+		io.WriteString(w, "\n<!-- truncated: the CGI process timed out -->\n")
+	}
+	rw.Header().Set(http.TrailerPrefix+truncatedTrailer, "timeout")
+}
+
+// isJSON reports whether contentType is a JSON media type.
+func isJSON(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func upperCaseAndUnderscore(r rune) rune {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return r - ('a' - 'A')
+	case r == '-':
+		return '_'
+	case r == '=':
+		// Maybe not part of the CGI 'spec' but would mess up
+		// the environment in any case, as Go represents the
+		// environment as a slice of "key=value" strings.
+		return '_'
+	}
+	// TODO: other transformations in spec or practice?
+	return r
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import "strings"
+
+// Helpers shared by the commands converting configurations of other web
+// servers into a Caddyfile.
+
+// writeCGIBlock writes a cgi block with the given matcher and executable.
+func writeCGIBlock(b *strings.Builder, matcher, exec, scriptName string, env, passEnv []string) {
+	b.WriteString("\tcgi " + matcher + " " + caddyQuote(exec))
+	if scriptName == "" && len(env) == 0 && len(passEnv) == 0 {
+		b.WriteString("\n")
+		return
+	}
+	b.WriteString(" {\n")
+	if scriptName != "" {
+		b.WriteString("\t\tscript_name " + caddyQuote(scriptName) + "\n")
+	}
+	if len(env) > 0 {
+		b.WriteString("\t\tenv")
+		for _, e := range env {
+			b.WriteString(" " + caddyQuote(e))
+		}
+		b.WriteString("\n")
+	}
+	if len(passEnv) > 0 {
+		b.WriteString("\t\tpass_env " + strings.Join(passEnv, " ") + "\n")
+	}
+	b.WriteString("\t}\n")
+}
+
+// caddyQuote quotes s as Caddyfile token if necessary. Within quotes, only
+// quotes are escaped.
+func caddyQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"") && !strings.HasPrefix(s, "#") && !strings.HasPrefix(s, "`") {
+		return s
+	}
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
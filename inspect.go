@@ -18,9 +18,9 @@ package cgi
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"fmt"
 	"net/http"
-	"net/http/cgi"
 	"os"
 	"sort"
 	"strings"
@@ -28,11 +28,36 @@ import (
 	"github.com/caddyserver/caddy/v2"
 )
 
+// inspects reports whether r is to be answered with the inspection page. With
+// an inspect header configured, only requests carrying it (with the token, if
+// any) are; all others execute as usual.
+func (c CGI) inspects(r *http.Request) bool {
+	if !c.Inspect {
+		return false
+	}
+	if c.InspectHeader == "" {
+		return true
+	}
+	values, ok := r.Header[http.CanonicalHeaderKey(c.InspectHeader)]
+	if !ok {
+		return false
+	}
+	if c.InspectToken == "" {
+		return true
+	}
+	for _, val := range values {
+		if subtle.ConstantTimeCompare([]byte(val), []byte(c.InspectToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
 type kvType struct {
 	key, val string
 }
 
-func inspect(hnd cgi.Handler, w http.ResponseWriter, req *http.Request, rep *caddy.Replacer) {
+func inspect(hnd handler, w http.ResponseWriter, req *http.Request, rep *caddy.Replacer) {
 	var buf bytes.Buffer
 
 	printf := func(format string, args ...interface{}) {
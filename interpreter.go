@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// applyInterpreters merges the interpreters of the cgi app with those of the
+// configuration, whose entries replace the ones for the same extension, and
+// checks them.
+func (c *CGI) applyInterpreters() error {
+	if len(c.app.Interpreters) == 0 && len(c.Interpreters) == 0 {
+		return nil
+	}
+	c.interpret = make(map[string][]string)
+	for _, m := range []map[string][]string{c.app.Interpreters, c.Interpreters} {
+		for ext, cmd := range m {
+			if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+				return fmt.Errorf("invalid interpreter extension %q, expected something like .py", ext)
+			}
+			if len(cmd) == 0 || cmd[0] == "" {
+				return fmt.Errorf("interpreter for %s has no command", ext)
+			}
+			c.interpret[ext] = cmd
+		}
+	}
+	return nil
+}
+
+// interpreter returns the interpreter and its arguments the executable at
+// path is run with, nil if it runs by itself.
+func (c CGI) interpreter(path string) []string {
+	return c.interpret[filepath.Ext(path)]
+}
+
+// interpreterCommand returns the path of the interpreter of h and the
+// arguments it gets before those of the script: its own ones and then the
+// script, whose path is taken relative to the working directory like the
+// executable otherwise.
+func (h *handler) interpreterCommand(script string) (string, []string, error) {
+	path := h.Interpreter[0]
+	if h.Chroot != "" {
+		var err error
+		if path, err = chrootPath(h.Chroot, path); err != nil {
+			return "", nil, fmt.Errorf("interpreter: %v", err)
+		}
+	} else if !strings.ContainsRune(path, filepath.Separator) && !strings.ContainsRune(path, '/') {
+		var err error
+		if path, err = exec.LookPath(path); err != nil {
+			return "", nil, fmt.Errorf("interpreter: %v", err)
+		}
+	}
+	args := append(h.Interpreter[1:len(h.Interpreter):len(h.Interpreter)], script)
+	return path, args, nil
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"net/http"
+	"runtime/pprof"
+)
+
+// Profiler label keys attached to the goroutines serving a CGI request.
+const (
+	labelRoute  = "cgi.route"
+	labelScript = "cgi.script"
+)
+
+// labelRequest attaches the route and script as profiler labels to the
+// current goroutine and to the context of r, so CPU and goroutine profiles
+// attribute the time spent on r to the route. Goroutines started while
+// serving r inherit the labels. The returned function restores the labels
+// the goroutine had before.
+func (c CGI) labelRequest(r *http.Request, script string) (*http.Request, func()) {
+	prev := r.Context()
+	ctx := pprof.WithLabels(prev, pprof.Labels(labelRoute, c.routeName(), labelScript, script))
+	pprof.SetGoroutineLabels(ctx)
+	return r.WithContext(ctx), func() { pprof.SetGoroutineLabels(prev) }
+}
@@ -0,0 +1,51 @@
+package cgi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"runtime/pprof"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// labelProgram answers with the profiler labels of its context.
+type labelProgram struct{}
+
+func (labelProgram) ServeCGI(ctx context.Context, args, env []string, stdin io.Reader, stdout io.Writer) error {
+	route, _ := pprof.Label(ctx, labelRoute)
+	script, _ := pprof.Label(ctx, labelScript)
+	_, err := fmt.Fprintf(stdout, "Content-Type: text/plain\r\n\r\n%s %s", route, script)
+	return err
+}
+
+func TestCGI_ServeHTTPProfileLabels(t *testing.T) {
+	c := CGI{
+		Name:       "wiki",
+		Executable: "test/missing",
+		logger:     zap.NewNop(),
+		program:    labelProgram{},
+	}
+	req := httptest.NewRequest("GET", "/some/path", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	res := httptest.NewRecorder()
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	if expected := "wiki test/missing"; res.Body.String() != expected {
+		t.Errorf("Unexpected labels %q. Expected %q.", res.Body.String(), expected)
+	}
+
+	// Without a name, the route is labelled with the executable.
+	c.Name = ""
+	res = httptest.NewRecorder()
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	if expected := "test/missing test/missing"; res.Body.String() != expected {
+		t.Errorf("Unexpected labels %q. Expected %q.", res.Body.String(), expected)
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// landlockRule grants a script access to everything beneath Path.
+type landlockRule struct {
+	Path  string `json:"path"`
+	Write bool   `json:"write,omitempty"`
+}
+
+// processLandlock validates the paths the CGI configuration restricts the
+// file system access of scripts to and returns the rules for them; nil if
+// the access isn't restricted.
+func (c CGI) processLandlock() ([]landlockRule, error) {
+	if len(c.LandlockRead) == 0 && len(c.LandlockWrite) == 0 {
+		return nil, nil
+	}
+	if err := landlockAvailable(); err != nil {
+		return nil, err
+	}
+	if selfExecutableErr != nil {
+		return nil, fmt.Errorf("landlock needs the path of the Caddy binary: %v", selfExecutableErr)
+	}
+	var rules []landlockRule
+	for _, list := range []struct {
+		paths []string
+		write bool
+	}{{c.LandlockRead, false}, {c.LandlockWrite, true}} {
+		for _, p := range list.paths {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				return nil, err
+			}
+			// Rules can only be added for existing paths.
+			if _, err := os.Stat(abs); err != nil {
+				return nil, fmt.Errorf("landlock path: %v", err)
+			}
+			rules = append(rules, landlockRule{Path: abs, Write: list.write})
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,62 @@
+package cgi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCGI_ServeHTTPLandlock(t *testing.T) {
+	if err := landlockAvailable(); err != nil {
+		t.Skip(err)
+	}
+	dir, err := ioutil.TempDir("", "cgi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"public", "data", "private"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, sub, "secret"), []byte(sub), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The script, its interpreter and the commands it runs.
+	read := []string{"test", filepath.Join(dir, "public")}
+	for _, p := range []string{"/bin", "/usr", "/lib", "/lib64", "/etc"} {
+		if _, err := os.Stat(p); err == nil {
+			read = append(read, p)
+		}
+	}
+	c := CGI{
+		Executable:    "test/landlock",
+		Args:          []string{dir},
+		LandlockRead:  read,
+		LandlockWrite: []string{filepath.Join(dir, "data"), "/dev/null"},
+		logger:        zap.NewNop(),
+	}
+	if c.landlock, err = c.processLandlock(); err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/landlock", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+
+	expected := "read public/secret\nread data/secret\ncreated data/new\n"
+	if res.Body.String() != expected {
+		t.Errorf("Unexpected response %q. Expected %q.", res.Body.String(), expected)
+	}
+}
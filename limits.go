@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// routeLimits holds the limits of a route that can be changed while the
+// config is running. Its values are set from the config when a handler is
+// provisioned and may be updated through the admin API afterwards.
+type routeLimits struct {
+	weight   int64
+	deadline int64 // time.Duration
+	timeout  int64 // time.Duration
+
+	// Handlers of the route with their own max_concurrent queue or cache;
+	// changes apply to all of them.
+	mu         sync.Mutex
+	concurrent int
+	queues     []*scheduler
+	cacheTTL   time.Duration
+	caches     []*responseCache
+}
+
+func (rl *routeLimits) getWeight() int {
+	return int(atomic.LoadInt64(&rl.weight))
+}
+
+func (rl *routeLimits) setWeight(weight int) {
+	atomic.StoreInt64(&rl.weight, int64(weight))
+}
+
+func (rl *routeLimits) getDeadline() time.Duration {
+	return time.Duration(atomic.LoadInt64(&rl.deadline))
+}
+
+func (rl *routeLimits) setDeadline(d time.Duration) {
+	atomic.StoreInt64(&rl.deadline, int64(d))
+}
+
+func (rl *routeLimits) getTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&rl.timeout))
+}
+
+func (rl *routeLimits) setTimeout(d time.Duration) {
+	atomic.StoreInt64(&rl.timeout, int64(d))
+}
+
+// addQueue registers the max_concurrent queue of a handler of the route.
+func (rl *routeLimits) addQueue(s *scheduler, capacity int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.queues = append(rl.queues, s)
+	rl.concurrent = capacity
+}
+
+// getMaxConcurrent returns the max_concurrent of the route; false if none of
+// its handlers has one.
+func (rl *routeLimits) getMaxConcurrent() (int, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.concurrent, len(rl.queues) > 0
+}
+
+func (rl *routeLimits) setMaxConcurrent(capacity int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.concurrent = capacity
+	for _, s := range rl.queues {
+		s.setCapacity(capacity)
+	}
+}
+
+// addCache registers the response cache of a handler of the route.
+func (rl *routeLimits) addCache(rc *responseCache, ttl time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.caches = append(rl.caches, rc)
+	rl.cacheTTL = ttl
+}
+
+// getCacheTTL returns the cache lifetime of the route; false if none of its
+// handlers caches responses.
+func (rl *routeLimits) getCacheTTL() (time.Duration, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.cacheTTL, len(rl.caches) > 0
+}
+
+func (rl *routeLimits) setCacheTTL(ttl time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.cacheTTL = ttl
+	for _, rc := range rl.caches {
+		rc.setTTL(ttl)
+	}
+}
+
+// limitsRegistry holds the limits of all routes by name.
+type limitsRegistry struct {
+	mu     sync.Mutex
+	routes map[string]*routeLimits
+}
+
+func newLimitsRegistry() *limitsRegistry {
+	return &limitsRegistry{routes: make(map[string]*routeLimits)}
+}
+
+// route returns the limits of the named route, creating them if necessary.
+func (lr *limitsRegistry) route(name string) *routeLimits {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	rl, ok := lr.routes[name]
+	if !ok {
+		rl = new(routeLimits)
+		lr.routes[name] = rl
+	}
+	return rl
+}
+
+// lookup returns the limits of the named route if it exists.
+func (lr *limitsRegistry) lookup(name string) (*routeLimits, bool) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	rl, ok := lr.routes[name]
+	return rl, ok
+}
+
+// names returns the names of all routes.
+func (lr *limitsRegistry) names() []string {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	names := make([]string, 0, len(lr.routes))
+	for name := range lr.routes {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// maxLocalRedirects is how many local redirects a request may go through
+// before it is answered with an error, so scripts redirecting to each other
+// don't loop forever.
+const maxLocalRedirects = 10
+
+// localRedirectsKey holds the number of local redirects the request of the
+// context went through.
+type localRedirectsKey struct{}
+
+// isLocalRedirect reports whether a response with headers and no status is
+// a local redirect response (RFC 3875 section 6.2.2): nothing but a Location
+// with an absolute path.
+func isLocalRedirect(headers http.Header) bool {
+	loc := headers.Get("Location")
+	return len(headers) == 1 && strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//")
+}
+
+// localRedirect answers r with the response the server produces for a GET
+// request for location, running it through all handlers again. Outside of a
+// server, the client is redirected instead.
+func (c CGI) localRedirect(w http.ResponseWriter, r *http.Request, location string) {
+	redirects, _ := r.Context().Value(localRedirectsKey{}).(int)
+	if redirects >= maxLocalRedirects {
+		c.logger.Error("too many local redirects", zap.String("location", location))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		c.logger.Error("invalid local redirect", zap.String("location", location), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	srv, ok := r.Context().Value(caddyhttp.ServerCtxKey).(http.Handler)
+	if !ok {
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusFound)
+		return
+	}
+	c.logger.Debug("local redirect", zap.String("from", r.RequestURI), zap.String("location", location))
+
+	req := r.Clone(context.WithValue(r.Context(), localRedirectsKey{}, redirects+1))
+	req.Method = http.MethodGet
+	req.URL.Path, req.URL.RawPath, req.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+	req.RequestURI = location
+	req.Body, req.ContentLength = http.NoBody, 0
+	req.TransferEncoding = nil
+	req.Header.Del("Content-Length")
+	req.Header.Del("Content-Type")
+	srv.ServeHTTP(w, req)
+}
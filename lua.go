@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+func init() {
+	caddy.RegisterModule(new(LuaProgram))
+}
+
+// LuaProgram runs the executable of a route, given by SCRIPT_FILENAME, as Lua
+// script in-process. Scripts see the CGI environment through os.getenv and
+// their arguments in arg; print and io.write produce the response and io.read
+// reads the request body. Libraries that would affect the whole server, like
+// os.exit or os.execute and the regular io library, aren't available.
+type LuaProgram struct {
+	mu      sync.Mutex
+	scripts map[string]*luaScript
+}
+
+// luaScript is a compiled script along with the modification time of its file,
+// so it can be recompiled once the file changes.
+type luaScript struct {
+	modTime time.Time
+	proto   *lua.FunctionProto
+}
+
+// CaddyModule returns the Caddy module information.
+func (*LuaProgram) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "cgi.programs.lua",
+		New: func() caddy.Module { return new(LuaProgram) },
+	}
+}
+
+// compile returns the compiled script at path, reusing the result of an
+// earlier call if the file hasn't changed since.
+func (p *LuaProgram) compile(path string) (*lua.FunctionProto, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	script, ok := p.scripts[path]
+	p.mu.Unlock()
+	if ok && script.modTime.Equal(info.ModTime()) {
+		return script.proto, nil
+	}
+
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Like the Lua interpreter, skip a shebang line so scripts can be run
+	// standalone as well.
+	if len(src) > 0 && src[0] == '#' {
+		if i := strings.IndexByte(string(src), '\n'); i >= 0 {
+			src = src[i:]
+		} else {
+			src = nil
+		}
+	}
+	chunk, err := parse.Parse(strings.NewReader(string(src)), path)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	if p.scripts == nil {
+		p.scripts = make(map[string]*luaScript)
+	}
+	p.scripts[path] = &luaScript{modTime: info.ModTime(), proto: proto}
+	p.mu.Unlock()
+	return proto, nil
+}
+
+// ServeCGI implements Program.
+func (p *LuaProgram) ServeCGI(ctx context.Context, args, env []string, stdin io.Reader, stdout io.Writer) error {
+	path := envValue(env, "SCRIPT_FILENAME")
+	if path == "" {
+		return fmt.Errorf("SCRIPT_FILENAME not set")
+	}
+	proto, err := p.compile(path)
+	if err != nil {
+		return err
+	}
+
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	L.SetContext(ctx)
+	out := bufio.NewWriter(stdout)
+	openLuaLibs(L, env, bufio.NewReader(stdin), out)
+
+	argTable := L.NewTable()
+	argTable.RawSetInt(0, lua.LString(path))
+	for i, arg := range args {
+		argTable.RawSetInt(i+1, lua.LString(arg))
+	}
+	L.SetGlobal("arg", argTable)
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		out.Flush()
+		return err
+	}
+	return out.Flush()
+}
+
+// envValue returns the value of key in env; empty if unset.
+func envValue(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], key+"=") {
+			return env[i][len(key)+1:]
+		}
+	}
+	return ""
+}
+
+// openLuaLibs opens the standard libraries that are safe to use within the
+// server and binds output, input and environment to the request.
+func openLuaLibs(L *lua.LState, env []string, in *bufio.Reader, out *bufio.Writer) {
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.LoadLibName, lua.OpenPackage},
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.OsLibName, lua.OpenOs},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	write := func(L *lua.LState, sep string) {
+		for i := 1; i <= L.GetTop(); i++ {
+			if i > 1 {
+				out.WriteString(sep)
+			}
+			out.WriteString(L.ToStringMeta(L.Get(i)).String())
+		}
+	}
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		write(L, "\t")
+		out.WriteString("\n")
+		return 0
+	}))
+
+	osTable := L.GetGlobal("os").(*lua.LTable)
+	for _, name := range []string{"execute", "exit", "remove", "rename", "setenv", "tmpname", "setlocale"} {
+		osTable.RawSetString(name, lua.LNil)
+	}
+	osTable.RawSetString("getenv", L.NewFunction(func(L *lua.LState) int {
+		key := L.CheckString(1)
+		for i := len(env) - 1; i >= 0; i-- {
+			if strings.HasPrefix(env[i], key+"=") {
+				L.Push(lua.LString(env[i][len(key)+1:]))
+				return 1
+			}
+		}
+		L.Push(lua.LNil)
+		return 1
+	}))
+
+	ioTable := L.NewTable()
+	ioTable.RawSetString("write", L.NewFunction(func(L *lua.LState) int {
+		write(L, "")
+		return 0
+	}))
+	ioTable.RawSetString("read", L.NewFunction(func(L *lua.LState) int {
+		L.Push(luaRead(L, in, L.OptString(1, "l")))
+		return 1
+	}))
+	L.SetGlobal("io", ioTable)
+}
+
+// luaRead reads from in according to the format of io.read: "a" for
+// everything, "l" for a line and "L" for a line with its newline; formats may
+// be prefixed with "*". It returns nil at the end of the input, except for
+// "a".
+func luaRead(L *lua.LState, in *bufio.Reader, format string) lua.LValue {
+	switch strings.TrimPrefix(format, "*") {
+	case "a":
+		data, err := ioutil.ReadAll(in)
+		if err != nil {
+			L.RaiseError("reading request body: %v", err)
+		}
+		return lua.LString(data)
+	case "l", "L":
+		line, err := in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err != io.EOF {
+				L.RaiseError("reading request body: %v", err)
+			}
+			return lua.LNil
+		}
+		if format == "l" || format == "*l" {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		}
+		return lua.LString(line)
+	}
+	L.ArgError(1, "invalid format")
+	return lua.LNil
+}
@@ -0,0 +1,42 @@
+package cgi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestLuaProgram(t *testing.T) {
+	for _, tc := range []struct {
+		args   []string
+		status int
+		body   string
+	}{
+		{[]string{"a", "b"}, http.StatusOK, "POST a,b body sandboxed"},
+		{[]string{"fail"}, http.StatusInternalServerError, ""},
+	} {
+		c := CGI{
+			Executable: "test/hello.lua",
+			Args:       tc.args,
+			logger:     zap.NewNop(),
+			program:    &LuaProgram{},
+		}
+		req := httptest.NewRequest(http.MethodPost, "/hello", strings.NewReader("body"))
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		res := httptest.NewRecorder()
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if res.Code != tc.status {
+			t.Errorf("Unexpected status %d. Expected %d.", res.Code, tc.status)
+		}
+		if tc.body != "" && res.Body.String() != tc.body {
+			t.Errorf("Unexpected body %q. Expected %q.", res.Body.String(), tc.body)
+		}
+	}
+}
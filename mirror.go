@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMirrorKeep is the number of environment mirrors kept if not
+// configured.
+const defaultMirrorKeep = 100
+
+// mirrorPrefix starts the names of the files written by an envMirror.
+const mirrorPrefix = "cgi-env-"
+
+// envMirror writes the environment and the command line of every request as
+// a JSON file into a diagnostics directory, keeping only the most recent
+// ones. File names start with the time of the request, so they sort by age,
+// and end with its request ID, which is also logged along with the request.
+type envMirror struct {
+	dir  string
+	keep int
+
+	mu sync.Mutex // serializes pruning
+}
+
+// mirrorRecord is the content of a mirror file.
+type mirrorRecord struct {
+	ID          string    `json:"id"`
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	URI         string    `json:"uri"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	Executable  string    `json:"executable"`
+	Interpreter []string  `json:"interpreter,omitempty"`
+	Args        []string  `json:"args"`
+	Dir         string    `json:"dir,omitempty"`
+	Env         []string  `json:"env"`
+}
+
+// newEnvMirror creates dir if needed and returns the mirror writing to it.
+func newEnvMirror(dir string, keep int) (*envMirror, error) {
+	if keep < 0 {
+		return nil, fmt.Errorf("invalid number of mirrors to keep: %d", keep)
+	}
+	if keep == 0 {
+		keep = defaultMirrorKeep
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &envMirror{dir: dir, keep: keep}, nil
+}
+
+// newRequestID returns a random ID for a request.
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// write mirrors the request req with ID id as executed by h and returns the
+// path of the file. The file is only readable by the owner, since the
+// environment may hold secrets.
+func (m *envMirror) write(id string, h *handler, req *http.Request) (string, error) {
+	now := time.Now()
+	data, err := json.MarshalIndent(mirrorRecord{
+		ID:          id,
+		Time:        now,
+		Method:      req.Method,
+		URI:         req.RequestURI,
+		RemoteAddr:  req.RemoteAddr,
+		Executable:  h.Path,
+		Interpreter: h.Interpreter,
+		Args:        h.Args,
+		Dir:         h.Dir,
+		Env:         h.environ(req),
+	}, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(m.dir, fmt.Sprintf("%s%020d-%s.json", mirrorPrefix, now.UnixNano(), id))
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return "", err
+	}
+	return path, m.prune()
+}
+
+// prune removes the oldest mirrors beyond the number to keep.
+func (m *envMirror) prune() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.Open(m.dir)
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	var mirrors []string
+	for _, name := range names {
+		if strings.HasPrefix(name, mirrorPrefix) && strings.HasSuffix(name, ".json") {
+			mirrors = append(mirrors, name)
+		}
+	}
+	if len(mirrors) <= m.keep {
+		return nil
+	}
+	sort.Strings(mirrors)
+	for _, name := range mirrors[:len(mirrors)-m.keep] {
+		if err := os.Remove(filepath.Join(m.dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
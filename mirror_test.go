@@ -0,0 +1,77 @@
+package cgi
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCGI_ServeHTTPEnvMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-cgi-mirror")
+	if err != nil {
+		t.Fatalf("Cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	c := CGI{
+		Executable: "test/missing",
+		Args:       []string{"{path}"},
+		Envs:       []string{"MIRROR_TEST=yes"},
+		logger:     zap.NewNop(),
+		program:    &testProgram{Greeting: "hello"},
+	}
+	if c.mirror, err = newEnvMirror(filepath.Join(dir, "mirror"), 2); err != nil {
+		t.Fatalf("Cannot create mirror: %v", err)
+	}
+
+	var ids []string
+	for _, path := range []string{"/first", "/second", "/third"} {
+		req := httptest.NewRequest("POST", path, strings.NewReader("body"))
+		repl := caddy.NewReplacer()
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+		if err := c.ServeHTTP(httptest.NewRecorder(), req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		id, _ := repl.GetString("cgi.request_id")
+		ids = append(ids, id)
+	}
+
+	// Only the two most recent requests are kept.
+	files, err := filepath.Glob(filepath.Join(dir, "mirror", mirrorPrefix+"*.json"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Unexpected mirrors %v (%v). Expected 2.", files, err)
+	}
+	for i, file := range files {
+		if !strings.HasSuffix(file, "-"+ids[i+1]+".json") {
+			t.Errorf("Unexpected mirror %s. Expected one of request %s.", file, ids[i+1])
+		}
+	}
+	data, err := ioutil.ReadFile(files[1])
+	if err != nil {
+		t.Fatalf("Cannot read mirror: %v", err)
+	}
+	var record mirrorRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatalf("Cannot parse mirror: %v", err)
+	}
+	if record.ID != ids[2] || record.URI != "/third" || record.Executable != "test/missing" {
+		t.Errorf("Unexpected mirror %+v.", record)
+	}
+	if len(record.Args) != 1 || record.Args[0] != "/third" {
+		t.Errorf("Unexpected args %v. Expected [/third].", record.Args)
+	}
+	var found bool
+	for _, e := range record.Env {
+		found = found || e == "MIRROR_TEST=yes"
+	}
+	if !found {
+		t.Errorf("Mirrored environment %v lacks MIRROR_TEST.", record.Env)
+	}
+}
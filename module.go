@@ -17,12 +17,24 @@
 package cgi
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
 )
 
 func init() {
@@ -36,24 +48,421 @@ func init() {
 type CGI struct {
 	// Name of executable script or binary
 	Executable string `json:"executable"`
-	// Working directory (default, current Caddy working directory)
+	// Working directory, placeholders are replaced per request (default,
+	// current Caddy working directory)
 	WorkingDirectory string `json:"workingDirectory,omitempty"`
+	// True to run scripts in the directory containing the executable, like
+	// Apache, instead of WorkingDirectory, which then only serves to find a
+	// relative executable
+	DirFromScript bool `json:"dirFromScript,omitempty"`
 	// The script path of the uri.
 	ScriptName string `json:"scriptName,omitempty"`
 	// Arguments to submit to executable
 	Args []string `json:"args,omitempty"`
+	// Interpreters by extension of the executable, each the command and its
+	// arguments, replacing those of the cgi app for the same extension
+	Interpreters map[string][]string `json:"interpreters,omitempty"`
+	// Regular expression the values of placeholders in Args, and arguments
+	// from the query string, have to match as a whole; requests with others
+	// are rejected with 400
+	ArgPattern string `json:"argPattern,omitempty"`
 	// Environment key value pairs (key=value) for this particular app
 	Envs []string `json:"envs,omitempty"`
 	// Environment keys to pass through for all apps
 	PassEnvs []string `json:"passEnvs,omitempty"`
 	// True to pass all environment variables to CGI executable
 	PassAll bool `json:"passAllEnvs,omitempty"`
+	// SERVER_SOFTWARE of the scripts (default: go), for scripts that expect
+	// a particular server
+	ServerSoftware string `json:"serverSoftware,omitempty"`
+	// GATEWAY_INTERFACE of the scripts (default: CGI/1.1)
+	GatewayInterface string `json:"gatewayInterface,omitempty"`
+	// Name patterns of the cookies passed in HTTP_COOKIE (default: all)
+	CookieAllow []string `json:"cookieAllow,omitempty"`
+	// Name patterns of the cookies left out of HTTP_COOKIE
+	CookieDeny []string `json:"cookieDeny,omitempty"`
+	// Rewrite of the Set-Cookie headers sent by the script
+	SetCookie *CookieRewrite `json:"setCookie,omitempty"`
+	// Response to requests that are shed under load instead of a plain 503
+	// error
+	ShedResponse *ShedResponse `json:"shedResponse,omitempty"`
+	// True to rebuild Content-Disposition headers of scripts with nothing
+	// but the disposition type and a file name stripped of paths and
+	// control characters
+	SanitizeDisposition bool `json:"sanitizeDisposition,omitempty"`
+	// Names of the response headers whose values are joined with commas if
+	// the script sends them more than once, or "*" for all but Set-Cookie;
+	// by default, such headers are sent repeatedly as well
+	FoldHeaders []string `json:"foldHeaders,omitempty"`
 	// True to return inspection page rather than call CGI executable
 	Inspect bool `json:"inspect,omitempty"`
+	// Request header limiting the inspection page to requests carrying it;
+	// all others execute as usual
+	InspectHeader string `json:"inspectHeader,omitempty"`
+	// Value the inspect header must have (default: any)
+	InspectToken string `json:"inspectToken,omitempty"`
+	// Replacer key holding the authenticated user (default http.auth.user.id)
+	RemoteUserKey string `json:"remoteUserKey,omitempty"`
+	// Environment variable receiving the authenticated user (default REMOTE_USER)
+	RemoteUserEnv string `json:"remoteUserEnv,omitempty"`
+	// Metadata keys next to the user key to export as <RemoteUserEnv>_<KEY>
+	RemoteUserMeta []string `json:"remoteUserMeta,omitempty"`
+	// True to not export the authenticated user at all
+	NoRemoteUser bool `json:"noRemoteUser,omitempty"`
+	// Placeholder (e.g. {http.request.host}) that selects a persistent process
+	// speaking the framed protocol instead of starting one process per request
+	PersistentKey string `json:"persistentKey,omitempty"`
+	// Time after which an unused persistent process is stopped (default 5m)
+	IdleTimeout caddy.Duration `json:"idleTimeout,omitempty"`
+	// Number of requests after which a persistent process or pool worker is
+	// replaced by a new one, to contain slow memory leaks (default:
+	// unlimited)
+	MaxRequests int `json:"maxRequests,omitempty"`
+	// Maximum number of persistent processes running at the same time; the
+	// one idle for the longest time is stopped to start another (default:
+	// unlimited)
+	MaxProcesses int `json:"maxProcesses,omitempty"`
+	// Signal sent to persistent processes kept across a config reload (e.g. SIGHUP)
+	ReloadSignal string `json:"reloadSignal,omitempty"`
+	// Starlark source defining transform(req), which can change executable,
+	// arguments and environment or reject the request
+	Transform string `json:"transform,omitempty"`
+	// Module from the cgi.programs namespace serving requests in-process
+	// instead of the executable
+	ProgramRaw json.RawMessage `json:"program,omitempty" caddy:"namespace=cgi.programs inline_key=program"`
+	// Number of instances speaking the framed protocol started ahead of time;
+	// requests go to an idle one
+	PoolSize int `json:"poolSize,omitempty"`
+	// Name of a signed cookie binding clients to the pool worker that served
+	// them first; empty to not bind them
+	Affinity string `json:"affinity,omitempty"`
+	// True to start the executable once as a FastCGI application listening
+	// on a socket managed by the handler, instead of once per request
+	FastCGI bool `json:"fastcgi,omitempty"`
+	// True to relay requests to an SCGI server, the one at SCGIAddress or
+	// else the executable started like with FastCGI
+	SCGI bool `json:"scgi,omitempty"`
+	// Network address of a running SCGI server (e.g. localhost:4000 or
+	// unix//run/app.sock)
+	SCGIAddress string `json:"scgiAddress,omitempty"`
+	// True to relay requests to a uWSGI worker over the uwsgi protocol, the
+	// one at UWSGIAddress or else the executable started like with FastCGI
+	UWSGI bool `json:"uwsgi,omitempty"`
+	// Network address of a running uWSGI worker (e.g. localhost:3031 or
+	// unix//run/app.sock)
+	UWSGIAddress string `json:"uwsgiAddress,omitempty"`
+	// Path of the Unix socket of an already running daemon to relay requests
+	// to, instead of starting the executable
+	Daemon string `json:"daemon,omitempty"`
+	// Name of this route for limits shared between routes (default: the executable)
+	Name string `json:"name,omitempty"`
+	// Share of the process limit of the cgi app this route gets when busy (default 1)
+	Weight int `json:"weight,omitempty"`
+	// Time after arrival after which a request waiting for a process is rejected
+	Deadline caddy.Duration `json:"deadline,omitempty"`
+	// Preset of timeouts, buffering and flushing for "interactive", "batch"
+	// or "streaming" routes; settings made explicitly take precedence, even
+	// if they are zero
+	Profile string `json:"profile,omitempty"`
+	// Maximum number of processes of this handler running at the same time;
+	// further requests are queued
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+	// Time a request may wait in the queue of MaxConcurrent before it is
+	// rejected with 503 (default: as long as the client waits)
+	QueueTimeout caddy.Duration `json:"queueTimeout,omitempty"`
+	// Maximum execution time of the script; it is terminated afterwards and
+	// the client gets 504 if no response was sent yet
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+	// Time the script has to send its response headers; it is terminated
+	// afterwards and the client gets 504. Unlike Timeout, this also applies
+	// to streaming routes and leaves the body as much time as it needs.
+	FirstByteTimeout caddy.Duration `json:"firstByteTimeout,omitempty"`
+	// True to mark responses cut off by Timeout: HTML gets a trailing
+	// comment and every response a trailer, while JSON is held back until
+	// the script is done and replaced by 504 if it timed out
+	MarkTruncated bool `json:"markTruncated,omitempty"`
+	// True to log the standard error of the script instead of passing it on
+	// to the one of Caddy: as an error if the script failed, otherwise as a
+	// warning
+	LogStderr bool `json:"logStderr,omitempty"`
+	// Number of bytes below which standard error of successful scripts is
+	// only logged at debug level
+	StderrMinBytes int `json:"stderrMinBytes,omitempty"`
+	// Number of times a script that exits unsuccessfully without any output
+	// is run again for requests with an idempotent method and no body,
+	// instead of answering with 500
+	Retries int `json:"retries,omitempty"`
+	// Time before the first retry, doubling with every further one (default
+	// 100ms)
+	RetryDelay caddy.Duration `json:"retryDelay,omitempty"`
+	// Maximum time between retries (default 5s)
+	RetryDelayMax caddy.Duration `json:"retryDelayMax,omitempty"`
+	// How to handle an executable that is busy (ETXTBSY) because it is
+	// being written to, as during deploys: "retry" to start it again with
+	// the delays of retries or "snapshot" to start a copy of it; by default
+	// the request fails
+	TextBusy string `json:"textBusy,omitempty"`
+	// Number of times a busy executable is started again with "retry"
+	// (default 5)
+	TextBusyRetries int `json:"textBusyRetries,omitempty"`
+	// Number of failures (unsuccessful exits) of a script within
+	// BreakerWindow after which requests for it are rejected with 503 for
+	// BreakerCooldown; 0 disables the circuit breaker
+	BreakerFailures int `json:"breakerFailures,omitempty"`
+	// Time within which failures are counted (default 1m)
+	BreakerWindow caddy.Duration `json:"breakerWindow,omitempty"`
+	// Time requests are rejected once the breaker opened (default 30s)
+	BreakerCooldown caddy.Duration `json:"breakerCooldown,omitempty"`
+	// File with the names of the environment variables of the route,
+	// recorded from the first request if missing; differences are logged
+	EnvBaseline string `json:"envBaseline,omitempty"`
+	// Directory to write the environment and command line of every request
+	// to as a JSON file, named after the request ID that is logged with it
+	EnvMirror string `json:"envMirror,omitempty"`
+	// Number of the most recent files kept in EnvMirror (default 100)
+	EnvMirrorKeep int `json:"envMirrorKeep,omitempty"`
+	// Signal that terminates timed out scripts (default SIGTERM)
+	KillSignal string `json:"killSignal,omitempty"`
+	// Time between KillSignal and killing forcibly (default 5s)
+	KillGrace caddy.Duration `json:"killGrace,omitempty"`
+	// Time running scripts get to finish when the config is reloaded before
+	// they are terminated (default: they are left running)
+	DrainTimeout caddy.Duration `json:"drainTimeout,omitempty"`
+	// True to kill the processes a script leaves behind once it exited
+	// (Unix only)
+	KillGroup bool `json:"killGroup,omitempty"`
+	// Time of silence after which a comment is injected into event streams
+	EventStreamKeepAlive caddy.Duration `json:"eventStreamKeepAlive,omitempty"`
+	// True for routes with long-running, incrementally written responses:
+	// flushes every write, disables the timeout and enables keep-alives
+	Streaming bool `json:"streaming,omitempty"`
+	// True for routes serving server-sent events: like Streaming, and
+	// successful responses are sent as uncached event streams
+	SSE bool `json:"sse,omitempty"`
+	// Interval in which responses are flushed to the client, coalescing the
+	// writes in between; with Streaming, in place of flushing every write
+	FlushInterval caddy.Duration `json:"flushInterval,omitempty"`
+	// Size in bytes up to which responses announcing their size, with
+	// Content-Length or X-Response-Size-Hint, are read completely and sent
+	// at once; responses announced larger are flushed on every write
+	ResponseBuffer int64 `json:"responseBuffer,omitempty"`
+	// True to send the Link headers with rel=preload of successful responses
+	// as 103 Early Hints before the response, and to push their targets on
+	// HTTP/2 connections that support it
+	EarlyHints bool `json:"earlyHints,omitempty"`
+	// True to answer local redirect responses of scripts (nothing but a
+	// Location with a path) with the resource at that path, as served by
+	// Caddy, instead of redirecting the client
+	LocalRedirects bool `json:"localRedirects,omitempty"`
+	// Directories whose files scripts may have sent in place of their
+	// response body by naming them in X-Sendfile (by absolute path) or
+	// X-Accel-Redirect (by path below the directories)
+	SendfileRoots []string `json:"sendfileRoots,omitempty"`
+	// How chunked request bodies are passed to the script: "spool" (default)
+	// reads them completely first to set CONTENT_LENGTH, "stream" passes them
+	// on while they arrive, without CONTENT_LENGTH
+	ChunkedBody string `json:"chunkedBody,omitempty"`
+	// When requests with Expect: 100-continue get their 100 Continue: "read"
+	// (default) once the body is first read, "immediate" before they wait
+	// for a process, or "never", rejecting them with 417 instead
+	ExpectContinue string `json:"expectContinue,omitempty"`
+	// True to connect standard input and output of scripts to Unix socket
+	// pairs instead of pipes (not on Windows)
+	SocketStdio bool `json:"socketStdio,omitempty"`
+	// Size in bytes of the send and receive buffers of the sockets of
+	// SocketStdio (default: the system default)
+	SocketBuffer int64 `json:"socketBuffer,omitempty"`
+	// True to hand the connection of upgrade requests over to the script when
+	// it answers with 101 Switching Protocols (Unix only; not over TLS or
+	// HTTP/2)
+	Upgrade bool `json:"upgrade,omitempty"`
+	// True to run the script of WebSocket requests for the whole session,
+	// with the messages of the client as lines on its standard input and the
+	// lines of its standard output as messages to the client
+	WebSocket bool `json:"websocket,omitempty"`
+	// CPU time the script may use (rounded up to seconds; Linux and macOS only)
+	LimitCPU caddy.Duration `json:"limitCpu,omitempty"`
+	// Address space the script may use, in bytes (Linux and macOS only)
+	LimitMemory int64 `json:"limitMemory,omitempty"`
+	// Number of files the script may open (Linux and macOS only)
+	LimitNofile int `json:"limitNofile,omitempty"`
+	// CPU scheduling priority of the script from -20 (highest) to 19
+	// (lowest); 0 leaves it unchanged (Linux and macOS only)
+	Nice int `json:"nice,omitempty"`
+	// File mode creation mask of the script in octal, like "027" (Linux and
+	// macOS only; rejected elsewhere)
+	Umask string `json:"umask,omitempty"`
+	// I/O scheduling class of the script: "realtime", "best-effort" or
+	// "idle" (Linux only)
+	IoniceClass string `json:"ioniceClass,omitempty"`
+	// Priority within IoniceClass from 0 (highest) to 7 (lowest)
+	IoniceLevel int `json:"ioniceLevel,omitempty"`
+	// User the script is executed as, by name or id (Unix only)
+	User string `json:"user,omitempty"`
+	// Group the script is executed as (default: primary group of User)
+	Group string `json:"group,omitempty"`
+	// Namespaces the script is executed in: ipc, mount, net, pid, uts
+	// (Linux only)
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Directory the script is confined to with chroot; executable and working
+	// directory must be inside it (Unix only)
+	Chroot string `json:"chroot,omitempty"`
+	// Seccomp preset ("default" or "basic-io") or path of a compiled BPF
+	// program restricting the system calls of the script (Linux only)
+	Seccomp string `json:"seccomp,omitempty"`
+	// Paths the script may read and execute beneath; with LandlockWrite,
+	// anything else is inaccessible to it (Linux 5.13 and later)
+	LandlockRead []string `json:"landlockRead,omitempty"`
+	// Paths the script may also modify beneath
+	LandlockWrite []string `json:"landlockWrite,omitempty"`
+	// Directory crashing scripts' core dumps are collected in (Linux only)
+	CoreDumps string `json:"coreDumps,omitempty"`
+	// Files passed to the script as descriptor 3 and above, each as
+	// name=path; paths starting with unix: are sockets connected to. The
+	// number of each is in CGI_FD_<NAME>.
+	ExtraFiles []string `json:"extraFiles,omitempty"`
+	// Delegated cgroup v2 directory in which every script process gets a
+	// transient cgroup of its own (Linux only)
+	Cgroup string `json:"cgroup,omitempty"`
+	// memory.max of the transient cgroups in bytes
+	CgroupMemory int64 `json:"cgroupMemory,omitempty"`
+	// cpu.max of the transient cgroups in percent of a CPU
+	CgroupCPU int `json:"cgroupCpu,omitempty"`
+	// Name of a sandbox defined in the cgi app whose restrictions apply
+	Sandbox string `json:"sandbox,omitempty"`
+	// "strict" to reject responses deviating from RFC 3875/7230, "compat" to
+	// additionally accept what old scripts rely on (default: lenient headers)
+	Conformance string `json:"conformance,omitempty"`
+	// True to strip a UTF-8 byte order mark and blank lines in front of the
+	// response headers, as left by some Windows editors (implied by compat)
+	StripBOM bool `json:"stripBom,omitempty"`
+
+	// URL path prefixes (e.g. /app/static/*) served as files from the working
+	// directory instead of executing the script
+	StaticPrefixes []string `json:"staticPrefixes,omitempty"`
+	// "add" or "remove" to redirect to paths with or without trailing slash;
+	// "add" only applies to the script name and to directories
+	TrailingSlash string `json:"trailingSlash,omitempty"`
+	// "nfc" to normalize PATH_INFO and SCRIPT_NAME to Unicode NFC, "raw" to
+	// export them percent-encoded as sent (default: decoded as is)
+	PathEncoding string `json:"pathEncoding,omitempty"`
+	// Longest query string accepted; longer ones are rejected with 414
+	MaxQueryLength int `json:"maxQueryLength,omitempty"`
+	// Query parameters (glob patterns like utm_*) removed before the request
+	// is handed to the script
+	StripQueryParams []string `json:"stripQueryParams,omitempty"`
+	// True to sort query parameters and lower-case the host before handing the
+	// request to the script
+	Canonicalize bool `json:"canonicalize,omitempty"`
+	// True to also pass the original query and host when canonicalizing
+	KeepOriginal bool `json:"keepOriginal,omitempty"`
+	// Interval in which the script is executed offline to bake the response
+	// for BakePath, which is then served statically
+	BakeInterval caddy.Duration `json:"bakeInterval,omitempty"`
+	// Path of the baked response (default: the script name)
+	BakePath string `json:"bakePath,omitempty"`
+	// Signal that triggers baking right away (e.g. SIGUSR2)
+	BakeSignal string `json:"bakeSignal,omitempty"`
+	// Time successful responses to GET and HEAD requests are cached for,
+	// unless their Cache-Control says otherwise; 0 to not cache responses
+	Cache caddy.Duration `json:"cache,omitempty"`
+	// Maximum size of the cached response bodies in memory (default 16MiB)
+	CacheSize int64 `json:"cacheSize,omitempty"`
+	// Request headers whose values are part of the cache key, next to the
+	// method, host, path and query; "remote_user" adds the authenticated user
+	CacheVary []string `json:"cacheVary,omitempty"`
+	// True to also keep cached responses in the storage of Caddy, where they
+	// survive evictions and reloads until they expire
+	CacheStorage bool `json:"cacheStorage,omitempty"`
+	// True to give successful responses to GET requests up to ETagLimit a
+	// strong ETag of their body, unless they have one, and to answer
+	// conditional requests with 304 (Not Modified)
+	ETag bool `json:"etag,omitempty"`
+	// Size up to which responses are buffered for their ETag (default 1MiB)
+	ETagLimit int64 `json:"etagLimit,omitempty"`
+	// True to buffer successful responses to GET requests completely and
+	// answer them like static files, honoring byte ranges
+	AcceptRanges bool `json:"acceptRanges,omitempty"`
+	// True to collect whole responses before sending them with their
+	// Content-Length instead of streaming them as they are written
+	BufferOutput bool `json:"bufferOutput,omitempty"`
+	// Size above which responses collected for AcceptRanges or BufferOutput
+	// are spooled to a temporary file instead of kept in memory (default
+	// 1MiB)
+	BufferSpool int64 `json:"bufferSpool,omitempty"`
+	// How HEAD requests are answered: "get" runs the script as for a GET
+	// request and drops the body, "cached" also answers them with the headers
+	// of a recent response to a GET request without running the script;
+	// empty to pass them on to the script as they are
+	Head string `json:"head,omitempty"`
+	// Time the headers of a response answer HEAD requests in "cached" mode,
+	// unless its Cache-Control says otherwise (default 1m)
+	HeadTTL caddy.Duration `json:"headTtl,omitempty"`
+	// True to run the script from a copy made along with SnapshotFiles
+	// whenever any of them changed, so requests never see a deploy in
+	// progress
+	DeploySnapshot bool `json:"deploySnapshot,omitempty"`
+	// Files and directories copied along with the script, relative to its
+	// directory
+	SnapshotFiles []string `json:"snapshotFiles,omitempty"`
+	// Directory the copies are made in (default: the temporary directory)
+	SnapshotDir string `json:"snapshotDir,omitempty"`
+	// True to execute the script once while provisioning, so caches are
+	// primed and errors surface before the first request
+	Warmup bool `json:"warmup,omitempty"`
+	// Path of the warm-up request (default: the script name)
+	WarmupPath string `json:"warmupPath,omitempty"`
+	// Arguments replacing the configured ones for the warm-up execution
+	WarmupArgs []string `json:"warmupArgs,omitempty"`
+	// True to make sure that the executable exists and can be executed while
+	// provisioning, so a config referring to a missing script fails to load
+	CheckExecutable bool `json:"checkExecutable,omitempty"`
+
+	logger     *zap.Logger
+	explicit   map[string]bool // JSON keys present in the config
+	app        *App
+	persistent *persistentPool
+	fastcgi    *socketApp
+	scgi       socketBackend
+	uwsgi      socketBackend
+	daemon     socketBackend
+	poolKey    string
+	limits     *routeLimits
+	bake       *baker
+	cache      *responseCache
+	heads      *headCache
+	shedBody   string
+	snapshots  *snapshotter
+	killSignal os.Signal
+	rlimits    []rlimit
+	ioprio     int
+	umask      *int
+	chroot     string
+	sendRoots  []string
+	fold       []string
+	seccomp    []byte
+	landlock   []landlockRule
+	credential *credential
+	namespaces namespaces
+	inheritEnv []string
+	interpret  map[string][]string
+	argPattern *regexp.Regexp
+	cgroup     *cgroupConfig
+	concurrent *scheduler
+	breaker    *circuitBreaker
+	baseline   *envBaseline
+	mirror     *envMirror
+	drain      *drainer
+	pool       *workerPool
+	program    Program
+	transform  *transform
+	extraFiles []extraFile
 }
 
 // Interface guards
 var (
+	_ caddy.Provisioner           = (*CGI)(nil)
+	_ caddy.CleanerUpper          = (*CGI)(nil)
 	_ caddyhttp.MiddlewareHandler = (*CGI)(nil)
 	_ caddyfile.Unmarshaler       = (*CGI)(nil)
 )
@@ -65,10 +474,494 @@ func (c CGI) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// Provision implements caddy.Provisioner.
+func (c *CGI) Provision(ctx caddy.Context) error {
+	c.logger = ctx.Logger(c)
+	if err := c.applyProfile(); err != nil {
+		return err
+	}
+	switch c.TrailingSlash {
+	case "", trailingSlashAdd, trailingSlashRemove:
+	default:
+		return fmt.Errorf("invalid trailing slash mode %q", c.TrailingSlash)
+	}
+	switch c.PathEncoding {
+	case "", pathEncodingNFC, pathEncodingRaw:
+	default:
+		return fmt.Errorf("invalid path encoding %q", c.PathEncoding)
+	}
+	switch c.Conformance {
+	case "", conformanceStrict, conformanceCompat:
+	default:
+		return fmt.Errorf("invalid conformance mode %q", c.Conformance)
+	}
+	switch c.ChunkedBody {
+	case "", chunkedBodySpool, chunkedBodyStream:
+	default:
+		return fmt.Errorf("invalid chunked body mode %q", c.ChunkedBody)
+	}
+	switch c.ExpectContinue {
+	case "", expectContinueRead, expectContinueImmediate, expectContinueNever:
+	default:
+		return fmt.Errorf("invalid expect continue mode %q", c.ExpectContinue)
+	}
+	if c.RemoteUserEnv != "" && !validEnvName(c.RemoteUserEnv) {
+		return fmt.Errorf("invalid remote user variable %q", c.RemoteUserEnv)
+	}
+	switch c.TextBusy {
+	case "", textBusyRetry, textBusySnapshot:
+	default:
+		return fmt.Errorf("invalid text busy mode %q", c.TextBusy)
+	}
+	if c.TextBusyRetries < 0 {
+		return fmt.Errorf("invalid number of text busy retries: %d", c.TextBusyRetries)
+	}
+	if c.BufferOutput && (c.Streaming || c.SSE) {
+		return fmt.Errorf("buffer_output cannot be combined with streaming or sse")
+	}
+	switch c.Head {
+	case "", headGet:
+	case headCached:
+		c.heads = newHeadCache(time.Duration(c.HeadTTL))
+	default:
+		return fmt.Errorf("invalid head mode %q", c.Head)
+	}
+	if c.SocketStdio {
+		if !socketStdioSupported {
+			return fmt.Errorf("socket_stdio is not supported on this platform")
+		}
+		if c.PoolSize > 0 || c.PersistentKey != "" || c.ProgramRaw != nil || c.FastCGI || c.SCGI || c.UWSGI || c.Daemon != "" || c.WebSocket {
+			return fmt.Errorf("socket_stdio cannot be combined with pool, persistent, program, fastcgi, scgi, uwsgi, daemon or websocket")
+		}
+	}
+	if c.SocketBuffer < 0 || c.SocketBuffer > math.MaxInt32 {
+		return fmt.Errorf("invalid socket buffer size %d", c.SocketBuffer)
+	}
+	if c.Upgrade {
+		if !upgradeSupported {
+			return fmt.Errorf("upgrade is not supported on this platform")
+		}
+		if c.PoolSize > 0 || c.PersistentKey != "" {
+			return fmt.Errorf("upgrade cannot be combined with pool or persistent")
+		}
+	}
+	if c.WebSocket {
+		if c.PoolSize > 0 || c.PersistentKey != "" || c.ProgramRaw != nil || c.Upgrade || c.FastCGI || c.SCGI || c.SCGIAddress != "" || c.UWSGI || c.Daemon != "" {
+			return fmt.Errorf("websocket cannot be combined with pool, persistent, program, upgrade, fastcgi, scgi, uwsgi or daemon")
+		}
+	}
+	app, err := ctx.App("cgi")
+	if err != nil {
+		return err
+	}
+	c.app = app.(*App)
+	c.limits = c.app.limits.route(c.routeName())
+	if c.Weight > 0 {
+		c.limits.setWeight(c.Weight)
+	} else {
+		c.limits.setWeight(1)
+	}
+	c.limits.setDeadline(time.Duration(c.Deadline))
+	c.limits.setTimeout(time.Duration(c.Timeout))
+	if c.BreakerFailures > 0 {
+		if c.PoolSize > 0 || c.PersistentKey != "" {
+			return fmt.Errorf("circuit breaker cannot be combined with pool or persistent")
+		}
+		c.breaker = newCircuitBreaker(c.BreakerFailures, time.Duration(c.BreakerWindow), time.Duration(c.BreakerCooldown))
+	}
+	if c.EnvBaseline != "" {
+		if c.baseline, err = newEnvBaseline(c.EnvBaseline); err != nil {
+			return fmt.Errorf("loading environment baseline: %v", err)
+		}
+	}
+	if c.EnvMirror != "" {
+		if c.mirror, err = newEnvMirror(c.EnvMirror, c.EnvMirrorKeep); err != nil {
+			return fmt.Errorf("preparing environment mirror: %v", err)
+		}
+	}
+	if c.MaxConcurrent > 0 {
+		c.concurrent = newScheduler(c.MaxConcurrent)
+		c.limits.addQueue(c.concurrent, c.MaxConcurrent)
+	}
+	if c.DrainTimeout > 0 {
+		c.drain = newDrainer()
+	}
+	if err := c.applySandbox(); err != nil {
+		return err
+	}
+	if err := c.applyInterpreters(); err != nil {
+		return err
+	}
+	if c.argPattern, err = compileArgPattern(c.ArgPattern); err != nil {
+		return err
+	}
+	if c.interpret != nil && c.ProgramRaw != nil {
+		return fmt.Errorf("interpreter cannot be combined with program")
+	}
+	if c.namespaces, err = parseNamespaces(c.Namespaces); err != nil {
+		return err
+	}
+	if c.rlimits, err = c.processLimits(); err != nil {
+		return err
+	}
+	if c.ioprio, err = c.processPriority(); err != nil {
+		return err
+	}
+	if c.umask, err = c.processUmask(); err != nil {
+		return err
+	}
+	if c.seccomp, err = c.processSeccomp(); err != nil {
+		return err
+	}
+	if c.landlock, err = c.processLandlock(); err != nil {
+		return err
+	}
+	if c.CoreDumps != "" {
+		if err := os.MkdirAll(c.CoreDumps, 0700); err != nil {
+			return err
+		}
+	}
+	if len(c.ExtraFiles) > 0 {
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("extra_files is not supported on this platform")
+		}
+		if c.extraFiles, err = openExtraFiles(c.ExtraFiles); err != nil {
+			return err
+		}
+	}
+	if c.KillGroup && !processGroupsSupported {
+		return fmt.Errorf("kill_group is not supported on this platform")
+	}
+	if c.credential, err = c.processCredential(); err != nil {
+		return err
+	}
+	if c.cgroup, err = c.processCgroup(); err != nil {
+		return err
+	}
+	if c.chroot, err = c.processChroot(); err != nil {
+		return err
+	}
+	if c.sendRoots, err = c.processSendfile(); err != nil {
+		return err
+	}
+	if c.fold, err = c.processFoldHeaders(); err != nil {
+		return err
+	}
+	if c.KillSignal != "" {
+		if c.killSignal, err = parseSignal(c.KillSignal); err != nil {
+			return err
+		}
+	}
+	if c.SetCookie != nil {
+		if err := c.SetCookie.validate(); err != nil {
+			return err
+		}
+	}
+	if c.ShedResponse != nil {
+		if c.shedBody, err = c.ShedResponse.load(); err != nil {
+			return err
+		}
+	}
+	if c.Transform != "" {
+		if c.transform, err = compileTransform(c.Transform); err != nil {
+			return fmt.Errorf("compiling transform: %v", err)
+		}
+	}
+	if c.ProgramRaw != nil {
+		if c.PersistentKey != "" || c.PoolSize > 0 {
+			return fmt.Errorf("program cannot be combined with persistent or pool")
+		}
+		mod, err := ctx.LoadModule(c, "ProgramRaw")
+		if err != nil {
+			return fmt.Errorf("loading program: %v", err)
+		}
+		c.program = mod.(Program)
+	}
+	if c.PoolSize > 0 {
+		if c.PersistentKey != "" {
+			return fmt.Errorf("pool and persistent cannot be combined")
+		}
+		var aff *affinity
+		if c.Affinity != "" {
+			if aff, err = newAffinity(c.Affinity); err != nil {
+				return err
+			}
+		}
+		h := c.newHandler(caddy.NewReplacer())
+		c.pool = newWorkerPool(c.PoolSize, &h, aff, c.MaxRequests, time.Duration(c.IdleTimeout))
+	} else if c.Affinity != "" {
+		return fmt.Errorf("affinity needs a pool")
+	}
+	if c.LogStderr && (c.PoolSize > 0 || c.PersistentKey != "" || c.ProgramRaw != nil || c.FastCGI || c.SCGI || c.UWSGI || c.Daemon != "") {
+		return fmt.Errorf("log_stderr cannot be combined with pool, persistent, program, fastcgi, scgi, uwsgi or daemon")
+	}
+	if c.FastCGI {
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("fastcgi is not supported on this platform")
+		}
+		if c.PoolSize > 0 || c.PersistentKey != "" || c.ProgramRaw != nil || c.Upgrade || c.BreakerFailures > 0 {
+			return fmt.Errorf("fastcgi cannot be combined with pool, persistent, program, upgrade or circuit breaker")
+		}
+		if c.fastcgi, err = c.startSocketApp("FastCGI"); err != nil {
+			return fmt.Errorf("starting FastCGI application: %v", err)
+		}
+	}
+	if c.SCGI {
+		if c.PoolSize > 0 || c.PersistentKey != "" || c.ProgramRaw != nil || c.Upgrade || c.BreakerFailures > 0 || c.FastCGI {
+			return fmt.Errorf("scgi cannot be combined with pool, persistent, program, upgrade, circuit breaker or fastcgi")
+		}
+		if c.SCGIAddress != "" {
+			if c.scgi, err = newRemoteBackend(c.SCGIAddress); err != nil {
+				return fmt.Errorf("invalid SCGI address: %v", err)
+			}
+		} else {
+			if runtime.GOOS == "windows" {
+				return fmt.Errorf("scgi without an address is not supported on this platform")
+			}
+			app, err := c.startSocketApp("SCGI")
+			if err != nil {
+				return fmt.Errorf("starting SCGI application: %v", err)
+			}
+			c.scgi = app
+		}
+	}
+	if c.UWSGI {
+		if c.PoolSize > 0 || c.PersistentKey != "" || c.ProgramRaw != nil || c.Upgrade || c.BreakerFailures > 0 || c.FastCGI || c.SCGI {
+			return fmt.Errorf("uwsgi cannot be combined with pool, persistent, program, upgrade, circuit breaker, fastcgi or scgi")
+		}
+		if c.UWSGIAddress != "" {
+			if c.uwsgi, err = newRemoteBackend(c.UWSGIAddress); err != nil {
+				return fmt.Errorf("invalid uwsgi address: %v", err)
+			}
+		} else {
+			if runtime.GOOS == "windows" {
+				return fmt.Errorf("uwsgi without an address is not supported on this platform")
+			}
+			app, err := c.startSocketApp("uwsgi")
+			if err != nil {
+				return fmt.Errorf("starting uwsgi application: %v", err)
+			}
+			c.uwsgi = app
+		}
+	}
+	if c.Daemon != "" {
+		if c.PoolSize > 0 || c.PersistentKey != "" || c.ProgramRaw != nil || c.Upgrade || c.BreakerFailures > 0 || c.FastCGI || c.SCGI || c.UWSGI {
+			return fmt.Errorf("daemon cannot be combined with pool, persistent, program, upgrade, circuit breaker, fastcgi, scgi or uwsgi")
+		}
+		c.daemon = remoteBackend{"unix", c.Daemon}
+		if staleSocket(c.Daemon) {
+			// The daemon may still be started, so this isn't an error.
+			c.logger.Warn("daemon socket is stale, the daemon isn't running", zap.String("socket", c.Daemon))
+		}
+	}
+	if c.MaxProcesses < 0 {
+		return fmt.Errorf("invalid number of persistent processes %d", c.MaxProcesses)
+	}
+	if c.PersistentKey != "" {
+		if c.MaxProcesses == 0 && strings.Contains(c.PersistentKey, "{http.request.") {
+			// Clients choosing the key could start any number of processes.
+			c.logger.Warn("persistent key depends on the request, consider limiting max_processes",
+				zap.String("key", c.PersistentKey))
+		}
+		var sig os.Signal
+		if c.ReloadSignal != "" {
+			if sig, err = parseSignal(c.ReloadSignal); err != nil {
+				return err
+			}
+		}
+		if err := c.loadPersistentPool(sig); err != nil {
+			return err
+		}
+	}
+	if c.CheckExecutable && c.SCGIAddress == "" && c.UWSGIAddress == "" && c.Daemon == "" {
+		if err := c.checkExecutable(); err != nil {
+			return fmt.Errorf("checking executable: %v", err)
+		}
+	}
+	if c.DeploySnapshot {
+		if c.PoolSize > 0 || c.PersistentKey != "" || c.ProgramRaw != nil || c.FastCGI || c.SCGI || c.UWSGI || c.Daemon != "" || c.Chroot != "" {
+			return fmt.Errorf("deploy_snapshot cannot be combined with pool, persistent, program, fastcgi, scgi, uwsgi, daemon or chroot")
+		}
+		if c.snapshots, err = newSnapshotter(c.SnapshotDir, c.SnapshotFiles); err != nil {
+			return fmt.Errorf("invalid snapshot: %v", err)
+		}
+	}
+	if c.Cache > 0 {
+		var storage cacheStorage
+		if c.CacheStorage {
+			storage = ctx.Storage()
+		}
+		c.cache = newResponseCache(time.Duration(c.Cache), c.CacheSize, c.CacheVary, storage, c.routeName(), c.logger)
+		c.limits.addCache(c.cache, time.Duration(c.Cache))
+	}
+	if c.Warmup {
+		if err := c.warmup(); err != nil {
+			return fmt.Errorf("warm-up: %v", err)
+		}
+	}
+	if c.BakeInterval > 0 {
+		path := c.BakePath
+		if path == "" {
+			path = c.ScriptName
+		}
+		if path == "" {
+			path = "/"
+		}
+		c.bake = newBaker(path, time.Duration(c.BakeInterval), c.logger)
+		if c.BakeSignal != "" {
+			sig, err := parseSignal(c.BakeSignal)
+			if err != nil {
+				return err
+			}
+			signal.Notify(c.bake.signals, sig)
+		}
+		go c.bake.run(*c)
+	}
+	return nil
+}
+
+// startSocketApp starts the executable as an application speaking protocol
+// on a socket of its own. Its environment has the configured variables, with
+// request placeholders left empty.
+func (c CGI) startSocketApp(protocol string) (*socketApp, error) {
+	repl := caddy.NewReplacer()
+	h := c.newHandler(repl)
+	for _, e := range c.Envs {
+		h.Env = append(h.Env, repl.ReplaceAll(e, ""))
+	}
+	return newSocketApp(&h, protocol)
+}
+
+// loadPersistentPool takes over the persistent pool of the previous config if
+// its processes were started the same way, or creates a new one.
+func (c *CGI) loadPersistentPool(sig os.Signal) error {
+	var err error
+	if c.poolKey, err = c.persistentPoolKey(); err != nil {
+		return err
+	}
+	pool, _, err := persistentPools.LoadOrNew(c.poolKey, func() (caddy.Destructor, error) {
+		return newPersistentPool(time.Duration(c.IdleTimeout), c.MaxRequests, c.MaxProcesses, c.logger), nil
+	})
+	if err != nil {
+		return err
+	}
+	c.persistent = pool.(*persistentPool)
+	c.persistent.adopt(c.app, c.logger, sig)
+	return nil
+}
+
+// persistentPoolKey identifies the persistent processes of this handler; the
+// processes are kept across config reloads as long as it doesn't change, so
+// it covers every setting that affects how they are started.
+func (c CGI) persistentPoolKey() (string, error) {
+	key, err := json.Marshal([]interface{}{
+		c.routeName(), c.Executable, c.Args, c.WorkingDirectory, c.DirFromScript,
+		c.PassEnvs, c.PassAll, c.PersistentKey, c.IdleTimeout, c.User, c.Group,
+		c.Sandbox, c.Chroot, c.Namespaces, c.Seccomp, c.LandlockRead, c.LandlockWrite,
+		c.Umask, c.MaxRequests, c.MaxProcesses, c.interpret,
+		c.LimitCPU, c.LimitMemory, c.LimitNofile, c.Nice, c.IoniceClass, c.IoniceLevel,
+		c.Cgroup, c.CgroupMemory, c.CgroupCPU, c.KillGroup, c.CoreDumps, c.ExtraFiles,
+	})
+	return string(key), err
+}
+
+// routeName returns the name identifying this route in limits and statistics.
+func (c CGI) routeName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Executable
+}
+
+// weight returns the current weight of the route.
+func (c CGI) weight() int {
+	if c.limits != nil {
+		return c.limits.getWeight()
+	}
+	return c.Weight
+}
+
+// deadline returns the current deadline of requests to the route.
+func (c CGI) deadline() time.Duration {
+	if c.limits != nil {
+		return c.limits.getDeadline()
+	}
+	return time.Duration(c.Deadline)
+}
+
+// timeout returns the current execution timeout of the route.
+func (c CGI) timeout() time.Duration {
+	if c.Streaming || c.SSE {
+		return 0
+	}
+	if c.limits != nil {
+		return c.limits.getTimeout()
+	}
+	return time.Duration(c.Timeout)
+}
+
+// keepAlive returns the keep-alive interval of event streams.
+func (c CGI) keepAlive() time.Duration {
+	if c.EventStreamKeepAlive == 0 && (c.Streaming || c.SSE) {
+		return defaultStreamingKeepAlive
+	}
+	return time.Duration(c.EventStreamKeepAlive)
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (c *CGI) Cleanup() error {
+	if c.drain != nil {
+		grace := time.Duration(c.KillGrace)
+		if grace <= 0 {
+			grace = defaultKillGrace
+		}
+		terminated, finished := c.drain.drain(time.Duration(c.DrainTimeout), grace)
+		if terminated > 0 {
+			c.logger.Warn("terminated CGI requests still running after drain timeout",
+				zap.Int("requests", terminated), zap.Duration("drain_timeout", time.Duration(c.DrainTimeout)))
+		}
+		if !finished {
+			c.logger.Warn("CGI requests did not finish after termination")
+		}
+	}
+	if c.bake != nil {
+		c.bake.close()
+	}
+	if c.pool != nil {
+		c.pool.close()
+	}
+	if c.fastcgi != nil {
+		c.fastcgi.close()
+	}
+	if c.scgi != nil {
+		c.scgi.close()
+	}
+	if c.uwsgi != nil {
+		c.uwsgi.close()
+	}
+	if c.daemon != nil {
+		c.daemon.close()
+	}
+	if c.snapshots != nil {
+		c.snapshots.close()
+	}
+	closeExtraFiles(c.extraFiles)
+	if c.persistent != nil {
+		if c.poolKey == "" {
+			c.persistent.close()
+			return nil
+		}
+		_, err := persistentPools.Delete(c.poolKey)
+		return err
+	}
+	return nil
+}
+
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
 func (c *CGI) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	// Consume 'em all. Matchers should be used to differentiate multiple instantiations.
 	// If they are not used, we simply combine them first-to-last.
+	directives := make(map[string]bool)
 	for d.Next() {
 		args := d.RemainingArgs()
 		if len(args) < 1 {
@@ -78,11 +971,17 @@ func (c *CGI) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		c.Args = args[1:]
 
 		for d.NextBlock(0) {
+			directives[d.Val()] = true
 			switch d.Val() {
 			case "dir":
 				if !d.Args(&c.WorkingDirectory) {
 					return d.ArgErr()
 				}
+			case "dir_from_script":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.DirFromScript = true
 			case "script_name":
 				if !d.Args(&c.ScriptName) {
 					return d.ArgErr()
@@ -97,15 +996,766 @@ func (c *CGI) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if len(c.PassEnvs) == 0 {
 					return d.ArgErr()
 				}
+			case "server_software":
+				if !d.Args(&c.ServerSoftware) {
+					return d.ArgErr()
+				}
+			case "gateway_interface":
+				if !d.Args(&c.GatewayInterface) {
+					return d.ArgErr()
+				}
 			case "pass_all_env":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
 				c.PassAll = true
+			case "cookie_allow":
+				c.CookieAllow = d.RemainingArgs()
+				if len(c.CookieAllow) == 0 {
+					return d.ArgErr()
+				}
+			case "set_cookie":
+				c.SetCookie = new(CookieRewrite)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "prefix":
+						if !d.Args(&c.SetCookie.Prefix) {
+							return d.ArgErr()
+						}
+					case "path":
+						if !d.Args(&c.SetCookie.Path) {
+							return d.ArgErr()
+						}
+					case "domain":
+						if !d.Args(&c.SetCookie.Domain) {
+							return d.ArgErr()
+						}
+					case "secure":
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+						c.SetCookie.Secure = true
+					case "http_only":
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+						c.SetCookie.HTTPOnly = true
+					case "same_site":
+						if !d.Args(&c.SetCookie.SameSite) {
+							return d.ArgErr()
+						}
+					default:
+						return fmt.Errorf("unknown set_cookie subdirective: %q", d.Val())
+					}
+				}
+			case "shed_response":
+				c.ShedResponse = new(ShedResponse)
+				if d.NextArg() {
+					var err error
+					if c.ShedResponse.Status, err = strconv.Atoi(d.Val()); err != nil {
+						return d.Errf("invalid status %q", d.Val())
+					}
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "retry_after":
+						if err := parseDuration(d, &c.ShedResponse.RetryAfter); err != nil {
+							return err
+						}
+					case "content_type":
+						if !d.Args(&c.ShedResponse.ContentType) {
+							return d.ArgErr()
+						}
+					case "body":
+						if !d.Args(&c.ShedResponse.Body) {
+							return d.ArgErr()
+						}
+					case "body_file":
+						if !d.Args(&c.ShedResponse.BodyFile) {
+							return d.ArgErr()
+						}
+					default:
+						return fmt.Errorf("unknown shed_response subdirective: %q", d.Val())
+					}
+				}
+			case "cookie_deny":
+				c.CookieDeny = d.RemainingArgs()
+				if len(c.CookieDeny) == 0 {
+					return d.ArgErr()
+				}
 			case "inspect":
 				c.Inspect = true
+				args := d.RemainingArgs()
+				if len(args) > 2 {
+					return d.ArgErr()
+				}
+				if len(args) > 0 {
+					c.InspectHeader = args[0]
+				}
+				if len(args) > 1 {
+					c.InspectToken = args[1]
+				}
+			case "remote_user":
+				args := d.RemainingArgs()
+				switch {
+				case len(args) == 1 && args[0] == "off":
+					c.NoRemoteUser = true
+				case len(args) == 1 || len(args) == 2:
+					c.RemoteUserKey = args[0]
+					if len(args) == 2 {
+						if !validEnvName(args[1]) {
+							return d.Errf("invalid remote user variable %q", args[1])
+						}
+						c.RemoteUserEnv = args[1]
+					}
+				default:
+					return d.ArgErr()
+				}
+			case "persistent":
+				if !d.Args(&c.PersistentKey) {
+					return d.ArgErr()
+				}
+			case "transform":
+				if !d.Args(&c.Transform) {
+					return d.ArgErr()
+				}
+			case "program":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				info, err := caddy.GetModule("cgi.programs." + name)
+				if err != nil {
+					return d.Errf("getting program module %q: %v", name, err)
+				}
+				prog := info.New()
+				if unm, ok := prog.(caddyfile.Unmarshaler); ok {
+					if err := unm.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+						return err
+					}
+				}
+				c.ProgramRaw = caddyconfig.JSONModuleObject(prog, "program", name, nil)
+			case "pool":
+				var size string
+				if !d.Args(&size) {
+					return d.ArgErr()
+				}
+				var err error
+				if c.PoolSize, err = strconv.Atoi(size); err != nil || c.PoolSize < 1 {
+					return d.Errf("invalid pool size %q", size)
+				}
+			case "affinity":
+				c.Affinity = defaultAffinityCookie
+				d.Args(&c.Affinity)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "fastcgi":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.FastCGI = true
+			case "scgi":
+				c.SCGI = true
+				d.Args(&c.SCGIAddress)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "uwsgi":
+				c.UWSGI = true
+				d.Args(&c.UWSGIAddress)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "daemon":
+				if !d.Args(&c.Daemon) {
+					return d.ArgErr()
+				}
+			case "reload_signal":
+				if !d.Args(&c.ReloadSignal) {
+					return d.ArgErr()
+				}
+			case "max_requests":
+				var n string
+				if !d.Args(&n) {
+					return d.ArgErr()
+				}
+				var err error
+				if c.MaxRequests, err = strconv.Atoi(n); err != nil || c.MaxRequests < 1 {
+					return d.Errf("invalid number of requests %q", n)
+				}
+			case "max_processes":
+				var n string
+				if !d.Args(&n) {
+					return d.ArgErr()
+				}
+				var err error
+				if c.MaxProcesses, err = strconv.Atoi(n); err != nil || c.MaxProcesses < 1 {
+					return d.Errf("invalid number of processes %q", n)
+				}
+			case "idle_timeout":
+				if err := parseDuration(d, &c.IdleTimeout); err != nil {
+					return err
+				}
+			case "deadline":
+				if err := parseDuration(d, &c.Deadline); err != nil {
+					return err
+				}
+			case "max_concurrent":
+				var n string
+				if !d.Args(&n) {
+					return d.ArgErr()
+				}
+				var err error
+				if c.MaxConcurrent, err = strconv.Atoi(n); err != nil || c.MaxConcurrent < 1 {
+					return d.Errf("invalid max_concurrent %q", n)
+				}
+			case "queue_timeout":
+				if err := parseDuration(d, &c.QueueTimeout); err != nil {
+					return err
+				}
+			case "timeout":
+				if err := parseDuration(d, &c.Timeout); err != nil {
+					return err
+				}
+			case "first_byte_timeout":
+				if err := parseDuration(d, &c.FirstByteTimeout); err != nil {
+					return err
+				}
+			case "mark_truncated":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.MarkTruncated = true
+			case "log_stderr":
+				c.LogStderr = true
+				var size string
+				if d.Args(&size) {
+					bytes, err := humanize.ParseBytes(size)
+					if err != nil {
+						return d.Errf("invalid size %q", size)
+					}
+					c.StderrMinBytes = int(bytes)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "circuit_breaker":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 3 {
+					return d.ArgErr()
+				}
+				var err error
+				if c.BreakerFailures, err = strconv.Atoi(args[0]); err != nil || c.BreakerFailures < 1 {
+					return d.Errf("invalid number of failures %q", args[0])
+				}
+				for i, dur := range []*caddy.Duration{&c.BreakerWindow, &c.BreakerCooldown} {
+					if len(args) < i+2 {
+						break
+					}
+					val, err := caddy.ParseDuration(args[i+1])
+					if err != nil || val <= 0 {
+						return d.Errf("invalid circuit breaker duration %q", args[i+1])
+					}
+					*dur = caddy.Duration(val)
+				}
+			case "env_baseline":
+				if !d.Args(&c.EnvBaseline) {
+					return d.ArgErr()
+				}
+			case "env_mirror":
+				if !d.Args(&c.EnvMirror) {
+					return d.ArgErr()
+				}
+				if d.NextArg() {
+					var err error
+					if c.EnvMirrorKeep, err = strconv.Atoi(d.Val()); err != nil || c.EnvMirrorKeep < 1 {
+						return d.Errf("invalid number of environment mirrors %q", d.Val())
+					}
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "retries":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 3 {
+					return d.ArgErr()
+				}
+				var err error
+				if c.Retries, err = strconv.Atoi(args[0]); err != nil || c.Retries < 0 {
+					return d.Errf("invalid number of retries %q", args[0])
+				}
+				for i, dur := range []*caddy.Duration{&c.RetryDelay, &c.RetryDelayMax} {
+					if len(args) < i+2 {
+						break
+					}
+					delay, err := caddy.ParseDuration(args[i+1])
+					if err != nil || delay <= 0 {
+						return d.Errf("invalid retry delay %q", args[i+1])
+					}
+					*dur = caddy.Duration(delay)
+				}
+			case "text_busy":
+				if !d.Args(&c.TextBusy) {
+					return d.ArgErr()
+				}
+				if d.NextArg() {
+					var err error
+					if c.TextBusyRetries, err = strconv.Atoi(d.Val()); err != nil || c.TextBusyRetries < 1 {
+						return d.Errf("invalid number of retries %q", d.Val())
+					}
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "kill_signal":
+				if !d.Args(&c.KillSignal) {
+					return d.ArgErr()
+				}
+			case "kill_group":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.KillGroup = true
+			case "drain_timeout":
+				if err := parseDuration(d, &c.DrainTimeout); err != nil {
+					return err
+				}
+			case "kill_grace":
+				if err := parseDuration(d, &c.KillGrace); err != nil {
+					return err
+				}
+			case "sse_keepalive":
+				if err := parseDuration(d, &c.EventStreamKeepAlive); err != nil {
+					return err
+				}
+			case "streaming":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.Streaming = true
+			case "profile":
+				if !d.Args(&c.Profile) {
+					return d.ArgErr()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if _, ok := profiles[c.Profile]; !ok {
+					return d.Errf("invalid profile %q", c.Profile)
+				}
+			case "flush_interval":
+				if err := parseDuration(d, &c.FlushInterval); err != nil {
+					return err
+				}
+			case "local_redirects":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.LocalRedirects = true
+			case "sendfile":
+				c.SendfileRoots = d.RemainingArgs()
+				if len(c.SendfileRoots) == 0 {
+					return d.ArgErr()
+				}
+			case "fold_headers":
+				c.FoldHeaders = d.RemainingArgs()
+				if len(c.FoldHeaders) == 0 {
+					return d.ArgErr()
+				}
+			case "sanitize_disposition":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.SanitizeDisposition = true
+			case "early_hints":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.EarlyHints = true
+			case "socket_stdio":
+				c.SocketStdio = true
+				var size string
+				if d.Args(&size) {
+					bytes, err := humanize.ParseBytes(size)
+					if err != nil || bytes == 0 {
+						return d.Errf("invalid socket buffer size %q", size)
+					}
+					c.SocketBuffer = int64(bytes)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "response_buffer":
+				var size string
+				if !d.Args(&size) {
+					return d.ArgErr()
+				}
+				bytes, err := humanize.ParseBytes(size)
+				if err != nil || bytes == 0 {
+					return d.Errf("invalid response buffer size %q", size)
+				}
+				c.ResponseBuffer = int64(bytes)
+			case "sse":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.SSE = true
+			case "chunked_body":
+				if !d.Args(&c.ChunkedBody) {
+					return d.ArgErr()
+				}
+			case "expect_continue":
+				if !d.Args(&c.ExpectContinue) {
+					return d.ArgErr()
+				}
+			case "upgrade":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.Upgrade = true
+			case "websocket":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.WebSocket = true
+			case "limit_cpu":
+				if err := parseDuration(d, &c.LimitCPU); err != nil {
+					return err
+				}
+			case "limit_memory":
+				var size string
+				if !d.Args(&size) {
+					return d.ArgErr()
+				}
+				bytes, err := humanize.ParseBytes(size)
+				if err != nil || bytes == 0 {
+					return d.Errf("invalid memory limit %q", size)
+				}
+				c.LimitMemory = int64(bytes)
+			case "limit_nofile":
+				var files string
+				if !d.Args(&files) {
+					return d.ArgErr()
+				}
+				var err error
+				if c.LimitNofile, err = strconv.Atoi(files); err != nil || c.LimitNofile < 1 {
+					return d.Errf("invalid file limit %q", files)
+				}
+			case "nice":
+				var nice string
+				if !d.Args(&nice) {
+					return d.ArgErr()
+				}
+				var err error
+				if c.Nice, err = strconv.Atoi(nice); err != nil {
+					return d.Errf("invalid nice value %q", nice)
+				}
+			case "umask":
+				if !d.Args(&c.Umask) {
+					return d.ArgErr()
+				}
+			case "ionice_class":
+				if !d.Args(&c.IoniceClass) {
+					return d.ArgErr()
+				}
+				if d.NextArg() {
+					var err error
+					if c.IoniceLevel, err = strconv.Atoi(d.Val()); err != nil {
+						return d.Errf("invalid ionice level %q", d.Val())
+					}
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "namespaces":
+				c.Namespaces = d.RemainingArgs()
+				if len(c.Namespaces) == 0 {
+					return d.ArgErr()
+				}
+			case "chroot":
+				if !d.Args(&c.Chroot) {
+					return d.ArgErr()
+				}
+			case "seccomp":
+				if !d.Args(&c.Seccomp) {
+					return d.ArgErr()
+				}
+			case "landlock_read":
+				paths := d.RemainingArgs()
+				if len(paths) == 0 {
+					return d.ArgErr()
+				}
+				c.LandlockRead = append(c.LandlockRead, paths...)
+			case "landlock_write":
+				paths := d.RemainingArgs()
+				if len(paths) == 0 {
+					return d.ArgErr()
+				}
+				c.LandlockWrite = append(c.LandlockWrite, paths...)
+			case "user":
+				if !d.Args(&c.User) {
+					return d.ArgErr()
+				}
+			case "group":
+				if !d.Args(&c.Group) {
+					return d.ArgErr()
+				}
+			case "core_dumps":
+				if !d.Args(&c.CoreDumps) {
+					return d.ArgErr()
+				}
+			case "extra_files":
+				files := d.RemainingArgs()
+				if len(files) == 0 {
+					return d.ArgErr()
+				}
+				c.ExtraFiles = append(c.ExtraFiles, files...)
+			case "cgroup":
+				if !d.Args(&c.Cgroup) {
+					return d.ArgErr()
+				}
+			case "cgroup_memory":
+				var size string
+				if !d.Args(&size) {
+					return d.ArgErr()
+				}
+				bytes, err := humanize.ParseBytes(size)
+				if err != nil || bytes == 0 {
+					return d.Errf("invalid memory limit %q", size)
+				}
+				c.CgroupMemory = int64(bytes)
+			case "cgroup_cpu":
+				var percent string
+				if !d.Args(&percent) {
+					return d.ArgErr()
+				}
+				var err error
+				if c.CgroupCPU, err = strconv.Atoi(strings.TrimSuffix(percent, "%")); err != nil || c.CgroupCPU < 1 {
+					return d.Errf("invalid CPU limit %q", percent)
+				}
+			case "arg_pattern":
+				if !d.Args(&c.ArgPattern) {
+					return d.ArgErr()
+				}
+			case "interpreter":
+				args := d.RemainingArgs()
+				if len(args) < 2 {
+					return d.ArgErr()
+				}
+				if c.Interpreters == nil {
+					c.Interpreters = make(map[string][]string)
+				}
+				c.Interpreters[args[0]] = args[1:]
+			case "sandbox":
+				if !d.Args(&c.Sandbox) {
+					return d.ArgErr()
+				}
+			case "conformance":
+				if !d.Args(&c.Conformance) {
+					return d.ArgErr()
+				}
+				if c.Conformance != conformanceStrict && c.Conformance != conformanceCompat {
+					return d.Errf("invalid conformance mode %q", c.Conformance)
+				}
+			case "strip_bom":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.StripBOM = true
+			case "name":
+				if !d.Args(&c.Name) {
+					return d.ArgErr()
+				}
+			case "weight":
+				var weight string
+				if !d.Args(&weight) {
+					return d.ArgErr()
+				}
+				var err error
+				if c.Weight, err = strconv.Atoi(weight); err != nil || c.Weight < 1 {
+					return d.Errf("invalid weight %q", weight)
+				}
+			case "static":
+				c.StaticPrefixes = d.RemainingArgs()
+				if len(c.StaticPrefixes) == 0 {
+					return d.ArgErr()
+				}
+			case "trailing_slash":
+				if !d.Args(&c.TrailingSlash) {
+					return d.ArgErr()
+				}
+				if c.TrailingSlash != trailingSlashAdd && c.TrailingSlash != trailingSlashRemove {
+					return d.Errf("invalid trailing_slash mode %q", c.TrailingSlash)
+				}
+			case "path_encoding":
+				if !d.Args(&c.PathEncoding) {
+					return d.ArgErr()
+				}
+				if c.PathEncoding != pathEncodingNFC && c.PathEncoding != pathEncodingRaw {
+					return d.Errf("invalid path_encoding %q", c.PathEncoding)
+				}
+			case "max_query_length":
+				var length string
+				if !d.Args(&length) {
+					return d.ArgErr()
+				}
+				var err error
+				if c.MaxQueryLength, err = strconv.Atoi(length); err != nil || c.MaxQueryLength < 1 {
+					return d.Errf("invalid max_query_length %q", length)
+				}
+			case "strip_query_params":
+				c.StripQueryParams = d.RemainingArgs()
+				if len(c.StripQueryParams) == 0 {
+					return d.ArgErr()
+				}
+			case "canonicalize":
+				c.Canonicalize = true
+				switch args := d.RemainingArgs(); {
+				case len(args) == 1 && args[0] == "keep_original":
+					c.KeepOriginal = true
+				case len(args) > 0:
+					return d.ArgErr()
+				}
+			case "bake":
+				args := d.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(args[0])
+				if err != nil || interval <= 0 {
+					return d.Errf("invalid bake interval %q", args[0])
+				}
+				c.BakeInterval = caddy.Duration(interval)
+				if len(args) == 2 {
+					c.BakePath = args[1]
+				}
+			case "bake_signal":
+				if !d.Args(&c.BakeSignal) {
+					return d.ArgErr()
+				}
+			case "cache":
+				if err := parseDuration(d, &c.Cache); err != nil {
+					return err
+				}
+				var size string
+				if d.Args(&size) {
+					bytes, err := humanize.ParseBytes(size)
+					if err != nil || bytes == 0 {
+						return d.Errf("invalid cache size %q", size)
+					}
+					c.CacheSize = int64(bytes)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "cache_vary":
+				c.CacheVary = d.RemainingArgs()
+				if len(c.CacheVary) == 0 {
+					return d.ArgErr()
+				}
+			case "cache_storage":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.CacheStorage = true
+			case "deploy_snapshot":
+				c.DeploySnapshot = true
+				c.SnapshotFiles = d.RemainingArgs()
+			case "snapshot_dir":
+				if !d.Args(&c.SnapshotDir) {
+					return d.ArgErr()
+				}
+			case "etag":
+				c.ETag = true
+				var size string
+				if d.Args(&size) {
+					bytes, err := humanize.ParseBytes(size)
+					if err != nil || bytes == 0 {
+						return d.Errf("invalid etag size %q", size)
+					}
+					c.ETagLimit = int64(bytes)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "head":
+				if !d.Args(&c.Head) {
+					return d.ArgErr()
+				}
+				if c.Head == headCached && d.NextArg() {
+					ttl, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("invalid duration %q: %v", d.Val(), err)
+					}
+					c.HeadTTL = caddy.Duration(ttl)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "accept_ranges", "buffer_output":
+				if d.Val() == "accept_ranges" {
+					c.AcceptRanges = true
+				} else {
+					c.BufferOutput = true
+				}
+				var size string
+				if d.Args(&size) {
+					bytes, err := humanize.ParseBytes(size)
+					if err != nil || bytes == 0 {
+						return d.Errf("invalid spool size %q", size)
+					}
+					c.BufferSpool = int64(bytes)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "warmup":
+				args := d.RemainingArgs()
+				if len(args) > 1 {
+					return d.ArgErr()
+				}
+				c.Warmup = true
+				if len(args) == 1 {
+					c.WarmupPath = args[0]
+				}
+			case "check_executable":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.CheckExecutable = true
+			case "warmup_args":
+				c.WarmupArgs = d.RemainingArgs()
+				if len(c.WarmupArgs) == 0 {
+					return d.ArgErr()
+				}
+			case "remote_user_meta":
+				c.RemoteUserMeta = d.RemainingArgs()
+				if len(c.RemoteUserMeta) == 0 {
+					return d.ArgErr()
+				}
 			default:
 				return fmt.Errorf("unknown subdirective: %q", d.Val())
 			}
 		}
 	}
+	return c.expandProfile(directives)
+}
+
+// parseDuration reads the single duration argument of the current subdirective.
+func parseDuration(d *caddyfile.Dispenser, dur *caddy.Duration) error {
+	var val string
+	if !d.Args(&val) {
+		return d.ArgErr()
+	}
+	parsed, err := caddy.ParseDuration(val)
+	if err != nil {
+		return d.Errf("invalid duration %q: %v", val, err)
+	}
+	*dur = caddy.Duration(parsed)
 	return nil
 }
 
@@ -0,0 +1,98 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// namespaces holds the clone flags of the namespaces a script is executed in.
+type namespaces uintptr
+
+var namespaceFlags = map[string]uintptr{
+	"ipc":   syscall.CLONE_NEWIPC,
+	"mount": syscall.CLONE_NEWNS,
+	"net":   syscall.CLONE_NEWNET,
+	"pid":   syscall.CLONE_NEWPID,
+	"uts":   syscall.CLONE_NEWUTS,
+}
+
+// parseNamespaces returns the flags for the given namespace names.
+func parseNamespaces(names []string) (namespaces, error) {
+	var ns namespaces
+	for _, name := range names {
+		flag, ok := namespaceFlags[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown namespace %q", name)
+		}
+		ns |= namespaces(flag)
+	}
+	return ns, nil
+}
+
+// isolatesProcesses reports whether the script gets new pid and mount
+// namespaces, in which the shim mounts a /proc showing only the processes of
+// the script.
+func (ns namespaces) isolatesProcesses() bool {
+	return ns&syscall.CLONE_NEWPID != 0 && ns&syscall.CLONE_NEWNS != 0
+}
+
+// mountProc replaces /proc with one for the current pid namespace. Mounts are
+// made private first, so this doesn't propagate to the host.
+func mountProc() error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %v", err)
+	}
+	return nil
+}
+
+// dropCredential switches the calling thread to cred, dropping supplementary
+// groups. The raw system calls only affect the calling thread, which is fine
+// right before exec.
+func dropCredential(cred *credential) error {
+	if _, _, errno := syscall.RawSyscall(sysSetgroups, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("dropping supplementary groups: %v", errno)
+	}
+	gid := uintptr(cred.Gid)
+	if _, _, errno := syscall.RawSyscall(sysSetresgid, gid, gid, gid); errno != 0 {
+		return fmt.Errorf("setting group %d: %v", cred.Gid, errno)
+	}
+	uid := uintptr(cred.Uid)
+	if _, _, errno := syscall.RawSyscall(sysSetresuid, uid, uid, uid); errno != 0 {
+		return fmt.Errorf("setting user %d: %v", cred.Uid, errno)
+	}
+	return nil
+}
+
+// apply makes cmd execute in new namespaces.
+func (ns namespaces) apply(cmd *exec.Cmd) {
+	if ns == 0 {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+	cmd.SysProcAttr.Cloneflags = uintptr(ns)
+}
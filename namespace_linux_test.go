@@ -0,0 +1,70 @@
+package cgi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCGI_ServeHTTPIsolatedProcesses(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("namespaces need root")
+	}
+	// The script must be reachable for the unprivileged user.
+	dir, err := ioutil.TempDir("", "cgi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	script, err := ioutil.ReadFile("test/procs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "procs"), script, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ns, err := parseNamespaces([]string{"pid", "mount"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := CGI{
+		Executable: filepath.Join(dir, "procs"),
+		logger:     zap.NewNop(),
+		namespaces: ns,
+		credential: &credential{Uid: 65534, Gid: 65534},
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/procs", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+
+	matches := regexp.MustCompile(`pid (\d+) processes (\d+) uid (\d+)`).FindStringSubmatch(res.Body.String())
+	if matches == nil {
+		t.Fatalf("Unexpected response %q.", res.Body.String())
+	}
+	if matches[1] != "1" {
+		t.Errorf("Unexpected pid %s. Expected %d.", matches[1], 1)
+	}
+	// The script and the commands of its pipeline.
+	if n, _ := strconv.Atoi(matches[2]); n > 4 {
+		t.Errorf("Unexpected number of visible processes %d. Expected at most %d.", n, 4)
+	}
+	if matches[3] != "65534" {
+		t.Errorf("Unexpected uid %s. Expected %d.", matches[3], 65534)
+	}
+}
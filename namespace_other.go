@@ -0,0 +1,47 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// namespaces are only implemented on Linux.
+type namespaces uintptr
+
+func parseNamespaces(names []string) (namespaces, error) {
+	if len(names) > 0 {
+		return 0, errors.New("namespaces are not supported on this platform")
+	}
+	return 0, nil
+}
+
+func (ns namespaces) apply(cmd *exec.Cmd) {}
+
+func (ns namespaces) isolatesProcesses() bool { return false }
+
+func mountProc() error {
+	return errors.New("namespaces are not supported on this platform")
+}
+
+func dropCredential(cred *credential) error {
+	return errors.New("namespaces are not supported on this platform")
+}
@@ -0,0 +1,602 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "cgi-import-nginx",
+		Func:  cmdImportNginx,
+		Usage: "[--fastcgi-pass <address>] <file>...",
+		Short: "Converts nginx locations served by fcgiwrap into a Caddyfile",
+		Long: `
+Reads nginx configuration files (nginx.conf or files of server blocks) and
+prints a Caddyfile to standard output, with a cgi block for every location
+that passes requests to fcgiwrap.
+
+Locations count as served by fcgiwrap if the address of their fastcgi_pass
+contains the --fastcgi-pass address, "fcgiwrap" by default. The executable is
+taken from the SCRIPT_FILENAME parameter (or root and the script name), and
+other fastcgi_param directives, including those of the standard fastcgi_params
+and fastcgi.conf includes, become environment variables with nginx variables
+replaced by Caddy placeholders. Anything that can't be converted is reported
+as a comment in the output.
+`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("cgi-import-nginx", flag.ExitOnError)
+			fs.String("fastcgi-pass", "fcgiwrap", "Part of the fastcgi_pass address of fcgiwrap")
+			return fs
+		}(),
+	})
+}
+
+func cmdImportNginx(fl caddycmd.Flags) (int, error) {
+	if fl.NArg() == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("no configuration files given")
+	}
+	var sources []apacheSource
+	for _, name := range fl.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		defer f.Close()
+		sources = append(sources, apacheSource{name: name, r: f})
+	}
+	out, err := convertNginx(sources, fl.String("fastcgi-pass"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Print(out)
+	return caddy.ExitCodeSuccess, nil
+}
+
+// nginxStandardParams are the parameters of the fastcgi_params file shipped
+// with nginx; fastcgi.conf adds SCRIPT_FILENAME.
+var nginxStandardParams = [][2]string{
+	{"QUERY_STRING", "$query_string"},
+	{"REQUEST_METHOD", "$request_method"},
+	{"CONTENT_TYPE", "$content_type"},
+	{"CONTENT_LENGTH", "$content_length"},
+	{"SCRIPT_NAME", "$fastcgi_script_name"},
+	{"REQUEST_URI", "$request_uri"},
+	{"DOCUMENT_URI", "$document_uri"},
+	{"DOCUMENT_ROOT", "$document_root"},
+	{"SERVER_PROTOCOL", "$server_protocol"},
+	{"REQUEST_SCHEME", "$scheme"},
+	{"HTTPS", "$https"},
+	{"GATEWAY_INTERFACE", "CGI/1.1"},
+	{"SERVER_SOFTWARE", "nginx/$nginx_version"},
+	{"REMOTE_ADDR", "$remote_addr"},
+	{"REMOTE_PORT", "$remote_port"},
+	{"SERVER_ADDR", "$server_addr"},
+	{"SERVER_PORT", "$server_port"},
+	{"SERVER_NAME", "$server_name"},
+	{"REDIRECT_STATUS", "200"},
+}
+
+// nginxModuleParams are set by the cgi handler itself.
+var nginxModuleParams = map[string]bool{
+	"QUERY_STRING":      true,
+	"REQUEST_METHOD":    true,
+	"CONTENT_TYPE":      true,
+	"CONTENT_LENGTH":    true,
+	"REQUEST_URI":       true,
+	"SERVER_PROTOCOL":   true,
+	"HTTPS":             true,
+	"GATEWAY_INTERFACE": true,
+	"SERVER_SOFTWARE":   true,
+	"REMOTE_ADDR":       true,
+	"REMOTE_PORT":       true,
+	"SERVER_PORT":       true,
+	"SERVER_NAME":       true,
+	"SCRIPT_FILENAME":   true,
+}
+
+// nginxVariables maps nginx variables to Caddy placeholders.
+var nginxVariables = map[string]string{
+	"uri":             "{http.request.uri.path}",
+	"document_uri":    "{http.request.uri.path}",
+	"request_uri":     "{http.request.uri}",
+	"query_string":    "{http.request.uri.query}",
+	"args":            "{http.request.uri.query}",
+	"host":            "{http.request.host}",
+	"server_name":     "{http.request.host}",
+	"remote_addr":     "{http.request.remote.host}",
+	"remote_port":     "{http.request.remote.port}",
+	"request_method":  "{http.request.method}",
+	"scheme":          "{http.request.scheme}",
+	"server_port":     "{http.request.port}",
+	"server_protocol": "{http.request.proto}",
+	"content_type":    "{http.request.header.Content-Type}",
+	"content_length":  "{http.request.header.Content-Length}",
+	"remote_user":     "{http.auth.user.id}",
+}
+
+// nginxDirective is a directive of a configuration file along with its block,
+// if it has one.
+type nginxDirective struct {
+	name  string
+	args  []string
+	line  int
+	block []nginxDirective
+}
+
+// parseNginx reads the directives of an nginx configuration file.
+func parseNginx(name string, r io.Reader) ([]nginxDirective, error) {
+	type token struct {
+		text   string
+		line   int
+		quoted bool
+	}
+	var tokens []token
+	sc := bufio.NewScanner(r)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := sc.Text()
+		for i := 0; i < len(line); {
+			c := line[i]
+			switch {
+			case c == ' ' || c == '\t' || c == '\r':
+				i++
+			case c == '#':
+				i = len(line)
+			case c == ';' || c == '{' || c == '}':
+				tokens = append(tokens, token{text: string(c), line: lineNo})
+				i++
+			case c == '"' || c == '\'':
+				var val strings.Builder
+				j := i + 1
+				for ; j < len(line) && line[j] != c; j++ {
+					if line[j] == '\\' && j+1 < len(line) {
+						j++
+					}
+					val.WriteByte(line[j])
+				}
+				if j == len(line) {
+					return nil, fmt.Errorf("%s:%d: unterminated quote", name, lineNo)
+				}
+				tokens = append(tokens, token{text: val.String(), line: lineNo, quoted: true})
+				i = j + 1
+			default:
+				j := i
+				for j < len(line) && !strings.ContainsRune(" \t\r;{}#", rune(line[j])) {
+					j++
+				}
+				tokens = append(tokens, token{text: line[i:j], line: lineNo})
+				i = j
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	pos := 0
+	var parse func(nested bool) ([]nginxDirective, error)
+	parse = func(nested bool) ([]nginxDirective, error) {
+		var dirs []nginxDirective
+		for pos < len(tokens) {
+			t := tokens[pos]
+			pos++
+			if !t.quoted && t.text == "}" {
+				if !nested {
+					return nil, fmt.Errorf("%s:%d: unexpected }", name, t.line)
+				}
+				return dirs, nil
+			}
+			if !t.quoted && (t.text == ";" || t.text == "{") {
+				return nil, fmt.Errorf("%s:%d: unexpected %s", name, t.line, t.text)
+			}
+			d := nginxDirective{name: t.text, line: t.line}
+			for {
+				if pos == len(tokens) {
+					return nil, fmt.Errorf("%s:%d: unterminated %s", name, t.line, t.text)
+				}
+				a := tokens[pos]
+				pos++
+				if !a.quoted && a.text == ";" {
+					break
+				}
+				if !a.quoted && a.text == "{" {
+					block, err := parse(true)
+					if err != nil {
+						return nil, err
+					}
+					if d.block = block; d.block == nil {
+						d.block = []nginxDirective{}
+					}
+					break
+				}
+				if !a.quoted && a.text == "}" {
+					return nil, fmt.Errorf("%s:%d: unexpected }", name, a.line)
+				}
+				d.args = append(d.args, a.text)
+			}
+			dirs = append(dirs, d)
+		}
+		if nested {
+			return nil, fmt.Errorf("%s: unterminated block", name)
+		}
+		return dirs, nil
+	}
+	return parse(false)
+}
+
+// nginxParam is a fastcgi_param; standard ones come from the fastcgi_params
+// and fastcgi.conf includes.
+type nginxParam struct {
+	name, value string
+	standard    bool
+}
+
+// nginxLevel holds the settings of a block, inherited from the enclosing one.
+type nginxLevel struct {
+	site   *nginxSite
+	root   string
+	params []nginxParam
+	split  string
+}
+
+// nginxSite is a server block.
+type nginxSite struct {
+	names     []string
+	port      string
+	listen    bool // port taken from a listen directive
+	locations []nginxLocation
+	notes     []string
+}
+
+// Kinds of locations in the order nginx prefers them.
+const (
+	nginxExact = iota
+	nginxPriorityPrefix
+	nginxRegexp
+	nginxPrefix
+)
+
+// nginxLocation is a location passing requests to fcgiwrap.
+type nginxLocation struct {
+	source string
+	line   int
+	kind   int
+	path   string // path or regular expression
+	lvl    *nginxLevel
+}
+
+// convertNginx converts the locations of the nginx configuration files in
+// sources that pass requests to an address containing pass into a
+// Caddyfile. With an empty pass, all locations with fastcgi_pass are
+// converted.
+func convertNginx(sources []apacheSource, pass string) (string, error) {
+	var sites []*nginxSite
+	var defaultSite *nginxSite
+	var notes []string
+	for _, src := range sources {
+		dirs, err := parseNginx(src.name, src.r)
+		if err != nil {
+			return "", err
+		}
+		var walk func(dirs []nginxDirective, parent *nginxLevel, block *nginxDirective)
+		walk = func(dirs []nginxDirective, parent *nginxLevel, block *nginxDirective) {
+			lvl := &nginxLevel{site: parent.site, root: parent.root, split: parent.split}
+			if block != nil && block.name == "server" {
+				lvl.site = &nginxSite{port: "80"}
+				sites = append(sites, lvl.site)
+			}
+			// Locations outside of server blocks, e.g. in snippets
+			// included by them, belong to a site of their own.
+			site := func() *nginxSite {
+				if lvl.site == nil {
+					if defaultSite == nil {
+						defaultSite = &nginxSite{port: "80"}
+						sites = append(sites, defaultSite)
+					}
+					lvl.site = defaultSite
+				}
+				return lvl.site
+			}
+			note := func(d nginxDirective, format string, args ...interface{}) {
+				n := fmt.Sprintf("%s:%d: ", src.name, d.line) + fmt.Sprintf(format, args...)
+				if lvl.site != nil {
+					lvl.site.notes = append(lvl.site.notes, n)
+				} else {
+					notes = append(notes, n)
+				}
+			}
+
+			// Settings apply to the whole block, wherever they appear.
+			var params []nginxParam
+			var fastcgiPass *nginxDirective
+			for i, d := range dirs {
+				switch d.name {
+				case "root":
+					if len(d.args) == 1 {
+						lvl.root = strings.TrimSuffix(d.args[0], "/")
+					}
+				case "fastcgi_param":
+					if len(d.args) >= 2 {
+						params = append(params, nginxParam{name: d.args[0], value: d.args[1]})
+					}
+				case "include":
+					switch base := path.Base(strings.Join(d.args, " ")); base {
+					case "fastcgi_params", "fastcgi.conf":
+						for _, p := range nginxStandardParams {
+							params = append(params, nginxParam{name: p[0], value: p[1], standard: true})
+						}
+						if base == "fastcgi.conf" {
+							params = append(params, nginxParam{name: "SCRIPT_FILENAME", value: "$document_root$fastcgi_script_name", standard: true})
+						}
+					default:
+						note(d, "include %s not followed", strings.Join(d.args, " "))
+					}
+				case "fastcgi_split_path_info":
+					if len(d.args) == 1 {
+						lvl.split = d.args[0]
+					}
+				case "fastcgi_pass":
+					fastcgiPass = &dirs[i]
+				case "listen":
+					if lvl.site != nil && block.name == "server" && !lvl.site.listen && len(d.args) > 0 {
+						port := d.args[0]
+						if i := strings.LastIndex(port, ":"); i >= 0 {
+							port = port[i+1:]
+						}
+						lvl.site.port, lvl.site.listen = port, true
+					}
+				case "server_name":
+					if lvl.site != nil && block.name == "server" {
+						for _, name := range d.args {
+							if name != "_" && name != "" {
+								lvl.site.names = append(lvl.site.names, name)
+							}
+						}
+					}
+				}
+			}
+			// Like nginx, only inherit parameters if there are none at
+			// this level.
+			if lvl.params = params; len(params) == 0 {
+				lvl.params = parent.params
+			}
+
+			if fastcgiPass != nil {
+				addr := strings.Join(fastcgiPass.args, " ")
+				switch {
+				case block == nil || block.name != "location":
+					note(*fastcgiPass, "fastcgi_pass outside of a location not converted")
+				case pass != "" && !strings.Contains(addr, pass):
+					note(*fastcgiPass, "fastcgi_pass %s not converted", addr)
+				default:
+					loc, ok := newNginxLocation(block.args)
+					if !ok {
+						note(*block, "location %s not converted", strings.Join(block.args, " "))
+						break
+					}
+					loc.source, loc.line, loc.lvl = src.name, block.line, lvl
+					s := site()
+					s.locations = append(s.locations, loc)
+				}
+			}
+
+			for i, d := range dirs {
+				switch d.name {
+				case "http", "server", "location":
+					if d.block != nil {
+						walk(d.block, lvl, &dirs[i])
+					}
+				case "if", "limit_except":
+					for _, inner := range d.block {
+						if inner.name == "fastcgi_pass" {
+							note(d, "fastcgi_pass within %s not converted", d.name)
+						}
+					}
+				}
+			}
+		}
+		walk(dirs, &nginxLevel{}, nil)
+	}
+
+	var b strings.Builder
+	b.WriteString("{\n\torder cgi last\n}\n")
+	for _, n := range notes {
+		b.WriteString("# " + n + "\n")
+	}
+	for _, site := range sites {
+		addrs := append([]string(nil), site.names...)
+		if len(addrs) == 0 {
+			addrs = []string{""}
+		}
+		for i, addr := range addrs {
+			if addr == "" || site.port != "80" && site.port != "443" {
+				addrs[i] = addr + ":" + site.port
+			}
+		}
+		b.WriteString("\n" + strings.Join(addrs, " ") + " {\n")
+		// nginx tries exact locations first, then the longest prefix
+		// with ^~, regular expressions in order and the longest prefix.
+		locs := append([]nginxLocation(nil), site.locations...)
+		sort.SliceStable(locs, func(i, j int) bool {
+			if locs[i].kind != locs[j].kind {
+				return locs[i].kind < locs[j].kind
+			}
+			return locs[i].kind != nginxRegexp && len(locs[i].path) > len(locs[j].path)
+		})
+		var blocks strings.Builder
+		for i, loc := range locs {
+			name := fmt.Sprintf("cgi%d", i+1)
+			matchers, exec, env, unsupported := loc.convert(name)
+			for _, v := range unsupported {
+				site.notes = append(site.notes, fmt.Sprintf("%s:%d: $%s not supported, left empty", loc.source, loc.line, v))
+			}
+			if len(matchers) == 1 {
+				blocks.WriteString("\t@" + name + " " + matchers[0] + "\n")
+			} else {
+				blocks.WriteString("\t@" + name + " {\n")
+				for _, m := range matchers {
+					blocks.WriteString("\t\t" + m + "\n")
+				}
+				blocks.WriteString("\t}\n")
+			}
+			// Like locations, the routes exclude each other.
+			var cgi strings.Builder
+			writeCGIBlock(&cgi, "*", exec, "", env, nil)
+			blocks.WriteString("\thandle @" + name + " {\n")
+			blocks.WriteString("\t" + strings.Replace(cgi.String(), "\n\t", "\n\t\t", -1))
+			blocks.WriteString("\t}\n")
+		}
+		for _, n := range site.notes {
+			b.WriteString("\t# " + n + "\n")
+		}
+		b.WriteString(blocks.String())
+		b.WriteString("}\n")
+	}
+	return b.String(), nil
+}
+
+// newNginxLocation returns the location for the arguments of a location
+// block; false if it can't be converted, like a named location.
+func newNginxLocation(args []string) (nginxLocation, bool) {
+	modifier := ""
+	if len(args) == 2 {
+		modifier, args = args[0], args[1:]
+	}
+	if len(args) != 1 {
+		return nginxLocation{}, false
+	}
+	loc := nginxLocation{path: args[0]}
+	switch modifier {
+	case "=":
+		loc.kind = nginxExact
+	case "^~":
+		loc.kind = nginxPriorityPrefix
+	case "":
+		if strings.HasPrefix(loc.path, "@") {
+			return nginxLocation{}, false
+		}
+		loc.kind = nginxPrefix
+	case "~":
+		loc.kind = nginxRegexp
+	case "~*":
+		loc.kind, loc.path = nginxRegexp, "(?i)"+loc.path
+	default:
+		return nginxLocation{}, false
+	}
+	return loc, true
+}
+
+// nginxVariable matches variables like $uri or ${uri}.
+var nginxVariable = regexp.MustCompile(`\$(\{\w+\}|\w+)`)
+
+// convert returns the matchers of the named matcher name, the executable and
+// the environment of the cgi block for loc, along with the variables that
+// couldn't be translated.
+func (loc nginxLocation) convert(name string) (matchers []string, exec string, env, unsupported []string) {
+	// The location is matched without a name, if the splitting expression
+	// provides the captures.
+	re := loc.path
+	switch loc.kind {
+	case nginxExact:
+		re = "^" + regexp.QuoteMeta(loc.path) + "$"
+	case nginxPriorityPrefix, nginxPrefix:
+		re = "^" + regexp.QuoteMeta(loc.path)
+	}
+	split := loc.lvl.split
+	if split == "" {
+		matchers = []string{"path_regexp " + name + " " + caddyQuote(re)}
+	} else {
+		matchers = []string{"path_regexp " + caddyQuote(re),
+			"vars_regexp " + name + " {http.request.uri.path} " + caddyQuote(split)}
+	}
+
+	translate := func(value string, report bool) (string, bool) {
+		ok := true
+		out := nginxVariable.ReplaceAllStringFunc(value, func(v string) string {
+			v = strings.Trim(v[1:], "{}")
+			switch {
+			case v == "document_root" && loc.lvl.root != "":
+				return loc.lvl.root
+			case v == "fastcgi_script_name" && split != "":
+				return "{http.regexp." + name + ".1}"
+			case v == "fastcgi_script_name":
+				return "{http.request.uri.path}"
+			case v == "fastcgi_path_info" && split != "":
+				return "{http.regexp." + name + ".2}"
+			case nginxVariables[v] != "":
+				return nginxVariables[v]
+			case strings.HasPrefix(v, "http_"):
+				return "{http.request.header." + strings.Replace(v[len("http_"):], "_", "-", -1) + "}"
+			case strings.HasPrefix(v, "cookie_"):
+				return "{http.request.cookie." + v[len("cookie_"):] + "}"
+			case strings.HasPrefix(v, "arg_"):
+				return "{http.request.uri.query." + v[len("arg_"):] + "}"
+			case len(v) == 1 && v >= "1" && v <= "9" && (split != "" || loc.kind == nginxRegexp):
+				return "{http.regexp." + name + "." + v + "}"
+			}
+			ok = false
+			if report {
+				unsupported = append(unsupported, v)
+			}
+			return ""
+		})
+		return out, ok
+	}
+
+	// Later parameters replace earlier ones of the same name.
+	values := make(map[string]nginxParam)
+	var names []string
+	for _, p := range loc.lvl.params {
+		if _, ok := values[p.name]; !ok {
+			names = append(names, p.name)
+		}
+		values[p.name] = p
+	}
+	execParam, ok := values["SCRIPT_FILENAME"]
+	if !ok {
+		// fcgiwrap falls back to the document root and script name.
+		execParam = nginxParam{value: "$document_root$fastcgi_script_name"}
+	}
+	exec, _ = translate(execParam.value, true)
+	for _, n := range names {
+		p := values[n]
+		if nginxModuleParams[n] {
+			continue
+		}
+		// Standard parameters that can't be translated are of no
+		// interest to scripts run by the cgi handler.
+		val, ok := translate(p.value, !p.standard)
+		if ok || !p.standard {
+			env = append(env, n+"="+val)
+		}
+	}
+	return matchers, exec, env, unsupported
+}
@@ -0,0 +1,129 @@
+package cgi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+)
+
+func TestConvertNginx(t *testing.T) {
+	conf := `
+include /etc/nginx/modules-enabled/*.conf;
+http {
+	server {
+		listen 80 default_server;
+		server_name example.com www.example.com;
+		root /var/www/html/;
+
+		location /cgi-bin/ {
+			gzip off;
+			root /usr/lib;
+			fastcgi_pass unix:/var/run/fcgiwrap.socket;
+			include fastcgi_params;
+			fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
+			fastcgi_param APP_MODE "production";
+		}
+		location ~* \.cgi$ {
+			fastcgi_pass unix:/var/run/fcgiwrap.socket;
+			include /etc/nginx/fastcgi.conf;
+			fastcgi_param TOKEN $http_x_token if_not_empty;
+			fastcgi_param SERVER_ADDR $server_addr;
+		}
+		location = /status {
+			include fastcgi_params;
+			fastcgi_param SCRIPT_FILENAME /usr/local/bin/status;
+			fastcgi_pass 127.0.0.1:9001; # fcgiwrap -s tcp:127.0.0.1:9001
+		}
+		location ~ \.php$ {
+			fastcgi_pass unix:/run/php/php-fpm.sock;
+		}
+	}
+	server {
+		listen [::]:8080;
+		server_name _;
+		root /srv/git;
+		location ^~ /git/ {
+			fastcgi_split_path_info ^(/git/[^/]+)(/.*)$;
+			fastcgi_param SCRIPT_FILENAME /usr/lib/git-core/git-http-backend;
+			fastcgi_param GIT_PROJECT_ROOT $document_root;
+			fastcgi_param PATH_INFO $fastcgi_path_info;
+			fastcgi_param REPO $1;
+			fastcgi_pass unix:/run/fcgiwrap.sock;
+			if ($request_method = POST) {
+				fastcgi_pass unix:/run/fcgiwrap-post.sock;
+			}
+		}
+	}
+}
+`
+	snippet := "location /tools/ {\n\tfastcgi_pass unix:/run/fcgiwrap.sock;\n\tfastcgi_param SCRIPT_FILENAME /opt$fastcgi_script_name;\n}\n"
+	expected := `{
+	order cgi last
+}
+# nginx.conf:2: include /etc/nginx/modules-enabled/*.conf not followed
+
+example.com www.example.com {
+	# nginx.conf:26: fastcgi_pass 127.0.0.1:9001 not converted
+	# nginx.conf:29: fastcgi_pass unix:/run/php/php-fpm.sock not converted
+	# nginx.conf:17: $server_addr not supported, left empty
+	@cgi1 path_regexp cgi1 (?i)\.cgi$
+	handle @cgi1 {
+		cgi * /var/www/html{http.request.uri.path} {
+			env SCRIPT_NAME={http.request.uri.path} DOCUMENT_URI={http.request.uri.path} DOCUMENT_ROOT=/var/www/html REQUEST_SCHEME={http.request.scheme} SERVER_ADDR= REDIRECT_STATUS=200 TOKEN={http.request.header.x-token}
+		}
+	}
+	@cgi2 path_regexp cgi2 ^/cgi-bin/
+	handle @cgi2 {
+		cgi * /usr/lib{http.request.uri.path} {
+			env SCRIPT_NAME={http.request.uri.path} DOCUMENT_URI={http.request.uri.path} DOCUMENT_ROOT=/usr/lib REQUEST_SCHEME={http.request.scheme} REDIRECT_STATUS=200 APP_MODE=production
+		}
+	}
+}
+
+:8080 {
+	# nginx.conf:43: fastcgi_pass within if not converted
+	@cgi1 {
+		path_regexp ^/git/
+		vars_regexp cgi1 {http.request.uri.path} ^(/git/[^/]+)(/.*)$
+	}
+	handle @cgi1 {
+		cgi * /usr/lib/git-core/git-http-backend {
+			env GIT_PROJECT_ROOT=/srv/git PATH_INFO={http.regexp.cgi1.2} REPO={http.regexp.cgi1.1}
+		}
+	}
+}
+
+:80 {
+	@cgi1 path_regexp cgi1 ^/tools/
+	handle @cgi1 {
+		cgi * /opt{http.request.uri.path}
+	}
+}
+`
+	out, err := convertNginx([]apacheSource{
+		{name: "nginx.conf", r: strings.NewReader(conf)},
+		{name: "snippets/fcgiwrap.conf", r: strings.NewReader(snippet)},
+	}, "fcgiwrap")
+	if err != nil {
+		t.Fatalf("Cannot convert: %v", err)
+	}
+	if out != expected {
+		t.Errorf("Unexpected Caddyfile\n========== Got ==========\n%s\n========== Wanted ==========\n%s", out, expected)
+	}
+	if _, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(out), nil); err != nil {
+		t.Errorf("Cannot adapt converted Caddyfile: %v", err)
+	}
+
+	all, err := convertNginx([]apacheSource{{name: "nginx.conf", r: strings.NewReader(conf)}}, "")
+	if err != nil {
+		t.Fatalf("Cannot convert: %v", err)
+	}
+	if !strings.Contains(all, "cgi * /usr/local/bin/status") || !strings.Contains(all, `path_regexp cgi3 \.php$`) {
+		t.Errorf("Unexpected conversion of all locations:\n%s", all)
+	}
+
+	if _, err := convertNginx([]apacheSource{{name: "nginx.conf", r: strings.NewReader("server {\n")}}, ""); err == nil {
+		t.Error("Unterminated block accepted.")
+	}
+}
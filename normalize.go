@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Modes of CGI.TrailingSlash
+const (
+	trailingSlashAdd    = "add"
+	trailingSlashRemove = "remove"
+)
+
+// Modes of CGI.PathEncoding
+const (
+	pathEncodingNFC = "nfc"
+	pathEncodingRaw = "raw"
+)
+
+// scriptPaths returns SCRIPT_NAME and PATH_INFO for the request in the
+// configured path encoding.
+func (c CGI) scriptPaths(r *http.Request) (scriptName, pathInfo string) {
+	switch c.PathEncoding {
+	case pathEncodingNFC:
+		return norm.NFC.String(c.ScriptName), norm.NFC.String(strings.TrimPrefix(r.URL.Path, c.ScriptName))
+	case pathEncodingRaw:
+		if scriptName, pathInfo, ok := splitEscapedPath(r.URL.EscapedPath(), c.ScriptName); ok {
+			return normalizeEscapes(scriptName), normalizeEscapes(pathInfo)
+		}
+	}
+	return c.ScriptName, strings.TrimPrefix(r.URL.Path, c.ScriptName)
+}
+
+// splitEscapedPath splits the percent-encoded path p right after the part
+// that decodes to prefix. It fails if p doesn't start with prefix once
+// decoded.
+func splitEscapedPath(p, prefix string) (head, tail string, ok bool) {
+	decoded := 0
+	i := 0
+	for decoded < len(prefix) && i < len(p) {
+		b := p[i]
+		n := 1
+		if b == '%' && i+2 < len(p) && isHex(p[i+1]) && isHex(p[i+2]) {
+			b = unhex(p[i+1])<<4 | unhex(p[i+2])
+			n = 3
+		}
+		if b != prefix[decoded] {
+			return "", "", false
+		}
+		decoded++
+		i += n
+	}
+	if decoded < len(prefix) {
+		return "", "", false
+	}
+	return p[:i], p[i:], true
+}
+
+// normalizeEscapes brings the percent-encoding of p into its canonical form:
+// unreserved characters are decoded and the remaining escapes use upper case
+// hex digits.
+func normalizeEscapes(p string) string {
+	if !strings.Contains(p, "%") {
+		return p
+	}
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '%' && i+2 < len(p) && isHex(p[i+1]) && isHex(p[i+2]) {
+			if b := unhex(p[i+1])<<4 | unhex(p[i+2]); isUnreserved(b) {
+				sb.WriteByte(b)
+			} else {
+				sb.WriteByte('%')
+				sb.WriteString(strings.ToUpper(p[i+1 : i+3]))
+			}
+			i += 2
+			continue
+		}
+		sb.WriteByte(p[i])
+	}
+	return sb.String()
+}
+
+func isHex(b byte) bool {
+	return '0' <= b && b <= '9' || 'a' <= b && b <= 'f' || 'A' <= b && b <= 'F'
+}
+
+func unhex(b byte) byte {
+	switch {
+	case '0' <= b && b <= '9':
+		return b - '0'
+	case 'a' <= b && b <= 'f':
+		return b - 'a' + 10
+	}
+	return b - 'A' + 10
+}
+
+// isUnreserved reports whether b is an unreserved character as of RFC 3986.
+func isUnreserved(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' ||
+		b == '-' || b == '.' || b == '_' || b == '~'
+}
+
+// canonicalRedirect redirects requests whose path does not have the
+// configured trailing slash form. It reports whether a redirect was sent.
+// Slashes are only added to the script name itself and to paths of
+// directories in the working directory, so PATH_INFO naming files, like
+// /app/report.csv, is left alone.
+func (c CGI) canonicalRedirect(w http.ResponseWriter, r *http.Request) bool {
+	switch c.TrailingSlash {
+	case trailingSlashAdd:
+		if strings.HasSuffix(r.URL.Path, "/") {
+			return false
+		}
+		if r.URL.Path != c.ScriptName {
+			if info, err := os.Stat(c.localPath(r, r.URL.Path)); err != nil || !info.IsDir() {
+				return false
+			}
+		}
+	case trailingSlashRemove:
+		if !strings.HasSuffix(r.URL.Path, "/") || r.URL.Path == "/" {
+			return false
+		}
+	default:
+		return false
+	}
+
+	u := *r.URL
+	fix := func(p string) string {
+		if c.TrailingSlash == trailingSlashAdd {
+			return p + "/"
+		}
+		return strings.TrimRight(p, "/")
+	}
+	u.Path = fix(u.Path)
+	if u.RawPath != "" {
+		u.RawPath = fix(u.RawPath)
+	}
+	if u.Path == "" {
+		u.Path, u.RawPath = "/", ""
+	}
+	if strings.HasPrefix(u.EscapedPath(), "//") {
+		// A Location starting with two slashes points to another host.
+		return false
+	}
+
+	code := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// Make sure the client repeats the request including its body.
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, u.RequestURI(), code)
+	return true
+}
+
+// scriptRequest returns the request as it is handed to the script, with the
+// configured query parameters stripped and canonicalized if requested.
+func (c CGI) scriptRequest(r *http.Request) *http.Request {
+	if len(c.StripQueryParams) == 0 && !c.Canonicalize {
+		return r
+	}
+	u := *r.URL
+	sr := new(http.Request)
+	*sr = *r
+	sr.URL = &u
+	if len(c.StripQueryParams) > 0 && u.RawQuery != "" {
+		u.RawQuery = c.filterQuery(u.RawQuery)
+	}
+	if c.Canonicalize {
+		u.RawQuery = sortQuery(u.RawQuery)
+		sr.Host = strings.ToLower(sr.Host)
+	}
+	return sr
+}
+
+// sortQuery orders the parameters of the raw query by name. Parameters of
+// the same name keep their relative order, as it may matter to the script.
+func sortQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	params := strings.Split(rawQuery, "&")
+	keys := make([]string, len(params))
+	for i, param := range params {
+		keys[i] = paramName(param)
+	}
+	sort.Stable(byKey{params, keys})
+	return strings.Join(params, "&")
+}
+
+type byKey struct {
+	params, keys []string
+}
+
+func (b byKey) Len() int           { return len(b.params) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.params[i], b.params[j] = b.params[j], b.params[i]
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+}
+
+// paramName returns the decoded name of a raw query parameter.
+func paramName(param string) string {
+	if i := strings.IndexByte(param, '='); i >= 0 {
+		param = param[:i]
+	}
+	if unescaped, err := url.QueryUnescape(param); err == nil {
+		return unescaped
+	}
+	return param
+}
+
+// filterQuery removes the parameters matching StripQueryParams from the raw
+// query, keeping the order and encoding of the others.
+func (c CGI) filterQuery(rawQuery string) string {
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		if !c.strippedParam(paramName(param)) {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+func (c CGI) strippedParam(key string) bool {
+	for _, pattern := range c.StripQueryParams {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
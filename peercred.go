@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(PeerCredentials{})
+	httpcaddyfile.RegisterDirective("cgi_peer_credentials", parsePeerCredentials)
+}
+
+// PeerCredentials is a listener wrapper that records the credentials of the
+// process on the other end of unix domain socket connections (SO_PEERCRED),
+// so they can be exported to CGI scripts. Connections of other kinds and
+// platforms without support for peer credentials are passed through as is.
+type PeerCredentials struct{}
+
+// Interface guards
+var (
+	_ caddy.ListenerWrapper = (*PeerCredentials)(nil)
+	_ caddyfile.Unmarshaler = (*PeerCredentials)(nil)
+)
+
+func (PeerCredentials) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.listeners.cgi_peer_credentials",
+		New: func() caddy.Module { return new(PeerCredentials) },
+	}
+}
+
+// WrapListener implements caddy.ListenerWrapper.
+func (p *PeerCredentials) WrapListener(l net.Listener) net.Listener {
+	return peerCredListener{l}
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (p *PeerCredentials) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// parsePeerCredentials sets up the listener wrapper for the current server block.
+func parsePeerCredentials(h httpcaddyfile.Helper) ([]httpcaddyfile.ConfigValue, error) {
+	var p PeerCredentials
+	if err := p.UnmarshalCaddyfile(h.Dispenser); err != nil {
+		return nil, err
+	}
+	return []httpcaddyfile.ConfigValue{{Class: "listener_wrapper", Value: &p}}, nil
+}
+
+// peerCred identifies the process connected to a unix domain socket.
+type peerCred struct {
+	pid, uid, gid int
+}
+
+// peerAddrPrefix marks remote addresses carrying peer credentials.
+const peerAddrPrefix = "unix:peer:"
+
+// peerAddr is the remote address of a connection whose peer credentials are
+// known. Its string form ends up as http.Request.RemoteAddr, which is the only
+// connection information that a handler gets to see.
+type peerAddr struct {
+	peerCred
+}
+
+func (a peerAddr) Network() string {
+	return "unix"
+}
+
+func (a peerAddr) String() string {
+	return fmt.Sprintf("%spid=%d,uid=%d,gid=%d", peerAddrPrefix, a.pid, a.uid, a.gid)
+}
+
+// parsePeerAddr extracts peer credentials from a remote address as produced
+// by peerAddr.String.
+func parsePeerAddr(remoteAddr string) (cred peerCred, ok bool) {
+	if !strings.HasPrefix(remoteAddr, peerAddrPrefix) {
+		return cred, false
+	}
+	for _, field := range strings.Split(strings.TrimPrefix(remoteAddr, peerAddrPrefix), ",") {
+		pair := strings.SplitN(field, "=", 2)
+		if len(pair) != 2 {
+			return cred, false
+		}
+		val, err := strconv.Atoi(pair[1])
+		if err != nil {
+			return cred, false
+		}
+		switch pair[0] {
+		case "pid":
+			cred.pid = val
+		case "uid":
+			cred.uid = val
+		case "gid":
+			cred.gid = val
+		default:
+			return cred, false
+		}
+	}
+	return cred, true
+}
+
+// peerEnv returns the environment describing the remote end of a unix domain
+// socket connection and makes the peer credentials available as {peer.pid},
+// {peer.uid} and {peer.gid} placeholders. It returns nil if the request did
+// not arrive over a unix domain socket.
+func peerEnv(r *http.Request, repl *caddy.Replacer) []string {
+	cred, hasCred := parsePeerAddr(r.RemoteAddr)
+	if _, isUnix := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); !isUnix && !hasCred {
+		return nil
+	}
+	// Like nginx, call the remote address of a unix domain socket "unix:".
+	env := []string{"REMOTE_ADDR=unix:", "REMOTE_HOST=unix:"}
+	if hasCred {
+		repl.Set("peer.pid", cred.pid)
+		repl.Set("peer.uid", cred.uid)
+		repl.Set("peer.gid", cred.gid)
+		env = append(env,
+			"REMOTE_PEER_PID="+strconv.Itoa(cred.pid),
+			"REMOTE_PEER_UID="+strconv.Itoa(cred.uid),
+			"REMOTE_PEER_GID="+strconv.Itoa(cred.gid))
+	}
+	return env
+}
+
+type peerCredListener struct {
+	net.Listener
+}
+
+func (l peerCredListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		if cred, err := peerCredentials(unixConn); err == nil {
+			return peerCredConn{Conn: conn, addr: peerAddr{cred}}, nil
+		}
+	}
+	return conn, nil
+}
+
+type peerCredConn struct {
+	net.Conn
+	addr peerAddr
+}
+
+func (c peerCredConn) RemoteAddr() net.Addr {
+	return c.addr
+}
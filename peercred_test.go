@@ -0,0 +1,50 @@
+package cgi
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestPeerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+
+	dir, err := ioutil.TempDir("", "cgi-peercred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := new(PeerCredentials).WrapListener(l)
+	defer wrapped.Close()
+
+	client, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := wrapped.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cred, ok := parsePeerAddr(conn.RemoteAddr().String())
+	if !ok {
+		t.Fatalf("Remote address %q carries no peer credentials.", conn.RemoteAddr())
+	}
+	expected := peerCred{pid: os.Getpid(), uid: os.Getuid(), gid: os.Getgid()}
+	if cred != expected {
+		t.Errorf("Unexpected peer credentials %+v. Expected %+v.", cred, expected)
+	}
+}
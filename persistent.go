@@ -0,0 +1,485 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Persistent processes serve one request after another using a simple framed
+// protocol on their standard input and output.
+//
+// A message is a sequence of frames, each consisting of the decimal length of
+// its payload, a newline and the payload itself. A frame of length zero
+// terminates the message. A request message starts with a frame holding the
+// CGI environment as NUL separated key=value pairs, followed by frames with
+// the request body. The response message carries a regular CGI response
+// (headers, blank line, body), split into as many frames as the process
+// likes.
+
+// defaultIdleTimeout is used for persistent processes if no idle timeout has
+// been configured.
+const defaultIdleTimeout = 5 * time.Minute
+
+// stopTimeout is how long a persistent process gets to exit after its
+// standard input has been closed, before it is killed.
+const stopTimeout = 5 * time.Second
+
+var errTooManyProcesses = errors.New("too many persistent processes")
+
+// frameWriter splits everything written into frames.
+type frameWriter struct {
+	w *bufio.Writer
+}
+
+func (fw frameWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := fw.w.WriteString(strconv.Itoa(len(p)) + "\n"); err != nil {
+		return 0, err
+	}
+	return fw.w.Write(p)
+}
+
+// End terminates the current message and flushes it.
+func (fw frameWriter) End() error {
+	if _, err := fw.w.WriteString("0\n"); err != nil {
+		return err
+	}
+	return fw.w.Flush()
+}
+
+// frameReader reads the payload of a single message; it returns io.EOF at the
+// terminating frame.
+type frameReader struct {
+	r         *bufio.Reader
+	remaining int
+	done      bool
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	if fr.done {
+		return 0, io.EOF
+	}
+	if fr.remaining == 0 {
+		line, err := fr.r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line))
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("invalid frame length %q", line)
+		}
+		if size == 0 {
+			fr.done = true
+			return 0, io.EOF
+		}
+		fr.remaining = size
+	}
+	if len(p) > fr.remaining {
+		p = p[:fr.remaining]
+	}
+	n, err := fr.r.Read(p)
+	fr.remaining -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// persistentProcess is a running instance of a CGI executable speaking the
+// framed protocol.
+type persistentProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	done   chan struct{} // closed once the process exited
+
+	mu       sync.Mutex // serializes requests
+	busy     int        // requests using or waiting for the process; guarded by the pool
+	lastUsed time.Time  // guarded by the pool
+	served   int        // requests served; guarded by the pool
+	retired  bool       // to be stopped once no longer busy; guarded by the pool
+}
+
+func startPersistentProcess(h *handler, env []string) (*persistentProcess, error) {
+	cg, err := h.Cgroup.create()
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := h.command(env, cg)
+	if err != nil {
+		cg.close(h.Logger)
+		return nil, err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cg.close(h.Logger)
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cg.close(h.Logger)
+		return nil, err
+	}
+	if err := startChild(cmd); err != nil {
+		cg.close(h.Logger)
+		return nil, err
+	}
+	if err := cg.attach(cmd.Process); err != nil {
+		cmd.Wait()
+		doneChild(cmd)
+		cg.close(h.Logger)
+		return nil, err
+	}
+	p := &persistentProcess{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		cmd.Wait()
+		doneChild(cmd)
+		if h.KillGroup {
+			killProcessGroup(cmd.Process.Pid)
+		}
+		h.collectCoreDump(cmd)
+		cg.close(h.Logger)
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// serve relays a single request to the process. It returns an error if the
+// process is no longer in a usable state afterwards.
+func (p *persistentProcess) serve(h *handler, rw http.ResponseWriter, req *http.Request) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.done:
+		h.Failure.set(failSpawn)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return errors.New("persistent process exited")
+	default:
+	}
+
+	// The process outlives the request, so it isn't terminated when the
+	// client goes away; the rest of the response is drained instead.
+	wd := h.watch(context.Background(), p.cmd.Process)
+	defer wd.stop()
+	if h.Timeout > 0 || h.HeaderTimeout > 0 {
+		rw = timeoutResponseWriter{&caddyhttp.ResponseWriterWrapper{ResponseWriter: rw}, wd}
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		fw := frameWriter{bufio.NewWriter(p.stdin)}
+		env := h.environ(req)
+		h.logEnvironSize(env)
+		if _, err := fw.Write([]byte(strings.Join(env, "\x00"))); err != nil {
+			written <- err
+			return
+		}
+		if req.Body != nil && req.ContentLength != 0 {
+			if _, err := io.Copy(fw, req.Body); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- fw.End()
+	}()
+
+	response := &frameReader{r: p.stdout}
+	copyErr := h.writeResponse(rw, response)
+	if wd.timedOut() {
+		h.Failure.cause(failTimeout)
+	}
+	// Whatever the outcome, the rest of the response has to be consumed to
+	// keep the stream in sync for the next request.
+	if _, err := io.Copy(ioutil.Discard, response); err != nil {
+		p.kill()
+		<-written
+		return err
+	}
+	if err := <-written; err != nil {
+		return err
+	}
+	if copyErr != nil {
+		h.Logger.Debug("client went away during persistent response", zap.Error(copyErr))
+	}
+	return nil
+}
+
+// stop asks the process to exit by closing its standard input and kills it if
+// it does not comply in time.
+func (p *persistentProcess) stop() {
+	p.stdin.Close()
+	select {
+	case <-p.done:
+	case <-time.After(stopTimeout):
+		p.kill()
+	}
+}
+
+func (p *persistentProcess) kill() {
+	p.cmd.Process.Kill()
+}
+
+// persistentPool keeps one persistent process per key.
+type persistentPool struct {
+	idleTimeout  time.Duration
+	maxRequests  int // requests after which a process is replaced; 0 if unlimited
+	maxProcesses int // processes running at the same time; 0 if unlimited
+
+	mu        sync.Mutex
+	logger    *zap.Logger
+	app       *App // app of the config that most recently adopted the pool
+	processes map[string]*persistentProcess
+	starting  map[string]*persistentStart
+	closed    bool
+}
+
+// persistentStart is a process being started for a key, which requests for
+// the same key wait for.
+type persistentStart struct {
+	done chan struct{} // closed once the start finished
+	err  error
+}
+
+// persistentPools keeps pools across config reloads, so their processes keep
+// running as long as the handler configuration they were started for stays
+// the same.
+var persistentPools = caddy.NewUsagePool()
+
+func newPersistentPool(idleTimeout time.Duration, maxRequests, maxProcesses int, logger *zap.Logger) *persistentPool {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	return &persistentPool{
+		idleTimeout:  idleTimeout,
+		maxRequests:  maxRequests,
+		maxProcesses: maxProcesses,
+		logger:       logger,
+		processes:    make(map[string]*persistentProcess),
+		starting:     make(map[string]*persistentStart),
+	}
+}
+
+// adopt hands the pool to a handler of a newly provisioned config. When the
+// pool is taken over from a previous config, sig (if not nil) is sent to its
+// processes so they can pick up changes of their own configuration.
+func (pp *persistentPool) adopt(app *App, logger *zap.Logger, sig os.Signal) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.app != nil && pp.app != app && sig != nil {
+		for key, p := range pp.processes {
+			if err := p.cmd.Process.Signal(sig); err != nil {
+				logger.Warn("cannot signal persistent process", zap.String("key", key), zap.Error(err))
+			}
+		}
+	}
+	pp.app = app
+	pp.logger = logger
+}
+
+// acquire returns the process for key, starting it if necessary. Processes
+// are started without holding pp.mu, so requests for other keys aren't held
+// up by a slow start; concurrent requests for the same key wait for it. If
+// maxProcesses are running already, the one idle for the longest time is
+// stopped to make room; errTooManyProcesses is returned if all are busy.
+func (pp *persistentPool) acquire(key string, h *handler) (*persistentProcess, error) {
+	pp.mu.Lock()
+	for {
+		if pp.closed {
+			pp.mu.Unlock()
+			return nil, errors.New("persistent pool has been closed")
+		}
+		if p, ok := pp.processes[key]; ok {
+			select {
+			case <-p.done:
+				// Exited while idle, by itself or killed from outside:
+				// replaced instead of failing the request.
+				pp.logger.Debug("persistent process exited, starting a new one", zap.String("key", key))
+				pp.remove(key, p)
+			default:
+				p.busy++
+				pp.mu.Unlock()
+				return p, nil
+			}
+		}
+		st, ok := pp.starting[key]
+		if !ok {
+			break
+		}
+		pp.mu.Unlock()
+		<-st.done
+		if st.err != nil {
+			return nil, st.err
+		}
+		pp.mu.Lock()
+	}
+	if pp.maxProcesses > 0 && len(pp.processes)+len(pp.starting) >= pp.maxProcesses && !pp.evictIdle() {
+		pp.mu.Unlock()
+		return nil, errTooManyProcesses
+	}
+	st := &persistentStart{done: make(chan struct{})}
+	pp.starting[key] = st
+	pp.mu.Unlock()
+
+	env := append(h.processEnviron(), "CGI_PERSISTENT_KEY="+key)
+	p, err := startPersistentProcess(h, env)
+
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	delete(pp.starting, key)
+	st.err = err
+	close(st.done)
+	if err != nil {
+		return nil, err
+	}
+	if pp.closed {
+		go p.stop()
+		return nil, errors.New("persistent pool has been closed")
+	}
+	pp.logger.Debug("started persistent process",
+		zap.String("key", key), zap.Int("pid", p.cmd.Process.Pid))
+	pp.processes[key] = p
+	p.busy++
+	return p, nil
+}
+
+// release hands p back to the pool; broken processes are removed right away,
+// idle ones once the idle timeout passed. Processes that served maxRequests
+// requests are replaced by a new one for further requests and stopped once
+// the requests already waiting for them are done.
+func (pp *persistentPool) release(key string, p *persistentProcess, broken bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	p.busy--
+	p.lastUsed = time.Now()
+	if broken {
+		pp.remove(key, p)
+		return
+	}
+	p.served++
+	if pp.maxRequests > 0 && p.served >= pp.maxRequests && !p.retired {
+		pp.logger.Debug("retiring persistent process", zap.String("key", key), zap.Int("requests", p.served))
+		p.retired = true
+		if pp.processes[key] == p {
+			delete(pp.processes, key)
+		}
+	}
+	if p.retired {
+		if p.busy == 0 {
+			go p.stop()
+		}
+		return
+	}
+	time.AfterFunc(pp.idleTimeout, func() {
+		pp.mu.Lock()
+		defer pp.mu.Unlock()
+		if p.busy == 0 && !p.retired && time.Since(p.lastUsed) >= pp.idleTimeout {
+			pp.logger.Debug("stopping idle persistent process", zap.String("key", key))
+			pp.remove(key, p)
+		}
+	})
+}
+
+// evictIdle stops the process that has been idle for the longest time and
+// reports whether there was one; pp.mu must be held.
+func (pp *persistentPool) evictIdle() bool {
+	var oldestKey string
+	var oldest *persistentProcess
+	for key, p := range pp.processes {
+		if p.busy == 0 && (oldest == nil || p.lastUsed.Before(oldest.lastUsed)) {
+			oldestKey, oldest = key, p
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	pp.logger.Debug("stopping idle persistent process to make room", zap.String("key", oldestKey))
+	pp.remove(oldestKey, oldest)
+	return true
+}
+
+// remove drops p from the pool and stops it; pp.mu must be held.
+func (pp *persistentPool) remove(key string, p *persistentProcess) {
+	if pp.processes[key] == p {
+		delete(pp.processes, key)
+	}
+	go p.stop()
+}
+
+// serve dispatches req to the persistent process for key.
+func (pp *persistentPool) serve(key string, h *handler, rw http.ResponseWriter, req *http.Request) {
+	p, err := pp.acquire(key, h)
+	if err == errTooManyProcesses {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		h.Logger.Warn("CGI error", zap.String("key", key), zap.Error(err))
+		return
+	}
+	if err != nil {
+		h.Failure.set(failSpawn)
+		rw.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("CGI error", zap.Error(err))
+		return
+	}
+	err = p.serve(h, rw, req)
+	if err != nil {
+		h.Logger.Error("persistent process failed", zap.String("key", key), zap.Error(err))
+	}
+	pp.release(key, p, err != nil)
+}
+
+// Destruct implements caddy.Destructor.
+func (pp *persistentPool) Destruct() error {
+	pp.close()
+	return nil
+}
+
+// close stops all processes of the pool.
+func (pp *persistentPool) close() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.closed = true
+	for key, p := range pp.processes {
+		pp.remove(key, p)
+	}
+}
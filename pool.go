@@ -0,0 +1,297 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// respawnDelay is how long the pool waits before replacing a worker that
+// failed to start or exited right after starting, so a broken script doesn't
+// keep the machine busy.
+const respawnDelay = time.Second
+
+// errPoolClosed is returned for requests to a pool whose config was unloaded.
+var errPoolClosed = errors.New("worker pool has been closed")
+
+// workerPool keeps a fixed number of instances of a script running, which
+// speak the framed protocol of persistent processes, and hands every request
+// to an idle one. With affinity, clients stick to the worker that served their
+// first request as long as it is running. With an idle timeout, workers that
+// weren't used for that long are stopped and started again on demand.
+type workerPool struct {
+	h           *handler      // template of the workers
+	affinity    *affinity     // nil without affinity
+	size        int           // number of workers
+	maxRequests int           // requests after which a worker is replaced; 0 if unlimited
+	idleTimeout time.Duration // time after which an unused worker is stopped; 0 if never
+
+	mu       sync.Mutex
+	workers  map[*persistentProcess]int // running workers and their numbers
+	idle     []*persistentProcess       // in the order they became idle
+	changed  chan struct{}              // closed when idle, workers or closed change
+	starting int                        // workers being started
+	next     int
+	closed   bool
+}
+
+// newWorkerPool starts size workers from h, each of which is replaced after
+// serving maxRequests requests and stopped after being unused for idleTimeout
+// unless these are 0.
+func newWorkerPool(size int, h *handler, aff *affinity, maxRequests int, idleTimeout time.Duration) *workerPool {
+	wp := &workerPool{
+		h:           h,
+		affinity:    aff,
+		size:        size,
+		maxRequests: maxRequests,
+		idleTimeout: idleTimeout,
+		workers:     make(map[*persistentProcess]int),
+		changed:     make(chan struct{}),
+	}
+	for i := 0; i < size; i++ {
+		wp.spawn()
+	}
+	return wp
+}
+
+// notify wakes up requests waiting for a worker; wp.mu must be held.
+func (wp *workerPool) notify() {
+	close(wp.changed)
+	wp.changed = make(chan struct{})
+}
+
+// spawn starts a new worker and makes it available; failures are retried
+// after respawnDelay.
+func (wp *workerPool) spawn() {
+	wp.mu.Lock()
+	if wp.closed {
+		wp.mu.Unlock()
+		return
+	}
+	wp.starting++
+	wp.mu.Unlock()
+	wp.start()
+}
+
+// start starts a worker already counted in starting.
+func (wp *workerPool) start() {
+	wp.mu.Lock()
+	if wp.closed {
+		wp.starting--
+		wp.mu.Unlock()
+		return
+	}
+	wp.next++
+	id := wp.next
+	wp.mu.Unlock()
+
+	env := append(wp.h.processEnviron(), "CGI_POOL_WORKER="+strconv.Itoa(id))
+	p, err := startPersistentProcess(wp.h, env)
+	if err != nil {
+		wp.h.Logger.Error("cannot start pool worker", zap.Error(err))
+		time.AfterFunc(respawnDelay, wp.start)
+		return
+	}
+	wp.h.Logger.Debug("started pool worker", zap.Int("worker", id), zap.Int("pid", p.cmd.Process.Pid))
+
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.starting--
+	if wp.closed {
+		go p.stop()
+		return
+	}
+	wp.workers[p] = id
+	wp.makeIdle(p)
+	go wp.monitor(p, id)
+}
+
+// makeIdle makes p available and, with an idle timeout, schedules stopping it
+// should it stay unused; wp.mu must be held.
+func (wp *workerPool) makeIdle(p *persistentProcess) {
+	p.lastUsed = time.Now()
+	wp.idle = append(wp.idle, p)
+	wp.notify()
+	if wp.idleTimeout > 0 {
+		time.AfterFunc(wp.idleTimeout, func() {
+			wp.expire(p)
+		})
+	}
+}
+
+// expire stops p if it has been idle for the idle timeout.
+func (wp *workerPool) expire(p *persistentProcess) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.closed || time.Since(p.lastUsed) < wp.idleTimeout || !wp.removeIdle(p) {
+		return
+	}
+	wp.h.Logger.Debug("stopping idle pool worker", zap.Int("worker", wp.workers[p]))
+	delete(wp.workers, p)
+	go p.stop()
+}
+
+// monitor replaces p once it exited.
+func (wp *workerPool) monitor(p *persistentProcess, id int) {
+	started := time.Now()
+	<-p.done
+	wp.mu.Lock()
+	_, running := wp.workers[p]
+	delete(wp.workers, p)
+	wp.removeIdle(p)
+	wp.notify()
+	if wp.closed || !running {
+		// Retired workers have been replaced already, idle ones are
+		// started again on demand.
+		wp.mu.Unlock()
+		return
+	}
+	wp.starting++
+	wp.mu.Unlock()
+	wp.h.Logger.Warn("pool worker exited", zap.Int("worker", id))
+	if time.Since(started) < respawnDelay {
+		time.AfterFunc(respawnDelay, wp.start)
+	} else {
+		wp.start()
+	}
+}
+
+// removeIdle drops p from the idle workers; wp.mu must be held.
+func (wp *workerPool) removeIdle(p *persistentProcess) bool {
+	for i, q := range wp.idle {
+		if q == p {
+			wp.idle = append(wp.idle[:i], wp.idle[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// worker returns the running worker with number id; nil if there is none.
+// wp.mu must be held.
+func (wp *workerPool) worker(id int) *persistentProcess {
+	for p, n := range wp.workers {
+		if n == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// acquire waits for an idle worker and returns it along with its number. If
+// the worker numbered want is running, acquire waits for that one. Workers
+// stopped for being idle are started again while requests wait.
+func (wp *workerPool) acquire(req *http.Request, want int) (*persistentProcess, int, error) {
+	for {
+		wp.mu.Lock()
+		if wp.closed {
+			wp.mu.Unlock()
+			return nil, 0, errPoolClosed
+		}
+		if len(wp.idle) == 0 && len(wp.workers)+wp.starting < wp.size {
+			wp.starting++
+			go wp.start()
+		}
+		if p := wp.worker(want); p != nil {
+			if wp.removeIdle(p) {
+				wp.mu.Unlock()
+				return p, want, nil
+			}
+		} else if len(wp.idle) > 0 {
+			p := wp.idle[0]
+			wp.idle = wp.idle[1:]
+			id := wp.workers[p]
+			wp.mu.Unlock()
+			return p, id, nil
+		}
+		changed := wp.changed
+		wp.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-req.Context().Done():
+			return nil, 0, req.Context().Err()
+		}
+	}
+}
+
+// release makes p available again unless it exited meanwhile. Workers that
+// served maxRequests requests are retired and replaced instead.
+func (wp *workerPool) release(p *persistentProcess) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	id, running := wp.workers[p]
+	if !running || wp.closed {
+		return
+	}
+	p.served++
+	if wp.maxRequests > 0 && p.served >= wp.maxRequests {
+		wp.h.Logger.Debug("retiring pool worker", zap.Int("worker", id), zap.Int("requests", p.served))
+		delete(wp.workers, p)
+		go p.stop()
+		wp.starting++
+		go wp.start()
+		return
+	}
+	wp.makeIdle(p)
+}
+
+// serve dispatches req to an idle worker.
+func (wp *workerPool) serve(h *handler, rw http.ResponseWriter, req *http.Request) {
+	want := 0
+	if wp.affinity != nil {
+		want = wp.affinity.worker(req)
+	}
+	p, id, err := wp.acquire(req, want)
+	if err != nil {
+		if req.Context().Err() == nil {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			h.Logger.Error("CGI error", zap.Error(err))
+		}
+		return
+	}
+	if wp.affinity != nil && id != want {
+		http.SetCookie(rw, wp.affinity.cookie(id, req))
+	}
+	if err := p.serve(h, rw, req); err != nil {
+		// The worker is out of sync; monitor replaces it.
+		h.Logger.Error("pool worker failed", zap.Error(err))
+		p.kill()
+		return
+	}
+	wp.release(p)
+}
+
+// close stops all workers.
+func (wp *workerPool) close() {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.closed {
+		return
+	}
+	wp.closed = true
+	wp.notify()
+	for p := range wp.workers {
+		go p.stop()
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import "fmt"
+
+// I/O scheduling classes as passed to ioprio_set.
+var ioniceClasses = map[string]int{
+	"realtime":    1,
+	"best-effort": 2,
+	"idle":        3,
+}
+
+// ioprioClassShift is the position of the class within an I/O priority.
+const ioprioClassShift = 13
+
+// processPriority validates the scheduling priorities of the CGI
+// configuration and returns the I/O priority to set; 0 if none.
+func (c CGI) processPriority() (ioprio int, err error) {
+	if c.Nice < -20 || c.Nice > 19 {
+		return 0, fmt.Errorf("invalid nice value %d, must be between -20 and 19", c.Nice)
+	}
+	if c.Nice != 0 && !rlimitsSupported {
+		return 0, fmt.Errorf("nice is not supported on this platform")
+	}
+	if c.IoniceClass == "" {
+		if c.IoniceLevel != 0 {
+			return 0, fmt.Errorf("ionice level needs an ionice class")
+		}
+	} else {
+		class, ok := ioniceClasses[c.IoniceClass]
+		if !ok {
+			return 0, fmt.Errorf("unknown ionice class %q", c.IoniceClass)
+		}
+		if c.IoniceLevel < 0 || c.IoniceLevel > 7 {
+			return 0, fmt.Errorf("invalid ionice level %d, must be between 0 and 7", c.IoniceLevel)
+		}
+		if !ioprioSupported {
+			return 0, fmt.Errorf("ionice is only supported on Linux")
+		}
+		ioprio = class<<ioprioClassShift | c.IoniceLevel
+	}
+	if (c.Nice != 0 || ioprio != 0) && selfExecutableErr != nil {
+		return 0, fmt.Errorf("scheduling priorities need the path of the Caddy binary: %v", selfExecutableErr)
+	}
+	return ioprio, nil
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const processGroupsSupported = false
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(pid int) {}
+
+func signalProcessGroup(pid int, sig os.Signal) error {
+	return errors.New("process groups are not supported")
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// jobs holds the job objects of running processes by pid. Killing a process
+// on Windows leaves its children running, like the interpreter started by a
+// cmd.exe script, which then keep the response open. All processes of a job
+// are terminated at once instead, and its kill-on-close limit takes care of
+// whatever is left once the process exited.
+var jobs = struct {
+	sync.Mutex
+	handles map[int]windows.Handle
+}{handles: make(map[int]windows.Handle)}
+
+// attachJob puts the process pid into a job object of its own. Children it
+// starts before that are not part of the job. Where that fails, e.g. in a
+// job that doesn't allow nested ones before Windows 8, the process is only
+// killed on its own.
+func attachJob(pid int) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return
+	}
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{}
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+	if _, err := windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		windows.CloseHandle(job)
+		return
+	}
+	proc, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(pid))
+	if err != nil {
+		windows.CloseHandle(job)
+		return
+	}
+	defer windows.CloseHandle(proc)
+	if err := windows.AssignProcessToJobObject(job, proc); err != nil {
+		windows.CloseHandle(job)
+		return
+	}
+	jobs.Lock()
+	jobs.handles[pid] = job
+	jobs.Unlock()
+}
+
+// closeJob closes the job object of the process pid, which terminates the
+// processes still in it.
+func closeJob(pid int) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	if job, ok := jobs.handles[pid]; ok {
+		windows.CloseHandle(job)
+		delete(jobs.handles, pid)
+	}
+}
+
+// killJob terminates all processes in the job object of the process pid. It
+// reports whether there is such a job.
+func killJob(pid int) bool {
+	jobs.Lock()
+	defer jobs.Unlock()
+	job, ok := jobs.handles[pid]
+	if ok {
+		windows.TerminateJobObject(job, 1)
+	}
+	return ok
+}
@@ -0,0 +1,48 @@
+//go:build windows
+// +build windows
+
+package cgi
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestCloseJob(t *testing.T) {
+	// The second ping is started by cmd.exe once it is in the job and keeps
+	// the output open until it exits, which would take a minute.
+	cmd := exec.Command("cmd.exe", "/c", "ping -n 2 127.0.0.1 >nul & ping -n 60 127.0.0.1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	pid := cmd.Process.Pid
+	attachJob(pid)
+	jobs.Lock()
+	_, ok := jobs.handles[pid]
+	jobs.Unlock()
+	if !ok {
+		t.Skip("job objects are not available")
+	}
+	drained := make(chan struct{})
+	go func() {
+		ioutil.ReadAll(stdout)
+		close(drained)
+	}()
+	time.Sleep(2 * time.Second)
+
+	// Closing the job terminates the child as well as cmd.exe itself.
+	closeJob(pid)
+	select {
+	case <-drained:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Child process still running after its job was closed.")
+	}
+	cmd.Wait()
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Profiles of routes, presetting a coherent combination of timeouts,
+// buffering and flushing.
+const (
+	profileInteractive = "interactive"
+	profileBatch       = "batch"
+	profileStreaming   = "streaming"
+)
+
+// preset is a setting a profile presets.
+type preset struct {
+	key       string       // in the JSON config
+	directive string       // in the Caddyfile
+	apply     func(c *CGI) // presets the setting unless it has a value
+}
+
+func presetDuration(key, directive string, field func(c *CGI) *caddy.Duration, value time.Duration) preset {
+	return preset{key, directive, func(c *CGI) {
+		if d := field(c); *d == 0 {
+			*d = caddy.Duration(value)
+		}
+	}}
+}
+
+func timeoutField(c *CGI) *caddy.Duration          { return &c.Timeout }
+func firstByteTimeoutField(c *CGI) *caddy.Duration { return &c.FirstByteTimeout }
+func queueTimeoutField(c *CGI) *caddy.Duration     { return &c.QueueTimeout }
+func killGraceField(c *CGI) *caddy.Duration        { return &c.KillGrace }
+func flushIntervalField(c *CGI) *caddy.Duration    { return &c.FlushInterval }
+
+var profiles = map[string][]preset{
+	// Pages someone waits for: fail fast rather than pile up.
+	profileInteractive: {
+		presetDuration("timeout", "timeout", timeoutField, 30*time.Second),
+		presetDuration("firstByteTimeout", "first_byte_timeout", firstByteTimeoutField, 10*time.Second),
+		presetDuration("queueTimeout", "queue_timeout", queueTimeoutField, 5*time.Second),
+		presetDuration("killGrace", "kill_grace", killGraceField, 2*time.Second),
+		{"responseBuffer", "response_buffer", func(c *CGI) {
+			if c.ResponseBuffer == 0 {
+				c.ResponseBuffer = 64 << 10
+			}
+		}},
+	},
+	// Reports and exports: time to finish and to clean up, with the output
+	// coalesced.
+	profileBatch: {
+		presetDuration("timeout", "timeout", timeoutField, 15*time.Minute),
+		presetDuration("killGrace", "kill_grace", killGraceField, 30*time.Second),
+		presetDuration("flushInterval", "flush_interval", flushIntervalField, time.Second),
+	},
+	// Long-running responses: no timeout once the headers arrived.
+	profileStreaming: {
+		{"streaming", "streaming", func(c *CGI) { c.Streaming = true }},
+		presetDuration("firstByteTimeout", "first_byte_timeout", firstByteTimeoutField, 30*time.Second),
+		presetDuration("killGrace", "kill_grace", killGraceField, 5*time.Second),
+	},
+}
+
+// applyProfile presets the settings of the profile of the route that are not
+// set explicitly, i.e. neither present in the config nor set to a value.
+func (c *CGI) applyProfile() error {
+	if c.Profile == "" {
+		return nil
+	}
+	presets, ok := profiles[c.Profile]
+	if !ok {
+		return fmt.Errorf("invalid profile %q", c.Profile)
+	}
+	for _, p := range presets {
+		if !c.explicit[p.key] {
+			p.apply(c)
+		}
+	}
+	return nil
+}
+
+// expandProfile applies the profile of a route parsed from the Caddyfile,
+// leaving alone the settings of the given subdirectives, and clears it.
+// Settings set to zero are omitted from the JSON config, so the profile
+// can't be applied once it is loaded.
+func (c *CGI) expandProfile(directives map[string]bool) error {
+	if c.Profile == "" {
+		return nil
+	}
+	c.explicit = make(map[string]bool)
+	for _, p := range profiles[c.Profile] {
+		if directives[p.directive] {
+			c.explicit[p.key] = true
+		}
+	}
+	err := c.applyProfile()
+	c.Profile, c.explicit = "", nil
+	return err
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It notes the settings present in
+// the config, which the profile of the route leaves alone even if they are
+// zero.
+func (c *CGI) UnmarshalJSON(b []byte) error {
+	type plain CGI
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return err
+	}
+	c.explicit = make(map[string]bool, len(keys))
+	for key := range keys {
+		c.explicit[key] = true
+	}
+	return nil
+}
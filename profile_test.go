@@ -0,0 +1,81 @@
+package cgi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestCGI_ApplyProfile(t *testing.T) {
+	c := CGI{Profile: profileInteractive, Timeout: caddy.Duration(time.Minute)}
+	if err := c.applyProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Timeout != caddy.Duration(time.Minute) {
+		t.Errorf("Unexpected timeout %v. Expected the explicit %v.", time.Duration(c.Timeout), time.Minute)
+	}
+	if c.FirstByteTimeout != caddy.Duration(10*time.Second) || c.QueueTimeout != caddy.Duration(5*time.Second) || c.ResponseBuffer != 64<<10 {
+		t.Errorf("Unexpected interactive settings %v, %v, %d.", time.Duration(c.FirstByteTimeout), time.Duration(c.QueueTimeout), c.ResponseBuffer)
+	}
+
+	c = CGI{Profile: profileStreaming}
+	if err := c.applyProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Streaming || c.timeout() != 0 || c.FirstByteTimeout != caddy.Duration(30*time.Second) {
+		t.Errorf("Unexpected streaming settings %v, %v, %v.", c.Streaming, c.timeout(), time.Duration(c.FirstByteTimeout))
+	}
+
+	c = CGI{Profile: profileBatch, FlushInterval: caddy.Duration(100 * time.Millisecond)}
+	if err := c.applyProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Timeout != caddy.Duration(15*time.Minute) || c.FlushInterval != caddy.Duration(100*time.Millisecond) {
+		t.Errorf("Unexpected batch settings %v, %v.", time.Duration(c.Timeout), time.Duration(c.FlushInterval))
+	}
+
+	if err := (&CGI{Profile: "bulk"}).applyProfile(); err == nil {
+		t.Error("Expected an error for an unknown profile.")
+	}
+}
+
+func TestCGI_ApplyProfileExplicitZero(t *testing.T) {
+	// Settings present in the JSON config are left alone even if they are
+	// zero or false.
+	var c CGI
+	if err := json.Unmarshal([]byte(`{"profile":"streaming","streaming":false,"firstByteTimeout":0}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.applyProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Streaming || c.FirstByteTimeout != 0 || c.KillGrace != caddy.Duration(5*time.Second) {
+		t.Errorf("Unexpected streaming settings %v, %v, %v.", c.Streaming, time.Duration(c.FirstByteTimeout), time.Duration(c.KillGrace))
+	}
+	if err := json.Unmarshal([]byte(`{"profile":"batch","timeoutt":"1s"}`), &c); err == nil {
+		t.Error("Expected an error for an unknown setting.")
+	}
+
+	// The Caddyfile expands the profile right away, since zero settings
+	// don't make it into the JSON config.
+	c = CGI{}
+	d := caddyfile.NewTestDispenser(`cgi /some/file {
+  profile interactive
+  timeout 0
+}`)
+	if err := c.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Cannot parse caddyfile: %v", err)
+	}
+	if c.Profile != "" || c.Timeout != 0 || c.FirstByteTimeout != caddy.Duration(10*time.Second) {
+		t.Errorf("Unexpected interactive settings %q, %v, %v.", c.Profile, time.Duration(c.Timeout), time.Duration(c.FirstByteTimeout))
+	}
+	d = caddyfile.NewTestDispenser(`cgi /some/file {
+  profile bulk
+}`)
+	if err := c.UnmarshalCaddyfile(d); err == nil {
+		t.Error("Expected an error for an unknown profile.")
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// Program is implemented by Caddy modules in the cgi.programs namespace. A
+// route configured with a program invokes it in-process instead of starting
+// the executable, with the semantics of a CGI script: args are the arguments
+// of the executable, env is the environment it would get, stdin carries the
+// request body and the response (headers, blank line, body) is written to
+// stdout. The context is done when the client went away or the timeout of
+// the route passed.
+type Program interface {
+	ServeCGI(ctx context.Context, args, env []string, stdin io.Reader, stdout io.Writer) error
+}
+
+// errResponseDone is seen by programs writing after the response has been
+// finished or aborted.
+var errResponseDone = errors.New("response done")
+
+// runProgram serves req with h.Program. The exit code is 0 if the program
+// returned without error and 1 otherwise.
+func (h *handler) runProgram(rw http.ResponseWriter, req *http.Request) (exitCode int, usage processUsage) {
+	ctx := req.Context()
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+	var stdin io.Reader = http.NoBody
+	if req.Body != nil && req.ContentLength != 0 {
+		stdin = req.Body
+	}
+	env := h.environ(req)
+	h.logEnvironSize(env)
+
+	stdoutRead, stdoutWrite := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := h.Program.ServeCGI(ctx, h.Args, env, stdin, stdoutWrite)
+		stdoutWrite.Close()
+		done <- err
+	}()
+	// A program ignoring the context still gets its writes refused.
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			stdoutRead.CloseWithError(ctx.Err())
+		case <-stop:
+		}
+	}()
+	h.writeResponse(rw, stdoutRead)
+	close(stop)
+	stdoutRead.CloseWithError(errResponseDone)
+	if err := <-done; err != nil {
+		h.Logger.Error("CGI program failed", zap.String("path", h.Path), zap.Error(err))
+		return 1, usage
+	}
+	return 0, usage
+}
@@ -0,0 +1,124 @@
+package cgi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(testProgram{})
+}
+
+// testProgram echoes its greeting, the request method and the request body.
+type testProgram struct {
+	Greeting string `json:"greeting,omitempty"`
+}
+
+func (testProgram) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "cgi.programs.test",
+		New: func() caddy.Module { return new(testProgram) },
+	}
+}
+
+func (p *testProgram) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			if d.Val() == "greeting" && d.NextArg() {
+				p.Greeting = d.Val()
+			}
+		}
+	}
+	return nil
+}
+
+func (p *testProgram) ServeCGI(ctx context.Context, args, env []string, stdin io.Reader, stdout io.Writer) error {
+	body, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	var method string
+	for _, e := range env {
+		if strings.HasPrefix(e, "REQUEST_METHOD=") {
+			method = e[len("REQUEST_METHOD="):]
+		}
+	}
+	if method == http.MethodDelete {
+		return fmt.Errorf("refusing to delete")
+	}
+	_, err = fmt.Fprintf(stdout, "Content-Type: text/plain\r\n\r\n%s %s %v %s", p.Greeting, method, args, body)
+	return err
+}
+
+func TestCGI_ServeHTTPProgram(t *testing.T) {
+	c := CGI{
+		Executable: "test/missing",
+		Args:       []string{"{path}"},
+		logger:     zap.NewNop(),
+		program:    &testProgram{Greeting: "hello"},
+	}
+	serve := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/some/path", strings.NewReader("body"))
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		res := httptest.NewRecorder()
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		return res
+	}
+
+	res := serve(http.MethodPost)
+	if res.Code != http.StatusOK {
+		t.Errorf("Unexpected status %d. Expected %d.", res.Code, http.StatusOK)
+	}
+	if expected := "hello POST [/some/path] body"; res.Body.String() != expected {
+		t.Errorf("Unexpected body %q. Expected %q.", res.Body.String(), expected)
+	}
+
+	// A program failing without a response is an internal error.
+	if res := serve(http.MethodDelete); res.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected status %d. Expected %d.", res.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestCGI_UnmarshalCaddyfileProgram(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`cgi /some/file {
+  program test {
+    greeting hi
+  }
+  timeout 1m
+}`)
+	var c CGI
+	if err := c.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Cannot parse caddyfile: %v", err)
+	}
+	var prog map[string]string
+	if err := json.Unmarshal(c.ProgramRaw, &prog); err != nil {
+		t.Fatalf("Cannot decode program: %v", err)
+	}
+	if prog["program"] != "test" || prog["greeting"] != "hi" {
+		t.Errorf("Unexpected program %s.", c.ProgramRaw)
+	}
+	if c.Timeout != caddy.Duration(time.Minute) {
+		t.Errorf("Unexpected timeout %v. Expected %v.", c.Timeout, "1m")
+	}
+
+	d = caddyfile.NewTestDispenser(`cgi /some/file {
+  program unknown
+}`)
+	if err := c.UnmarshalCaddyfile(d); err == nil {
+		t.Error("Expected an error for an unknown program.")
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"net/http"
+	"time"
+)
+
+// Defaults of the delays between retries of failed scripts.
+const (
+	defaultRetryDelay    = 100 * time.Millisecond
+	defaultRetryDelayMax = 5 * time.Second
+)
+
+// idempotentMethods are the request methods scripts may be run again for.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// retryDelay returns the time to wait before retrying after attempt, which
+// doubles from RetryDelay with every attempt up to RetryDelayMax.
+func (h *handler) retryDelay(attempt int) time.Duration {
+	delay := h.RetryDelay
+	for i := 0; i < attempt && delay < h.RetryDelayMax; i++ {
+		delay *= 2
+	}
+	if delay > h.RetryDelayMax {
+		delay = h.RetryDelayMax
+	}
+	return delay
+}
+
+// retryDelay returns the time before the first retry.
+func (c CGI) retryDelay() time.Duration {
+	if c.RetryDelay <= 0 {
+		return defaultRetryDelay
+	}
+	return time.Duration(c.RetryDelay)
+}
+
+// retryDelayMax returns the maximum time between retries.
+func (c CGI) retryDelayMax() time.Duration {
+	if c.RetryDelayMax <= 0 {
+		return defaultRetryDelayMax
+	}
+	return time.Duration(c.RetryDelayMax)
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Sandbox is a named set of restrictions defined in the app and shared by
+// the routes referring to it. Settings of a route take precedence over those
+// of its sandbox.
+type Sandbox struct {
+	// User the script is executed as, by name or id (Unix only)
+	User string `json:"user,omitempty"`
+	// Group the script is executed as (default: primary group of User)
+	Group string `json:"group,omitempty"`
+	// CPU time the script may use (rounded up to seconds; Linux and macOS only)
+	LimitCPU caddy.Duration `json:"limitCpu,omitempty"`
+	// Address space the script may use, in bytes (Linux and macOS only)
+	LimitMemory int64 `json:"limitMemory,omitempty"`
+	// Number of files the script may open (Linux and macOS only)
+	LimitNofile int `json:"limitNofile,omitempty"`
+	// File mode creation mask of the script in octal (Linux and macOS only;
+	// rejected elsewhere)
+	Umask string `json:"umask,omitempty"`
+	// Directory the script is confined to with chroot (Unix only)
+	Chroot string `json:"chroot,omitempty"`
+	// Namespaces the script is executed in: ipc, mount, net, pid, uts
+	// (Linux only)
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Seccomp preset or path of a compiled BPF program (Linux only)
+	Seccomp string `json:"seccomp,omitempty"`
+	// Paths the script may read and execute, or also modify, beneath; the
+	// rest of the file system is inaccessible (Linux only)
+	LandlockRead  []string `json:"landlockRead,omitempty"`
+	LandlockWrite []string `json:"landlockWrite,omitempty"`
+	// Patterns (like LC_*) of the host environment variables the script may
+	// inherit; others are dropped even if passed by the route. Unset means
+	// no restriction, an empty list allows nothing but PATH
+	InheritEnv []string `json:"inheritEnv,omitempty"`
+}
+
+// applySandbox merges the sandbox the configuration refers to into it.
+func (c *CGI) applySandbox() error {
+	if c.Sandbox == "" {
+		return nil
+	}
+	sb, ok := c.app.Sandboxes[c.Sandbox]
+	if !ok {
+		return fmt.Errorf("unknown sandbox %q", c.Sandbox)
+	}
+	if c.User == "" && c.Group == "" {
+		c.User, c.Group = sb.User, sb.Group
+	}
+	if c.Chroot == "" {
+		c.Chroot = sb.Chroot
+	}
+	if c.Umask == "" {
+		c.Umask = sb.Umask
+	}
+	if c.LimitCPU == 0 {
+		c.LimitCPU = sb.LimitCPU
+	}
+	if c.LimitMemory == 0 {
+		c.LimitMemory = sb.LimitMemory
+	}
+	if c.LimitNofile == 0 {
+		c.LimitNofile = sb.LimitNofile
+	}
+	if c.Namespaces == nil {
+		c.Namespaces = sb.Namespaces
+	}
+	if c.Seccomp == "" {
+		c.Seccomp = sb.Seccomp
+	}
+	if c.LandlockRead == nil && c.LandlockWrite == nil {
+		c.LandlockRead, c.LandlockWrite = sb.LandlockRead, sb.LandlockWrite
+	}
+	c.inheritEnv = sb.InheritEnv
+	return nil
+}
+
+// envAllowed reports whether the host variable name may be inherited under
+// the given patterns; nil patterns allow everything.
+func envAllowed(patterns []string, name string) bool {
+	if patterns == nil {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
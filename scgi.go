@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// An SCGI request is a netstring holding the CGI environment as NUL
+// terminated names and values, with CONTENT_LENGTH first and SCGI set to 1,
+// followed by exactly CONTENT_LENGTH bytes of body. The response is a regular
+// CGI response, ending when the server closes the connection.
+
+// scgiHeaders returns the netstring of the request headers for env, a list of
+// key=value pairs, and a body of length bytes.
+func scgiHeaders(env []string, length int64) []byte {
+	var b strings.Builder
+	b.WriteString("CONTENT_LENGTH\x00" + strconv.FormatInt(length, 10) + "\x00SCGI\x001\x00")
+	for _, e := range env {
+		eq := strings.IndexByte(e, '=')
+		if eq < 0 || e[:eq] == "CONTENT_LENGTH" || e[:eq] == "SCGI" {
+			continue
+		}
+		b.WriteString(e[:eq] + "\x00" + e[eq+1:] + "\x00")
+	}
+	return []byte(strconv.Itoa(b.Len()) + ":" + b.String() + ",")
+}
+
+// spoolChunked returns req with its body spooled if it is chunked, for
+// protocols that need the length of the body ahead, and the function that
+// removes the spooled body again. If spooling failed, rw has been answered
+// and ok is false.
+func (h *handler) spoolChunked(rw http.ResponseWriter, req *http.Request) (spooled *http.Request, cleanup func(), ok bool) {
+	if req.ContentLength >= 0 {
+		return req, func() {}, true
+	}
+	spooled, cleanup, err := spoolBody(req)
+	if err != nil {
+		status := err.(caddyhttp.HandlerError).StatusCode
+		if status != http.StatusBadRequest {
+			// Not merely a broken upload of the client.
+			h.Failure.set(failBodyLimit)
+		}
+		rw.WriteHeader(status)
+		h.Logger.Error("cannot spool chunked request body", zap.Error(err))
+		return nil, nil, false
+	}
+	return spooled, cleanup, true
+}
+
+// serveSCGI relays req to the SCGI server at backend. Chunked request bodies
+// are spooled first, since their length has to be sent ahead.
+func (h *handler) serveSCGI(backend socketBackend, rw http.ResponseWriter, req *http.Request) {
+	req, cleanup, ok := h.spoolChunked(rw, req)
+	if !ok {
+		return
+	}
+	defer cleanup()
+	conn, err := backend.dial()
+	if err != nil {
+		h.Failure.set(failSpawn)
+		rw.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("SCGI error", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	h.serveConn(rw, req, conn, "SCGI", func(w *bufio.Writer) error {
+		env := h.environ(req)
+		h.logEnvironSize(env)
+		if _, err := w.Write(scgiHeaders(env, req.ContentLength)); err != nil {
+			return err
+		}
+		if req.Body != nil && req.ContentLength > 0 {
+			if _, err := io.CopyN(w, req.Body, req.ContentLength); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}, conn)
+}
@@ -0,0 +1,136 @@
+package cgi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// scgiEcho serves SCGI requests on ln, answering with the request headers
+// and body it got.
+func scgiEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			size, err := r.ReadString(':')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSuffix(size, ":"))
+			headers := make([]byte, n+1)
+			if _, err := io.ReadFull(r, headers); err != nil {
+				return
+			}
+			fields := bytes.Split(headers[:n], []byte{0})
+			length, _ := strconv.Atoi(string(fields[1]))
+			body := make([]byte, length)
+			io.ReadFull(r, body)
+			fmt.Fprintf(conn, "Status: 201 Created\r\nContent-Type: text/plain\r\n\r\n")
+			for i := 0; i+1 < len(fields); i += 2 {
+				switch name := string(fields[i]); name {
+				case "CONTENT_LENGTH", "SCGI", "REQUEST_METHOD", "PATH_INFO", "SCGI_TEST":
+					fmt.Fprintf(conn, "%s [%s]\n", name, fields[i+1])
+				}
+			}
+			fmt.Fprintf(conn, "BODY [%s]\n", body)
+		}()
+	}
+}
+
+// TestSCGIHelper is the SCGI application started by TestCGI_ServeHTTPSCGI;
+// the test binary serves as the executable.
+func TestSCGIHelper(t *testing.T) {
+	if os.Getenv("SCGI_HELPER") != "1" {
+		return
+	}
+	ln, err := net.FileListener(os.Stdin)
+	if err != nil {
+		os.Exit(1)
+	}
+	scgiEcho(ln)
+	os.Exit(0)
+}
+
+func TestCGI_ServeHTTPSCGI(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer ln.Close()
+	go scgiEcho(ln)
+
+	remote := CGI{
+		Executable: "/srv/app.py",
+		Envs:       []string{"SCGI_TEST=remote"},
+		ScriptName: "/app",
+		logger:     zap.NewNop(),
+	}
+	if remote.scgi, err = newRemoteBackend(ln.Addr().String()); err != nil {
+		t.Fatalf("Invalid address: %v", err)
+	}
+	backends := []CGI{remote}
+	if runtime.GOOS != "windows" {
+		spawned := CGI{
+			Executable: os.Args[0],
+			Args:       []string{"-test.run=^TestSCGIHelper$"},
+			Envs:       []string{"SCGI_HELPER=1", "SCGI_TEST=spawned"},
+			ScriptName: "/app",
+			logger:     zap.NewNop(),
+		}
+		app, err := spawned.startSocketApp("SCGI")
+		if err != nil {
+			t.Fatalf("Cannot start SCGI application: %v", err)
+		}
+		spawned.scgi = app
+		defer spawned.Cleanup()
+		backends = append(backends, spawned)
+	}
+
+	for _, c := range backends {
+		for _, step := range []struct {
+			method, body string
+			chunked      bool
+		}{
+			{http.MethodGet, "", false},
+			{http.MethodPost, "name=value", false},
+			{http.MethodPost, "chunked", true},
+		} {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(step.method, "/app/path", strings.NewReader(step.body))
+			if step.chunked {
+				req.ContentLength = -1
+				req.TransferEncoding = []string{"chunked"}
+			}
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+				t.Fatalf("Cannot serve http: %v", err)
+			}
+			if res.Code != http.StatusCreated {
+				t.Errorf("Unexpected statusCode %d. Expected %d.", res.Code, http.StatusCreated)
+			}
+			expected := fmt.Sprintf("CONTENT_LENGTH [%d]\nSCGI [1]\nREQUEST_METHOD [%s]\nPATH_INFO [/path]\nSCGI_TEST [%s]\nBODY [%s]",
+				len(step.body), step.method, strings.TrimPrefix(c.Envs[len(c.Envs)-1], "SCGI_TEST="), step.body)
+			if body := strings.TrimSpace(res.Body.String()); body != expected {
+				t.Errorf("Unexpected body\n========== Got ==========\n%s\n========== Wanted ==========\n%s", body, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errDeadlineTooShort is returned by scheduler.acquire for requests that would
+// have to wait although they are not expected to finish in time anyway.
+var errDeadlineTooShort = errors.New("remaining deadline shorter than expected execution time")
+
+// scheduler limits the number of concurrently executing CGI requests (if its
+// capacity is greater than 0). Free slots are handed to waiting requests
+// using stride scheduling: every route has a pass value that advances by the
+// inverse of its weight whenever one of its requests is admitted, and the
+// waiting route with the lowest pass goes next. A busy route therefore cannot
+// starve a quiet one, and routes that were idle don't bank credit they could
+// spend all at once afterwards.
+type scheduler struct {
+	mu       sync.Mutex
+	capacity int
+	running  int
+	pass     float64 // pass of the most recently admitted route
+	routes   map[string]*schedRoute
+}
+
+type schedRoute struct {
+	pass    float64
+	waiting []*schedWaiter
+}
+
+type schedWaiter struct {
+	stride float64
+	ready  chan struct{}
+}
+
+func newScheduler(capacity int) *scheduler {
+	return &scheduler{
+		capacity: capacity,
+		routes:   make(map[string]*schedRoute),
+	}
+}
+
+// acquire waits for a free slot for the given route. Requests that would have
+// to wait are rejected right away if the deadline of ctx is less than
+// expected away. The returned function must be called once the request is
+// done.
+func (s *scheduler) acquire(ctx context.Context, route string, weight int, expected time.Duration) (release func(), err error) {
+	if weight < 1 {
+		weight = 1
+	}
+	stride := 1 / float64(weight)
+
+	s.mu.Lock()
+	rt, ok := s.routes[route]
+	if !ok {
+		rt = new(schedRoute)
+		s.routes[route] = rt
+	}
+	if len(rt.waiting) == 0 && rt.pass < s.pass {
+		rt.pass = s.pass
+	}
+	if s.free() && !s.backlog() {
+		s.admit(rt, stride)
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && expected > 0 && time.Until(deadline) < expected {
+		s.mu.Unlock()
+		return nil, errDeadlineTooShort
+	}
+	w := &schedWaiter{stride: stride, ready: make(chan struct{})}
+	rt.waiting = append(rt.waiting, w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return s.release, nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	select {
+	case <-w.ready:
+		// Admitted while giving up; hand the slot on.
+		s.mu.Unlock()
+		s.release()
+		return nil, ctx.Err()
+	default:
+	}
+	for i, other := range rt.waiting {
+		if other == w {
+			rt.waiting = append(rt.waiting[:i], rt.waiting[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+	return nil, ctx.Err()
+}
+
+func (s *scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	s.dispatch()
+}
+
+// queued returns the number of waiting requests by route.
+func (s *scheduler) queued() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]int, len(s.routes))
+	for name, rt := range s.routes {
+		res[name] = len(rt.waiting)
+	}
+	return res
+}
+
+// setCapacity changes the limit; 0 means unlimited.
+func (s *scheduler) setCapacity(capacity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capacity = capacity
+	s.dispatch()
+}
+
+// free reports whether another request may run; s.mu must be held.
+func (s *scheduler) free() bool {
+	return s.capacity <= 0 || s.running < s.capacity
+}
+
+// usage returns the number of running requests and the limit.
+func (s *scheduler) usage() (running, capacity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running, s.capacity
+}
+
+// backlog reports whether any request is waiting; s.mu must be held.
+func (s *scheduler) backlog() bool {
+	for _, rt := range s.routes {
+		if len(rt.waiting) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// admit accounts for a request of rt starting; s.mu must be held.
+func (s *scheduler) admit(rt *schedRoute, stride float64) {
+	s.pass = rt.pass
+	rt.pass += stride
+	s.running++
+}
+
+// dispatch admits waiting requests as long as there is capacity left; s.mu
+// must be held.
+func (s *scheduler) dispatch() {
+	for s.free() {
+		var next *schedRoute
+		for _, rt := range s.routes {
+			if len(rt.waiting) > 0 && (next == nil || rt.pass < next.pass) {
+				next = rt
+			}
+		}
+		if next == nil {
+			return
+		}
+		w := next.waiting[0]
+		next.waiting = next.waiting[1:]
+		s.admit(next, w.stride)
+		close(w.ready)
+	}
+}
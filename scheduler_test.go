@@ -0,0 +1,148 @@
+package cgi
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// enqueue starts a request of route in the background and waits until it is
+// queued. Admitted requests are reported on admitted and release their slot
+// right away.
+func enqueue(t *testing.T, s *scheduler, route string, weight int, admitted chan<- string) {
+	s.mu.Lock()
+	var before int
+	if rt, ok := s.routes[route]; ok {
+		before = len(rt.waiting)
+	}
+	s.mu.Unlock()
+
+	go func() {
+		release, err := s.acquire(context.Background(), route, weight, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		admitted <- route
+		release()
+	}()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		var queued int
+		if rt, ok := s.routes[route]; ok {
+			queued = len(rt.waiting)
+		}
+		s.mu.Unlock()
+		if queued > before {
+			return
+		}
+	}
+	t.Fatalf("Request of route %q did not get queued.", route)
+}
+
+func TestScheduler_Fairness(t *testing.T) {
+	s := newScheduler(1)
+	release, err := s.acquire(context.Background(), "busy", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan string, 10)
+	for i := 0; i < 5; i++ {
+		enqueue(t, s, "busy", 1, admitted)
+	}
+	enqueue(t, s, "quiet", 1, admitted)
+	release()
+
+	var order []string
+	for i := 0; i < 6; i++ {
+		order = append(order, <-admitted)
+	}
+	if order[0] != "quiet" && order[1] != "quiet" {
+		t.Errorf("Quiet route was starved by the busy one: %v", order)
+	}
+}
+
+func TestScheduler_Weights(t *testing.T) {
+	s := newScheduler(1)
+	release, err := s.acquire(context.Background(), "init", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan string, 40)
+	for i := 0; i < 20; i++ {
+		enqueue(t, s, "heavy", 3, admitted)
+		enqueue(t, s, "light", 1, admitted)
+	}
+	release()
+
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[<-admitted]++
+	}
+	if counts["heavy"] < 5 || counts["heavy"] > 7 {
+		t.Errorf("Unexpected share of admissions %v. Expected about 6 heavy and 2 light.", counts)
+	}
+}
+
+func TestScheduler_Cancel(t *testing.T) {
+	s := newScheduler(1)
+	release, err := s.acquire(context.Background(), "a", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.acquire(ctx, "b", 1, 0); err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error %v. Expected %v.", err, context.DeadlineExceeded)
+	}
+	release()
+
+	if release, err = s.acquire(context.Background(), "b", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if s.running != 0 {
+		t.Errorf("Unexpected number of running requests %d. Expected 0.", s.running)
+	}
+}
+
+func TestScheduler_Deadline(t *testing.T) {
+	s := newScheduler(1)
+	release, err := s.acquire(context.Background(), "a", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := s.acquire(ctx, "a", 1, 2*time.Second); err != errDeadlineTooShort {
+		t.Fatalf("Unexpected error %v. Expected %v.", err, errDeadlineTooShort)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Rejection took %v instead of being immediate.", elapsed)
+	}
+}
+
+func TestScheduler_SetCapacity(t *testing.T) {
+	s := newScheduler(1)
+	release, err := s.acquire(context.Background(), "a", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	admitted := make(chan string, 1)
+	enqueue(t, s, "b", 1, admitted)
+	s.setCapacity(2)
+	select {
+	case <-admitted:
+	case <-time.After(time.Second):
+		t.Fatal("Waiting request not admitted after raising the limit.")
+	}
+}
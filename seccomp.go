@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+// seccompMaxInsns is the maximum length of a seccomp filter program.
+const seccompMaxInsns = 4096
+
+// sockFilterSize is the size of a struct sock_filter instruction.
+const sockFilterSize = 8
+
+// processSeccomp returns the seccomp filter program of the CGI configuration
+// as a sequence of struct sock_filter; nil if none is configured. The profile
+// is either the name of a preset or the path of a compiled program.
+func (c CGI) processSeccomp() ([]byte, error) {
+	if c.Seccomp == "" {
+		return nil, nil
+	}
+	if !seccompSupported {
+		return nil, fmt.Errorf("seccomp is only supported on Linux")
+	}
+	if selfExecutableErr != nil {
+		return nil, fmt.Errorf("seccomp needs the path of the Caddy binary: %v", selfExecutableErr)
+	}
+	if preset, ok := seccompPresets[c.Seccomp]; ok {
+		return preset.compile()
+	}
+	prog, err := ioutil.ReadFile(c.Seccomp)
+	if err != nil {
+		return nil, fmt.Errorf("unknown seccomp preset or unreadable profile: %v", err)
+	}
+	if len(prog) == 0 || len(prog)%sockFilterSize != 0 || len(prog)/sockFilterSize > seccompMaxInsns {
+		return nil, fmt.Errorf("seccomp profile %s is no valid BPF program", c.Seccomp)
+	}
+	return prog, nil
+}
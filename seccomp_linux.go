@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const seccompSupported = true
+
+// Return values of seccomp filters.
+const (
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+)
+
+// Offsets within struct seccomp_data. The lower half of the first argument
+// comes first on the little endian architectures presets are provided for.
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArg0 = 16
+)
+
+const (
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+)
+
+// seccompPreset is a built-in profile: the denied system calls fail with
+// EPERM, all others are allowed.
+type seccompPreset struct {
+	denied []uint32
+	// localSockets lets socket fail unless it creates a Unix domain socket.
+	localSockets bool
+}
+
+// seccompSystemSyscalls debug other processes, administrate the system or
+// leave the namespaces of the script; scripts have no business calling them.
+var seccompSystemSyscalls = append([]uint32{
+	unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV, unix.SYS_KCMP,
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_OPEN_TREE, unix.SYS_MOVE_MOUNT,
+	unix.SYS_FSOPEN, unix.SYS_FSCONFIG, unix.SYS_FSMOUNT, unix.SYS_FSPICK,
+	unix.SYS_UNSHARE, unix.SYS_SETNS,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE, unix.SYS_KEXEC_LOAD,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD, unix.SYS_LOOKUP_DCOOKIE,
+	unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY, unix.SYS_KEYCTL,
+	unix.SYS_REBOOT, unix.SYS_SWAPON, unix.SYS_SWAPOFF, unix.SYS_ACCT, unix.SYS_SYSLOG,
+	unix.SYS_QUOTACTL, unix.SYS_VHANGUP, unix.SYS_FANOTIFY_INIT, unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_SETTIMEOFDAY, unix.SYS_CLOCK_SETTIME, unix.SYS_CLOCK_ADJTIME, unix.SYS_ADJTIMEX,
+	unix.SYS_SETHOSTNAME, unix.SYS_SETDOMAINNAME,
+}, seccompArchSyscalls...)
+
+var seccompPresets = map[string]seccompPreset{
+	"default": {denied: seccompSystemSyscalls},
+	"basic-io": {
+		denied:       append(seccompSystemSyscalls[:len(seccompSystemSyscalls):len(seccompSystemSyscalls)], seccompNetworkSyscalls...),
+		localSockets: true,
+	},
+}
+
+// nativeEndian is the byte order of filter programs.
+var nativeEndian = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// compile returns the filter program of the preset. Processes of a foreign
+// architecture are killed, since the system call numbers wouldn't match.
+func (p seccompPreset) compile() ([]byte, error) {
+	if seccompArch == 0 {
+		return nil, fmt.Errorf("seccomp presets are not supported on %s", runtime.GOARCH)
+	}
+	const (
+		load = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		jeq  = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jge  = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		ret  = unix.BPF_RET | unix.BPF_K
+	)
+	deny := bpfStmt(ret, seccompRetErrno|uint32(syscall.EPERM))
+	prog := []unix.SockFilter{
+		bpfStmt(load, seccompDataArch),
+		bpfJump(jeq, seccompArch, 1, 0),
+		bpfStmt(ret, seccompRetKillProcess),
+		bpfStmt(load, seccompDataNr),
+	}
+	if seccompX32Bit != 0 {
+		prog = append(prog, bpfJump(jge, seccompX32Bit, 0, 1), deny)
+	}
+	for _, nr := range p.denied {
+		prog = append(prog, bpfJump(jeq, nr, 0, 1), deny)
+	}
+	if p.localSockets {
+		prog = append(prog,
+			bpfJump(jeq, unix.SYS_SOCKET, 0, 4),
+			bpfStmt(load, seccompDataArg0),
+			bpfJump(jeq, unix.AF_UNIX, 0, 1),
+			bpfStmt(ret, seccompRetAllow),
+			deny,
+		)
+	}
+	prog = append(prog, bpfStmt(ret, seccompRetAllow))
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, nativeEndian, prog); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadSeccomp confines the calling thread to the filter program prog. Since
+// it also sets no_new_privs, set-user-ID binaries lose their effect.
+func loadSeccomp(prog []byte) error {
+	filter := make([]unix.SockFilter, len(prog)/sockFilterSize)
+	if err := binary.Read(bytes.NewReader(prog), nativeEndian, filter); err != nil {
+		return err
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("setting no_new_privs: %v", err)
+	}
+	fprog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&fprog))); errno != 0 {
+		return fmt.Errorf("loading seccomp filter: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package cgi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCGI_ServeHTTPSeccomp(t *testing.T) {
+	if seccompArch == 0 {
+		t.Skip("no seccomp presets on this architecture")
+	}
+	serve := func(preset string) string {
+		c := CGI{Executable: "test/seccomp", Seccomp: preset, logger: zap.NewNop()}
+		var err error
+		if c.seccomp, err = c.processSeccomp(); err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/seccomp", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		return res.Body.String()
+	}
+
+	unconfined := serve("")
+	if !strings.Contains(unconfined, "unshare [ok]") {
+		t.Skipf("user namespaces are not available: %q", unconfined)
+	}
+	for _, tc := range []struct {
+		preset  string
+		socket  string
+		unshare string
+	}{
+		{"default", "refused", "not permitted"},
+		{"basic-io", "not permitted", "not permitted"},
+	} {
+		body := serve(tc.preset)
+		lines := strings.SplitN(body, "\n", 2)
+		if len(lines) != 2 || !strings.Contains(lines[0], tc.socket) || !strings.Contains(lines[1], tc.unshare) {
+			t.Errorf("Preset %s: unexpected response %q. Expected socket to fail with %q and unshare with %q.",
+				tc.preset, body, tc.socket, tc.unshare)
+		}
+	}
+}
+
+func TestCGI_ProcessSeccompProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"empty", "", false},
+		{"truncated", "\x06\x00\x00\x00\x00\x00", false},
+		{"allow", "\x06\x00\x00\x00\x00\x00\xff\x7f", true},
+	} {
+		path := filepath.Join(dir, tc.name)
+		if err := ioutil.WriteFile(path, []byte(tc.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		prog, err := CGI{Seccomp: path}.processSeccomp()
+		if tc.ok && (err != nil || string(prog) != tc.data) {
+			t.Errorf("Profile %s: unexpected program %q (%v).", tc.name, prog, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("Profile %s: expected an error.", tc.name)
+		}
+	}
+	if _, err := (CGI{Seccomp: filepath.Join(dir, "missing")}).processSeccomp(); err == nil {
+		t.Error("Expected an error for a missing profile.")
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"go.uber.org/zap"
+)
+
+// Response headers that make the module answer with a file in place of the
+// body of the script: X-Sendfile names the file by its absolute path (as
+// with Apache's mod_xsendfile), X-Accel-Redirect by its path below one of the
+// roots (as with nginx).
+const (
+	sendfileHeader      = "X-Sendfile"
+	accelRedirectHeader = "X-Accel-Redirect"
+)
+
+// processSendfile validates the sendfile roots of the CGI configuration and
+// returns their absolute paths.
+func (c CGI) processSendfile() ([]string, error) {
+	var roots []string
+	for _, root := range c.SendfileRoots {
+		if root == "" {
+			return nil, fmt.Errorf("empty sendfile root")
+		}
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, abs)
+	}
+	return roots, nil
+}
+
+// isSendfile reports whether a response with headers names a file to send.
+func isSendfile(headers http.Header) bool {
+	return headers.Get(sendfileHeader) != "" || headers.Get(accelRedirectHeader) != ""
+}
+
+// sendfile answers r with the file named by headers, along with the other
+// headers of the script. Files outside of the sendfile roots, also by way of
+// symbolic links, are an error.
+func (c CGI) sendfile(w http.ResponseWriter, r *http.Request, headers http.Header) {
+	name := headers.Get(sendfileHeader)
+	var p string
+	if name != "" {
+		p = c.sendfilePath(name)
+	} else {
+		name = headers.Get(accelRedirectHeader)
+		p = c.accelRedirectPath(name)
+	}
+	headers.Del(sendfileHeader)
+	headers.Del(accelRedirectHeader)
+	if p == "" {
+		c.logger.Error("file to send is outside of the sendfile roots", zap.String("file", name))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		c.logger.Error("cannot open file to send", zap.String("file", name), zap.Error(err))
+		if os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		c.logger.Error("cannot send file", zap.String("file", name), zap.Error(err))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	c.logger.Debug("sending file", zap.String("file", p))
+
+	// The length of the file is not the one of the body of the script.
+	headers.Del("Content-Length")
+	for k, vv := range headers {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	// ServeContent takes care of ranges and conditional requests and, if the
+	// script didn't set one, the content type.
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// sendfilePath returns the path of the file with the absolute path name if
+// it is within one of the sendfile roots; empty otherwise.
+func (c CGI) sendfilePath(name string) string {
+	if !filepath.IsAbs(name) {
+		return ""
+	}
+	return c.withinRoots(filepath.Clean(name))
+}
+
+// accelRedirectPath returns the path of the file with the URI path uri
+// below the first sendfile root that has it; empty if there is none.
+func (c CGI) accelRedirectPath(uri string) string {
+	name, err := url.PathUnescape(uri)
+	if err != nil {
+		return ""
+	}
+	name = filepath.FromSlash(path.Clean("/" + name))
+	for _, root := range c.sendRoots {
+		p := filepath.Join(root, name)
+		if _, err := os.Lstat(p); err == nil {
+			return c.withinRoots(p)
+		}
+	}
+	return ""
+}
+
+// withinRoots returns p if it, with all symbolic links resolved, is within
+// one of the sendfile roots; empty otherwise. Paths that don't exist are
+// returned as they are so opening them fails as usual.
+func (c CGI) withinRoots(p string) string {
+	real, err := filepath.EvalSymlinks(p)
+	if os.IsNotExist(err) {
+		real, err = p, nil
+	}
+	if err != nil {
+		return ""
+	}
+	for _, root := range c.sendRoots {
+		if resolved, err := filepath.EvalSymlinks(root); err == nil {
+			root = resolved
+		}
+		if _, err := chrootPath(root, real); err == nil {
+			return p
+		}
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Reasons of shedding requests, as in the cgi.shed.reason placeholder.
+const (
+	shedCircuitOpen = "circuit_open"
+	shedDraining    = "draining"
+	shedQueueFull   = "queue_full"
+	shedScheduler   = "scheduler"
+)
+
+// ShedResponse describes the response to requests the handler sheds instead
+// of running the script, because the circuit breaker is open, the handler is
+// shutting down or no process slot became free in time. Placeholders in the
+// body are replaced, including {cgi.shed.reason} and
+// {cgi.shed.retry_after}.
+type ShedResponse struct {
+	// Status code (default 503)
+	Status int `json:"status,omitempty"`
+	// Time clients are told to wait before retrying, replacing the one of the
+	// circuit breaker; 0 to send no Retry-After header otherwise
+	RetryAfter caddy.Duration `json:"retryAfter,omitempty"`
+	// Content type of the body (default text/plain; charset=utf-8)
+	ContentType string `json:"contentType,omitempty"`
+	// Body of the response
+	Body string `json:"body,omitempty"`
+	// File the body is read from when the config is loaded, instead of Body
+	BodyFile string `json:"bodyFile,omitempty"`
+}
+
+// load validates the response and returns its body.
+func (sr ShedResponse) load() (string, error) {
+	if sr.Status != 0 && (sr.Status < 400 || sr.Status > 599) {
+		return "", fmt.Errorf("invalid shed response status %d, must be between 400 and 599", sr.Status)
+	}
+	if sr.RetryAfter < 0 {
+		return "", fmt.Errorf("invalid shed response retry after %v", time.Duration(sr.RetryAfter))
+	}
+	if sr.BodyFile == "" {
+		return sr.Body, nil
+	}
+	if sr.Body != "" {
+		return "", fmt.Errorf("shed response body and body_file cannot be combined")
+	}
+	body, err := ioutil.ReadFile(sr.BodyFile)
+	if err != nil {
+		return "", fmt.Errorf("reading shed response body: %v", err)
+	}
+	return string(body), nil
+}
+
+// shed answers a request that is not run for reason, after which clients
+// may retry in retryAfter (0 if unknown), with the configured ShedResponse,
+// or else with err as 503 (Service Unavailable) error for the error routes
+// of Caddy.
+func (c CGI) shed(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, repl *caddy.Replacer, reason string, retryAfter time.Duration, err error) error {
+	if c.ShedResponse != nil && c.ShedResponse.RetryAfter > 0 {
+		retryAfter = time.Duration(c.ShedResponse.RetryAfter)
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	repl.Set("cgi.shed.reason", reason)
+	repl.Set("cgi.shed.retry_after", seconds)
+	if seconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	if c.ShedResponse == nil {
+		return caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
+	status := c.ShedResponse.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	contentType := c.ShedResponse.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	io.WriteString(w, repl.ReplaceKnown(c.shedBody, ""))
+	return next.ServeHTTP(w, r)
+}
@@ -0,0 +1,79 @@
+package cgi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCGI_ServeHTTPShedResponse(t *testing.T) {
+	c := CGI{
+		Executable:    "test/example",
+		MaxConcurrent: 1,
+		QueueTimeout:  caddy.Duration(10 * time.Millisecond),
+		ShedResponse: &ShedResponse{
+			Status:      http.StatusTooManyRequests,
+			RetryAfter:  caddy.Duration(4500 * time.Millisecond),
+			ContentType: "application/json",
+			Body:        `{"error": "{cgi.shed.reason}", "retry": {cgi.shed.retry_after}}`,
+		},
+		concurrent: newScheduler(1),
+		logger:     zap.NewNop(),
+	}
+	var err error
+	if c.shedBody, err = c.ShedResponse.load(); err != nil {
+		t.Fatal(err)
+	}
+	// Occupy the only slot.
+	release, err := c.concurrent.acquire(context.Background(), "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	req := httptest.NewRequest(http.MethodGet, "/example", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	res := httptest.NewRecorder()
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Unexpected error %v.", err)
+	}
+	if res.Code != http.StatusTooManyRequests {
+		t.Errorf("Unexpected status %d. Expected %d.", res.Code, http.StatusTooManyRequests)
+	}
+	if retry := res.Header().Get("Retry-After"); retry != "5" {
+		t.Errorf("Unexpected Retry-After %q. Expected %q.", retry, "5")
+	}
+	if ct := res.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Unexpected content type %q. Expected application/json.", ct)
+	}
+	if expected := `{"error": "queue_full", "retry": 5}`; res.Body.String() != expected {
+		t.Errorf("Unexpected body %q. Expected %q.", res.Body.String(), expected)
+	}
+}
+
+func TestShedResponse_Load(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "busy.json")
+	if err := ioutil.WriteFile(file, []byte(`{"error": "busy"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := (ShedResponse{BodyFile: file}).load(); err != nil || body != `{"error": "busy"}` {
+		t.Errorf("Unexpected body %q, %v of the body file.", body, err)
+	}
+	for _, invalid := range []ShedResponse{
+		{Status: 200},
+		{Status: 600},
+		{RetryAfter: -1},
+		{Body: "busy", BodyFile: file},
+		{BodyFile: file + ".missing"},
+	} {
+		if _, err := invalid.load(); err == nil {
+			t.Errorf("Expected an error for %+v.", invalid)
+		}
+	}
+}
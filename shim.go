@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Some settings have to be applied in the child process before the script is
+// executed, which os/exec doesn't provide for. In that case the Caddy binary
+// itself is started with shimEnv describing the settings; the init function
+// below applies them and replaces the process with the script.
+const shimEnv = "CADDY_CGI_SHIM"
+
+// shimSpec describes what the shim does before executing the script.
+type shimSpec struct {
+	Path    string   `json:"path"`
+	Rlimits []rlimit `json:"rlimits,omitempty"`
+	Nice    int      `json:"nice,omitempty"`
+	Umask   *int     `json:"umask,omitempty"`
+	IOPrio  int      `json:"ioprio,omitempty"`
+	// Landlock restricts the file system access of the script
+	Landlock []landlockRule `json:"landlock,omitempty"`
+	// Seccomp is the filter program loaded right before executing the
+	// script
+	Seccomp []byte `json:"seccomp,omitempty"`
+	// MountProc makes the shim mount a /proc of the new pid namespace
+	MountProc bool `json:"mountProc,omitempty"`
+	// Credential is applied by the shim after mounting /proc, which the
+	// unprivileged user couldn't do
+	Credential *credential `json:"credential,omitempty"`
+	// Cgroup makes the shim wait until it has been moved into its cgroup
+	Cgroup bool `json:"cgroup,omitempty"`
+}
+
+// rlimit is a resource limit as passed to setrlimit.
+type rlimit struct {
+	Resource int    `json:"resource"`
+	Cur      uint64 `json:"cur"`
+	Max      uint64 `json:"max"`
+}
+
+// rlimInfinity is the value of an unlimited resource.
+const rlimInfinity = ^uint64(0)
+
+// selfExecutable is the binary started as shim.
+var selfExecutable, selfExecutableErr = os.Executable()
+
+func init() {
+	if spec, ok := os.LookupEnv(shimEnv); ok {
+		if err := runShim(spec); err != nil {
+			fmt.Fprintf(os.Stderr, "cgi: %v\n", err)
+		}
+		os.Exit(127)
+	}
+}
+
+// needed reports whether the shim has anything to do.
+func (spec shimSpec) needed() bool {
+	return len(spec.Rlimits) > 0 || spec.Nice != 0 || spec.Umask != nil || spec.IOPrio != 0 || len(spec.Landlock) > 0 || len(spec.Seccomp) > 0 || spec.MountProc || spec.Cgroup
+}
+
+// env returns the environment variable passing spec to the shim.
+func (spec shimSpec) env() string {
+	data, _ := json.Marshal(spec) // cannot fail for plain values
+	return shimEnv + "=" + string(data)
+}
+
+// processLimits returns the resource limits of the CGI configuration.
+func (c CGI) processLimits() ([]rlimit, error) {
+	var limits []rlimit
+	if c.LimitCPU > 0 {
+		// The process gets SIGXCPU at the soft limit and is killed a second
+		// later.
+		secs := uint64((time.Duration(c.LimitCPU) + time.Second - 1) / time.Second)
+		limits = append(limits, rlimit{Resource: rlimitCPU, Cur: secs, Max: secs + 1})
+	}
+	if c.LimitMemory > 0 {
+		limits = append(limits, rlimit{Resource: rlimitMemory, Cur: uint64(c.LimitMemory), Max: uint64(c.LimitMemory)})
+	}
+	if c.LimitNofile > 0 {
+		limits = append(limits, rlimit{Resource: rlimitNofile, Cur: uint64(c.LimitNofile), Max: uint64(c.LimitNofile)})
+	}
+	if c.CoreDumps != "" {
+		if !coreDumpsSupported {
+			return nil, fmt.Errorf("core dumps are not supported on this platform")
+		}
+		limits = append(limits, rlimit{Resource: rlimitCore, Cur: rlimInfinity, Max: rlimInfinity})
+	}
+	if len(limits) > 0 {
+		if !rlimitsSupported {
+			return nil, fmt.Errorf("resource limits are not supported on this platform")
+		}
+		if selfExecutableErr != nil {
+			return nil, fmt.Errorf("resource limits need the path of the Caddy binary: %v", selfExecutableErr)
+		}
+	}
+	return limits, nil
+}
+
+// processUmask parses the octal umask of the CGI configuration; nil if the
+// umask of Caddy is inherited.
+func (c CGI) processUmask() (*int, error) {
+	if c.Umask == "" {
+		return nil, nil
+	}
+	mask, err := strconv.ParseUint(c.Umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return nil, fmt.Errorf("invalid umask %q, must be octal between 0 and 0777", c.Umask)
+	}
+	if !rlimitsSupported {
+		return nil, fmt.Errorf("umask is not supported on this platform")
+	}
+	if selfExecutableErr != nil {
+		return nil, fmt.Errorf("umask needs the path of the Caddy binary: %v", selfExecutableErr)
+	}
+	umask := int(mask)
+	return &umask, nil
+}
@@ -0,0 +1,120 @@
+//go:build linux || darwin
+// +build linux darwin
+
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+const rlimitsSupported = true
+
+const (
+	rlimitCPU    = syscall.RLIMIT_CPU
+	rlimitMemory = syscall.RLIMIT_AS
+	rlimitNofile = syscall.RLIMIT_NOFILE
+	rlimitCore   = syscall.RLIMIT_CORE
+)
+
+// runShim applies the settings in spec and executes the script. It only
+// returns on errors.
+func runShim(spec string) error {
+	var s shimSpec
+	if err := json.Unmarshal([]byte(spec), &s); err != nil {
+		return fmt.Errorf("invalid shim spec: %v", err)
+	}
+	os.Unsetenv(shimEnv)
+	// Priorities are per thread on Linux; the one calling exec has to get
+	// them.
+	runtime.LockOSThread()
+	if s.Cgroup {
+		// Caddy writes a byte once the process is in its cgroup and
+		// closes the pipe without writing if that failed.
+		pipe := os.NewFile(3, "cgroup")
+		if n, _ := pipe.Read(make([]byte, 1)); n != 1 {
+			return errors.New("not moved into cgroup")
+		}
+		pipe.Close()
+	}
+	if s.MountProc {
+		if err := mountProc(); err != nil {
+			return err
+		}
+	}
+	if s.Umask != nil {
+		syscall.Umask(*s.Umask)
+	}
+	for _, l := range s.Rlimits {
+		if err := syscall.Setrlimit(l.Resource, &syscall.Rlimit{Cur: l.Cur, Max: l.Max}); err != nil {
+			return fmt.Errorf("setting resource limit %d: %v", l.Resource, err)
+		}
+	}
+	if s.Credential != nil {
+		if err := dropCredential(s.Credential); err != nil {
+			return err
+		}
+	}
+	if s.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, s.Nice); err != nil {
+			return fmt.Errorf("setting nice value %d: %v", s.Nice, err)
+		}
+	}
+	if s.IOPrio != 0 {
+		if err := setIOPrio(s.IOPrio); err != nil {
+			return fmt.Errorf("setting I/O priority: %v", err)
+		}
+	}
+	if len(s.Landlock) > 0 {
+		if err := landlockRestrict(s.Landlock); err != nil {
+			return err
+		}
+	}
+	if len(s.Seccomp) > 0 {
+		if err := loadSeccomp(s.Seccomp); err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(s.Path, os.Args, os.Environ())
+}
+
+// logLimitExit logs processes that were presumably terminated because they
+// exceeded a resource limit.
+func (h *handler) logLimitExit(state *os.ProcessState) {
+	if len(h.Rlimits) == 0 || state == nil {
+		return
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return
+	}
+	switch sig := status.Signal(); sig {
+	case syscall.SIGXCPU:
+		h.Logger.Warn("CGI process exceeded its CPU time limit", zap.String("path", h.Path))
+	case syscall.SIGKILL, syscall.SIGSEGV, syscall.SIGABRT, syscall.SIGBUS:
+		h.Logger.Warn("CGI process with resource limits terminated by signal",
+			zap.String("path", h.Path), zap.Stringer("signal", sig))
+	}
+}
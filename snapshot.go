@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// snapshotTries is how often copying a script is attempted when it keeps
+// changing while it is copied.
+const snapshotTries = 3
+
+// snapshotter runs scripts from copies, made along with their companion files
+// whenever any of them changed, so a request never sees a deploy in
+// progress. Each copy is a generation in a directory of its own, which is
+// removed once it was replaced and the last request using it finished.
+type snapshotter struct {
+	dir   string   // parent of the generation directories
+	files []string // companions, relative to the directory of the script
+
+	mu      sync.Mutex
+	current map[string]*generation // by script
+	closed  bool
+}
+
+// generation is a copy of a script and its companions.
+type generation struct {
+	dir    string
+	script string // path of the copy of the script
+	stamp  string // of the copied files
+	refs   int
+}
+
+// newSnapshotter returns a snapshotter copying scripts along with files into
+// directories within dir, the temporary directory if empty. files may not
+// leave the directory of scripts.
+func newSnapshotter(dir string, files []string) (*snapshotter, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	for _, file := range files {
+		if filepath.IsAbs(file) || file == ".." || strings.HasPrefix(filepath.Clean(file), ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s: companion files must be relative to the script", file)
+		}
+	}
+	return &snapshotter{dir: dir, files: files, current: make(map[string]*generation)}, nil
+}
+
+// acquire returns the current generation of script, making a new one if the
+// script or its companions changed. The generation has to be released once
+// the request finished.
+func (s *snapshotter) acquire(script string) (*generation, error) {
+	script, err := filepath.Abs(script)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stamp, err := s.stamp(script)
+	if err != nil {
+		return nil, err
+	}
+	gen := s.current[script]
+	if gen == nil || gen.stamp != stamp {
+		next, err := s.snapshot(script, stamp)
+		if err != nil {
+			return nil, err
+		}
+		if gen != nil && gen.refs == 0 {
+			os.RemoveAll(gen.dir)
+		}
+		s.current[script] = next
+		gen = next
+	}
+	gen.refs++
+	return gen, nil
+}
+
+// release ends the use of gen by a request.
+func (s *snapshotter) release(gen *generation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gen.refs--
+	if gen.refs == 0 && (s.closed || s.isOutdated(gen)) {
+		os.RemoveAll(gen.dir)
+	}
+}
+
+// isOutdated reports whether gen was replaced; s.mu must be held.
+func (s *snapshotter) isOutdated(gen *generation) bool {
+	for _, current := range s.current {
+		if current == gen {
+			return false
+		}
+	}
+	return true
+}
+
+// close removes the generations that are not in use; the others are removed
+// once released.
+func (s *snapshotter) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for script, gen := range s.current {
+		if gen.refs == 0 {
+			os.RemoveAll(gen.dir)
+		}
+		delete(s.current, script)
+	}
+}
+
+// snapshot copies script and its companions into a new generation. If they
+// change while being copied, which means that a deploy is in progress, the
+// copy is made again.
+func (s *snapshotter) snapshot(script, stamp string) (*generation, error) {
+	for try := 1; ; try++ {
+		gen, err := s.copy(script, stamp)
+		if err != nil {
+			return nil, err
+		}
+		after, err := s.stamp(script)
+		if err == nil && after == stamp {
+			return gen, nil
+		}
+		os.RemoveAll(gen.dir)
+		if err != nil {
+			return nil, err
+		}
+		if try == snapshotTries {
+			return nil, fmt.Errorf("%s keeps changing while it is copied", script)
+		}
+		stamp = after
+	}
+}
+
+// copy copies script and its companions into a new directory.
+func (s *snapshotter) copy(script, stamp string) (*generation, error) {
+	dir, err := ioutil.TempDir(s.dir, "caddy-cgi-snapshot")
+	if err != nil {
+		return nil, err
+	}
+	// Scripts may run as another user.
+	if err := os.Chmod(dir, 0755); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	gen := &generation{dir: dir, script: filepath.Join(dir, filepath.Base(script)), stamp: stamp}
+	err = s.walk(script, func(rel string, info os.FileInfo) error {
+		return copyFile(filepath.Join(filepath.Dir(script), rel), filepath.Join(dir, rel), info.Mode().Perm())
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return gen, nil
+}
+
+// stamp returns a summary of the names, sizes, modes and modification times
+// of script and its companions, which changes when any of them changes.
+func (s *snapshotter) stamp(script string) (string, error) {
+	var entries []string
+	err := s.walk(script, func(rel string, info os.FileInfo) error {
+		entries = append(entries, fmt.Sprintf("%s %d %v %d", rel, info.Size(), info.Mode(), info.ModTime().UnixNano()))
+		return nil
+	})
+	sort.Strings(entries)
+	return strings.Join(entries, "\n"), err
+}
+
+// walk calls fn for script and every file of its companions, with their paths
+// relative to the directory of the script. Symbolic links are followed,
+// except to directories.
+func (s *snapshotter) walk(script string, fn func(rel string, info os.FileInfo) error) error {
+	base := filepath.Dir(script)
+	info, err := os.Stat(script)
+	if err != nil {
+		return err
+	}
+	if err := fn(filepath.Base(script), info); err != nil {
+		return err
+	}
+	for _, file := range s.files {
+		err := filepath.Walk(filepath.Join(base, file), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				if info, err = os.Stat(path); err != nil || info.IsDir() {
+					return err
+				}
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(base, path)
+			if err != nil {
+				return err
+			}
+			return fn(rel, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the file src to dst with mode, creating the parent
+// directories of dst.
+func copyFile(src, dst string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
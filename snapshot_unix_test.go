@@ -0,0 +1,91 @@
+//go:build !windows
+// +build !windows
+
+package cgi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCGI_ServeHTTPDeploySnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-cgi-deploy")
+	if err != nil {
+		t.Fatalf("Cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	app, snapshots := filepath.Join(dir, "app"), filepath.Join(dir, "snapshots")
+	for _, d := range []string{filepath.Join(app, "data"), snapshots} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("Cannot create directory: %v", err)
+		}
+	}
+	script := filepath.Join(app, "app.cgi")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nprintf 'Content-Type: text/plain\\r\\n\\r\\n'\ncat data/msg.txt\n"), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(app, "data", "msg.txt"), []byte("v1"), 0644)
+	}
+	if err != nil {
+		t.Fatalf("Cannot write script: %v", err)
+	}
+
+	c := CGI{Executable: script, logger: zap.NewNop()}
+	if c.snapshots, err = newSnapshotter(snapshots, []string{"data"}); err != nil {
+		t.Fatalf("Cannot create snapshotter: %v", err)
+	}
+	serve := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		res := httptest.NewRecorder()
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		return res.Body.String()
+	}
+	generations := func() int {
+		entries, _ := ioutil.ReadDir(snapshots)
+		return len(entries)
+	}
+
+	if body := serve(); body != "v1" {
+		t.Errorf("Unexpected body %q. Expected %q.", body, "v1")
+	}
+	// A request in flight keeps its generation while a deploy changes the
+	// companion files.
+	inFlight, err := c.snapshots.acquire(script)
+	if err != nil {
+		t.Fatalf("Cannot acquire generation: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(app, "data", "msg.txt"), []byte("v2 deployed"), 0644); err != nil {
+		t.Fatalf("Cannot deploy: %v", err)
+	}
+	if body := serve(); body != "v2 deployed" {
+		t.Errorf("Unexpected body %q. Expected %q.", body, "v2 deployed")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(inFlight.dir, "data", "msg.txt")); err != nil || string(data) != "v1" {
+		t.Errorf("Unexpected companion %q (%v) of the generation in flight. Expected %q.", data, err, "v1")
+	}
+	if n := generations(); n != 2 {
+		t.Errorf("Unexpected %d generations. Expected 2.", n)
+	}
+	c.snapshots.release(inFlight)
+	if n := generations(); n != 1 {
+		t.Errorf("Unexpected %d generations after the request finished. Expected 1.", n)
+	}
+	c.snapshots.close()
+	if n := generations(); n != 0 {
+		t.Errorf("Unexpected %d generations after closing. Expected 0.", n)
+	}
+
+	if _, err := newSnapshotter("", []string{"../secrets"}); err == nil {
+		t.Error("Expected an error for a companion outside the directory of the script.")
+	}
+}
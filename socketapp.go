@@ -0,0 +1,279 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// socketBackend is a server that gets a connection of its own for every
+// request, like FastCGI and SCGI applications.
+type socketBackend interface {
+	dial() (net.Conn, error)
+	close()
+}
+
+// remoteBackend is a server running on its own at a network address.
+type remoteBackend struct {
+	network, address string
+}
+
+// newRemoteBackend returns the backend at addr, a network address as
+// understood by caddy.ParseNetworkAddress, e.g. localhost:4000 or
+// unix//run/app.sock.
+func newRemoteBackend(addr string) (remoteBackend, error) {
+	na, err := caddy.ParseNetworkAddress(addr)
+	if err != nil {
+		return remoteBackend{}, err
+	}
+	if na.PortRangeSize() > 1 {
+		return remoteBackend{}, fmt.Errorf("%s: a single address is required", addr)
+	}
+	return remoteBackend{na.Network, na.JoinHostPort(0)}, nil
+}
+
+func (rb remoteBackend) dial() (net.Conn, error) {
+	return net.Dial(rb.network, rb.address)
+}
+
+func (rb remoteBackend) close() {}
+
+// staleSocket reports whether path is a Unix socket nothing listens on
+// anymore, like one left behind by a crashed server.
+func staleSocket(path string) bool {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return errors.Is(err, syscall.ECONNREFUSED)
+	}
+	conn.Close()
+	return false
+}
+
+// socketApp is an application started from a handler that accepts
+// connections on a Unix socket managed by the module. Like web servers
+// usually do for FastCGI applications, the listening socket is handed to the
+// process as its standard input.
+type socketApp struct {
+	h        *handler // template of the process
+	protocol string   // name of the protocol for the log
+	dir      string   // temporary directory holding the socket
+	socket   string
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd     // running process; nil if none
+	done    chan struct{} // closed once cmd exited
+	started time.Time
+	closed  bool
+}
+
+// newSocketApp starts the application of h, which speaks protocol. The
+// socket lives in a temporary directory only Caddy can access, which is
+// removed when the application is stopped or else, after a crash, swept
+// with the other temporary files.
+func newSocketApp(h *handler, protocol string) (*socketApp, error) {
+	dir, err := ioutil.TempDir("", fmt.Sprintf("cgi_socket_%d_", os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
+	sa := &socketApp{h: h, protocol: protocol, dir: dir, socket: filepath.Join(dir, "app.sock")}
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	if err := sa.start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return sa, nil
+}
+
+// start listens on the socket and starts the process with the listening
+// socket as its standard input; sa.mu must be held.
+func (sa *socketApp) start() error {
+	os.Remove(sa.socket)
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: sa.socket, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	// The socket file stays when the process exits, so it can be bound
+	// again.
+	ln.SetUnlinkOnClose(false)
+	defer ln.Close()
+	// Regardless of the umask, only Caddy connects to the socket.
+	if err := os.Chmod(sa.socket, 0600); err != nil {
+		return err
+	}
+	lnFile, err := ln.File()
+	if err != nil {
+		return err
+	}
+	defer lnFile.Close()
+
+	// Unlike the CGI environment of a request, the configured variables
+	// can only reach the application through its own environment.
+	env := append(sa.h.processEnviron(), sa.h.Env...)
+	cmd, err := sa.h.command(env, nil)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = lnFile
+	if err := startChild(cmd); err != nil {
+		return err
+	}
+	sa.cmd, sa.done, sa.started = cmd, make(chan struct{}), time.Now()
+	sa.h.Logger.Debug("started "+sa.protocol+" application", zap.String("path", sa.h.Path), zap.Int("pid", cmd.Process.Pid))
+	go func(done chan struct{}) {
+		cmd.Wait()
+		doneChild(cmd)
+		if sa.h.KillGroup {
+			killProcessGroup(cmd.Process.Pid)
+		}
+		sa.mu.Lock()
+		if !sa.closed {
+			sa.h.Logger.Warn(sa.protocol+" application exited", zap.String("path", sa.h.Path),
+				zap.Int("exit_code", cmd.ProcessState.ExitCode()))
+		}
+		if sa.cmd == cmd {
+			sa.cmd = nil
+		}
+		sa.mu.Unlock()
+		close(done)
+	}(sa.done)
+	return nil
+}
+
+// dial connects to the application, starting it again if it exited, though
+// not sooner than respawnDelay after the previous start.
+func (sa *socketApp) dial() (net.Conn, error) {
+	sa.mu.Lock()
+	if sa.closed {
+		sa.mu.Unlock()
+		return nil, errors.New(sa.protocol + " application has been stopped")
+	}
+	if sa.cmd == nil {
+		if wait := respawnDelay - time.Since(sa.started); wait > 0 {
+			sa.mu.Unlock()
+			return nil, fmt.Errorf("%s application exited, restarting in %v", sa.protocol, wait.Round(time.Millisecond))
+		}
+		if err := sa.start(); err != nil {
+			sa.mu.Unlock()
+			return nil, err
+		}
+	}
+	sa.mu.Unlock()
+	return net.Dial("unix", sa.socket)
+}
+
+// close stops the application, killing it if it doesn't exit in time, and
+// removes the socket.
+func (sa *socketApp) close() {
+	sa.mu.Lock()
+	sa.closed = true
+	cmd, done := sa.cmd, sa.done
+	sa.mu.Unlock()
+	if cmd != nil {
+		sig := sa.h.KillSignal
+		if sig == nil {
+			sig = defaultKillSignal
+		}
+		if err := cmd.Process.Signal(sig); err != nil {
+			cmd.Process.Kill()
+		}
+		select {
+		case <-done:
+		case <-time.After(stopTimeout):
+			cmd.Process.Kill()
+			<-done
+		}
+	}
+	os.RemoveAll(sa.dir)
+}
+
+// serveConn relays req over conn, a connection of its own: send writes the
+// request to the connection, while the CGI response is read from response.
+// Only the connection is closed on timeout or when the client went away,
+// the application keeps running for other requests.
+func (h *handler) serveConn(rw http.ResponseWriter, req *http.Request, conn net.Conn, protocol string, send func(w *bufio.Writer) error, response io.Reader) {
+	var expired int32
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		var timeout <-chan time.Time
+		if h.Timeout > 0 {
+			timer := time.NewTimer(h.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-timeout:
+			atomic.StoreInt32(&expired, 1)
+			h.Logger.Warn(protocol+" request timed out", zap.String("path", h.Path), zap.Duration("timeout", h.Timeout))
+			conn.Close()
+		case <-req.Context().Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	written := make(chan error, 1)
+	go func() {
+		written <- send(bufio.NewWriter(conn))
+	}()
+
+	if err := h.writeResponse(connResponseWriter{&caddyhttp.ResponseWriterWrapper{ResponseWriter: rw}, &expired}, response); err != nil {
+		conn.Close()
+	}
+	if atomic.LoadInt32(&expired) == 1 {
+		h.Failure.cause(failTimeout)
+	}
+	if err := <-written; err != nil && atomic.LoadInt32(&expired) == 0 && req.Context().Err() == nil {
+		h.Logger.Debug("cannot send request to "+protocol+" application", zap.Error(err))
+	}
+}
+
+// connResponseWriter answers with 504 instead of 500 when the request timed
+// out before the application sent a valid response.
+type connResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	expired *int32
+}
+
+func (cw connResponseWriter) WriteHeader(status int) {
+	if status == http.StatusInternalServerError && atomic.LoadInt32(cw.expired) == 1 {
+		status = http.StatusGatewayTimeout
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Modes of passing chunked request bodies to scripts.
+const (
+	chunkedBodySpool  = "spool"
+	chunkedBodyStream = "stream"
+)
+
+// spoolWriter writes to a temporary file and accounts for its growth.
+type spoolWriter struct {
+	f   *os.File
+	err error // first error writing the file
+}
+
+func (sw *spoolWriter) Write(p []byte) (int, error) {
+	n, err := sw.f.Write(p)
+	tempFiles.grow(sw.f.Name(), int64(n))
+	return n, sw.fail(err)
+}
+
+// fail records err as the first error writing the file, if it is one.
+func (sw *spoolWriter) fail(err error) error {
+	if err != nil && sw.err == nil {
+		sw.err = err
+	}
+	return err
+}
+
+// readFull reads into buf until it is full or r fails; unlike io.ReadFull,
+// it returns io.EOF at the end of r, whether buf is full or not, and passes
+// on io.ErrUnexpectedEOF of a truncated body.
+func readFull(r io.Reader, buf []byte) (n int, err error) {
+	for n < len(buf) && err == nil {
+		var m int
+		m, err = r.Read(buf[n:])
+		n += m
+	}
+	return n, err
+}
+
+// fill copies body into the file as configured by s.
+func (sw *spoolWriter) fill(body io.Reader, s spillSettings) (int64, error) {
+	if s.direct {
+		if err := sw.fail(setDirectIO(sw.f, true)); err != nil {
+			return 0, err
+		}
+	}
+	buf := s.buffer()
+	var written int64
+	for {
+		n, err := readFull(body, buf)
+		if n > 0 {
+			if s.direct && n%directIOAlign != 0 {
+				// Only the end of the body may not fill the buffer, which
+				// is written without direct I/O.
+				if err := sw.fail(setDirectIO(sw.f, false)); err != nil {
+					return written, err
+				}
+			}
+			if _, err := sw.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+			if s.sync == tempSyncAlways {
+				if err := sw.fail(fdatasync(sw.f)); err != nil {
+					return written, err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	if s.direct {
+		// The script reads the file without regard to alignment.
+		if err := sw.fail(setDirectIO(sw.f, false)); err != nil {
+			return written, err
+		}
+	}
+	if s.sync == tempSyncEnd {
+		if err := sw.fail(fdatasync(sw.f)); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// spoolBody reads a chunked request body into a temporary file, since
+// scripts rely on CONTENT_LENGTH to know how much to read. The returned
+// request has the file as body and its size as content length; cleanup
+// removes the file once the script is done with it. Errors are
+// caddyhttp.HandlerErrors telling whether the client or the server failed.
+func spoolBody(req *http.Request) (spooled *http.Request, cleanup func(), err error) {
+	f, err := tempFiles.create("body")
+	if err != nil {
+		return nil, nil, caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	cleanup = func() {
+		f.Close()
+		tempFiles.remove(f.Name())
+	}
+	sw := &spoolWriter{f: f}
+	n, err := sw.fill(req.Body, tempFiles.settings())
+	if err != nil {
+		cleanup()
+		status := http.StatusBadRequest
+		if sw.err != nil {
+			status = http.StatusInternalServerError
+		} else if isBodyTooLarge(err) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		return nil, nil, caddyhttp.Error(status, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	spooled = req.WithContext(req.Context())
+	spooled.Body = f
+	spooled.ContentLength = n
+	spooled.TransferEncoding = nil
+	return spooled, cleanup, nil
+}
+
+// bodyTee copies a chunked request body into a temporary file in the
+// background while the script already reads what has arrived so far. The
+// script doesn't get CONTENT_LENGTH, but neither has to wait for the whole
+// upload nor slows down the client when it reads slowly.
+type bodyTee struct {
+	f    *os.File
+	done chan struct{} // closed once the body isn't read any further
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signaled when written, ended or stopped change
+	written int64
+	read    int64
+	ended   bool  // the body has been read completely or failed
+	err     error // error reading or storing the body, if any
+	stopped bool  // the script is done; the rest of the body isn't needed
+}
+
+// teeBody starts copying the body of req into a temporary file.
+func teeBody(req *http.Request) (*bodyTee, error) {
+	f, err := tempFiles.create("body")
+	if err != nil {
+		return nil, err
+	}
+	t := &bodyTee{f: f, done: make(chan struct{})}
+	t.cond = sync.NewCond(&t.mu)
+	go t.fill(req.Body, tempFiles.settings())
+	return t, nil
+}
+
+// fill copies body into the file. Direct I/O isn't used, since the script
+// reads the file while it is written.
+func (t *bodyTee) fill(body io.Reader, s spillSettings) {
+	defer close(t.done)
+	buf := make([]byte, s.bufferSize)
+	var off int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := t.f.WriteAt(buf[:n], off); werr != nil {
+				n, err = 0, werr
+			} else if s.sync == tempSyncAlways {
+				if werr := fdatasync(t.f); werr != nil {
+					err = werr
+				}
+			}
+			tempFiles.grow(t.f.Name(), int64(n))
+			off += int64(n)
+		}
+		if err == io.EOF && s.sync == tempSyncEnd {
+			if werr := fdatasync(t.f); werr != nil {
+				err = werr
+			}
+		}
+
+		t.mu.Lock()
+		t.written = off
+		if err != nil {
+			t.ended = true
+			if err != io.EOF {
+				t.err = err
+			}
+		}
+		end := t.ended || t.stopped
+		t.cond.Broadcast()
+		t.mu.Unlock()
+		if end {
+			return
+		}
+	}
+}
+
+// Read returns the next part of the body, waiting for it to arrive.
+func (t *bodyTee) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	for t.read >= t.written && !t.ended && !t.stopped {
+		t.cond.Wait()
+	}
+	if t.read >= t.written {
+		err := t.err
+		t.mu.Unlock()
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	if avail := t.written - t.read; int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	off := t.read
+	t.mu.Unlock()
+
+	n, err := t.f.ReadAt(p, off)
+	t.mu.Lock()
+	t.read += int64(n)
+	t.mu.Unlock()
+	if n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// close stops copying the body and removes the file. A read of the body
+// that is in progress is waited for, since the body must not be used once
+// the request has been handled.
+func (t *bodyTee) close() {
+	t.mu.Lock()
+	t.stopped = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+	<-t.done
+	t.f.Close()
+	tempFiles.remove(t.f.Name())
+}
+
+// isBodyTooLarge reports whether err is the error of a body cut off by
+// http.MaxBytesReader, as used by the request_body handler.
+func isBodyTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
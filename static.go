@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// isStatic reports whether urlPath is below one of the static prefixes.
+func (c CGI) isStatic(urlPath string) bool {
+	_, ok := c.staticPrefix(urlPath)
+	return ok
+}
+
+// staticPrefix returns the static prefix urlPath is below, once cleaned, so
+// dot segments can't lead out of it.
+func (c CGI) staticPrefix(urlPath string) (string, bool) {
+	urlPath = cleanURLPath(urlPath)
+	for _, prefix := range c.StaticPrefixes {
+		if prefix = strings.TrimSuffix(prefix, "*"); strings.HasPrefix(urlPath, prefix) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// cleanURLPath resolves the dot segments and duplicate slashes of urlPath,
+// keeping a trailing slash.
+func cleanURLPath(urlPath string) string {
+	cleaned := path.Clean("/" + urlPath)
+	if strings.HasSuffix(urlPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// serveStatic serves the file the request path refers to. The path below the
+// script name is looked up in the working directory of the script, so assets
+// can be laid out next to it like the URLs the script generates suggest.
+func (c CGI) serveStatic(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+	}
+
+	prefix, ok := c.staticPrefix(r.URL.Path)
+	if !ok {
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+	// The file has to be below the directory the prefix maps to.
+	name := c.localPath(r, r.URL.Path)
+	dir := c.localPath(r, path.Dir(prefix+"x"))
+	if rel, err := filepath.Rel(dir, name); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			return caddyhttp.Error(http.StatusNotFound, err)
+		case os.IsPermission(err):
+			return caddyhttp.Error(http.StatusForbidden, err)
+		}
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	if info.IsDir() {
+		return caddyhttp.Error(http.StatusNotFound, nil)
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+	return nil
+}
+
+// localPath returns the file urlPath below the script name refers to in the
+// working directory of the script.
+func (c CGI) localPath(r *http.Request, urlPath string) string {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	root := repl.ReplaceAll(c.WorkingDirectory, "")
+	if c.DirFromScript && !filepath.IsAbs(c.Executable) {
+		root = filepath.Dir(filepath.Join(root, c.Executable))
+	} else if root == "" || c.DirFromScript {
+		root = filepath.Dir(c.Executable)
+	}
+	name := path.Clean("/" + strings.TrimPrefix(cleanURLPath(urlPath), c.ScriptName))
+	return filepath.Join(root, filepath.FromSlash(name))
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statsWindow is the number of most recent executions statistics are based on.
+const statsWindow = 128
+
+// statsPercentiles are the latency percentiles reported by the stats API.
+var statsPercentiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+type statsSample struct {
+	duration time.Duration
+	exitCode int
+	exited   bool // false if there is no exit code, e.g. for persistent processes
+	usage    processUsage
+}
+
+// routeStats collects execution statistics of a route.
+type routeStats struct {
+	mu      sync.Mutex
+	samples [statsWindow]statsSample
+	next    int
+	count   int
+	total   uint64
+	errors  map[string]uint64 // failed requests by class
+}
+
+// record adds a finished execution that isn't tied to the exit of a process.
+func (rs *routeStats) record(d time.Duration) {
+	rs.add(statsSample{duration: d})
+}
+
+// recordExit adds a finished execution whose process exited with code.
+func (rs *routeStats) recordExit(d time.Duration, code int, usage processUsage) {
+	rs.add(statsSample{duration: d, exitCode: code, exited: true, usage: usage})
+}
+
+// recordFailure counts a request that failed with the given class.
+func (rs *routeStats) recordFailure(class string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.errors == nil {
+		rs.errors = make(map[string]uint64)
+	}
+	rs.errors[class]++
+}
+
+func (rs *routeStats) add(s statsSample) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.samples[rs.next] = s
+	rs.next = (rs.next + 1) % statsWindow
+	if rs.count < statsWindow {
+		rs.count++
+	}
+	rs.total++
+}
+
+// window returns a copy of the recorded samples.
+func (rs *routeStats) window() (samples []statsSample, total uint64) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	samples = make([]statsSample, rs.count)
+	copy(samples, rs.samples[:rs.count])
+	return samples, rs.total
+}
+
+// percentile returns the p-th percentile (0 < p <= 1) of the recorded
+// durations, or 0 if nothing has been recorded yet.
+func (rs *routeStats) percentile(p float64) time.Duration {
+	samples, _ := rs.window()
+	return percentiles(samples, p)[0]
+}
+
+// percentiles returns the given percentiles of the durations of samples.
+func percentiles(samples []statsSample, ps ...float64) []time.Duration {
+	res := make([]time.Duration, len(ps))
+	if len(samples) == 0 {
+		return res
+	}
+	sorted := make([]time.Duration, len(samples))
+	for i, s := range samples {
+		sorted[i] = s.duration
+	}
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a] < sorted[b]
+	})
+	for i, p := range ps {
+		idx := int(p*float64(len(sorted))+0.5) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		if idx >= len(sorted) {
+			idx = len(sorted) - 1
+		}
+		res[i] = sorted[idx]
+	}
+	return res
+}
+
+// RouteStats is the JSON representation of the statistics of a route. Latency,
+// exit codes and resource usage cover the most recent executions only.
+type RouteStats struct {
+	// Executions since the config was loaded
+	Total uint64 `json:"total"`
+	// Number of executions latency and exit codes are based on
+	Window int `json:"window"`
+	// Latency percentiles in seconds, keyed by percentile (e.g. "p95")
+	Latency map[string]float64 `json:"latency"`
+	// Number of processes by exit code
+	ExitCodes map[string]int `json:"exitCodes"`
+	// Number of processes by terminating signal (e.g. "SIGSEGV")
+	Signals map[string]int `json:"signals"`
+	// User and system CPU time of the processes in seconds
+	CPUUser   float64 `json:"cpuUser"`
+	CPUSystem float64 `json:"cpuSystem"`
+	// Largest maximum resident set size of the processes in bytes
+	MaxRSS int64 `json:"maxRss"`
+	// Page faults of the processes
+	MinorFaults int64 `json:"minorFaults"`
+	MajorFaults int64 `json:"majorFaults"`
+	// Requests currently waiting for the process limit
+	Queued int `json:"queued"`
+	// Requests since the config was loaded that the module answered with
+	// an error status, by class (e.g. "timeout")
+	Errors map[string]uint64 `json:"errors"`
+}
+
+// snapshot returns the current statistics of rs.
+func (rs *routeStats) snapshot() RouteStats {
+	samples, total := rs.window()
+	res := RouteStats{
+		Total:     total,
+		Window:    len(samples),
+		Latency:   make(map[string]float64),
+		ExitCodes: make(map[string]int),
+		Signals:   make(map[string]int),
+		Errors:    make(map[string]uint64),
+	}
+	rs.mu.Lock()
+	for class, n := range rs.errors {
+		res.Errors[class] = n
+	}
+	rs.mu.Unlock()
+	for i, d := range percentiles(samples, statsPercentiles...) {
+		res.Latency["p"+strconv.Itoa(int(statsPercentiles[i]*100))] = d.Seconds()
+	}
+	for _, s := range samples {
+		if !s.exited {
+			continue
+		}
+		res.ExitCodes[strconv.Itoa(s.exitCode)]++
+		if s.usage.Signal != "" {
+			res.Signals[s.usage.Signal]++
+		}
+		res.CPUUser += s.usage.User.Seconds()
+		res.CPUSystem += s.usage.System.Seconds()
+		if s.usage.MaxRSS > res.MaxRSS {
+			res.MaxRSS = s.usage.MaxRSS
+		}
+		res.MinorFaults += s.usage.MinorFaults
+		res.MajorFaults += s.usage.MajorFaults
+	}
+	return res
+}
+
+// statsRegistry holds the statistics of all routes by name.
+type statsRegistry struct {
+	mu     sync.Mutex
+	routes map[string]*routeStats
+}
+
+func newStatsRegistry() *statsRegistry {
+	return &statsRegistry{routes: make(map[string]*routeStats)}
+}
+
+// route returns the statistics of the named route.
+func (sr *statsRegistry) route(name string) *routeStats {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	rs, ok := sr.routes[name]
+	if !ok {
+		rs = new(routeStats)
+		sr.routes[name] = rs
+	}
+	return rs
+}
+
+// snapshot returns the current statistics of all routes by name.
+func (sr *statsRegistry) snapshot() map[string]RouteStats {
+	sr.mu.Lock()
+	routes := make(map[string]*routeStats, len(sr.routes))
+	for name, rs := range sr.routes {
+		routes[name] = rs
+	}
+	sr.mu.Unlock()
+
+	res := make(map[string]RouteStats, len(routes))
+	for name, rs := range routes {
+		res[name] = rs.snapshot()
+	}
+	return res
+}
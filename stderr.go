@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// stderrLogLimit is the most of the standard error of a process kept for the
+// log; the rest is only counted.
+const stderrLogLimit = 16 << 10
+
+// stderrGrace is how long the standard error of a process that exited is
+// read on, in case processes it left in the background still hold it open.
+const stderrGrace = 100 * time.Millisecond
+
+// stderrCapture collects the standard error of a process for the log.
+type stderrCapture struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	total int
+	done  chan struct{} // closed once the pipe was read to its end
+}
+
+// captureStderr connects the standard error of cmd to a pipe read by the
+// returned capture. The write end of the pipe is returned, too; it has to be
+// closed once the process was started. Unlike an io.Writer as cmd.Stderr, the
+// pipe doesn't keep cmd.Wait from returning while background processes hold
+// on to it.
+func captureStderr(cmd *exec.Cmd) (*stderrCapture, *os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd.Stderr = w
+	sc := &stderrCapture{done: make(chan struct{})}
+	go func() {
+		defer close(sc.done)
+		defer r.Close()
+		chunk := make([]byte, 4096)
+		for {
+			n, err := r.Read(chunk)
+			sc.mu.Lock()
+			sc.total += n
+			if keep := stderrLogLimit - sc.buf.Len(); keep > 0 {
+				if keep > n {
+					keep = n
+				}
+				sc.buf.Write(chunk[:keep])
+			}
+			sc.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return sc, w, nil
+}
+
+// log logs the output collected from the process pid once it exited. Output
+// of failed processes is logged as an error. Otherwise it is only a warning,
+// which is logged at debug level instead for less than StderrMin bytes.
+func (sc *stderrCapture) log(h *handler, pid int, failed bool) {
+	select {
+	case <-sc.done:
+	case <-time.After(stderrGrace):
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.total == 0 {
+		return
+	}
+	level := zap.WarnLevel
+	if failed {
+		level = zap.ErrorLevel
+	} else if sc.total < h.StderrMin {
+		level = zap.DebugLevel
+	}
+	if ce := h.Logger.Check(level, "CGI process wrote to standard error"); ce != nil {
+		ce.Write(zap.String("path", h.Path), zap.Int("pid", pid), zap.Int("bytes", sc.total),
+			zap.ByteString("output", bytes.TrimRight(sc.buf.Bytes(), "\r\n")))
+	}
+}
+
+// statusResponseWriter records the status sent to the client.
+type statusResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	status *int
+}
+
+func (sw statusResponseWriter) WriteHeader(status int) {
+	if *sw.status == 0 && !isInformational(status) {
+		*sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
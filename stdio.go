@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"io"
+	"os/exec"
+)
+
+// socketStdio connects standard output and, with withStdin, standard input
+// of cmd to socket pairs. It returns the ends of the handler and the function
+// that closes the ends of the script, once it started.
+func (h *handler) socketStdio(cmd *exec.Cmd, withStdin bool) (stdin io.WriteCloser, stdout io.ReadCloser, closeChild func(), err error) {
+	outParent, outChild, err := newStdioSocket(h.SocketBuffer)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cmd.Stdout = outChild
+	if !withStdin {
+		return nil, outParent, func() { outChild.Close() }, nil
+	}
+	inParent, inChild, err := newStdioSocket(h.SocketBuffer)
+	if err != nil {
+		outParent.Close()
+		outChild.Close()
+		return nil, nil, nil, err
+	}
+	cmd.Stdin = inChild
+	return inParent, outParent, func() {
+		inChild.Close()
+		outChild.Close()
+	}, nil
+}
+
+// closeStdio closes the ends of the handler returned by socketStdio.
+func closeStdio(stdin io.WriteCloser, stdout io.ReadCloser) {
+	if stdin != nil {
+		stdin.Close()
+	}
+	stdout.Close()
+}
@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"os"
+	"syscall"
+)
+
+const socketStdioSupported = true
+
+// newStdioSocket returns a connected pair of stream sockets to use in place
+// of a pipe for standard input or output: the end for the handler and the
+// one for the script. With size > 0, both ends get send and receive buffers
+// of that size.
+func newStdioSocket(size int) (parent, child *os.File, err error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+	if size > 0 {
+		for _, fd := range fds {
+			for _, opt := range []int{syscall.SO_SNDBUF, syscall.SO_RCVBUF} {
+				if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, opt, size); err != nil {
+					syscall.Close(fds[0])
+					syscall.Close(fds[1])
+					return nil, nil, os.NewSyscallError("setsockopt", err)
+				}
+			}
+		}
+	}
+	// The end of the handler is served by the runtime poller, the script
+	// gets a regular blocking one.
+	if err := syscall.SetNonblock(fds[0], true); err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return nil, nil, os.NewSyscallError("setnonblock", err)
+	}
+	return os.NewFile(uintptr(fds[0]), "stdio"), os.NewFile(uintptr(fds[1]), "stdio"), nil
+}
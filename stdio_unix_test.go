@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package cgi
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestNewStdioSocket(t *testing.T) {
+	parent, child, err := newStdioSocket(256 << 10)
+	if err != nil {
+		t.Fatalf("Cannot create socket pair: %v", err)
+	}
+	defer parent.Close()
+	defer child.Close()
+	// The kernel may double the size for its bookkeeping.
+	size, err := syscall.GetsockoptInt(int(child.Fd()), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size < 256<<10 {
+		t.Errorf("Unexpected receive buffer of %d bytes. Expected at least %d.", size, 256<<10)
+	}
+}
+
+func TestCGI_ServeHTTPSocketStdio(t *testing.T) {
+	c := CGI{
+		Executable:   "/bin/sh",
+		Args:         []string{"-c", `printf "Content-Type: application/octet-stream\n\n"; cat`},
+		SocketStdio:  true,
+		SocketBuffer: 128 << 10,
+		logger:       zap.NewNop(),
+	}
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	for _, upload := range [][]byte{body, nil} {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/echo", bytes.NewReader(upload))
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		if res.Code != http.StatusOK || !bytes.Equal(res.Body.Bytes(), upload) {
+			t.Errorf("Unexpected response %d with %d bytes. Expected %d with %d bytes.", res.Code, res.Body.Len(), http.StatusOK, len(upload))
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sizeHintHeader announces the size of the response body, like
+// Content-Length, without promising it.
+const sizeHintHeader = "X-Response-Size-Hint"
+
+// responseSizeHint returns the size of the response body announced in
+// headers, either by sizeHintHeader or Content-Length; -1 if unknown.
+func responseSizeHint(headers http.Header) int64 {
+	for _, name := range []string{sizeHintHeader, "Content-Length"} {
+		if v := headers.Get(name); v != "" {
+			if size, err := strconv.ParseInt(v, 10, 64); err == nil && size >= 0 {
+				return size
+			}
+		}
+	}
+	return -1
+}
+
+// keepAliveComment is sent in silent event streams. As a comment line it is
+// ignored by clients, even in the middle of an event.
+var keepAliveComment = []byte(": keep-alive\n")
+
+// defaultStreamingKeepAlive is the keep-alive interval of event streams on
+// streaming routes.
+const defaultStreamingKeepAlive = 30 * time.Second
+
+// streamWriter flushes every write to the client or, with an interval, the
+// writes of each interval together. For event streams it can additionally
+// inject comments if the script stays silent for keepAlive.
+type streamWriter struct {
+	rw        http.ResponseWriter
+	keepAlive time.Duration
+	interval  time.Duration
+
+	mu         sync.Mutex
+	timer      *time.Timer
+	flushTimer *time.Timer // pending flush of the interval, if any
+	lineStart  bool        // whether the last write ended a line
+	closed     bool
+}
+
+func newStreamWriter(rw http.ResponseWriter, keepAlive, interval time.Duration) *streamWriter {
+	sw := &streamWriter{rw: rw, keepAlive: keepAlive, interval: interval, lineStart: true}
+	if keepAlive > 0 {
+		sw.mu.Lock()
+		sw.timer = time.AfterFunc(keepAlive, sw.ping)
+		sw.mu.Unlock()
+	}
+	return sw
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	n, err := sw.rw.Write(p)
+	if n > 0 {
+		sw.lineStart = p[n-1] == '\n'
+	}
+	switch {
+	case sw.interval <= 0:
+		sw.flush()
+	case sw.flushTimer == nil:
+		sw.flushTimer = time.AfterFunc(sw.interval, sw.flushInterval)
+	}
+	if sw.timer != nil {
+		sw.timer.Reset(sw.keepAlive)
+	}
+	return n, err
+}
+
+// ping sends a keep-alive comment unless it would split a line.
+func (sw *streamWriter) ping() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.closed {
+		return
+	}
+	if sw.lineStart {
+		if _, err := sw.rw.Write(keepAliveComment); err != nil {
+			return
+		}
+		sw.flush()
+	}
+	sw.timer.Reset(sw.keepAlive)
+}
+
+// flush sends buffered data to the client; sw.mu must be held.
+func (sw *streamWriter) flush() {
+	if sw.flushTimer != nil {
+		sw.flushTimer.Stop()
+		sw.flushTimer = nil
+	}
+	if f, ok := sw.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// flushInterval sends the writes of the interval to the client.
+func (sw *streamWriter) flushInterval() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if !sw.closed && sw.flushTimer != nil {
+		sw.flush()
+	}
+}
+
+// close stops the keep-alive comments and sends what is left of the
+// interval.
+func (sw *streamWriter) close() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.flushTimer != nil {
+		sw.flush()
+	}
+	sw.closed = true
+	if sw.timer != nil {
+		sw.timer.Stop()
+	}
+}
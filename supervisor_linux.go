@@ -0,0 +1,102 @@
+//go:build linux
+// +build linux
+
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER of prctl(2).
+const prSetChildSubreaper = 36
+
+// supervisorInterval is how often the supervisor looks for orphans even
+// without SIGCHLD.
+const supervisorInterval = 10 * time.Second
+
+var supervisorOnce sync.Once
+
+// startSupervisor makes Caddy the subreaper of its descendants and starts
+// reaping the orphans it inherits if subreaper is set. Without it nothing is
+// reaped, not even as PID 1, since the children of other modules can't be
+// told apart from orphans and collecting them would fail their Wait.
+func startSupervisor(logger *zap.Logger, subreaper bool) error {
+	if !subreaper {
+		return nil
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		return fmt.Errorf("becoming child subreaper: %v", errno)
+	}
+	supervisorOnce.Do(func() {
+		sigchld := make(chan os.Signal, 1)
+		signal.Notify(sigchld, syscall.SIGCHLD)
+		go func() {
+			ticker := time.NewTicker(supervisorInterval)
+			for {
+				select {
+				case <-sigchld:
+				case <-ticker.C:
+				}
+				reapOrphans(logger)
+			}
+		}()
+	})
+	return nil
+}
+
+// reapOrphans collects exited children that weren't started by a handler.
+func reapOrphans(logger *zap.Logger) {
+	children.Lock()
+	defer children.Unlock()
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+	self := os.Getpid()
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || children.pids[pid] {
+			continue
+		}
+		stat, err := ioutil.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// The command in parentheses may contain anything; state and
+		// parent pid follow it.
+		fields := bytes.Fields(stat[bytes.LastIndexByte(stat, ')')+1:])
+		if len(fields) < 2 || string(fields[0]) != "Z" || string(fields[1]) != strconv.Itoa(self) {
+			continue
+		}
+		var status syscall.WaitStatus
+		if _, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil {
+			logger.Debug("reaped orphaned process", zap.Int("pid", pid), zap.Int("exit_code", status.ExitStatus()))
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package cgi
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// processState returns the state of pid from /proc or "" if it is gone.
+func processState(pid int) string {
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return ""
+	}
+	return string(bytes.Fields(stat[bytes.LastIndexByte(stat, ')')+1:])[0])
+}
+
+func TestCGI_ServeHTTPKillGroup(t *testing.T) {
+	c := CGI{
+		Executable: "test/background",
+		KillGroup:  true,
+		logger:     zap.NewNop(),
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(res.Body.String()))
+	if err != nil {
+		t.Fatalf("Unexpected body %q", res.Body.String())
+	}
+
+	// The killed process may linger as zombie until init reaps it.
+	deadline := time.Now().Add(time.Second)
+	for state := processState(pid); state != "" && state != "Z"; state = processState(pid) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("Background process survived in state %s.", state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCGI_ServeHTTPKillGroupTimeout(t *testing.T) {
+	c := CGI{
+		Executable: "test/tree",
+		KillGroup:  true,
+		Timeout:    caddy.Duration(100 * time.Millisecond),
+		KillGrace:  caddy.Duration(5 * time.Second),
+		logger:     zap.NewNop(),
+	}
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	start := time.Now()
+	if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+		t.Fatalf("Cannot serve http: %v", err)
+	}
+	// The child gets the signal the script ignores, so the script doesn't
+	// have to be killed after the grace period.
+	if elapsed := time.Since(start); elapsed >= time.Duration(c.KillGrace) {
+		t.Errorf("Unexpected duration %v. Expected less than %v.", elapsed, time.Duration(c.KillGrace))
+	}
+}
+
+func TestReapOrphans(t *testing.T) {
+	// A child that wasn't started by a handler stands in for an orphan.
+	pid, err := syscall.ForkExec("/bin/sh", []string{"sh", "-c", "exit 3"}, &syscall.ProcAttr{Env: os.Environ()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for processState(pid) != "Z" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Child did not exit.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	reapOrphans(zap.NewNop())
+	if state := processState(pid); state != "" {
+		t.Errorf("Orphan was not reaped, state %s.", state)
+	}
+}
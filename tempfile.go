@@ -0,0 +1,253 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Temporary files are named cgi_<kind>_<pid>_<random>, where pid is the
+// process that created them, so files left behind by a crashed Caddy can be
+// told apart from those of a running one. Directories holding the sockets of
+// applications are named the same way.
+var tempFileKinds = []string{"body", "response", "socket"}
+
+const (
+	// tempRemoveAttempts is how often removing a temporary file is tried.
+	tempRemoveAttempts = 5
+	// tempRemoveDelay is the delay before the first retry; it doubles with
+	// every further one.
+	tempRemoveDelay = time.Second
+)
+
+// defaultTempBufferSize is the size of the buffer request bodies are written
+// to temporary files with, unless configured otherwise.
+const defaultTempBufferSize = 32 * 1024
+
+// directIOAlign is the alignment of buffers, offsets and sizes direct I/O
+// requires; 4096 covers the logical block size of common devices.
+const directIOAlign = 4096
+
+// Policies of flushing temporary files to disk.
+const (
+	tempSyncNone   = "none"
+	tempSyncEnd    = "end"
+	tempSyncAlways = "always"
+)
+
+// spillSettings tune how request bodies are written to temporary files.
+type spillSettings struct {
+	bufferSize int
+	direct     bool // bypass the page cache; for spooled bodies only
+	sync       string
+}
+
+// buffer returns a buffer for writing temporary files.
+func (s spillSettings) buffer() []byte {
+	if s.direct {
+		return alignedBuffer(s.bufferSize)
+	}
+	return make([]byte, s.bufferSize)
+}
+
+// tempTracker keeps track of the temporary files created by this process.
+type tempTracker struct {
+	mu       sync.Mutex
+	logger   *zap.Logger
+	files    map[string]int64 // existing files and their size
+	leaked   map[string]bool  // files that couldn't be removed
+	warnSize int64
+	warned   bool
+	spill    spillSettings
+	created  uint64
+	failures uint64
+}
+
+// tempFiles tracks the temporary files of all configs.
+var tempFiles = newTempTracker()
+
+func newTempTracker() *tempTracker {
+	return &tempTracker{
+		logger: zap.NewNop(),
+		files:  make(map[string]int64),
+		leaked: make(map[string]bool),
+		spill:  spillSettings{bufferSize: defaultTempBufferSize, sync: tempSyncNone},
+	}
+}
+
+// configure sets the logger and the total size of temporary files above
+// which a warning is logged; 0 disables the warning.
+func (tt *tempTracker) configure(logger *zap.Logger, warnSize int64) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tt.logger = logger
+	tt.warnSize = warnSize
+	tt.warned = false
+}
+
+// tune sets how request bodies are written to temporary files.
+func (tt *tempTracker) tune(spill spillSettings) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tt.spill = spill
+}
+
+// settings returns how request bodies are written to temporary files.
+func (tt *tempTracker) settings() spillSettings {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	return tt.spill
+}
+
+// create makes a new temporary file of kind in the temporary directory.
+func (tt *tempTracker) create(kind string) (*os.File, error) {
+	f, err := ioutil.TempFile("", fmt.Sprintf("cgi_%s_%d_", kind, os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tt.files[f.Name()] = 0
+	tt.created++
+	return f, nil
+}
+
+// size returns the total size of the existing files; tt.mu must be held.
+func (tt *tempTracker) size() int64 {
+	var total int64
+	for _, size := range tt.files {
+		total += size
+	}
+	return total
+}
+
+// grow records that n bytes were written to the file at path. Once the total
+// size first exceeds the configured threshold, a warning is logged.
+func (tt *tempTracker) grow(path string, n int64) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if _, ok := tt.files[path]; !ok {
+		return
+	}
+	tt.files[path] += n
+	if tt.warnSize <= 0 {
+		return
+	}
+	total := tt.size()
+	if total > tt.warnSize && !tt.warned {
+		tt.warned = true
+		tt.logger.Warn("temporary files exceed size threshold",
+			zap.Int64("bytes", total), zap.Int64("threshold", tt.warnSize), zap.Int("files", len(tt.files)))
+	} else if total <= tt.warnSize {
+		tt.warned = false
+	}
+}
+
+// remove deletes the file at path. Failures are retried in the background
+// with increasing delays and logged; files that still can't be removed are
+// given up on and reported as leaked.
+func (tt *tempTracker) remove(path string) {
+	tt.removeAttempt(path, 1)
+}
+
+func (tt *tempTracker) removeAttempt(path string, attempt int) {
+	err := os.Remove(path)
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if err == nil || os.IsNotExist(err) {
+		delete(tt.files, path)
+		delete(tt.leaked, path)
+		return
+	}
+	tt.failures++
+	if attempt >= tempRemoveAttempts {
+		tt.leaked[path] = true
+		tt.logger.Error("cannot remove temporary file, giving up",
+			zap.String("path", path), zap.Int("attempts", attempt), zap.Error(err))
+		return
+	}
+	delay := tempRemoveDelay << uint(attempt-1)
+	tt.logger.Warn("cannot remove temporary file, retrying",
+		zap.String("path", path), zap.Duration("delay", delay), zap.Error(err))
+	time.AfterFunc(delay, func() {
+		tt.removeAttempt(path, attempt+1)
+	})
+}
+
+// sweep removes temporary files left behind by processes that no longer run,
+// for example after a crash.
+func (tt *tempTracker) sweep() {
+	for _, kind := range tempFileKinds {
+		matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "cgi_"+kind+"_*_*"))
+		for _, path := range matches {
+			fields := strings.SplitN(strings.TrimPrefix(filepath.Base(path), "cgi_"+kind+"_"), "_", 2)
+			pid, err := strconv.Atoi(fields[0])
+			if err != nil || pid == os.Getpid() || processAlive(pid) {
+				continue
+			}
+			tt.mu.Lock()
+			logger := tt.logger
+			tt.mu.Unlock()
+			if err := os.RemoveAll(path); err != nil {
+				logger.Warn("cannot remove orphaned temporary file", zap.String("path", path), zap.Error(err))
+				continue
+			}
+			logger.Info("removed orphaned temporary file", zap.String("path", path), zap.Int("pid", pid))
+		}
+	}
+}
+
+// TempFileStats describes the temporary files, like spooled request bodies,
+// of the Caddy process.
+type TempFileStats struct {
+	// Files currently existing, including leaked ones
+	Files int `json:"files"`
+	// Their total size in bytes
+	Bytes int64 `json:"bytes"`
+	// Files created so far
+	Created uint64 `json:"created"`
+	// Failed attempts to remove a file
+	CleanupFailures uint64 `json:"cleanupFailures"`
+	// Files that couldn't be removed and were given up on
+	Leaked []string `json:"leaked,omitempty"`
+}
+
+func (tt *tempTracker) snapshot() TempFileStats {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	stats := TempFileStats{
+		Files:           len(tt.files),
+		Bytes:           tt.size(),
+		Created:         tt.created,
+		CleanupFailures: tt.failures,
+	}
+	for path := range tt.leaked {
+		stats.Leaked = append(stats.Leaked, path)
+	}
+	sort.Strings(stats.Leaked)
+	return stats
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const directIOSupported = true
+
+// setDirectIO turns direct I/O, bypassing the page cache, on or off for f.
+func setDirectIO(f *os.File, on bool) error {
+	flags, err := unix.FcntlInt(f.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+	if on {
+		flags |= unix.O_DIRECT
+	} else {
+		flags &^= unix.O_DIRECT
+	}
+	_, err = unix.FcntlInt(f.Fd(), unix.F_SETFL, flags)
+	return err
+}
+
+// probeDirectIO checks whether the temporary directory supports direct I/O.
+func probeDirectIO() error {
+	f, err := ioutil.TempFile("", "cgi_probe_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := setDirectIO(f, true); err != nil {
+		return err
+	}
+	_, err = f.Write(alignedBuffer(directIOAlign))
+	return err
+}
+
+// alignedBuffer returns a buffer of size bytes starting at a multiple of
+// directIOAlign in memory, as direct I/O requires.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlign)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlign - 1))
+	if off != 0 {
+		off = directIOAlign - off
+	}
+	return buf[off : off+size]
+}
+
+// fdatasync flushes the data of f to disk, without metadata like the
+// modification time.
+func fdatasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
@@ -0,0 +1,194 @@
+package cgi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestTempTracker_Remove(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	tt := newTempTracker()
+	tt.configure(zap.New(core), 10)
+
+	f, err := tt.create("body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("0123456789ab"))
+	tt.grow(f.Name(), 12)
+	f.Close()
+	if n := logs.FilterMessage("temporary files exceed size threshold").Len(); n != 1 {
+		t.Errorf("Unexpected number of threshold warnings %d. Expected %d.", n, 1)
+	}
+	tt.remove(f.Name())
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("Temporary file %s not removed.", f.Name())
+	}
+
+	// A non-empty directory can't be removed until it is emptied.
+	dir, err := ioutil.TempDir("", "cgi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocker := filepath.Join(dir, "blocker")
+	if err := ioutil.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tt.mu.Lock()
+	tt.files[dir] = 0
+	tt.mu.Unlock()
+	tt.remove(dir)
+	if stats := tt.snapshot(); stats.Files != 1 || stats.CleanupFailures != 1 {
+		t.Errorf("Unexpected stats %+v. Expected 1 file and 1 cleanup failure.", stats)
+	}
+	os.Remove(blocker)
+	time.Sleep(tempRemoveDelay + 200*time.Millisecond)
+	if stats := tt.snapshot(); stats.Files != 0 || stats.Created != 1 {
+		t.Errorf("Unexpected stats %+v. Expected no files left.", stats)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Directory %s not removed on retry.", dir)
+	}
+}
+
+func TestTempTracker_Sweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmpdir := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	defer os.Setenv("TMPDIR", tmpdir)
+
+	// A process that surely exited.
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	orphaned := filepath.Join(dir, fmt.Sprintf("cgi_body_%d_1", cmd.ProcessState.Pid()))
+	own := filepath.Join(dir, fmt.Sprintf("cgi_body_%d_2", os.Getpid()))
+	foreign := filepath.Join(dir, "cgi_other_1_3")
+	for _, path := range []string{orphaned, own, foreign} {
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	socketDir := filepath.Join(dir, fmt.Sprintf("cgi_socket_%d_4", cmd.ProcessState.Pid()))
+	if err := os.Mkdir(socketDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(socketDir, "app.sock"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newTempTracker().sweep()
+	if _, err := os.Stat(orphaned); !os.IsNotExist(err) {
+		t.Error("Orphaned temporary file not removed.")
+	}
+	if _, err := os.Stat(socketDir); !os.IsNotExist(err) {
+		t.Error("Orphaned socket directory not removed.")
+	}
+	for _, path := range []string{own, foreign} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Unexpected removal of %s.", path)
+		}
+	}
+}
+
+// spillVariants returns the settings of writing temporary files worth
+// comparing, including direct I/O where the temporary directory supports it.
+func spillVariants(bufferSizes ...int) map[string]spillSettings {
+	variants := make(map[string]spillSettings)
+	for _, size := range bufferSizes {
+		for _, sync := range []string{tempSyncNone, tempSyncEnd, tempSyncAlways} {
+			variants[fmt.Sprintf("buffer=%d/sync=%s", size, sync)] = spillSettings{bufferSize: size, sync: sync}
+			if probeDirectIO() == nil {
+				variants[fmt.Sprintf("buffer=%d/sync=%s/direct", size, sync)] = spillSettings{bufferSize: size, sync: sync, direct: true}
+			}
+		}
+	}
+	return variants
+}
+
+func TestSpoolBody(t *testing.T) {
+	defer tempFiles.tune(tempFiles.settings())
+
+	// Not a multiple of the buffer size, so the end is written separately.
+	body := bytes.Repeat([]byte("0123456789abcdef"), 3*directIOAlign/16+7)
+	for name, spill := range spillVariants(directIOAlign, 2*directIOAlign) {
+		t.Run(name, func(t *testing.T) {
+			tempFiles.tune(spill)
+			req := httptest.NewRequest("POST", "/", iotest.HalfReader(bytes.NewReader(body)))
+			spooled, cleanup, err := spoolBody(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanup()
+			if spooled.ContentLength != int64(len(body)) {
+				t.Errorf("Unexpected content length %d. Expected %d.", spooled.ContentLength, len(body))
+			}
+			// The script reads with arbitrary sizes.
+			got, err := ioutil.ReadAll(iotest.OneByteReader(spooled.Body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("Unexpected spooled body of %d bytes. Expected %d bytes.", len(got), len(body))
+			}
+		})
+	}
+}
+
+// truncatedReader fails like the body of a request whose client hung up.
+type truncatedReader struct{}
+
+func (truncatedReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestSpoolBody_Truncated(t *testing.T) {
+	body := io.MultiReader(bytes.NewReader([]byte("partial")), truncatedReader{})
+	_, _, err := spoolBody(httptest.NewRequest("POST", "/", body))
+	var herr caddyhttp.HandlerError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected error %v. Expected status %d.", err, http.StatusBadRequest)
+	}
+}
+
+func BenchmarkSpoolBody(b *testing.B) {
+	defer tempFiles.tune(tempFiles.settings())
+
+	body := bytes.Repeat([]byte{'x'}, 4<<20)
+	for name, spill := range spillVariants(32*1024, 256*1024, 1024*1024) {
+		b.Run(name, func(b *testing.B) {
+			tempFiles.tune(spill)
+			b.SetBytes(int64(len(body)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, cleanup, err := spoolBody(httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+					if err != nil {
+						b.Fatal(err)
+					}
+					cleanup()
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,14 @@
+#!/usr/bin/env lua
+
+-- Answers with the request method, the arguments and the request body. With
+-- "fail" as argument, it raises an error before producing any output.
+
+if arg[1] == "fail" then
+	error("failing on request")
+end
+print("Content-Type: text/plain")
+print()
+io.write(os.getenv("REQUEST_METHOD"), " ", table.concat(arg, ","), " ", io.read("*a"))
+if os.exit == nil then
+	io.write(" sandboxed")
+end
@@ -0,0 +1,8 @@
+# Not executable by itself, run through an interpreter. Prints whether the
+# shell exits on errors, its script name and its arguments.
+
+strict=no
+case $- in
+*e*) strict=yes ;;
+esac
+printf "Content-type: text/plain\n\nstrict=%s script=%s args=%s\n" "$strict" "$0" "$*"
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Ways to handle executables that are busy, being written to while they are
+// to be started, as during deploys.
+const (
+	textBusyRetry    = "retry"    // start again after a delay
+	textBusySnapshot = "snapshot" // start a copy of the executable
+)
+
+// defaultBusyRetries is the number of times a busy executable is started
+// again with textBusyRetry if not configured.
+const defaultBusyRetries = 5
+
+// isTextBusy reports whether err means that the executable could not be
+// started because it is open for writing.
+func isTextBusy(err error) bool {
+	return errors.Is(err, syscall.ETXTBSY) || strings.Contains(err.Error(), "text file busy")
+}
+
+// snapshotExecutable copies the executable at path to a hidden file next to
+// it, so it keeps its directory and filesystem, and returns the path of the
+// copy, which is to be removed once the process exited.
+func snapshotExecutable(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+	dst, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".snapshot-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Chmod(info.Mode().Perm() | 0100)
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+// busyRetries returns the number of times a busy executable is started again.
+func (c CGI) busyRetries() int {
+	if c.TextBusyRetries <= 0 {
+		return defaultBusyRetries
+	}
+	return c.TextBusyRetries
+}
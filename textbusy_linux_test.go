@@ -0,0 +1,72 @@
+package cgi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCGI_ServeHTTPTextBusy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-cgi-busy")
+	if err != nil {
+		t.Fatalf("Cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "busy.cgi")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nprintf 'Content-Type: text/plain\\r\\n\\r\\nok'\n"), 0755); err != nil {
+		t.Fatalf("Cannot write script: %v", err)
+	}
+
+	serve := func(c CGI, release time.Duration) *httptest.ResponseRecorder {
+		// Executables that are open for writing can't be started.
+		f, err := os.OpenFile(script, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatalf("Cannot open script: %v", err)
+		}
+		defer f.Close()
+		if release > 0 {
+			timer := time.AfterFunc(release, func() { f.Close() })
+			defer timer.Stop()
+		}
+		c.Executable = script
+		c.logger = zap.NewNop()
+		req := httptest.NewRequest(http.MethodGet, "/busy", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		res := httptest.NewRecorder()
+		if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+			t.Fatalf("Cannot serve http: %v", err)
+		}
+		return res
+	}
+
+	if res := serve(CGI{}, 0); res.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected status %d. Expected %d.", res.Code, http.StatusInternalServerError)
+	}
+
+	res := serve(CGI{TextBusy: textBusyRetry, RetryDelay: caddy.Duration(50 * time.Millisecond)}, 80*time.Millisecond)
+	if res.Code != http.StatusOK || res.Body.String() != "ok" {
+		t.Errorf("Unexpected response %d %q. Expected %d %q.", res.Code, res.Body.String(), http.StatusOK, "ok")
+	}
+
+	// Giving up after the retries.
+	res = serve(CGI{TextBusy: textBusyRetry, TextBusyRetries: 2, RetryDelay: caddy.Duration(time.Millisecond)}, 0)
+	if res.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected status %d. Expected %d.", res.Code, http.StatusInternalServerError)
+	}
+
+	res = serve(CGI{TextBusy: textBusySnapshot}, 0)
+	if res.Code != http.StatusOK || res.Body.String() != "ok" {
+		t.Errorf("Unexpected response %d %q. Expected %d %q.", res.Code, res.Body.String(), http.StatusOK, "ok")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Unexpected %d files left. Expected the copy to be removed.", len(files))
+	}
+}
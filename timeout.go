@@ -0,0 +1,185 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// defaultKillGrace is the time a timed out process gets to exit after the
+// kill signal before it is killed forcibly.
+const defaultKillGrace = 5 * time.Second
+
+// watchdog terminates a process that exceeds the execution timeout or whose
+// client went away.
+type watchdog struct {
+	h    *handler
+	proc *os.Process
+
+	mu          sync.Mutex
+	timer       *time.Timer // pending timeout or grace period
+	headerTimer *time.Timer // pending header timeout, until the headers arrived
+	terminating bool
+	stopped     bool
+	done        chan struct{}
+	expired     int32
+}
+
+// watch starts a watchdog for proc. Once the timeout of h passed, the header
+// timeout of h passed before headersDone was called or ctx is done, proc gets
+// the kill signal of h and is killed forcibly if it is still running after
+// the grace period. With KillGroup, both go to the whole process group of
+// proc. The watchdog must be stopped once the process exited.
+func (h *handler) watch(ctx context.Context, proc *os.Process) *watchdog {
+	wd := &watchdog{h: h, proc: proc, done: make(chan struct{})}
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	if h.Timeout > 0 {
+		wd.timer = time.AfterFunc(h.Timeout, func() {
+			wd.terminate(h.Timeout)
+		})
+	}
+	if h.HeaderTimeout > 0 {
+		wd.headerTimer = time.AfterFunc(h.HeaderTimeout, func() {
+			wd.terminate(h.HeaderTimeout)
+		})
+	}
+	if done := ctx.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				wd.terminate(0)
+			case <-wd.done:
+			}
+		}()
+	}
+	return wd
+}
+
+// terminate signals the process and schedules killing it forcibly. timeout
+// is the time limit the process exceeded; 0 if the client went away.
+func (wd *watchdog) terminate(timeout time.Duration) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	if wd.stopped || wd.terminating {
+		return
+	}
+	wd.terminating = true
+	if wd.timer != nil {
+		wd.timer.Stop()
+	}
+	if wd.headerTimer != nil {
+		wd.headerTimer.Stop()
+	}
+
+	sig := wd.h.KillSignal
+	if sig == nil {
+		sig = defaultKillSignal
+	}
+	grace := wd.h.KillGrace
+	if grace <= 0 {
+		grace = defaultKillGrace
+	}
+	if timeout > 0 {
+		atomic.StoreInt32(&wd.expired, 1)
+		wd.h.Logger.Warn("CGI process timed out",
+			zap.Int("pid", wd.proc.Pid), zap.Duration("timeout", timeout), zap.Stringer("signal", sig))
+	} else {
+		wd.h.Logger.Debug("client went away, terminating CGI process",
+			zap.Int("pid", wd.proc.Pid), zap.Stringer("signal", sig))
+	}
+	if err := wd.signal(sig); err != nil {
+		wd.kill()
+		return
+	}
+	wd.timer = time.AfterFunc(grace, wd.kill)
+}
+
+// signal sends sig to the process or, with KillGroup, its process group.
+// Killing a process that has a job object (on Windows) kills all processes of
+// the job.
+func (wd *watchdog) signal(sig os.Signal) error {
+	if sig == os.Kill && killJob(wd.proc.Pid) {
+		return nil
+	}
+	if wd.h.KillGroup {
+		return signalProcessGroup(wd.proc.Pid, sig)
+	}
+	return wd.proc.Signal(sig)
+}
+
+// kill kills the process forcibly, along with its process group with
+// KillGroup and the processes of its job object, if any.
+func (wd *watchdog) kill() {
+	if wd.h.KillGroup {
+		killProcessGroup(wd.proc.Pid)
+	}
+	killJob(wd.proc.Pid)
+	wd.proc.Kill()
+}
+
+// stop ends the watchdog; the process exited.
+func (wd *watchdog) stop() {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	wd.stopped = true
+	close(wd.done)
+	if wd.timer != nil {
+		wd.timer.Stop()
+	}
+	if wd.headerTimer != nil {
+		wd.headerTimer.Stop()
+	}
+}
+
+// headersDone disarms the header timeout; the response headers arrived.
+func (wd *watchdog) headersDone() {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	if wd.headerTimer != nil {
+		wd.headerTimer.Stop()
+	}
+}
+
+// timedOut reports whether the process exceeded the timeout.
+func (wd *watchdog) timedOut() bool {
+	return atomic.LoadInt32(&wd.expired) == 1
+}
+
+// timeoutResponseWriter answers with 504 instead of 500 when a process was
+// terminated before it produced a valid response. Writing the status also
+// means that the response headers arrived.
+type timeoutResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	wd *watchdog
+}
+
+func (tw timeoutResponseWriter) WriteHeader(status int) {
+	if status == http.StatusInternalServerError && tw.wd.timedOut() {
+		status = http.StatusGatewayTimeout
+	}
+	tw.wd.headersDone()
+	tw.ResponseWriter.WriteHeader(status)
+}
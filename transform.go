@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// maxTransformSteps bounds the computation a transform may do per request.
+const maxTransformSteps = 1000000
+
+// transform is a compiled Starlark snippet defining a function transform(req)
+// that decides per request how the script is executed.
+type transform struct {
+	fn *starlark.Function
+}
+
+// transformResult holds the decisions of a transform; zero values leave the
+// configured behavior unchanged.
+type transformResult struct {
+	executable string
+	args       []string
+	argsSet    bool
+	env        []string
+	status     int
+}
+
+// compileTransform executes src, which must define transform(req).
+func compileTransform(src string) (*transform, error) {
+	thread := &starlark.Thread{Name: "provision"}
+	thread.SetMaxExecutionSteps(maxTransformSteps)
+	globals, err := starlark.ExecFile(thread, "transform", src, nil)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := globals["transform"].(*starlark.Function)
+	if !ok {
+		return nil, fmt.Errorf("transform must define a function transform(req)")
+	}
+	if fn.NumParams() != 1 {
+		return nil, fmt.Errorf("transform(req) must take exactly one parameter")
+	}
+	return &transform{fn: fn}, nil
+}
+
+// apply calls the transform for r.
+func (t *transform) apply(r *http.Request, scriptName, pathInfo string) (res transformResult, err error) {
+	thread := &starlark.Thread{Name: "transform"}
+	thread.SetMaxExecutionSteps(maxTransformSteps)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		thread.Cancel("request done")
+	}()
+
+	ret, err := starlark.Call(thread, t.fn, starlark.Tuple{transformRequest(r, scriptName, pathInfo)}, nil)
+	if err != nil {
+		return res, err
+	}
+	if ret == starlark.None {
+		return res, nil
+	}
+	dict, ok := ret.(*starlark.Dict)
+	if !ok {
+		return res, fmt.Errorf("transform returned %s, expected dict or None", ret.Type())
+	}
+	for _, item := range dict.Items() {
+		key, ok := starlark.AsString(item[0])
+		if !ok {
+			return res, fmt.Errorf("transform returned non-string key %s", item[0])
+		}
+		value := item[1]
+		switch key {
+		case "executable":
+			if res.executable, ok = starlark.AsString(value); !ok || res.executable == "" {
+				return res, fmt.Errorf("executable must be a non-empty string")
+			}
+		case "args":
+			if res.args, err = starlarkStrings(value); err != nil {
+				return res, fmt.Errorf("args: %v", err)
+			}
+			res.argsSet = true
+		case "env":
+			env, ok := value.(*starlark.Dict)
+			if !ok {
+				return res, fmt.Errorf("env must be a dict")
+			}
+			for _, kv := range env.Items() {
+				k, ok1 := starlark.AsString(kv[0])
+				v, ok2 := starlark.AsString(kv[1])
+				if !ok1 || !ok2 || k == "" || strings.Contains(k, "=") {
+					return res, fmt.Errorf("invalid env entry %s: %s", kv[0], kv[1])
+				}
+				res.env = append(res.env, k+"="+v)
+			}
+		case "status":
+			status, err := starlark.AsInt32(value)
+			if err != nil || status < 100 || status > 599 {
+				return res, fmt.Errorf("invalid status %s", value)
+			}
+			res.status = status
+		default:
+			return res, fmt.Errorf("unknown result key %q", key)
+		}
+	}
+	return res, nil
+}
+
+// transformRequest returns the req value passed to transform(req).
+func transformRequest(r *http.Request, scriptName, pathInfo string) starlark.Value {
+	headers := new(starlark.Dict)
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		headers.SetKey(starlark.String(strings.ToLower(name)), starlark.String(strings.Join(r.Header[name], ", ")))
+	}
+	params := new(starlark.Dict)
+	for name, values := range r.URL.Query() {
+		list := make([]starlark.Value, len(values))
+		for i, v := range values {
+			list[i] = starlark.String(v)
+		}
+		params.SetKey(starlark.String(name), starlark.NewList(list))
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"method":      starlark.String(r.Method),
+		"host":        starlark.String(r.Host),
+		"path":        starlark.String(r.URL.Path),
+		"query":       starlark.String(r.URL.RawQuery),
+		"params":      params,
+		"headers":     headers,
+		"remote_addr": starlark.String(r.RemoteAddr),
+		"script_name": starlark.String(scriptName),
+		"path_info":   starlark.String(pathInfo),
+	})
+}
+
+// starlarkStrings converts a list or tuple of strings.
+func starlarkStrings(v starlark.Value) ([]string, error) {
+	iterable, ok := v.(starlark.Indexable)
+	if _, isString := v.(starlark.String); !ok || isString {
+		return nil, fmt.Errorf("expected list of strings, got %s", v.Type())
+	}
+	list := make([]string, iterable.Len())
+	for i := range list {
+		s, ok := starlark.AsString(iterable.Index(i))
+		if !ok {
+			return nil, fmt.Errorf("expected list of strings, got %s", iterable.Index(i).Type())
+		}
+		list[i] = s
+	}
+	return list, nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+)
+
+// Scripts of upgrade requests get a datagram socket, whose file descriptor
+// is in CGI_UPGRADE_FD. Once a script answers with status 101, the client
+// connection is sent over it in a single message: the file descriptor as
+// SCM_RIGHTS and as data what the client already sent beyond the request.
+
+// isUpgradeRequest reports whether req asks to switch protocols.
+func isUpgradeRequest(req *http.Request) bool {
+	return req.Header.Get("Upgrade") != "" && httpguts.HeaderValuesContainsToken(req.Header["Connection"], "upgrade")
+}
+
+// upgradeResponseWriter hands the connection over to the script when it
+// switches protocols.
+type upgradeResponseWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	sock *net.UnixConn
+	wd   *watchdog
+}
+
+// handOff sends the 101 response with headers and passes the connection to
+// the script. Failures are answered with 500 if possible; once the headers
+// have been sent, the connection is closed.
+func (uw upgradeResponseWriter) handOff(h *handler, headers http.Header) {
+	uw.wd.headersDone()
+	conn, brw, err := uw.Hijack()
+	if err != nil {
+		uw.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("cannot take over connection for upgrade", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+	f, err := connFile(conn)
+	if err != nil {
+		brw.WriteString("HTTP/1.1 500 Internal Server Error\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		brw.Flush()
+		h.Logger.Error("cannot hand over connection for upgrade", zap.Error(err))
+		return
+	}
+	defer f.Close()
+	if err := writeSwitchingProtocols(brw.Writer, headers); err != nil {
+		h.Logger.Debug("client went away during upgrade", zap.Error(err))
+		return
+	}
+	buffered, _ := brw.Reader.Peek(brw.Reader.Buffered())
+	if err := sendFile(uw.sock, f, buffered); err != nil {
+		h.Logger.Error("cannot hand over connection for upgrade", zap.Error(err))
+	}
+}
+
+// connFile returns a duplicate of the file descriptor of conn.
+func connFile(conn net.Conn) (*os.File, error) {
+	fc, ok := conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("connection of type %T has no file descriptor", conn)
+	}
+	return fc.File()
+}
+
+// writeSwitchingProtocols writes a 101 response with headers to w.
+func writeSwitchingProtocols(w *bufio.Writer, headers http.Header) error {
+	w.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	headers.Write(w)
+	w.WriteString("\r\n")
+	return w.Flush()
+}
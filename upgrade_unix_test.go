@@ -0,0 +1,73 @@
+//go:build !windows
+// +build !windows
+
+package cgi
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestCGI_ServeHTTPUpgrade(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is needed for the upgrading script")
+	}
+	c := CGI{Executable: "test/upgrade", Upgrade: true, logger: zap.NewNop()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(w, r, NoOpNextHandler{}); err != nil {
+			t.Errorf("Cannot serve http: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if strings.TrimSpace(string(body)) != "NO UPGRADE" {
+		t.Errorf("Unexpected body %q of a regular request. Expected %q.", body, "NO UPGRADE")
+	}
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The first line of the new protocol may already arrive with the
+	// request.
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhello\n"))
+	br := bufio.NewReader(conn)
+	res, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("Unexpected response %d with Upgrade %q. Expected %d with %q.",
+			res.StatusCode, res.Header.Get("Upgrade"), http.StatusSwitchingProtocols, "echo")
+	}
+	for _, line := range []string{"hello", "world"} {
+		if line != "hello" {
+			conn.Write([]byte(line + "\n"))
+		}
+		got, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "ECHO "+line+"\n" {
+			t.Errorf("Unexpected line %q. Expected %q.", got, "ECHO "+line+"\n")
+		}
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// processUsage is the resource usage of an exited process.
+type processUsage struct {
+	User        time.Duration // user CPU time
+	System      time.Duration // system CPU time
+	MaxRSS      int64         // maximum resident set size in bytes (Unix only)
+	MinorFaults int64         // page faults without I/O (Unix only)
+	MajorFaults int64         // page faults with I/O (Unix only)
+	Signal      string        // signal that terminated the process, if any
+}
+
+// fields returns u as log fields.
+func (u processUsage) fields() []zap.Field {
+	fields := []zap.Field{
+		zap.Duration("cpu_user", u.User),
+		zap.Duration("cpu_system", u.System),
+		zap.Int64("max_rss", u.MaxRSS),
+		zap.Int64("minor_faults", u.MinorFaults),
+		zap.Int64("major_faults", u.MajorFaults),
+	}
+	if u.Signal != "" {
+		fields = append(fields, zap.String("signal", u.Signal))
+	}
+	return fields
+}
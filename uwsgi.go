@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// A uwsgi request is a packet of the CGI environment, with a header of
+// modifier1 (0 for WSGI), the size of the variables as 16 bit little endian
+// and modifier2, and each variable as name and value prefixed with their 16
+// bit little endian sizes. Then follow exactly CONTENT_LENGTH bytes of body.
+// The response of uWSGI workers is an HTTP response, including its status
+// line, ending when the worker closes the connection.
+
+// uwsgiMaxSize is the largest size of a variable or of all of them.
+const uwsgiMaxSize = 0xffff
+
+// uwsgiPacket returns the request packet for env, a list of key=value pairs,
+// and a body of length bytes.
+func uwsgiPacket(env []string, length int64) ([]byte, error) {
+	var vars bytes.Buffer
+	add := func(name, value string) error {
+		if len(name) > uwsgiMaxSize || len(value) > uwsgiMaxSize {
+			return fmt.Errorf("uwsgi variable %s exceeds %d bytes", name, uwsgiMaxSize)
+		}
+		var size [2]byte
+		binary.LittleEndian.PutUint16(size[:], uint16(len(name)))
+		vars.Write(size[:])
+		vars.WriteString(name)
+		binary.LittleEndian.PutUint16(size[:], uint16(len(value)))
+		vars.Write(size[:])
+		vars.WriteString(value)
+		return nil
+	}
+	add("CONTENT_LENGTH", strconv.FormatInt(length, 10))
+	for _, e := range env {
+		eq := strings.IndexByte(e, '=')
+		if eq < 0 || e[:eq] == "CONTENT_LENGTH" {
+			continue
+		}
+		if err := add(e[:eq], e[eq+1:]); err != nil {
+			return nil, err
+		}
+	}
+	if vars.Len() > uwsgiMaxSize {
+		return nil, fmt.Errorf("uwsgi variables of %d bytes exceed %d bytes", vars.Len(), uwsgiMaxSize)
+	}
+	packet := []byte{0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(packet[1:], uint16(vars.Len()))
+	return append(packet, vars.Bytes()...), nil
+}
+
+// uwsgiResponse reads the response of a uWSGI worker as a CGI response, with
+// its status line turned into a Status header. Responses without a status
+// line are read as they are.
+type uwsgiResponse struct {
+	r    *bufio.Reader
+	body io.Reader // the converted response, once the status line was read
+}
+
+func (ur *uwsgiResponse) Read(p []byte) (int, error) {
+	if ur.body == nil {
+		ur.body = ur.r
+		if prefix, _ := ur.r.Peek(5); string(prefix) == "HTTP/" {
+			line, err := ur.r.ReadString('\n')
+			if err != nil {
+				return 0, err
+			}
+			// "HTTP/1.1 200 OK" becomes "Status: 200 OK".
+			var status string
+			if parts := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 2); len(parts) == 2 {
+				status = parts[1]
+			}
+			ur.body = io.MultiReader(strings.NewReader("Status: "+status+"\r\n"), ur.r)
+		}
+	}
+	return ur.body.Read(p)
+}
+
+// serveUWSGI relays req to the uWSGI worker at backend. Chunked request
+// bodies are spooled first, since their length has to be sent ahead.
+func (h *handler) serveUWSGI(backend socketBackend, rw http.ResponseWriter, req *http.Request) {
+	req, cleanup, ok := h.spoolChunked(rw, req)
+	if !ok {
+		return
+	}
+	defer cleanup()
+	env := h.environ(req)
+	h.logEnvironSize(env)
+	packet, err := uwsgiPacket(env, req.ContentLength)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("uwsgi error", zap.Error(err))
+		return
+	}
+	conn, err := backend.dial()
+	if err != nil {
+		h.Failure.set(failSpawn)
+		rw.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("uwsgi error", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	h.serveConn(rw, req, conn, "uwsgi", func(w *bufio.Writer) error {
+		if _, err := w.Write(packet); err != nil {
+			return err
+		}
+		if req.Body != nil && req.ContentLength > 0 {
+			if _, err := io.CopyN(w, req.Body, req.ContentLength); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}, &uwsgiResponse{r: bufio.NewReader(conn)})
+}
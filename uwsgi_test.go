@@ -0,0 +1,149 @@
+package cgi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// uwsgiEcho serves uwsgi requests on ln, answering with the variables and
+// body it got.
+func uwsgiEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			var header [4]byte
+			if _, err := io.ReadFull(r, header[:]); err != nil {
+				return
+			}
+			vars := make([]byte, binary.LittleEndian.Uint16(header[1:]))
+			if _, err := io.ReadFull(r, vars); err != nil {
+				return
+			}
+			var fields []string
+			for len(vars) >= 2 {
+				n := int(binary.LittleEndian.Uint16(vars))
+				fields = append(fields, string(vars[2:2+n]))
+				vars = vars[2+n:]
+			}
+			var length int
+			for i := 0; i+1 < len(fields); i += 2 {
+				if fields[i] == "CONTENT_LENGTH" {
+					length, _ = strconv.Atoi(fields[i+1])
+				}
+			}
+			body := make([]byte, length)
+			io.ReadFull(r, body)
+			fmt.Fprintf(conn, "HTTP/1.1 201 Created\r\nContent-Type: text/plain\r\n\r\n")
+			for i := 0; i+1 < len(fields); i += 2 {
+				switch name := fields[i]; name {
+				case "CONTENT_LENGTH", "REQUEST_METHOD", "PATH_INFO", "UWSGI_TEST":
+					fmt.Fprintf(conn, "%s [%s]\n", name, fields[i+1])
+				}
+			}
+			fmt.Fprintf(conn, "BODY [%s]\n", body)
+		}()
+	}
+}
+
+// TestUWSGIHelper is the uWSGI worker started by TestCGI_ServeHTTPUWSGI; the
+// test binary serves as the executable.
+func TestUWSGIHelper(t *testing.T) {
+	if os.Getenv("UWSGI_HELPER") != "1" {
+		return
+	}
+	ln, err := net.FileListener(os.Stdin)
+	if err != nil {
+		os.Exit(1)
+	}
+	uwsgiEcho(ln)
+	os.Exit(0)
+}
+
+func TestCGI_ServeHTTPUWSGI(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer ln.Close()
+	go uwsgiEcho(ln)
+
+	remote := CGI{
+		Executable: "/srv/app.py",
+		Envs:       []string{"UWSGI_TEST=remote"},
+		ScriptName: "/app",
+		logger:     zap.NewNop(),
+	}
+	if remote.uwsgi, err = newRemoteBackend(ln.Addr().String()); err != nil {
+		t.Fatalf("Invalid address: %v", err)
+	}
+	backends := []CGI{remote}
+	if runtime.GOOS != "windows" {
+		spawned := CGI{
+			Executable: os.Args[0],
+			Args:       []string{"-test.run=^TestUWSGIHelper$"},
+			Envs:       []string{"UWSGI_HELPER=1", "UWSGI_TEST=spawned"},
+			ScriptName: "/app",
+			logger:     zap.NewNop(),
+		}
+		app, err := spawned.startSocketApp("uwsgi")
+		if err != nil {
+			t.Fatalf("Cannot start uwsgi application: %v", err)
+		}
+		spawned.uwsgi = app
+		defer spawned.Cleanup()
+		backends = append(backends, spawned)
+	}
+
+	for _, c := range backends {
+		for _, step := range []struct {
+			method, body string
+			chunked      bool
+		}{
+			{http.MethodGet, "", false},
+			{http.MethodPost, "name=value", false},
+			{http.MethodPost, "chunked", true},
+		} {
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest(step.method, "/app/path", strings.NewReader(step.body))
+			if step.chunked {
+				req.ContentLength = -1
+				req.TransferEncoding = []string{"chunked"}
+			}
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			if err := c.ServeHTTP(res, req, NoOpNextHandler{}); err != nil {
+				t.Fatalf("Cannot serve http: %v", err)
+			}
+			if res.Code != http.StatusCreated {
+				t.Errorf("Unexpected statusCode %d. Expected %d.", res.Code, http.StatusCreated)
+			}
+			expected := fmt.Sprintf("CONTENT_LENGTH [%d]\nREQUEST_METHOD [%s]\nPATH_INFO [/path]\nUWSGI_TEST [%s]\nBODY [%s]",
+				len(step.body), step.method, strings.TrimPrefix(c.Envs[len(c.Envs)-1], "UWSGI_TEST="), step.body)
+			if body := strings.TrimSpace(res.Body.String()); body != expected {
+				t.Errorf("Unexpected body\n========== Got ==========\n%s\n========== Wanted ==========\n%s", body, expected)
+			}
+		}
+	}
+
+	if _, err := uwsgiPacket([]string{"HUGE=" + strings.Repeat("x", uwsgiMaxSize+1)}, 0); err == nil {
+		t.Error("Expected an error for a variable exceeding the uwsgi limit.")
+	}
+}
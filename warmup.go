@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// warmupKey marks the context of the warm-up request; its value holds the
+// arguments replacing the configured ones, if any.
+type warmupKey struct{}
+
+// warmup executes the script once for a synthetic GET request. Responses
+// with a server error status count as failure.
+func (c *CGI) warmup() error {
+	path := c.WarmupPath
+	if path == "" {
+		path = c.ScriptName
+	}
+	if path == "" {
+		path = "/"
+	}
+	ctx := context.WithValue(context.Background(), warmupKey{}, c.WarmupArgs)
+	ctx = context.WithValue(ctx, caddy.ReplacerCtxKey, caddy.NewReplacer())
+	req, err := http.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	start := time.Now()
+	rec := &bakeRecorder{header: make(http.Header)}
+	if err := c.ServeHTTP(rec, req, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	})); err != nil {
+		return err
+	}
+	if rec.status >= http.StatusInternalServerError {
+		return fmt.Errorf("script responded with status %d", rec.status)
+	}
+	c.logger.Info("warmed up", zap.String("path", path), zap.Int("status", rec.status),
+		zap.Duration("duration", time.Since(start)))
+	return nil
+}
+
+// checkExecutable makes sure that the executable exists and can be executed,
+// or that its interpreter can be found. Executables and working directories
+// with placeholders are only known per request and not checked.
+func (c *CGI) checkExecutable() error {
+	if strings.Contains(c.Executable, "{") || strings.Contains(c.WorkingDirectory, "{") {
+		return nil
+	}
+	path := c.Executable
+	if !filepath.IsAbs(path) && c.WorkingDirectory != "" {
+		path = filepath.Join(c.WorkingDirectory, path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	if interpreter := c.interpreter(path); interpreter != nil {
+		if strings.ContainsRune(interpreter[0], filepath.Separator) || strings.ContainsRune(interpreter[0], '/') {
+			_, err = os.Stat(interpreter[0])
+		} else {
+			_, err = exec.LookPath(interpreter[0])
+		}
+		if err != nil {
+			return fmt.Errorf("interpreter: %v", err)
+		}
+		return nil
+	}
+	if c.ProgramRaw == nil && runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
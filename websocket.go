@@ -0,0 +1,384 @@
+/*
+ * Copyright (c) 2020 Andreas Schneider
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cgi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+)
+
+// With websocket, the script of a WebSocket request runs for the whole
+// session: every message of the client becomes a line on its standard input
+// and every line of its standard output a message to the client, like
+// websocketd does it. The handshake and framing (RFC 6455) are done here.
+
+const (
+	websocketGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	websocketMaxMessage = 1 << 20
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	wsCloseNormal    = 1000
+	wsCloseProtocol  = 1002
+	wsCloseTooBig    = 1009
+	wsCloseNoStatus  = 1005
+	wsCloseWriteWait = 5 * time.Second
+)
+
+var (
+	errWebSocketProtocol = errors.New("WebSocket protocol error")
+	errWebSocketTooBig   = errors.New("WebSocket message too large")
+	errWebSocketClosed   = errors.New("WebSocket session closed")
+)
+
+// isWebSocketRequest reports whether req opens a WebSocket over HTTP/1.1.
+func isWebSocketRequest(req *http.Request) bool {
+	return req.ProtoMajor == 1 && isUpgradeRequest(req) &&
+		httpguts.HeaderValuesContainsToken(req.Header["Upgrade"], "websocket")
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept value for key.
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsConn writes frames to the client; the bridge and the reader both write,
+// so writes are serialized.
+type wsConn struct {
+	net.Conn
+	mu     sync.Mutex
+	closed bool // close frame sent
+}
+
+// writeFrame sends a single unmasked frame.
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closed {
+		return errWebSocketClosed
+	}
+	if opcode == wsClose {
+		ws.closed = true
+		ws.SetWriteDeadline(time.Now().Add(wsCloseWriteWait))
+	}
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, byte(n>>8), byte(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	if _, err := ws.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeClose sends a close frame with code.
+func (ws *wsConn) writeClose(code int) error {
+	return ws.writeFrame(wsClose, []byte{byte(code >> 8), byte(code)})
+}
+
+// readFrame reads a frame of the client, which has to be masked, and
+// unmasks its payload.
+func readFrame(r *bufio.Reader) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0f
+	if header[0]&0x70 != 0 || header[1]&0x80 == 0 {
+		// Reserved bits without extension or unmasked.
+		return fin, opcode, nil, errWebSocketProtocol
+	}
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (n > 125 || !fin) {
+		return fin, opcode, nil, errWebSocketProtocol
+	}
+	if n > websocketMaxMessage {
+		return fin, opcode, nil, errWebSocketTooBig
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// serveWebSocket completes the handshake of a WebSocket request and bridges
+// the session to the script. Timeouts don't apply to sessions; the script is
+// terminated once the client closed the session or went away.
+func (h *handler) serveWebSocket(rw http.ResponseWriter, req *http.Request) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || key == "" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		rw.Header().Set("Sec-WebSocket-Version", "13")
+		rw.WriteHeader(http.StatusUpgradeRequired)
+		return
+	}
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		rw.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	internalError := func(err error) {
+		h.Failure.set(failSpawn)
+		rw.WriteHeader(http.StatusInternalServerError)
+		h.Logger.Error("CGI error", zap.Error(err))
+	}
+
+	cg, err := h.Cgroup.create()
+	if err != nil {
+		internalError(err)
+		return
+	}
+	defer cg.close(h.Logger)
+	cmd, err := h.command(h.environ(req), cg)
+	if err != nil {
+		internalError(err)
+		return
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		internalError(err)
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		internalError(err)
+		return
+	}
+	if err := startChild(cmd); err != nil {
+		internalError(err)
+		return
+	}
+	defer doneChild(cmd)
+	if err := cg.attach(cmd.Process); err != nil {
+		cmd.Wait()
+		internalError(err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session := *h
+	session.Timeout, session.HeaderTimeout = 0, 0
+	wd := session.watch(ctx, cmd.Process)
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		// Nothing has been sent yet.
+		cancel()
+		cmd.Wait()
+		wd.stop()
+		internalError(err)
+		return
+	}
+	ws := &wsConn{Conn: conn}
+	defer ws.Close()
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		stdin.Close()
+		cancel()
+	} else {
+		inputDone := make(chan struct{})
+		go func() {
+			defer close(inputDone)
+			defer cancel()
+			h.websocketInput(ws, brw.Reader, stdin)
+		}()
+		h.websocketOutput(ws, stdout)
+		// Give the client the chance to answer the close frame.
+		select {
+		case <-inputDone:
+		case <-time.After(wsCloseWriteWait):
+		}
+		ws.Close()
+		<-inputDone
+	}
+	cmd.Wait()
+	wd.stop()
+	if h.KillGroup {
+		killProcessGroup(cmd.Process.Pid)
+	}
+	h.Logger.Debug("WebSocket session ended", zap.String("path", h.Path),
+		zap.Int("pid", cmd.Process.Pid), zap.Int("exit_code", cmd.ProcessState.ExitCode()))
+}
+
+// websocketInput writes the messages of the client as lines to stdin and
+// answers pings, until the client closes the session or goes away; then
+// stdin is closed.
+func (h *handler) websocketInput(ws *wsConn, r *bufio.Reader, stdin io.WriteCloser) {
+	defer stdin.Close()
+	var message []byte
+	for {
+		fin, opcode, payload, err := readFrame(r)
+		switch {
+		case err == errWebSocketProtocol:
+			ws.writeClose(wsCloseProtocol)
+			return
+		case err == errWebSocketTooBig:
+			ws.writeClose(wsCloseTooBig)
+			return
+		case err != nil:
+			return
+		}
+		switch opcode {
+		case wsPing:
+			ws.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			if code == wsCloseNoStatus {
+				code = wsCloseNormal
+			}
+			ws.writeClose(code)
+			return
+		case wsText, wsBinary:
+			if message != nil {
+				ws.writeClose(wsCloseProtocol)
+				return
+			}
+			message = payload[:len(payload):len(payload)]
+		case wsContinuation:
+			if message == nil {
+				ws.writeClose(wsCloseProtocol)
+				return
+			}
+			if len(message)+len(payload) > websocketMaxMessage {
+				ws.writeClose(wsCloseTooBig)
+				return
+			}
+			message = append(message, payload...)
+		default:
+			ws.writeClose(wsCloseProtocol)
+			return
+		}
+		if !fin {
+			continue
+		}
+		if _, err := stdin.Write(append(message, '\n')); err != nil {
+			h.Logger.Debug("WebSocket script stopped reading", zap.Error(err))
+			ws.writeClose(wsCloseNormal)
+			return
+		}
+		message = nil
+	}
+}
+
+// websocketOutput sends the lines of stdout as messages to the client, text
+// ones if they are valid UTF-8 and binary ones otherwise, and closes the
+// session once the script closed its standard output.
+func (h *handler) websocketOutput(ws *wsConn, stdout io.Reader) {
+	r := bufio.NewReader(stdout)
+	for {
+		line, err := readMessageLine(r)
+		if err == errWebSocketTooBig {
+			h.Logger.Warn("WebSocket message of script too large, closing session", zap.String("path", h.Path))
+			ws.writeClose(wsCloseTooBig)
+			return
+		}
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+			opcode := byte(wsText)
+			if !utf8.Valid(line) {
+				opcode = wsBinary
+			}
+			if err := ws.writeFrame(opcode, line); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				h.Logger.Debug("reading WebSocket output failed", zap.Error(err))
+			}
+			ws.writeClose(wsCloseNormal)
+			return
+		}
+	}
+}
+
+// readMessageLine reads a line including its line ending; lines beyond the
+// message size limit are an error.
+func readMessageLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > websocketMaxMessage+2 {
+			return nil, errWebSocketTooBig
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package cgi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// writeClientFrame writes a masked frame like a client does.
+func writeClientFrame(w io.Writer, fin bool, opcode byte, payload []byte) error {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{first, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// readServerFrame reads an unmasked frame of at most 125 bytes.
+func readServerFrame(r io.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, header[1])
+	_, err := io.ReadFull(r, payload)
+	return header[0] & 0x0f, payload, err
+}
+
+func TestWebsocketAccept(t *testing.T) {
+	// The example of RFC 6455.
+	if accept := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept value %q. Expected %q.", accept, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+	}
+}
+
+func TestCGI_ServeHTTPWebSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test script is a shell script")
+	}
+	c := CGI{Executable: "test/wsecho", WebSocket: true, logger: zap.NewNop()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		if err := c.ServeHTTP(w, r, NoOpNextHandler{}); err != nil {
+			t.Errorf("Cannot serve http: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	handshake := "GET /chat HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	// The first message may already arrive with the request.
+	conn.Write([]byte(handshake))
+	writeClientFrame(conn, true, wsText, []byte("hello"))
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected response %d with accept value %q. Expected %d with %q.",
+			res.StatusCode, res.Header.Get("Sec-WebSocket-Accept"), http.StatusSwitchingProtocols, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+	}
+
+	expectFrame := func(opcode byte, payload string) {
+		t.Helper()
+		gotOpcode, gotPayload, err := readServerFrame(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotOpcode != opcode || string(gotPayload) != payload {
+			t.Errorf("Unexpected frame %d %q. Expected %d %q.", gotOpcode, gotPayload, opcode, payload)
+		}
+	}
+	expectFrame(wsText, "GET HELLO")
+	// A fragmented message is one line, with a ping in between.
+	writeClientFrame(conn, false, wsText, []byte("wor"))
+	writeClientFrame(conn, true, wsPing, []byte("are you there"))
+	writeClientFrame(conn, true, wsContinuation, []byte("ld"))
+	expectFrame(wsPong, "are you there")
+	expectFrame(wsText, "GET WORLD")
+
+	writeClientFrame(conn, true, wsClose, []byte{0x03, 0xe8})
+	opcode, payload, err := readServerFrame(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != wsClose || len(payload) != 2 || binary.BigEndian.Uint16(payload) != wsCloseNormal {
+		t.Errorf("Unexpected frame %d %v. Expected close with %d.", opcode, payload, wsCloseNormal)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("Unexpected error %v after closing. Expected %v.", err, io.EOF)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUpgradeRequired || res.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Errorf("Unexpected response %d with version %q. Expected %d with %q.",
+			res.StatusCode, res.Header.Get("Sec-WebSocket-Version"), http.StatusUpgradeRequired, "13")
+	}
+}